@@ -0,0 +1,890 @@
+package redisclone
+
+import (
+	"bufio"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log/slog"
+	"maps"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Key permissions of a key pattern, %R~ grants reads, %W~ writes and ~ both
+const (
+	ACLReadPermission = 1 << iota
+	ACLWritePermission
+
+	ACLAllPermissions = ACLReadPermission | ACLWritePermission
+)
+
+// Reasons and contexts reported by ACL LOG
+const (
+	ACLDeniedCommand = "command"
+	ACLDeniedKey     = "key"
+	ACLDeniedChannel = "channel"
+	ACLDeniedAuth    = "auth"
+
+	ACLContextTopLevel = "toplevel"
+	ACLContextMulti    = "multi"
+	ACLContextLua      = "lua"
+)
+
+// Entries of the same denial within this window are merged into one
+const ACLLogGroupingWindow = 60 * time.Second
+
+var ACLCategories = []string{"keyspace", "read", "write", "set", "sortedset", "list", "hash", "string", "bitmap", "hyperloglog", "geo", "stream", "pubsub", "admin", "fast", "slow", "blocking", "dangerous", "connection", "transaction", "scripting"}
+
+type KeyPattern struct {
+	Pattern string
+	Flags   int
+}
+
+// A user is never modified once published, SETUSER replaces it with an updated copy
+type User struct {
+	Name      string
+	Enabled   bool
+	NoPass    bool
+	Passwords []string // SHA256 digests in hex
+	Commands  []string // command rules in the order they apply, always starting with +@all or -@all
+	Keys      []KeyPattern
+	Channels  []string
+	allowed   map[string]bool // full command names the rules allow, derived from Commands
+}
+
+type ACLLogEntry struct {
+	ID         int64
+	Count      int
+	Reason     string
+	Context    string
+	Object     string
+	Username   string
+	ClientInfo string
+	Created    time.Time
+	Updated    time.Time
+}
+
+type ACL struct {
+	users    map[string]*User
+	commands *CommandTable
+	log      []*ACLLogEntry // newest first
+	nextID   int64
+	lock     sync.RWMutex
+}
+
+func NewACL(commands *CommandTable) *ACL {
+	a := &ACL{users: make(map[string]*User), commands: commands}
+	a.users["default"] = a.NewDefaultUser()
+	return a
+}
+
+// The default user starts with access to everything and no password
+func (a *ACL) NewDefaultUser() *User {
+	u, _ := a.ApplyRules(a.NewUser("default"), []string{"on", "nopass", "~*", "&*", "+@all"})
+	return u
+}
+
+func (a *ACL) NewUser(name string) *User {
+	u := &User{Name: name, Commands: []string{"-@all"}}
+	u.allowed = a.AllowedCommands(u.Commands)
+	return u
+}
+
+func HashPassword(password []byte) string {
+	sum := sha256.Sum256(password)
+	return hex.EncodeToString(sum[:])
+}
+
+func IsValidPasswordHash(hash string) bool {
+	if len(hash) != 64 {
+		return false
+	}
+	for _, b := range []byte(hash) {
+		if (b < '0' || b > '9') && (b < 'a' || b > 'f') {
+			return false
+		}
+	}
+	return true
+}
+
+func IsValidUsername(name string) bool {
+	return name != "" && !strings.ContainsAny(name, " \x00")
+}
+
+// Applies SETUSER rules to a copy of u, u itself is left untouched
+func (a *ACL) ApplyRules(u *User, rules []string) (*User, error) {
+	updated := *u
+	updated.Passwords = slices.Clone(u.Passwords)
+	updated.Commands = slices.Clone(u.Commands)
+	updated.Keys = slices.Clone(u.Keys)
+	updated.Channels = slices.Clone(u.Channels)
+
+	for _, rule := range rules {
+		if err := a.ApplyRule(&updated, rule); err != nil {
+			return nil, fmt.Errorf("Error in ACL SETUSER modifier '%s': %s", rule, err.Error())
+		}
+	}
+	updated.allowed = a.AllowedCommands(updated.Commands)
+	return &updated, nil
+}
+
+func (a *ACL) ApplyRule(u *User, rule string) error {
+	if rule == "" {
+		return errors.New("Syntax error")
+	}
+	switch lower := strings.ToLower(rule); {
+	case lower == "on":
+		u.Enabled = true
+	case lower == "off":
+		u.Enabled = false
+	case lower == "nopass":
+		u.NoPass = true
+		u.Passwords = nil
+	case lower == "resetpass":
+		u.NoPass = false
+		u.Passwords = nil
+	case lower == "allkeys":
+		u.Keys = []KeyPattern{{Pattern: "*", Flags: ACLAllPermissions}}
+	case lower == "resetkeys":
+		u.Keys = nil
+	case lower == "allchannels":
+		u.Channels = []string{"*"}
+	case lower == "resetchannels":
+		u.Channels = nil
+	case lower == "allcommands":
+		u.Commands = []string{"+@all"}
+	case lower == "nocommands":
+		u.Commands = []string{"-@all"}
+	case lower == "reset":
+		for _, r := range []string{"resetpass", "resetkeys", "resetchannels", "off", "-@all"} {
+			a.ApplyRule(u, r)
+		}
+	case rule[0] == '>' || rule[0] == '#':
+		hash := HashPassword([]byte(rule[1:]))
+		if rule[0] == '#' {
+			hash = rule[1:]
+			if !IsValidPasswordHash(hash) {
+				return errors.New("The password hash must be exactly 64 characters and contain only lowercase hexadecimal characters")
+			}
+		}
+		if !slices.Contains(u.Passwords, hash) {
+			u.Passwords = append(u.Passwords, hash)
+		}
+		u.NoPass = false
+	case rule[0] == '<' || rule[0] == '!':
+		hash := HashPassword([]byte(rule[1:]))
+		if rule[0] == '!' {
+			hash = rule[1:]
+			if !IsValidPasswordHash(hash) {
+				return errors.New("The password hash must be exactly 64 characters and contain only lowercase hexadecimal characters")
+			}
+		}
+		i := slices.Index(u.Passwords, hash)
+		if i < 0 {
+			return errors.New("The password you are trying to remove from the user does not exist")
+		}
+		u.Passwords = slices.Delete(u.Passwords, i, i+1)
+	case rule[0] == '~' || rule[0] == '%':
+		pattern, err := ParseKeyPattern(rule)
+		if err != nil {
+			return err
+		}
+		u.Keys = append(u.Keys, pattern)
+	case rule[0] == '&':
+		u.Channels = append(u.Channels, rule[1:])
+	case rule[0] == '+' || rule[0] == '-':
+		if lower[1:] == "@all" {
+			u.Commands = []string{lower}
+			return nil
+		}
+		if !a.IsValidCommandRule(lower[1:]) {
+			return errors.New("Unknown command or category name in ACL")
+		}
+		u.Commands = append(u.Commands, lower)
+	default:
+		return errors.New("Syntax error")
+	}
+	return nil
+}
+
+// Parses ~pattern, %R~pattern, %W~pattern or %RW~pattern
+func ParseKeyPattern(rule string) (KeyPattern, error) {
+	if rule[0] == '~' {
+		return KeyPattern{Pattern: rule[1:], Flags: ACLAllPermissions}, nil
+	}
+
+	perms, pattern, ok := strings.Cut(rule[1:], "~")
+	if !ok || perms == "" {
+		return KeyPattern{}, errors.New("Syntax error")
+	}
+	flags := 0
+	for _, p := range strings.ToUpper(perms) {
+		switch p {
+		case 'R':
+			flags |= ACLReadPermission
+		case 'W':
+			flags |= ACLWritePermission
+		default:
+			return KeyPattern{}, errors.New("Syntax error")
+		}
+	}
+	return KeyPattern{Pattern: pattern, Flags: flags}, nil
+}
+
+// A rule names a category with @, a command, or a single subcommand as command|subcommand
+func (a *ACL) IsValidCommandRule(name string) bool {
+	if category, ok := strings.CutPrefix(name, "@"); ok {
+		return slices.Contains(ACLCategories, category)
+	}
+	container, sub, isSub := strings.Cut(name, "|")
+	rc := a.commands.Lookup(container)
+	if rc == nil {
+		return false
+	}
+	return !isSub || rc.FindSubcommand(sub) != nil
+}
+
+// Replays the command rules over every command and subcommand
+func (a *ACL) AllowedCommands(rules []string) map[string]bool {
+	allowed := make(map[string]bool)
+	for _, rule := range rules {
+		allow, name := rule[0] == '+', rule[1:]
+		for _, rc := range a.commands.All() {
+			for _, target := range append([]*RedisCommand{rc}, rc.Subcommands...) {
+				if !CommandRuleMatches(name, rc, target) {
+					continue
+				}
+				if allow {
+					allowed[target.Name] = true
+				} else {
+					delete(allowed, target.Name)
+				}
+			}
+		}
+	}
+	return allowed
+}
+
+// Whether a rule covers target, which is either the top level command rc or one of its subcommands
+func CommandRuleMatches(name string, rc, target *RedisCommand) bool {
+	if category, ok := strings.CutPrefix(name, "@"); ok {
+		return category == "all" || slices.Contains(target.Categories, category)
+	}
+	if strings.Contains(name, "|") {
+		return target.Name == name
+	}
+	return rc.Name == name
+}
+
+// Textual form of a user as used by ACL LIST and the ACL file
+func (u *User) Describe() string {
+	parts := []string{"user", u.Name}
+	if u.Enabled {
+		parts = append(parts, "on")
+	} else {
+		parts = append(parts, "off")
+	}
+	if u.NoPass {
+		parts = append(parts, "nopass")
+	}
+	for _, hash := range u.Passwords {
+		parts = append(parts, "#"+hash)
+	}
+	if keys := u.DescribeKeys(); keys != "" {
+		parts = append(parts, keys)
+	}
+	parts = append(parts, u.DescribeChannels(), strings.Join(u.Commands, " "))
+	return strings.Join(parts, " ")
+}
+
+func (u *User) DescribeKeys() string {
+	var parts []string
+	for _, k := range u.Keys {
+		switch k.Flags {
+		case ACLAllPermissions:
+			parts = append(parts, "~"+k.Pattern)
+		case ACLReadPermission:
+			parts = append(parts, "%R~"+k.Pattern)
+		case ACLWritePermission:
+			parts = append(parts, "%W~"+k.Pattern)
+		}
+	}
+	return strings.Join(parts, " ")
+}
+
+func (u *User) DescribeChannels() string {
+	if len(u.Channels) == 0 {
+		return "resetchannels"
+	}
+	parts := make([]string, 0, len(u.Channels))
+	for _, ch := range u.Channels {
+		parts = append(parts, "&"+ch)
+	}
+	return strings.Join(parts, " ")
+}
+
+// Checks password against the user's digests without leaking which one matched or how much of it
+func (u *User) CheckPassword(password []byte) bool {
+	if u.NoPass {
+		return true
+	}
+	hash := []byte(HashPassword(password))
+	matched := false
+	for _, stored := range u.Passwords {
+		if subtle.ConstantTimeCompare(hash, []byte(stored)) == 1 {
+			matched = true
+		}
+	}
+	return matched
+}
+
+func (u *User) CanAccessKey(key string, flags int) bool {
+	for _, k := range u.Keys {
+		if k.Flags&flags == flags && StringMatch(k.Pattern, key, false) {
+			return true
+		}
+	}
+	return false
+}
+
+// Patterns subscribed to with PSUBSCRIBE must be allowed literally, a narrower pattern isn't enough.
+// allchannels (&*) is the exception and allows every pattern too.
+func (u *User) CanAccessChannel(channel string, isPattern bool) bool {
+	for _, allowed := range u.Channels {
+		if allowed == "*" || (isPattern && allowed == channel) || (!isPattern && StringMatch(allowed, channel, false)) {
+			return true
+		}
+	}
+	return false
+}
+
+// Key permissions a command needs: ACCESS reads the value, INSERT, UPDATE and DELETE write it, neither only needs some access.
+// Commands without a key spec, like EVAL, need full access. The second result is false when the arguments aren't keys.
+func KeySpecPermissions(rc *RedisCommand) (int, bool) {
+	if len(rc.KeySpecs) == 0 {
+		return ACLAllPermissions, true
+	}
+	flags := 0
+	for _, spec := range rc.KeySpecs {
+		switch spec {
+		case "NOT_KEY":
+			return 0, false
+		case "ACCESS":
+			flags |= ACLReadPermission
+		case "INSERT", "UPDATE", "DELETE":
+			flags |= ACLWritePermission
+		}
+	}
+	return flags, true
+}
+
+// Channel arguments of the pub/sub commands ACLs restrict
+func ChannelArgs(rc *RedisCommand, cmd Command) (channels [][]byte, isPattern bool) {
+	switch rc.Name {
+	case "publish", "spublish":
+		return cmd.Args[:1], false
+	case "subscribe", "ssubscribe":
+		return cmd.Args, false
+	case "psubscribe":
+		return cmd.Args, true
+	}
+	return nil, false
+}
+
+// Returns the reason and offending object when u may not run cmd, or an empty reason when it may
+func (u *User) CheckCommand(rc *RedisCommand, cmd Command) (string, string) {
+	if !u.allowed[rc.Name] {
+		return ACLDeniedCommand, rc.Name
+	}
+	if flags, ok := KeySpecPermissions(rc); ok {
+		for _, key := range rc.Keys(cmd) {
+			if !u.CanAccessKey(string(key), flags) {
+				return ACLDeniedKey, string(key)
+			}
+		}
+	}
+	channels, isPattern := ChannelArgs(rc, cmd)
+	for _, ch := range channels {
+		if !u.CanAccessChannel(string(ch), isPattern) {
+			return ACLDeniedChannel, string(ch)
+		}
+	}
+	return "", ""
+}
+
+func (a *ACL) Get(name string) *User {
+	a.lock.RLock()
+	defer a.lock.RUnlock()
+	return a.users[name]
+}
+
+// Creates the user if needed and applies rules to it, nothing changes if any rule is invalid
+func (a *ACL) SetUser(name string, rules []string) error {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+
+	u, ok := a.users[name]
+	if !ok {
+		u = a.NewUser(name)
+	}
+	updated, err := a.ApplyRules(u, rules)
+	if err != nil {
+		return err
+	}
+	a.users[name] = updated
+	return nil
+}
+
+// Returns how many of the users existed
+func (a *ACL) DeleteUsers(names []string) int {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+
+	deleted := 0
+	for _, name := range names {
+		if _, ok := a.users[name]; ok {
+			delete(a.users, name)
+			deleted += 1
+		}
+	}
+	return deleted
+}
+
+// Returns every user sorted by name
+func (a *ACL) Users() []*User {
+	a.lock.RLock()
+	defer a.lock.RUnlock()
+
+	users := slices.Collect(maps.Values(a.users))
+	slices.SortFunc(users, func(x, y *User) int { return strings.Compare(x.Name, y.Name) })
+	return users
+}
+
+// Keeps requirepass in sync with the default user, an empty value removes its password
+func (a *ACL) ApplyRequirePass(v ConfigValue) error {
+	if v.Raw == "" {
+		return a.SetUser("default", []string{"nopass"})
+	}
+	return a.SetUser("default", []string{"resetpass", ">" + v.Raw})
+}
+
+// Records a denial, repeating the same denial within the grouping window only bumps its count
+func (a *ACL) Log(entry ACLLogEntry, maxLen int) {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+
+	now := time.Now()
+	for i, e := range a.log {
+		if e.Reason == entry.Reason && e.Context == entry.Context && e.Object == entry.Object && e.Username == entry.Username && now.Sub(e.Updated) < ACLLogGroupingWindow {
+			e.Count += 1
+			e.Updated = now
+			e.ClientInfo = entry.ClientInfo
+			a.log = slices.Insert(slices.Delete(a.log, i, i+1), 0, e)
+			return
+		}
+	}
+
+	entry.ID = a.nextID
+	a.nextID += 1
+	entry.Count = 1
+	entry.Created, entry.Updated = now, now
+	a.log = slices.Insert(a.log, 0, &entry)
+	if len(a.log) > maxLen {
+		a.log = a.log[:maxLen]
+	}
+}
+
+// Returns copies of the newest count entries, all of them for a negative count
+func (a *ACL) LogEntries(count int) []ACLLogEntry {
+	a.lock.RLock()
+	defer a.lock.RUnlock()
+
+	if count < 0 || count > len(a.log) {
+		count = len(a.log)
+	}
+	entries := make([]ACLLogEntry, 0, count)
+	for _, e := range a.log[:count] {
+		entries = append(entries, *e)
+	}
+	return entries
+}
+
+func (a *ACL) ResetLog() {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	a.log = nil
+}
+
+// Replaces every user with the ones declared in path, the current users stay if any line is invalid.
+// Returns the names of the users that no longer exist.
+func (a *ACL) LoadFile(path string) ([]string, error) {
+	contents, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("Error loading ACLs, opening file '%s': %s", path, err.Error())
+	}
+
+	users := make(map[string]*User)
+	var problems []string
+	for i, line := range strings.Split(string(contents), "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || line[0] == '#' {
+			continue
+		}
+		fail := func(reason string) {
+			problems = append(problems, fmt.Sprintf("%s:%d: %s.", path, i+1, reason))
+		}
+
+		args, ok := SplitArgs([]byte(line))
+		if !ok {
+			fail("unbalanced quotes in acl line")
+			continue
+		}
+		if len(args) < 2 || string(args[0]) != "user" {
+			fail("line should start with user keyword")
+			continue
+		}
+		name := string(args[1])
+		if !IsValidUsername(name) {
+			fail("Usernames can't contain spaces or null characters")
+			continue
+		}
+		if _, dup := users[name]; dup {
+			fail(fmt.Sprintf("Duplicate user '%s' found", name))
+			continue
+		}
+
+		rules := make([]string, 0, len(args)-2)
+		for _, r := range args[2:] {
+			rules = append(rules, string(r))
+		}
+		u, err := a.ApplyRules(a.NewUser(name), rules)
+		if err != nil {
+			fail(err.Error())
+			continue
+		}
+		users[name] = u
+	}
+	if len(problems) > 0 {
+		return nil, errors.New(strings.Join(problems, " "))
+	}
+	if _, ok := users["default"]; !ok {
+		users["default"] = a.NewDefaultUser()
+	}
+
+	a.lock.Lock()
+	defer a.lock.Unlock()
+
+	var removed []string
+	for name := range a.users {
+		if _, ok := users[name]; !ok {
+			removed = append(removed, name)
+		}
+	}
+	a.users = users
+	return removed, nil
+}
+
+// Writes every user to path through a temp file, so a failed save never truncates the existing file
+func (a *ACL) SaveFile(path string) error {
+	tmp, err := os.CreateTemp(filepath.Dir(path), "redis-acl-*.tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	w := bufio.NewWriter(tmp)
+	for _, u := range a.Users() {
+		w.WriteString(u.Describe())
+		w.WriteByte('\n')
+	}
+	if err := w.Flush(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
+
+// Checks whether c's user may run cmd, denials are logged and counted before the NOPERM error is returned
+func (h *Handler) CheckPermissions(c *Client, rc *RedisCommand, cmd Command, context string) []byte {
+	// connection handshakes work for everyone, so a restricted client can still switch user or leave
+	if rc.HasFlag(FlagNoAuth) {
+		return nil
+	}
+
+	username := c.User()
+	reason, object := ACLDeniedCommand, rc.Name
+	if u := h.ACL.Get(username); u != nil {
+		reason, object = u.CheckCommand(rc, cmd)
+	}
+	if reason == "" {
+		return nil
+	}
+
+	info := c
+	if c.Caller != nil {
+		info = c.Caller
+	}
+	h.ACL.Log(ACLLogEntry{Reason: reason, Context: context, Object: object, Username: username, ClientInfo: h.ClientInfoLine(info)}, int(h.Config.GetInt("acllog-max-len")))
+
+	switch reason {
+	case ACLDeniedKey:
+		h.Stats.ACLDeniedKey.Add(1)
+		return h.Encoder.GenerateSimpleError("NOPERM No permissions to access a key")
+	case ACLDeniedChannel:
+		h.Stats.ACLDeniedChannel.Add(1)
+		return h.Encoder.GenerateSimpleError("NOPERM No permissions to access a channel")
+	}
+	h.Stats.ACLDeniedCommand.Add(1)
+	return h.Encoder.GenerateSimpleError(fmt.Sprintf("NOPERM User %s has no permissions to run the '%s' command", username, rc.Name))
+}
+
+// Disconnects the clients authenticated as one of users, the calling client is closed once it got its reply
+func (h *Handler) DisconnectUsers(c *Client, users []string) {
+	if len(users) == 0 {
+		return
+	}
+	for _, client := range h.Clients.All() {
+		if !slices.Contains(users, client.User()) {
+			continue
+		}
+		if client == c {
+			c.CloseAfterReply = true
+			continue
+		}
+		h.KillClient(client)
+	}
+}
+
+func (h *Handler) ACLFileError() []byte {
+	return h.Encoder.GenerateSimpleError("ERR This Redis instance is not configured to use an ACL file. You may want to specify users via the ACL SETUSER command and then issue a CONFIG REWRITE (assuming you have a Redis configuration file set) in order to store users in the Redis configuration.")
+}
+
+// ACL Commands
+func (h *Handler) HandleACLSetUserCommand(c *Client, cmd Command) []byte {
+	name := string(cmd.Args[1])
+	if !IsValidUsername(name) {
+		return h.Encoder.GenerateSimpleError("ERR Usernames can't contain spaces or null characters")
+	}
+
+	rules := make([]string, 0, len(cmd.Args)-2)
+	for _, r := range cmd.Args[2:] {
+		rules = append(rules, string(r))
+	}
+	if err := h.ACL.SetUser(name, rules); err != nil {
+		return h.Encoder.GenerateSimpleError("ERR " + err.Error())
+	}
+	return h.Encoder.GetSimpleStringOk()
+}
+
+func (h *Handler) HandleACLGetUserCommand(c *Client, cmd Command) []byte {
+	u := h.ACL.Get(string(cmd.Args[1]))
+	if u == nil {
+		return h.Encoder.GetNull(c.Protocol)
+	}
+
+	flags := [][]byte{h.Encoder.GenerateBulkString([]byte("off"))}
+	if u.Enabled {
+		flags[0] = h.Encoder.GenerateBulkString([]byte("on"))
+	}
+	if u.NoPass {
+		flags = append(flags, h.Encoder.GenerateBulkString([]byte("nopass")))
+	}
+	passwords := make([][]byte, 0, len(u.Passwords))
+	for _, hash := range u.Passwords {
+		passwords = append(passwords, h.Encoder.GenerateBulkString([]byte(hash)))
+	}
+	channels := ""
+	if len(u.Channels) > 0 {
+		channels = u.DescribeChannels()
+	}
+
+	return h.Encoder.GenerateMap(c.Protocol, [][]byte{
+		h.Encoder.GenerateBulkString([]byte("flags")), h.Encoder.GenerateRawArray(flags),
+		h.Encoder.GenerateBulkString([]byte("passwords")), h.Encoder.GenerateRawArray(passwords),
+		h.Encoder.GenerateBulkString([]byte("commands")), h.Encoder.GenerateBulkString([]byte(strings.Join(u.Commands, " "))),
+		h.Encoder.GenerateBulkString([]byte("keys")), h.Encoder.GenerateBulkString([]byte(u.DescribeKeys())),
+		h.Encoder.GenerateBulkString([]byte("channels")), h.Encoder.GenerateBulkString([]byte(channels)),
+		h.Encoder.GenerateBulkString([]byte("selectors")), h.Encoder.GenerateRawArray(nil),
+	})
+}
+
+func (h *Handler) HandleACLDelUserCommand(c *Client, cmd Command) []byte {
+	names := make([]string, 0, len(cmd.Args)-1)
+	for _, arg := range cmd.Args[1:] {
+		if string(arg) == "default" {
+			return h.Encoder.GenerateSimpleError("ERR The 'default' user cannot be removed")
+		}
+		names = append(names, string(arg))
+	}
+
+	deleted := h.ACL.DeleteUsers(names)
+	h.DisconnectUsers(c, names)
+	return h.Encoder.GenerateInt(deleted)
+}
+
+func (h *Handler) HandleACLListCommand(c *Client, cmd Command) []byte {
+	var lines [][]byte
+	for _, u := range h.ACL.Users() {
+		lines = append(lines, h.Encoder.GenerateBulkString([]byte(u.Describe())))
+	}
+	return h.Encoder.GenerateRawArray(lines)
+}
+
+func (h *Handler) HandleACLUsersCommand(c *Client, cmd Command) []byte {
+	var names [][]byte
+	for _, u := range h.ACL.Users() {
+		names = append(names, h.Encoder.GenerateBulkString([]byte(u.Name)))
+	}
+	return h.Encoder.GenerateRawArray(names)
+}
+
+func (h *Handler) HandleACLWhoAmICommand(c *Client, cmd Command) []byte {
+	return h.Encoder.GenerateBulkString([]byte(c.User()))
+}
+
+func (h *Handler) HandleACLCatCommand(c *Client, cmd Command) []byte {
+	var names [][]byte
+	if len(cmd.Args) == 1 {
+		for _, category := range ACLCategories {
+			names = append(names, h.Encoder.GenerateBulkString([]byte(category)))
+		}
+		return h.Encoder.GenerateRawArray(names)
+	}
+	if len(cmd.Args) > 2 {
+		return h.Encoder.GenerateSimpleError("ERR syntax error")
+	}
+
+	category := strings.ToLower(string(cmd.Args[1]))
+	if !slices.Contains(ACLCategories, category) {
+		return h.Encoder.GenerateSimpleError(fmt.Sprintf("ERR Unknown category '%s'", cmd.Args[1]))
+	}
+	for _, rc := range h.Commands.All() {
+		for _, target := range append([]*RedisCommand{rc}, rc.Subcommands...) {
+			if slices.Contains(target.Categories, category) {
+				names = append(names, h.Encoder.GenerateBulkString([]byte(target.Name)))
+			}
+		}
+	}
+	return h.Encoder.GenerateRawArray(names)
+}
+
+func (h *Handler) HandleACLGenPassCommand(c *Client, cmd Command) []byte {
+	bits := 256
+	if len(cmd.Args) > 2 {
+		return h.Encoder.GenerateSimpleError("ERR syntax error")
+	}
+	if len(cmd.Args) == 2 {
+		n, err := strconv.Atoi(string(cmd.Args[1]))
+		if err != nil || n <= 0 || n > 4096 {
+			return h.Encoder.GenerateSimpleError("ERR ACL GENPASS argument must be the number of bits for the output password, a positive number up to 4096")
+		}
+		bits = n
+	}
+
+	// every hex character holds 4 bits, round up to whole characters
+	chars := (bits + 3) / 4
+	random := make([]byte, (chars+1)/2)
+	rand.Read(random)
+	return h.Encoder.GenerateBulkString([]byte(hex.EncodeToString(random)[:chars]))
+}
+
+func (h *Handler) HandleACLDryRunCommand(c *Client, cmd Command) []byte {
+	u := h.ACL.Get(string(cmd.Args[1]))
+	if u == nil {
+		return h.Encoder.GenerateSimpleError(fmt.Sprintf("ERR User '%s' not found", cmd.Args[1]))
+	}
+	run := Command{Name: string(cmd.Args[2]), Args: cmd.Args[3:]}
+	if h.Commands.Lookup(run.Name) == nil {
+		return h.Encoder.GenerateSimpleError(fmt.Sprintf("ERR Command '%s' not found", run.Name))
+	}
+	rc, errReply := h.ResolveCommand(run)
+	if errReply != nil {
+		return errReply
+	}
+
+	switch reason, object := u.CheckCommand(rc, run); reason {
+	case ACLDeniedCommand:
+		return h.Encoder.GenerateBulkString(fmt.Appendf(nil, "User %s has no permissions to run the '%s' command", u.Name, object))
+	case ACLDeniedKey:
+		return h.Encoder.GenerateBulkString(fmt.Appendf(nil, "User %s has no permissions to access the '%s' key", u.Name, object))
+	case ACLDeniedChannel:
+		return h.Encoder.GenerateBulkString(fmt.Appendf(nil, "User %s has no permissions to access the '%s' channel", u.Name, object))
+	}
+	return h.Encoder.GetSimpleStringOk()
+}
+
+func (h *Handler) HandleACLLogCommand(c *Client, cmd Command) []byte {
+	count := 10
+	if len(cmd.Args) > 2 {
+		return h.Encoder.GenerateSimpleError("ERR syntax error")
+	}
+	if len(cmd.Args) == 2 {
+		if strings.EqualFold(string(cmd.Args[1]), "RESET") {
+			h.ACL.ResetLog()
+			return h.Encoder.GetSimpleStringOk()
+		}
+		n, err := strconv.Atoi(string(cmd.Args[1]))
+		if err != nil {
+			return h.Encoder.GenerateSimpleError("ERR value is not an integer or out of range")
+		}
+		if n < 0 {
+			return h.Encoder.GenerateSimpleError("ERR value is out of range, must be positive")
+		}
+		count = n
+	}
+
+	now := time.Now()
+	var entries [][]byte
+	for _, e := range h.ACL.LogEntries(count) {
+		entries = append(entries, h.Encoder.GenerateMap(c.Protocol, [][]byte{
+			h.Encoder.GenerateBulkString([]byte("count")), h.Encoder.GenerateInt(e.Count),
+			h.Encoder.GenerateBulkString([]byte("reason")), h.Encoder.GenerateBulkString([]byte(e.Reason)),
+			h.Encoder.GenerateBulkString([]byte("context")), h.Encoder.GenerateBulkString([]byte(e.Context)),
+			h.Encoder.GenerateBulkString([]byte("object")), h.Encoder.GenerateBulkString([]byte(e.Object)),
+			h.Encoder.GenerateBulkString([]byte("username")), h.Encoder.GenerateBulkString([]byte(e.Username)),
+			h.Encoder.GenerateBulkString([]byte("age-seconds")), h.Encoder.GenerateDouble(c.Protocol, now.Sub(e.Created).Seconds()),
+			h.Encoder.GenerateBulkString([]byte("client-info")), h.Encoder.GenerateBulkString([]byte(e.ClientInfo)),
+			h.Encoder.GenerateBulkString([]byte("entry-id")), h.Encoder.GenerateInt(int(e.ID)),
+			h.Encoder.GenerateBulkString([]byte("timestamp-created")), h.Encoder.GenerateInt(int(e.Created.UnixMilli())),
+			h.Encoder.GenerateBulkString([]byte("timestamp-last-updated")), h.Encoder.GenerateInt(int(e.Updated.UnixMilli())),
+		}))
+	}
+	return h.Encoder.GenerateRawArray(entries)
+}
+
+func (h *Handler) HandleACLLoadCommand(c *Client, cmd Command) []byte {
+	path := h.Config.GetString("aclfile")
+	if path == "" {
+		return h.ACLFileError()
+	}
+	removed, err := h.ACL.LoadFile(path)
+	if err != nil {
+		return h.Encoder.GenerateSimpleError("ERR " + err.Error())
+	}
+	h.DisconnectUsers(c, removed)
+	return h.Encoder.GetSimpleStringOk()
+}
+
+func (h *Handler) HandleACLSaveCommand(c *Client, cmd Command) []byte {
+	path := h.Config.GetString("aclfile")
+	if path == "" {
+		return h.ACLFileError()
+	}
+	if err := h.ACL.SaveFile(path); err != nil {
+		slog.Warn("Saving the ACL file failed", "path", path, "err", err)
+		return h.Encoder.GenerateSimpleError("ERR There was an error trying to save the ACLs. Please check the server logs for more information")
+	}
+	return h.Encoder.GetSimpleStringOk()
+}
@@ -0,0 +1,281 @@
+package redisclone
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestParseKeyPattern(t *testing.T) {
+	tests := []struct {
+		rule string
+		want KeyPattern
+		err  bool
+	}{
+		{rule: "~*", want: KeyPattern{Pattern: "*", Flags: ACLAllPermissions}},
+		{rule: "~", want: KeyPattern{Pattern: "", Flags: ACLAllPermissions}},
+		{rule: "%R~app:*", want: KeyPattern{Pattern: "app:*", Flags: ACLReadPermission}},
+		{rule: "%w~log:*", want: KeyPattern{Pattern: "log:*", Flags: ACLWritePermission}},
+		{rule: "%RW~x", want: KeyPattern{Pattern: "x", Flags: ACLAllPermissions}},
+		{rule: "%~x", err: true},
+		{rule: "%X~x", err: true},
+		{rule: "%R", err: true},
+	}
+
+	for _, tt := range tests {
+		got, err := ParseKeyPattern(tt.rule)
+		if (err != nil) != tt.err || got != tt.want {
+			t.Errorf("ParseKeyPattern(%q) = %v, %v, want %v, error %v", tt.rule, got, err, tt.want, tt.err)
+		}
+	}
+}
+
+func TestApplyRules(t *testing.T) {
+	hash := HashPassword([]byte("pw"))
+	tests := []struct {
+		name  string
+		rules []string
+		want  string
+		err   string
+	}{
+		{name: "new user", want: "user u off resetchannels -@all"},
+		{name: "full user", rules: []string{"on", ">pw", "~app:*", "%R~ro:*", "&news", "+get", "+client|id"}, want: "user u on #" + hash + " ~app:* %R~ro:* &news -@all +get +client|id"},
+		{name: "password hash", rules: []string{"#" + hash, ">pw"}, want: "user u off #" + hash + " resetchannels -@all"},
+		{name: "removed password", rules: []string{">pw", "<pw"}, want: "user u off resetchannels -@all"},
+		{name: "nopass drops passwords", rules: []string{">pw", "nopass"}, want: "user u off nopass resetchannels -@all"},
+		{name: "all shorthands", rules: []string{"allkeys", "allchannels", "allcommands"}, want: "user u off ~* &* +@all"},
+		{name: "+@all starts over", rules: []string{"+get", "-@all", "+@read", "+@all"}, want: "user u off resetchannels +@all"},
+		{name: "reset", rules: []string{"on", ">pw", "allkeys", "allcommands", "reset"}, want: "user u off resetchannels -@all"},
+		{name: "unknown command", rules: []string{"+nosuch"}, err: "Error in ACL SETUSER modifier '+nosuch': Unknown command or category name in ACL"},
+		{name: "unknown subcommand", rules: []string{"+client|nosuch"}, err: "Error in ACL SETUSER modifier '+client|nosuch': Unknown command or category name in ACL"},
+		{name: "unknown category", rules: []string{"+@nosuch"}, err: "Error in ACL SETUSER modifier '+@nosuch': Unknown command or category name in ACL"},
+		{name: "missing password", rules: []string{"<pw"}, err: "Error in ACL SETUSER modifier '<pw': The password you are trying to remove from the user does not exist"},
+		{name: "invalid hash", rules: []string{"#ABC"}, err: "Error in ACL SETUSER modifier '#ABC': The password hash must be exactly 64 characters and contain only lowercase hexadecimal characters"},
+		{name: "invalid key pattern", rules: []string{"%X~a"}, err: "Error in ACL SETUSER modifier '%X~a': Syntax error"},
+		{name: "unknown rule", rules: []string{"on", "bogus"}, err: "Error in ACL SETUSER modifier 'bogus': Syntax error"},
+	}
+
+	a := NewACL((&Server{}).BuildCommandTable())
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			original := a.NewUser("u")
+			u, err := a.ApplyRules(original, tt.rules)
+			if tt.err != "" {
+				if err == nil || err.Error() != tt.err {
+					t.Fatalf("got error %v, want %q", err, tt.err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := u.Describe(); got != tt.want {
+				t.Fatalf("got %q, want %q", got, tt.want)
+			}
+			if got := original.Describe(); got != "user u off resetchannels -@all" {
+				t.Fatalf("the original user changed to %q", got)
+			}
+		})
+	}
+}
+
+func TestCheckCommand(t *testing.T) {
+	h := &Handler{Commands: (&Server{}).BuildCommandTable()}
+	h.ACL = NewACL(h.Commands)
+	restricted, _ := h.ACL.ApplyRules(h.ACL.NewUser("restricted"), []string{"on", "~app:*", "%R~ro:*", "&news", "&n*", "+@all", "-flushall", "-client|kill"})
+	everything := h.ACL.NewDefaultUser()
+
+	tests := []struct {
+		user   *User
+		args   []string
+		reason string
+		object string
+	}{
+		{user: restricted, args: []string{"get", "app:1"}},
+		{user: restricted, args: []string{"get", "ro:1"}},
+		{user: restricted, args: []string{"get", "other"}, reason: ACLDeniedKey, object: "other"},
+		{user: restricted, args: []string{"set", "ro:1", "v"}, reason: ACLDeniedKey, object: "ro:1"},
+		{user: restricted, args: []string{"blpop", "app:1", "other", "0"}, reason: ACLDeniedKey, object: "other"},
+		{user: restricted, args: []string{"eval", "return 1", "1", "app:1"}},
+		{user: restricted, args: []string{"eval", "return 1", "1", "ro:1"}, reason: ACLDeniedKey, object: "ro:1"},
+		{user: restricted, args: []string{"flushall"}, reason: ACLDeniedCommand, object: "flushall"},
+		{user: restricted, args: []string{"client", "kill", "ID", "1"}, reason: ACLDeniedCommand, object: "client|kill"},
+		{user: restricted, args: []string{"client", "id"}},
+		{user: restricted, args: []string{"publish", "news", "m"}},
+		{user: restricted, args: []string{"publish", "sport", "m"}, reason: ACLDeniedChannel, object: "sport"},
+		{user: restricted, args: []string{"subscribe", "news", "nx"}},
+		{user: restricted, args: []string{"psubscribe", "n*"}},
+		// a pattern narrower than an allowed one still isn't allowed
+		{user: restricted, args: []string{"psubscribe", "nx*"}, reason: ACLDeniedChannel, object: "nx*"},
+		{user: everything, args: []string{"psubscribe", "nx*"}},
+		{user: everything, args: []string{"flushall"}},
+	}
+
+	for _, tt := range tests {
+		cmd := Command{Name: tt.args[0]}
+		for _, arg := range tt.args[1:] {
+			cmd.Args = append(cmd.Args, []byte(arg))
+		}
+		rc, errReply := h.ResolveCommand(cmd)
+		if errReply != nil {
+			t.Fatalf("%q: %s", tt.args, errReply)
+		}
+		if reason, object := tt.user.CheckCommand(rc, cmd); reason != tt.reason || object != tt.object {
+			t.Errorf("%s %q: got %q, %q, want %q, %q", tt.user.Name, tt.args, reason, object, tt.reason, tt.object)
+		}
+	}
+}
+
+func TestACLLogGrouping(t *testing.T) {
+	a := NewACL((&Server{}).BuildCommandTable())
+	denial := ACLLogEntry{Reason: ACLDeniedCommand, Context: ACLContextTopLevel, Object: "get", Username: "u"}
+
+	a.Log(denial, 2)
+	a.Log(denial, 2)
+	entries := a.LogEntries(-1)
+	if len(entries) != 1 || entries[0].Count != 2 || entries[0].ID != 0 {
+		t.Fatalf("got %+v, want one entry seen twice", entries)
+	}
+
+	// the oldest entries are dropped beyond the max length, and a repeat moves back to the front
+	for _, object := range []string{"set", "get", "lpush"} {
+		denial.Object = object
+		a.Log(denial, 2)
+	}
+	entries = a.LogEntries(-1)
+	if len(entries) != 2 || entries[0].Object != "lpush" || entries[1].Object != "get" || entries[1].Count != 3 {
+		t.Fatalf("unexpected entries %+v", entries)
+	}
+	if entries := a.LogEntries(1); len(entries) != 1 {
+		t.Fatalf("got %d entries, want 1", len(entries))
+	}
+
+	a.ResetLog()
+	if entries := a.LogEntries(-1); len(entries) != 0 {
+		t.Fatalf("got %+v after a reset", entries)
+	}
+}
+
+func TestACLUsers(t *testing.T) {
+	s := startServer(t)
+	admin := dial(t, s.Addr())
+
+	expectReply(t, admin.Do("ACL", "SETUSER", "alice", "on", ">pw", "~app:*", "&news", "+get", "+set", "+acl|whoami"), "OK")
+	expectReply(t, admin.Do("ACL", "SETUSER", "alice", "+nosuch"), replyError("ERR Error in ACL SETUSER modifier '+nosuch': Unknown command or category name in ACL"))
+	expectReply(t, admin.Do("ACL", "SETUSER", "has space"), replyError("ERR Usernames can't contain spaces or null characters"))
+	expectReply(t, admin.Do("ACL", "GETUSER", "alice"), []any{
+		"flags", []any{"on"}, "passwords", []any{HashPassword([]byte("pw"))}, "commands", "-@all +get +set +acl|whoami",
+		"keys", "~app:*", "channels", "&news", "selectors", []any{},
+	})
+	expectReply(t, admin.Do("ACL", "GETUSER", "nobody"), nil)
+	resp3 := dial(t, s.Addr())
+	resp3.Do("HELLO", "3")
+	resp3.Send("ACL", "GETUSER", "nobody")
+	if line, _ := resp3.r.ReadString('\n'); line != "_\r\n" {
+		t.Fatalf("got %q, want a RESP3 null for an unknown user", line)
+	}
+	expectReply(t, admin.Do("ACL", "USERS"), []any{"alice", "default"})
+	expectReply(t, admin.Do("ACL", "LIST"), []any{
+		"user alice on #" + HashPassword([]byte("pw")) + " ~app:* &news -@all +get +set +acl|whoami",
+		"user default on nopass ~* &* +@all",
+	})
+	expectReply(t, admin.Do("ACL", "DRYRUN", "alice", "get", "other"), "User alice has no permissions to access the 'other' key")
+	expectReply(t, admin.Do("ACL", "DRYRUN", "alice", "get", "app:1"), "OK")
+
+	alice := dial(t, s.Addr())
+	expectReply(t, alice.Do("AUTH", "alice", "nope"), replyError(WrongPassError))
+	expectReply(t, alice.Do("AUTH", "alice", "pw"), "OK")
+	expectReply(t, alice.Do("ACL", "WHOAMI"), "alice")
+	expectReply(t, alice.Do("SET", "app:1", "v"), "OK")
+	expectReply(t, alice.Do("GET", "other"), replyError("NOPERM No permissions to access a key"))
+	expectReply(t, alice.Do("LPUSH", "app:l", "a"), replyError("NOPERM User alice has no permissions to run the 'lpush' command"))
+
+	// denials inside a transaction are logged with their context
+	expectReply(t, alice.Do("ACL", "SETUSER", "alice", "+multi", "+exec"), replyError("NOPERM User alice has no permissions to run the 'acl|setuser' command"))
+	expectReply(t, admin.Do("ACL", "SETUSER", "alice", "+multi", "+exec"), "OK")
+	expectReply(t, alice.Do("MULTI"), "OK")
+	expectReply(t, alice.Do("LPUSH", "app:l", "a"), replyError("NOPERM User alice has no permissions to run the 'lpush' command"))
+	expectReply(t, alice.Do("EXEC"), replyError("EXECABORT Transaction discarded because of previous errors."))
+	log := admin.Do("ACL", "LOG").([]any)
+	if len(log) != 5 {
+		t.Fatalf("got %d ACL LOG entries, want 5", len(log))
+	}
+	for i, want := range [][]any{
+		{"count", int64(1), "reason", "command", "context", "multi", "object", "lpush", "username", "alice"},
+		{"count", int64(1), "reason", "command", "context", "toplevel", "object", "acl|setuser", "username", "alice"},
+		{"count", int64(1), "reason", "command", "context", "toplevel", "object", "lpush", "username", "alice"},
+		{"count", int64(1), "reason", "key", "context", "toplevel", "object", "other", "username", "alice"},
+		{"count", int64(1), "reason", "auth", "context", "toplevel", "object", "AUTH", "username", "alice"},
+	} {
+		expectReply(t, log[i].([]any)[:10], want)
+	}
+	expectReply(t, admin.Do("ACL", "LOG", "RESET"), "OK")
+	expectReply(t, admin.Do("ACL", "LOG"), []any{})
+
+	// deleting a user disconnects its clients
+	expectReply(t, admin.Do("ACL", "DELUSER", "default"), replyError("ERR The 'default' user cannot be removed"))
+	expectReply(t, admin.Do("ACL", "DELUSER", "alice", "nobody"), int64(1))
+	if _, err := readReply(alice.r); err == nil {
+		t.Fatal("the deleted user's client is still connected")
+	}
+}
+
+func TestACLShutdownDenied(t *testing.T) {
+	s := startServer(t)
+	admin, c := dial(t, s.Addr()), dial(t, s.Addr())
+	expectReply(t, admin.Do("ACL", "SETUSER", "reader", "on", "nopass", "allkeys", "+get"), "OK")
+	expectReply(t, c.Do("AUTH", "reader", "any"), "OK")
+
+	expectReply(t, c.Do("SHUTDOWN", "NOSAVE"), replyError("NOPERM User reader has no permissions to run the 'shutdown' command"))
+	expectReply(t, c.Do("GET", "k"), nil)
+	log := admin.Do("ACL", "LOG", "1").([]any)
+	expectReply(t, log[0].([]any)[:10], []any{"count", int64(1), "reason", "command", "context", "toplevel", "object", "shutdown", "username", "reader"})
+}
+
+func TestACLFile(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "users.acl")
+	if err := os.WriteFile(path, []byte("# team accounts\nuser bob on >pw ~bob:* +get\n\nuser default on nopass ~* &* +@all\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	s := startServer(t, fmt.Sprintf("aclfile %q", path))
+	admin := dial(t, s.Addr())
+	expectReply(t, admin.Do("ACL", "USERS"), []any{"bob", "default"})
+
+	bob := dial(t, s.Addr())
+	expectReply(t, bob.Do("AUTH", "bob", "pw"), "OK")
+	expectReply(t, bob.Do("GET", "bob:1"), nil)
+
+	// SAVE writes the current users, LOAD swaps them all and disconnects removed users
+	expectReply(t, admin.Do("ACL", "SETUSER", "carol", "on", ">pw2", "+@read"), "OK")
+	expectReply(t, admin.Do("ACL", "SAVE"), "OK")
+	saved, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if lines := strings.Split(strings.TrimSpace(string(saved)), "\n"); len(lines) != 3 || !strings.HasPrefix(lines[1], "user carol on #") {
+		t.Fatalf("unexpected ACL file %q", saved)
+	}
+
+	if err := os.WriteFile(path, []byte("user carol on >pw2 +@read\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	expectReply(t, admin.Do("ACL", "LOAD"), "OK")
+	expectReply(t, admin.Do("ACL", "USERS"), []any{"carol", "default"})
+	if _, err := readReply(bob.r); err == nil {
+		t.Fatal("the removed user's client is still connected")
+	}
+
+	// a broken file leaves the current users in place
+	if err := os.WriteFile(path, []byte("user carol on\nuser carol off\nbob on\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	expectReply(t, admin.Do("ACL", "LOAD"), replyError(fmt.Sprintf("ERR %s:2: Duplicate user 'carol' found. %s:3: line should start with user keyword.", path, path)))
+	expectReply(t, admin.Do("ACL", "USERS"), []any{"carol", "default"})
+
+	noFile := dial(t, startServer(t).Addr())
+	expectReply(t, noFile.Do("ACL", "SAVE"), replyError("ERR This Redis instance is not configured to use an ACL file. You may want to specify users via the ACL SETUSER command and then issue a CONFIG REWRITE (assuming you have a Redis configuration file set) in order to store users in the Redis configuration."))
+}
@@ -0,0 +1,66 @@
+package redisclone
+
+const (
+	NoAuthError    = "NOAUTH Authentication required."
+	WrongPassError = "WRONGPASS invalid username-password pair or user is disabled."
+)
+
+// Clients authenticate unless they did already, or connected while the default user needed no password
+func (h *Handler) AuthRequired(c *Client) bool {
+	if c.Authenticated() {
+		return false
+	}
+	u := h.ACL.Get("default")
+	return u == nil || !u.NoPass || !u.Enabled
+}
+
+// The NOAUTH reply for a command an unauthenticated client may not run, nil if it may
+func (h *Handler) CheckAuth(c *Client, rc *RedisCommand) []byte {
+	if rc.HasFlag(FlagNoAuth) || !h.AuthRequired(c) {
+		return nil
+	}
+	return h.Encoder.GenerateSimpleError(NoAuthError)
+}
+
+// Connections start as the default user, already authenticated if it needs no password
+func (h *Handler) SetDefaultAuth(c *Client) {
+	c.ResetAuthentication()
+	if !h.AuthRequired(c) {
+		c.SetAuthenticated("default")
+	}
+}
+
+// Checks a username-password pair against the ACL users, disabled users can't log in
+func (h *Handler) CheckCredentials(username, password []byte) bool {
+	u := h.ACL.Get(string(username))
+	return u != nil && u.Enabled && u.CheckPassword(password)
+}
+
+// Authenticates c as username, failures are counted and leave the current authentication in place
+func (h *Handler) Authenticate(c *Client, username, password []byte) bool {
+	if !h.CheckCredentials(username, password) {
+		h.Stats.AuthFailures.Add(1)
+		h.ACL.Log(ACLLogEntry{Reason: ACLDeniedAuth, Context: ACLContextTopLevel, Object: "AUTH", Username: string(username), ClientInfo: h.ClientInfoLine(c)}, int(h.Config.GetInt("acllog-max-len")))
+		return false
+	}
+	c.SetAuthenticated(string(username))
+	return true
+}
+
+func (h *Handler) HandleAuthCommand(c *Client, cmd Command) []byte {
+	if len(cmd.Args) > 2 {
+		return h.Encoder.GenerateSimpleError("ERR syntax error")
+	}
+
+	username, password := []byte("default"), cmd.Args[0]
+	if len(cmd.Args) == 2 {
+		username, password = cmd.Args[0], cmd.Args[1]
+	} else if u := h.ACL.Get("default"); u != nil && u.NoPass {
+		return h.Encoder.GenerateSimpleError("ERR AUTH <password> called without any password configured for the default user. Are you sure your configuration is correct?")
+	}
+
+	if !h.Authenticate(c, username, password) {
+		return h.Encoder.GenerateSimpleError(WrongPassError)
+	}
+	return h.Encoder.GetSimpleStringOk()
+}
@@ -0,0 +1,69 @@
+package redisclone
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestNoAuth(t *testing.T) {
+	tests := []struct {
+		args  []string
+		reply any
+	}{
+		{args: []string{"GET", "k"}, reply: replyError(NoAuthError)},
+		{args: []string{"PING"}, reply: replyError(NoAuthError)},
+		{args: []string{"SUBSCRIBE", "ch"}, reply: replyError(NoAuthError)},
+		{args: []string{"CLIENT", "ID"}, reply: replyError(NoAuthError)},
+		{args: []string{"SHUTDOWN", "NOSAVE"}, reply: replyError(NoAuthError)},
+		{args: []string{"HELLO", "3"}, reply: replyError("NOAUTH HELLO must be called with the client already authenticated, otherwise the HELLO <proto> AUTH <user> <pass> option can be used to authenticate the client and select the RESP protocol version at the same time")},
+		{args: []string{"AUTH", "wrong"}, reply: replyError(WrongPassError)},
+		{args: []string{"RESET"}, reply: "RESET"},
+	}
+
+	s := startServer(t, "requirepass secret")
+	c := dial(t, s.Addr())
+	for _, tt := range tests {
+		expectReply(t, c.Do(tt.args...), tt.reply)
+	}
+
+	// the server is still up after the rejected SHUTDOWN
+	expectReply(t, c.Do("AUTH", "secret"), "OK")
+	expectReply(t, c.Do("PING"), "PONG")
+	if info := c.Do("INFO", "stats").(string); !strings.Contains(info, "acl_access_denied_auth:1\r\n") {
+		t.Fatalf("unexpected stats %q", info)
+	}
+}
+
+func TestAuth(t *testing.T) {
+	s := startServer(t, "requirepass secret")
+	c := dial(t, s.Addr())
+
+	expectReply(t, c.Do("AUTH", "default", "wrong"), replyError(WrongPassError))
+	expectReply(t, c.Do("AUTH", "a", "b", "c"), replyError("ERR syntax error"))
+	expectReply(t, c.Do("AUTH", "default", "secret"), "OK")
+	expectReply(t, c.Do("SET", "k", "v"), "OK")
+	// a failed AUTH keeps the current authentication
+	expectReply(t, c.Do("AUTH", "wrong"), replyError(WrongPassError))
+	expectReply(t, c.Do("GET", "k"), "v")
+	// and RESET drops it
+	expectReply(t, c.Do("RESET"), "RESET")
+	expectReply(t, c.Do("GET", "k"), replyError(NoAuthError))
+
+	// HELLO authenticates and switches protocol in one go, a syntax error isn't counted as a failed login
+	hello := dial(t, s.Addr())
+	expectReply(t, hello.Do("HELLO", "3", "AUTH", "default"), replyError("ERR Syntax error in HELLO option 'AUTH'"))
+	expectReply(t, hello.Do("HELLO", "3", "AUTH", "default", "wrong"), replyError(WrongPassError))
+	reply := hello.Do("HELLO", "3", "AUTH", "default", "secret", "SETNAME", "app").([]any)
+	expectReply(t, reply[:6], []any{"server", "redis", "version", RedisVersion, "proto", int64(3)})
+	expectReply(t, hello.Do("CLIENT", "GETNAME"), "app")
+	if info := hello.Do("INFO", "stats").(string); !strings.Contains(info, "acl_access_denied_auth:3\r\n") {
+		t.Fatalf("unexpected stats %q", info)
+	}
+
+	// clearing requirepass lets new connections in without AUTH
+	expectReply(t, c.Do("AUTH", "secret"), "OK")
+	expectReply(t, c.Do("CONFIG", "SET", "requirepass", ""), "OK")
+	open := dial(t, s.Addr())
+	expectReply(t, open.Do("GET", "k"), "v")
+	expectReply(t, open.Do("AUTH", "secret"), replyError("ERR AUTH <password> called without any password configured for the default user. Are you sure your configuration is correct?"))
+}
@@ -0,0 +1,370 @@
+package redisclone
+
+import (
+	"net"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Name and Protocol are only written by the client's own goroutine while holding lock,
+// other goroutines must read them through the accessors
+type Client struct {
+	ID        int64
+	Conn      net.Conn
+	CreatedAt time.Time
+	Name      string
+	Protocol  int
+	db        int         // selected database, written under lock so CLIENT LIST can read it
+	Multi     *MultiState // set between MULTI and EXEC/DISCARD, only touched by the client's own goroutine
+	Watch     *WatchState
+	Script    bool    // the fake client scripts run their commands through
+	Caller    *Client // the client running the current script, only set on the scripting client
+	waiter    *Waiter
+	lock      sync.Mutex
+
+	// Connection state shown by CLIENT LIST and CLIENT INFO, guarded by lock
+	user            string
+	authenticated   bool // only consulted while the default user requires a password
+	lastInteraction time.Time
+	lastCommand     string // full name of the last command, e.g. client|list
+	queued          int    // commands queued since MULTI, -1 outside a transaction
+	noEvict         bool
+	noTouch         bool
+
+	ReleaseExecLock func() // set while a blocking command runs, releases its exec lock once the client blocks
+
+	// Subscriptions are only changed by the client's own goroutine while holding the PubSub lock
+	channels      map[string]struct{}
+	patterns      map[string]struct{}
+	shardChannels map[string]struct{}
+	subscribed    atomic.Bool // mirrors SubscriptionCount() > 0 for other goroutines, updated after every command
+
+	// Replies and pushed messages wait here for the writer goroutine, so producers like PUBLISH never block on a slow connection
+	CloseAfterReply bool // set by QUIT, the connection is closed once pending output is written
+	output          []byte
+	outputClosed    bool
+	outputReady     chan struct{}
+	outputDone      chan struct{}
+	closeOnce       sync.Once
+	killed          chan struct{} // closed by CLIENT KILL, wakes the client's goroutine if it waits on a pause
+	killOnce        sync.Once
+	outputLock      sync.Mutex
+	Limits          *OutputLimits // nil for clients without output buffer limits
+	softLimitSince  time.Time     // when pending output went over the soft limit, guarded by outputLock
+}
+
+func NewClient(id int64, conn net.Conn) *Client {
+	now := time.Now()
+	return &Client{
+		ID:              id,
+		Conn:            conn,
+		CreatedAt:       now,
+		Protocol:        RESP2,
+		user:            "default",
+		lastInteraction: now,
+		lastCommand:     "NULL",
+		queued:          -1,
+		Watch:           NewWatchState(),
+		channels:        make(map[string]struct{}),
+		patterns:        make(map[string]struct{}),
+		shardChannels:   make(map[string]struct{}),
+		outputReady:     make(chan struct{}, 1),
+		killed:          make(chan struct{}),
+		outputDone:      make(chan struct{}),
+	}
+}
+
+// Queues b for the writer goroutine, it is sent once Flush is called
+func (c *Client) Write(b []byte) {
+	c.outputLock.Lock()
+	defer c.outputLock.Unlock()
+
+	if !c.outputClosed {
+		c.output = append(c.output, b...)
+		if c.Limits != nil && c.UnsafeOutputLimitReached() {
+			c.UnsafeDisconnectForOutputLimit()
+		}
+	}
+}
+
+// Wakes the writer goroutine without waiting for the write to happen
+func (c *Client) Flush() {
+	select {
+	case c.outputReady <- struct{}{}:
+	default:
+	}
+}
+
+// Queues b and wakes the writer, used to push messages from other clients' goroutines
+func (c *Client) Push(b []byte) {
+	c.Write(b)
+	c.Flush()
+}
+
+// Writes queued output until the client is closed, then sends what is left and closes the connection
+func (c *Client) WriteLoop() {
+	defer c.Conn.Close()
+	for {
+		select {
+		case <-c.outputReady:
+			if err := c.WritePending(); err != nil {
+				return
+			}
+		case <-c.outputDone:
+			c.WritePending()
+			return
+		}
+	}
+}
+
+func (c *Client) WritePending() error {
+	c.outputLock.Lock()
+	pending := c.output
+	c.output = nil
+	c.outputLock.Unlock()
+
+	if len(pending) == 0 {
+		return nil
+	}
+	if _, err := c.Conn.Write(pending); err != nil {
+		c.outputLock.Lock()
+		c.outputClosed = true
+		c.output = nil
+		c.outputLock.Unlock()
+		return err
+	}
+	return nil
+}
+
+// Stops the writer goroutine once the pending output has been written, safe to call more than once
+func (c *Client) Close() {
+	c.closeOnce.Do(func() { close(c.outputDone) })
+}
+
+// Closes the connection from another client's goroutine, the client frees itself once it notices
+func (c *Client) Kill() {
+	c.killOnce.Do(func() { close(c.killed) })
+	c.Conn.Close()
+}
+
+func (c *Client) Killed() <-chan struct{} {
+	return c.killed
+}
+
+// Number of channels, patterns and shard channels the client is subscribed to, only safe from the client's own goroutine
+func (c *Client) SubscriptionCount() int {
+	return len(c.channels) + len(c.patterns) + len(c.shardChannels)
+}
+
+func (c *Client) ShardSubscriptionCount() int {
+	return len(c.shardChannels)
+}
+
+func (c *Client) SetName(name string) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	c.Name = name
+}
+
+func (c *Client) SetProtocol(proto int) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	c.Protocol = proto
+}
+
+func (c *Client) SelectDB(db int) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	c.db = db
+}
+
+// Index of the selected database, safe to call from any goroutine
+func (c *Client) DB() int {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	return c.db
+}
+
+// Returns the client's name and protocol version, safe to call from any goroutine
+func (c *Client) Identity() (string, int) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	return c.Name, c.Protocol
+}
+
+// Called by the client's own goroutine before running a command, unknown commands are recorded as NULL
+func (c *Client) RecordCommand(name string) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	c.lastCommand = name
+	c.lastInteraction = time.Now()
+}
+
+// Called by the client's own goroutine after every command so other goroutines can see the transaction and subscription state
+func (c *Client) RecordState() {
+	c.subscribed.Store(c.SubscriptionCount() > 0)
+	queued := -1
+	if c.Multi != nil {
+		queued = len(c.Multi.Queued)
+	}
+
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	c.queued = queued
+}
+
+func (c *Client) SetNoEvict(on bool) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	c.noEvict = on
+}
+
+func (c *Client) SetNoTouch(on bool) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	c.noTouch = on
+}
+
+func (c *Client) SetAuthenticated(user string) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	c.user = user
+	c.authenticated = true
+}
+
+// Back to the default user, which has to authenticate again if it requires a password
+func (c *Client) ResetAuthentication() {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	c.user = "default"
+	c.authenticated = false
+}
+
+func (c *Client) Authenticated() bool {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	return c.authenticated
+}
+
+func (c *Client) User() string {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	return c.user
+}
+
+// Snapshot of the connection state for CLIENT LIST and CLIENT INFO
+type ClientDescription struct {
+	Name        string
+	User        string
+	Protocol    int
+	DB          int
+	Age         time.Duration
+	Idle        time.Duration
+	LastCommand string
+	Queued      int
+	NoEvict     bool
+	NoTouch     bool
+}
+
+// Safe to call from any goroutine
+func (c *Client) Describe() ClientDescription {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	now := time.Now()
+	return ClientDescription{
+		Name:        c.Name,
+		User:        c.user,
+		Protocol:    c.Protocol,
+		DB:          c.db,
+		Age:         now.Sub(c.CreatedAt),
+		Idle:        now.Sub(c.lastInteraction),
+		LastCommand: c.lastCommand,
+		Queued:      c.queued,
+		NoEvict:     c.noEvict,
+		NoTouch:     c.noTouch,
+	}
+}
+
+// Set (or clear with nil) the waiter a client is currently blocked on
+func (c *Client) SetBlockingWaiter(w *Waiter) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	c.waiter = w
+}
+
+func (c *Client) BlockingWaiter() *Waiter {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	return c.waiter
+}
+
+type ClientList struct {
+	clients map[int64]*Client
+	nextID  int64
+	lock    sync.RWMutex
+}
+
+func NewClientList() *ClientList {
+	return &ClientList{clients: make(map[int64]*Client)}
+}
+
+// Create a client for a freshly accepted connection and register it under a new unique ID, nil once max clients are connected
+func (cl *ClientList) Add(conn net.Conn, max int) *Client {
+	cl.lock.Lock()
+	defer cl.lock.Unlock()
+
+	if len(cl.clients) >= max {
+		return nil
+	}
+
+	cl.nextID += 1
+	c := NewClient(cl.nextID, conn)
+	cl.clients[c.ID] = c
+	return c
+}
+
+func (cl *ClientList) Remove(c *Client) {
+	cl.lock.Lock()
+	defer cl.lock.Unlock()
+
+	delete(cl.clients, c.ID)
+}
+
+func (cl *ClientList) Get(id int64) (*Client, bool) {
+	cl.lock.RLock()
+	defer cl.lock.RUnlock()
+
+	c, ok := cl.clients[id]
+	return c, ok
+}
+
+// Returns a snapshot of all connected clients ordered by ID
+func (cl *ClientList) All() []*Client {
+	cl.lock.RLock()
+	defer cl.lock.RUnlock()
+
+	clients := make([]*Client, 0, len(cl.clients))
+	for _, c := range cl.clients {
+		clients = append(clients, c)
+	}
+	sort.Slice(clients, func(i, j int) bool { return clients[i].ID < clients[j].ID })
+	return clients
+}
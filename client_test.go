@@ -0,0 +1,222 @@
+package redisclone
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+)
+
+// Returns the CLIENT LIST fields of the client with id
+func clientFields(t *testing.T, c *testClient, id int64) map[string]string {
+	t.Helper()
+	line := strings.TrimSpace(c.Do("CLIENT", "LIST", "ID", fmt.Sprint(id)).(string))
+	fields := make(map[string]string)
+	for _, field := range strings.Fields(line) {
+		k, v, _ := strings.Cut(field, "=")
+		fields[k] = v
+	}
+	return fields
+}
+
+func TestClientUnblock(t *testing.T) {
+	tests := []struct {
+		args  []string
+		reply any
+	}{
+		{args: nil, reply: nil},
+		{args: []string{"TIMEOUT"}, reply: nil},
+		{args: []string{"ERROR"}, reply: replyError("UNBLOCKED client unblocked via CLIENT UNBLOCK")},
+	}
+
+	s := startServer(t)
+	c, blocked := dial(t, s.Addr()), dial(t, s.Addr())
+	id := blocked.Do("CLIENT", "ID").(int64)
+
+	for _, tt := range tests {
+		blocked.Send("BLPOP", "a", "b", "0")
+		waitForBlockedClients(t, c, 1)
+		fields := clientFields(t, c, id)
+		if fields["flags"] != "b" || fields["bkeys"] != "a,b" || fields["cmd"] != "blpop" {
+			t.Fatalf("unexpected CLIENT LIST entry %v for a blocked client", fields)
+		}
+
+		expectReply(t, c.Do(append([]string{"CLIENT", "UNBLOCK", fmt.Sprint(id)}, tt.args...)...), int64(1))
+		expectReply(t, blocked.Read(), tt.reply)
+		waitForBlockedClients(t, c, 0)
+		if fields := clientFields(t, c, id); fields["flags"] != "N" || fields["bkeys"] != "" {
+			t.Fatalf("unexpected CLIENT LIST entry %v after unblocking", fields)
+		}
+	}
+
+	// a client that isn't blocked, or doesn't exist, is left alone
+	expectReply(t, c.Do("CLIENT", "UNBLOCK", fmt.Sprint(id)), int64(0))
+	expectReply(t, c.Do("CLIENT", "UNBLOCK", "999999"), int64(0))
+	expectReply(t, c.Do("CLIENT", "UNBLOCK", "x"), replyError("ERR value is not an integer or out of range"))
+	expectReply(t, c.Do("CLIENT", "UNBLOCK", fmt.Sprint(id), "LATER"), replyError("ERR CLIENT UNBLOCK reason should be TIMEOUT or ERROR"))
+}
+
+func TestIsValidClientName(t *testing.T) {
+	tests := []struct {
+		name  string
+		valid bool
+	}{
+		{name: "", valid: true},
+		{name: "worker-1", valid: true},
+		{name: "a:b{c}~!", valid: true},
+		{name: "has space"},
+		{name: "new\nline"},
+		{name: "tab\t"},
+		{name: "caf\xc3\xa9"},
+	}
+
+	for _, tt := range tests {
+		if got := IsValidClientName([]byte(tt.name)); got != tt.valid {
+			t.Errorf("IsValidClientName(%q) = %v, want %v", tt.name, got, tt.valid)
+		}
+	}
+}
+
+func TestParseClientType(t *testing.T) {
+	tests := []struct {
+		arg  string
+		want string
+		err  bool
+	}{
+		{arg: "normal", want: "normal"},
+		{arg: "PUBSUB", want: "pubsub"},
+		{arg: "master", want: "master"},
+		{arg: "replica", want: "replica"},
+		{arg: "slave", want: "replica"},
+		{arg: "monitor", err: true},
+	}
+
+	for _, tt := range tests {
+		got, err := ParseClientType([]byte(tt.arg))
+		if (err != nil) != tt.err || got != tt.want {
+			t.Errorf("ParseClientType(%q) = %q, %v, want %q, error %v", tt.arg, got, err, tt.want, tt.err)
+		}
+	}
+}
+
+func TestClientNameAndInfo(t *testing.T) {
+	s := startServer(t)
+	c := dial(t, s.Addr())
+	id := c.Do("CLIENT", "ID").(int64)
+
+	expectReply(t, c.Do("CLIENT", "GETNAME"), nil)
+	expectReply(t, c.Do("CLIENT", "SETNAME", "has space"), replyError("ERR Client names cannot contain spaces, newlines or special characters."))
+	expectReply(t, c.Do("CLIENT", "SETNAME", "worker"), "OK")
+	expectReply(t, c.Do("CLIENT", "GETNAME"), "worker")
+
+	expectReply(t, c.Do("SELECT", "2"), "OK")
+	expectReply(t, c.Do("CLIENT", "NO-EVICT", "ON"), "OK")
+	expectReply(t, c.Do("CLIENT", "NO-TOUCH", "ON"), "OK")
+	expectReply(t, c.Do("CLIENT", "NO-TOUCH", "MAYBE"), replyError("ERR syntax error"))
+	fields := clientFields(t, c, id)
+	want := map[string]string{"id": fmt.Sprint(id), "addr": c.conn.LocalAddr().String(), "name": "worker", "db": "2", "flags": "eT", "cmd": "client|list", "user": "default", "resp": "2"}
+	for k, v := range want {
+		if fields[k] != v {
+			t.Errorf("CLIENT LIST field %s = %q, want %q", k, fields[k], v)
+		}
+	}
+
+	// CLIENT INFO describes the calling connection with the same fields
+	info := strings.TrimSpace(c.Do("CLIENT", "INFO").(string))
+	if !strings.HasPrefix(info, fmt.Sprintf("id=%d addr=%s ", id, c.conn.LocalAddr())) || !strings.Contains(info, " cmd=client|info ") {
+		t.Fatalf("unexpected CLIENT INFO %q", info)
+	}
+
+	// an empty name clears it
+	expectReply(t, c.Do("CLIENT", "SETNAME", ""), "OK")
+	expectReply(t, c.Do("CLIENT", "GETNAME"), nil)
+}
+
+func TestClientList(t *testing.T) {
+	s := startServer(t)
+	c, sub := dial(t, s.Addr()), dial(t, s.Addr())
+	id, subID := c.Do("CLIENT", "ID").(int64), sub.Do("CLIENT", "ID").(int64)
+	expectReply(t, sub.Do("SUBSCRIBE", "ch"), []any{"subscribe", "ch", int64(1)})
+
+	ids := func(args ...string) []string {
+		var ids []string
+		for _, line := range strings.Split(strings.TrimSpace(c.Do(append([]string{"CLIENT", "LIST"}, args...)...).(string)), "\n") {
+			if line != "" {
+				ids = append(ids, strings.TrimPrefix(strings.Fields(line)[0], "id="))
+			}
+		}
+		return ids
+	}
+	tests := []struct {
+		args []string
+		want []string
+	}{
+		{args: nil, want: []string{fmt.Sprint(id), fmt.Sprint(subID)}},
+		{args: []string{"TYPE", "normal"}, want: []string{fmt.Sprint(id)}},
+		{args: []string{"TYPE", "pubsub"}, want: []string{fmt.Sprint(subID)}},
+		{args: []string{"TYPE", "replica"}, want: nil},
+		{args: []string{"ID", fmt.Sprint(subID), "999999"}, want: []string{fmt.Sprint(subID)}},
+		{args: []string{"TYPE", "pubsub", "ID", fmt.Sprint(id)}, want: nil},
+	}
+	for _, tt := range tests {
+		if got := ids(tt.args...); fmt.Sprint(got) != fmt.Sprint(tt.want) {
+			t.Errorf("CLIENT LIST %q = %v, want %v", tt.args, got, tt.want)
+		}
+	}
+
+	expectReply(t, c.Do("CLIENT", "LIST", "TYPE", "monitor"), replyError("ERR Unknown client type 'monitor'"))
+	expectReply(t, c.Do("CLIENT", "LIST", "ID", "0"), replyError("ERR Invalid client ID"))
+	expectReply(t, c.Do("CLIENT", "LIST", "ID"), replyError("ERR syntax error"))
+	expectReply(t, c.Do("CLIENT", "LIST", "ALL"), replyError("ERR syntax error"))
+}
+
+func TestClientKill(t *testing.T) {
+	s := startServer(t)
+	c := dial(t, s.Addr())
+	id := c.Do("CLIENT", "ID").(int64)
+
+	// waits for the killed connection to be closed by the server
+	expectClosed := func(victim *testClient) {
+		t.Helper()
+		if _, err := readReply(victim.r); err == nil {
+			t.Fatal("the killed client's connection is still open")
+		}
+	}
+
+	victim := dial(t, s.Addr())
+	victimID := victim.Do("CLIENT", "ID").(int64)
+	expectReply(t, c.Do("CLIENT", "KILL", victim.conn.LocalAddr().String()), "OK")
+	expectClosed(victim)
+	waitFor(t, func() bool { return len(clientFields(t, c, victimID)) <= 1 })
+	expectReply(t, c.Do("CLIENT", "KILL", victim.conn.LocalAddr().String()), replyError("ERR No such client"))
+
+	victim = dial(t, s.Addr())
+	victimID = victim.Do("CLIENT", "ID").(int64)
+	expectReply(t, c.Do("CLIENT", "KILL", "ID", fmt.Sprint(victimID)), int64(1))
+	expectClosed(victim)
+
+	// the filter form skips the caller unless SKIPME no is given
+	victim = dial(t, s.Addr())
+	expectReply(t, victim.Do("PING"), "PONG")
+	expectReply(t, c.Do("CLIENT", "KILL", "TYPE", "normal"), int64(1))
+	expectClosed(victim)
+	expectReply(t, c.Do("CLIENT", "KILL", "ID", fmt.Sprint(id)), int64(0))
+
+	invalid := []struct {
+		args  []string
+		reply replyError
+	}{
+		{args: []string{"ID", "0"}, reply: "ERR client-id should be greater than 0"},
+		{args: []string{"USER", "nobody"}, reply: "ERR No such user 'nobody'"},
+		{args: []string{"TYPE", "monitor"}, reply: "ERR Unknown client type 'monitor'"},
+		{args: []string{"SKIPME", "maybe"}, reply: "ERR syntax error"},
+		{args: []string{"ID", "1", "TYPE"}, reply: "ERR syntax error"},
+		{args: []string{"NAME", "x"}, reply: "ERR syntax error"},
+	}
+	for _, tt := range invalid {
+		expectReply(t, c.Do(append([]string{"CLIENT", "KILL"}, tt.args...)...), tt.reply)
+	}
+
+	// killing itself still gets the reply out before the connection closes
+	expectReply(t, c.Do("CLIENT", "KILL", "ID", fmt.Sprint(id), "SKIPME", "no"), int64(1))
+	expectClosed(c)
+}
@@ -0,0 +1,39 @@
+package main
+
+import (
+	"fmt"
+	"log/slog"
+	"os"
+
+	"RedisClone"
+)
+
+func main() {
+	args := os.Args[1:]
+	if len(args) == 1 && (args[0] == "-v" || args[0] == "--version") {
+		fmt.Printf("Redis server v=%s (RedisClone)\n", redisclone.RedisVersion)
+		return
+	}
+	if len(args) == 1 && (args[0] == "-h" || args[0] == "--help") {
+		fmt.Println("Usage: ./redis-server [/path/to/redis.conf] [options]")
+		fmt.Println("Examples:")
+		fmt.Println("       ./redis-server (run the server with default config)")
+		fmt.Println("       ./redis-server /etc/redis/6379.conf")
+		fmt.Println("       ./redis-server --port 7777")
+		fmt.Println("       ./redis-server /etc/myredis.conf --loglevel verbose")
+		return
+	}
+
+	config, err := redisclone.LoadConfigFromArgs(args)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+
+	server, err := redisclone.NewServer(redisclone.Options{Config: config, LoadSnapshot: true, HandleSignals: true})
+	if err != nil {
+		slog.Error("Fatal error starting the server, exiting.", "err", err)
+		os.Exit(1)
+	}
+	server.Wait()
+}
@@ -0,0 +1,528 @@
+package redisclone
+
+import (
+	"fmt"
+	"slices"
+	"strings"
+)
+
+type CommandProc func(c *Client, cmd Command) []byte
+
+type CommandFlag uint64
+
+const (
+	FlagWrite CommandFlag = 1 << iota
+	FlagReadonly
+	FlagDenyOOM
+	FlagAdmin
+	FlagPubSub
+	FlagNoScript
+	FlagBlocking
+	FlagLoading
+	FlagStale
+	FlagFast
+	FlagNoAuth
+	FlagNoMulti
+	FlagMovableKeys
+	FlagAllowBusy
+	FlagMayReplicate
+)
+
+// Names as reported by COMMAND INFO, in the same order as the flags above
+var commandFlagNames = []string{"write", "readonly", "denyoom", "admin", "pubsub", "noscript", "blocking", "loading", "stale", "fast", "no_auth", "no_multi", "movablekeys", "allow_busy", "may_replicate"}
+
+type RedisCommand struct {
+	Name        string // lowercase, subcommands use the "container|sub" form
+	Proc        CommandProc
+	Arity       int // exact number of arguments including the name, negative means at least -Arity
+	Flags       CommandFlag
+	FirstKey    int // position of the first key in argv, 0 when the command takes no keys
+	LastKey     int // negative values count from the end of argv
+	KeyStep     int
+	KeySpecs    []string                  // access flags of the key spec, e.g. RW ACCESS DELETE
+	GetKeys     func(argv [][]byte) []int // finds key positions for commands whose keys move around
+	Exclusive   bool                      // runs with every other command locked out, for EXEC and scripts
+	Categories  []string                  // ACL categories without the leading @
+	Summary     string
+	Since       string
+	Group       string
+	Subcommands []*RedisCommand
+}
+
+func (rc *RedisCommand) HasFlag(f CommandFlag) bool {
+	return rc.Flags&f != 0
+}
+
+// Checks the argument count including the command name (and subcommand name for subcommands)
+func (rc *RedisCommand) CheckArity(argc int) bool {
+	return (rc.Arity > 0 && argc == rc.Arity) || (rc.Arity < 0 && argc >= -rc.Arity)
+}
+
+// Returns the positions of the keys in argv, where argv[0] is the command name
+func (rc *RedisCommand) KeyPositions(argv [][]byte) []int {
+	if rc.GetKeys != nil {
+		return rc.GetKeys(argv)
+	}
+	if rc.FirstKey == 0 {
+		return nil
+	}
+
+	last := rc.LastKey
+	if last < 0 {
+		last = len(argv) + last
+	}
+	var positions []int
+	for i := rc.FirstKey; i <= last && i < len(argv); i += rc.KeyStep {
+		positions = append(positions, i)
+	}
+	return positions
+}
+
+// Returns the key names a parsed command refers to
+func (rc *RedisCommand) Keys(cmd Command) [][]byte {
+	argv := cmd.Argv()
+	var keys [][]byte
+	for _, i := range rc.KeyPositions(argv) {
+		keys = append(keys, argv[i])
+	}
+	return keys
+}
+
+func (rc *RedisCommand) FindSubcommand(name string) *RedisCommand {
+	full := rc.Name + "|" + strings.ToLower(name)
+	for _, sub := range rc.Subcommands {
+		if sub.Name == full {
+			return sub
+		}
+	}
+	return nil
+}
+
+type CommandTable struct {
+	commands map[string]*RedisCommand
+}
+
+func NewCommandTable(commands []*RedisCommand) *CommandTable {
+	t := &CommandTable{commands: make(map[string]*RedisCommand)}
+	for _, rc := range commands {
+		t.commands[rc.Name] = rc
+	}
+	return t
+}
+
+// Case insensitive lookup of a top level command
+func (t *CommandTable) Lookup(name string) *RedisCommand {
+	return t.commands[strings.ToLower(name)]
+}
+
+// Returns every top level command sorted by name
+func (t *CommandTable) All() []*RedisCommand {
+	all := make([]*RedisCommand, 0, len(t.commands))
+	for _, rc := range t.commands {
+		all = append(all, rc)
+	}
+	slices.SortFunc(all, func(a, b *RedisCommand) int { return strings.Compare(a.Name, b.Name) })
+	return all
+}
+
+// Full name of the command cmd runs, e.g. client|list, or NULL when it's unknown
+func (t *CommandTable) FullName(cmd Command) string {
+	rc := t.Lookup(cmd.Name)
+	if rc == nil {
+		return "NULL"
+	}
+	if len(rc.Subcommands) > 0 && len(cmd.Args) > 0 {
+		if sub := rc.FindSubcommand(string(cmd.Args[0])); sub != nil {
+			return sub.Name
+		}
+	}
+	return rc.Name
+}
+
+func (t *CommandTable) Count() int {
+	return len(t.commands)
+}
+
+// Returns the full argument vector, with the command name as argv[0]
+func (cmd Command) Argv() [][]byte {
+	return append([][]byte{[]byte(cmd.Name)}, cmd.Args...)
+}
+
+// Finds the command (or subcommand) to run and checks its arity, returning an error reply on failure
+func (h *Handler) ResolveCommand(cmd Command) (*RedisCommand, []byte) {
+	rc := h.Commands.Lookup(cmd.Name)
+	if rc == nil {
+		var args strings.Builder
+		for _, v := range cmd.Args {
+			if args.Len() >= 128 {
+				break
+			}
+			fmt.Fprintf(&args, "'%s' ", v)
+		}
+		return nil, h.Encoder.GenerateSimpleError(fmt.Sprintf("ERR unknown command '%s', with args beginning with: %s", cmd.Name, args.String()))
+	}
+
+	if len(rc.Subcommands) > 0 && len(cmd.Args) > 0 {
+		sub := rc.FindSubcommand(string(cmd.Args[0]))
+		if sub == nil {
+			return nil, h.Encoder.GenerateSimpleError(fmt.Sprintf("ERR unknown subcommand '%s'. Try %s HELP.", cmd.Args[0], strings.ToUpper(rc.Name)))
+		}
+		rc = sub
+	}
+
+	if !rc.CheckArity(len(cmd.Args) + 1) {
+		return nil, h.Encoder.GenerateSimpleError(fmt.Sprintf("ERR wrong number of arguments for '%s' command", rc.Name))
+	}
+	return rc, nil
+}
+
+// Built from the subcommand summaries of a container command like CLIENT or CONFIG
+func (h *Handler) HandleHelpSubcommand(c *Client, cmd Command) []byte {
+	container := h.Commands.Lookup(cmd.Name)
+	lines := [][]byte{fmt.Appendf(nil, "%s <subcommand> [<arg> [value] [opt] ...]. Subcommands are:", strings.ToUpper(container.Name))}
+	for _, sub := range container.Subcommands {
+		_, name, _ := strings.Cut(sub.Name, "|")
+		lines = append(lines, []byte(strings.ToUpper(name)), fmt.Appendf(nil, "    %s", sub.Summary))
+	}
+
+	var items [][]byte
+	for _, line := range lines {
+		items = append(items, h.Encoder.GenerateSimpleString(line))
+	}
+	return h.Encoder.GenerateRawArray(items)
+}
+
+func (s *Server) BuildCommandTable() *CommandTable {
+	h := &s.Handler
+	help := func(container string) *RedisCommand {
+		return &RedisCommand{Name: container + "|help", Proc: h.HandleHelpSubcommand, Arity: 2, Flags: FlagLoading | FlagStale, Categories: []string{"slow"}, Summary: "Returns helpful text about the different subcommands.", Since: "5.0.0", Group: "server"}
+	}
+
+	return NewCommandTable([]*RedisCommand{
+		// Connection
+		{Name: "ping", Proc: h.HandlePingCommand, Arity: -1, Flags: FlagFast, Categories: []string{"fast", "connection"}, Summary: "Returns the server's liveliness response.", Since: "1.0.0", Group: "connection"},
+		{Name: "echo", Proc: h.HandleEchoCommand, Arity: 2, Flags: FlagFast, Categories: []string{"fast", "connection"}, Summary: "Returns the given string.", Since: "1.0.0", Group: "connection"},
+		{Name: "auth", Proc: h.HandleAuthCommand, Arity: -2, Flags: FlagNoScript | FlagLoading | FlagStale | FlagFast | FlagNoAuth | FlagAllowBusy, Categories: []string{"fast", "connection"}, Summary: "Authenticates the connection.", Since: "1.0.0", Group: "connection"},
+		{Name: "hello", Proc: h.HandleHelloCommand, Arity: -1, Flags: FlagNoScript | FlagLoading | FlagStale | FlagFast | FlagNoAuth | FlagAllowBusy, Categories: []string{"fast", "connection"}, Summary: "Handshakes with the Redis server.", Since: "6.0.0", Group: "connection"},
+		{Name: "client", Arity: -2, Categories: []string{"slow"}, Summary: "A container for client connection commands.", Since: "2.4.0", Group: "connection", Subcommands: []*RedisCommand{
+			{Name: "client|list", Proc: h.HandleClientListCommand, Arity: -2, Flags: FlagAdmin | FlagNoScript | FlagLoading | FlagStale, Categories: []string{"admin", "slow", "dangerous", "connection"}, Summary: "Lists open connections.", Since: "2.4.0", Group: "connection"},
+			{Name: "client|unblock", Proc: h.HandleClientUnblockCommand, Arity: -3, Flags: FlagAdmin | FlagNoScript | FlagLoading | FlagStale, Categories: []string{"admin", "slow", "dangerous", "connection"}, Summary: "Unblocks a client blocked by a blocking command from a different connection.", Since: "5.0.0", Group: "connection"},
+			{Name: "client|tracking", Proc: h.HandleClientTrackingCommand, Arity: -3, Flags: FlagNoScript | FlagLoading | FlagStale, Categories: []string{"slow", "connection"}, Summary: "Controls server-assisted client-side caching for the connection.", Since: "6.0.0", Group: "connection"},
+			{Name: "client|caching", Proc: h.HandleClientCachingCommand, Arity: 3, Flags: FlagNoScript | FlagLoading | FlagStale, Categories: []string{"slow", "connection"}, Summary: "Instructs the server whether to track the keys in the next request.", Since: "6.0.0", Group: "connection"},
+			{Name: "client|getredir", Proc: h.HandleClientGetRedirCommand, Arity: 2, Flags: FlagNoScript | FlagLoading | FlagStale, Categories: []string{"slow", "connection"}, Summary: "Returns the client ID to which the connection's tracking notifications are redirected.", Since: "6.0.0", Group: "connection"},
+			{Name: "client|trackinginfo", Proc: h.HandleClientTrackingInfoCommand, Arity: 2, Flags: FlagNoScript | FlagLoading | FlagStale, Categories: []string{"slow", "connection"}, Summary: "Returns information about server-assisted client-side caching for the connection.", Since: "6.2.0", Group: "connection"},
+			{Name: "client|id", Proc: h.HandleClientIDCommand, Arity: 2, Flags: FlagNoScript | FlagLoading | FlagStale, Categories: []string{"slow", "connection"}, Summary: "Returns the unique client ID of the connection.", Since: "5.0.0", Group: "connection"},
+			{Name: "client|info", Proc: h.HandleClientInfoCommand, Arity: 2, Flags: FlagNoScript | FlagLoading | FlagStale, Categories: []string{"slow", "connection"}, Summary: "Returns information about the connection.", Since: "6.2.0", Group: "connection"},
+			{Name: "client|setname", Proc: h.HandleClientSetNameCommand, Arity: 3, Flags: FlagNoScript | FlagLoading | FlagStale, Categories: []string{"slow", "connection"}, Summary: "Sets the connection name.", Since: "2.6.9", Group: "connection"},
+			{Name: "client|getname", Proc: h.HandleClientGetNameCommand, Arity: 2, Flags: FlagNoScript | FlagLoading | FlagStale, Categories: []string{"slow", "connection"}, Summary: "Returns the name of the connection.", Since: "2.6.9", Group: "connection"},
+			{Name: "client|kill", Proc: h.HandleClientKillCommand, Arity: -3, Flags: FlagAdmin | FlagNoScript | FlagLoading | FlagStale, Categories: []string{"admin", "slow", "dangerous", "connection"}, Summary: "Terminates open connections.", Since: "2.4.0", Group: "connection"},
+			{Name: "client|pause", Proc: h.HandleClientPauseCommand, Arity: -3, Flags: FlagAdmin | FlagNoScript | FlagLoading | FlagStale, Categories: []string{"admin", "slow", "dangerous", "connection"}, Summary: "Suspends commands processing.", Since: "3.0.0", Group: "connection"},
+			{Name: "client|unpause", Proc: h.HandleClientUnpauseCommand, Arity: 2, Flags: FlagAdmin | FlagNoScript | FlagLoading | FlagStale, Categories: []string{"admin", "slow", "dangerous", "connection"}, Summary: "Resumes processing commands from paused clients.", Since: "6.2.0", Group: "connection"},
+			{Name: "client|no-evict", Proc: h.HandleClientNoEvictCommand, Arity: 3, Flags: FlagAdmin | FlagNoScript | FlagLoading | FlagStale, Categories: []string{"admin", "slow", "dangerous", "connection"}, Summary: "Sets the client eviction mode of the connection.", Since: "7.0.0", Group: "connection"},
+			{Name: "client|no-touch", Proc: h.HandleClientNoTouchCommand, Arity: 3, Flags: FlagNoScript | FlagLoading | FlagStale, Categories: []string{"slow", "connection"}, Summary: "Controls whether commands sent by the client affect the LRU/LFU of accessed keys.", Since: "7.2.0", Group: "connection"},
+			help("client"),
+		}},
+
+		{Name: "select", Proc: h.HandleSelectCommand, Arity: 2, Flags: FlagLoading | FlagStale | FlagFast, Categories: []string{"fast", "connection"}, Summary: "Changes the selected database.", Since: "1.0.0", Group: "connection"},
+		{Name: "reset", Proc: h.HandleResetCommand, Arity: 1, Flags: FlagNoScript | FlagLoading | FlagStale | FlagFast | FlagNoAuth | FlagAllowBusy, Categories: []string{"fast", "connection"}, Summary: "Resets the connection.", Since: "6.2.0", Group: "connection"},
+		{Name: "quit", Proc: h.HandleQuitCommand, Arity: -1, Flags: FlagNoScript | FlagLoading | FlagStale | FlagFast | FlagNoAuth | FlagAllowBusy, Categories: []string{"fast", "connection"}, Summary: "Closes the connection.", Since: "1.0.0", Group: "connection"},
+
+		// Pub/Sub
+		{Name: "subscribe", Proc: h.HandleSubscribeCommand, Arity: -2, Flags: FlagPubSub | FlagNoScript | FlagLoading | FlagStale, Categories: []string{"pubsub", "slow"}, Summary: "Listens for messages published to channels.", Since: "2.0.0", Group: "pubsub"},
+		{Name: "unsubscribe", Proc: h.HandleUnsubscribeCommand, Arity: -1, Flags: FlagPubSub | FlagNoScript | FlagLoading | FlagStale, Categories: []string{"pubsub", "slow"}, Summary: "Stops listening to messages posted to channels.", Since: "2.0.0", Group: "pubsub"},
+		{Name: "psubscribe", Proc: h.HandlePSubscribeCommand, Arity: -2, Flags: FlagPubSub | FlagNoScript | FlagLoading | FlagStale, Categories: []string{"pubsub", "slow"}, Summary: "Listens for messages published to channels that match one or more patterns.", Since: "2.0.0", Group: "pubsub"},
+		{Name: "punsubscribe", Proc: h.HandlePUnsubscribeCommand, Arity: -1, Flags: FlagPubSub | FlagNoScript | FlagLoading | FlagStale, Categories: []string{"pubsub", "slow"}, Summary: "Stops listening to messages published to channels that match one or more patterns.", Since: "2.0.0", Group: "pubsub"},
+		{Name: "publish", Proc: h.HandlePublishCommand, Arity: 3, Flags: FlagPubSub | FlagLoading | FlagStale | FlagFast | FlagMayReplicate, Categories: []string{"pubsub", "fast"}, Summary: "Posts a message to a channel.", Since: "2.0.0", Group: "pubsub"},
+		{Name: "ssubscribe", Proc: h.HandleSSubscribeCommand, Arity: -2, Flags: FlagPubSub | FlagNoScript | FlagLoading | FlagStale, FirstKey: 1, LastKey: -1, KeyStep: 1, KeySpecs: []string{"NOT_KEY"}, Categories: []string{"pubsub", "slow"}, Summary: "Listens for messages published to shard channels.", Since: "7.0.0", Group: "pubsub"},
+		{Name: "sunsubscribe", Proc: h.HandleSUnsubscribeCommand, Arity: -1, Flags: FlagPubSub | FlagNoScript | FlagLoading | FlagStale, FirstKey: 1, LastKey: -1, KeyStep: 1, KeySpecs: []string{"NOT_KEY"}, Categories: []string{"pubsub", "slow"}, Summary: "Stops listening to messages posted to shard channels.", Since: "7.0.0", Group: "pubsub"},
+		{Name: "spublish", Proc: h.HandleSPublishCommand, Arity: 3, Flags: FlagPubSub | FlagLoading | FlagStale | FlagFast | FlagMayReplicate, FirstKey: 1, LastKey: 1, KeyStep: 1, KeySpecs: []string{"NOT_KEY"}, Categories: []string{"pubsub", "fast"}, Summary: "Post a message to a shard channel", Since: "7.0.0", Group: "pubsub"},
+		{Name: "pubsub", Arity: -2, Categories: []string{"slow"}, Summary: "A container for Pub/Sub commands.", Since: "2.8.0", Group: "pubsub", Subcommands: []*RedisCommand{
+			{Name: "pubsub|channels", Proc: h.HandlePubSubChannelsCommand, Arity: -2, Flags: FlagPubSub | FlagLoading | FlagStale, Categories: []string{"pubsub", "slow"}, Summary: "Returns the active channels.", Since: "2.8.0", Group: "pubsub"},
+			{Name: "pubsub|numsub", Proc: h.HandlePubSubNumSubCommand, Arity: -2, Flags: FlagPubSub | FlagLoading | FlagStale, Categories: []string{"pubsub", "slow"}, Summary: "Returns a count of subscribers to channels.", Since: "2.8.0", Group: "pubsub"},
+			{Name: "pubsub|shardchannels", Proc: h.HandlePubSubShardChannelsCommand, Arity: -2, Flags: FlagPubSub | FlagLoading | FlagStale, Categories: []string{"pubsub", "slow"}, Summary: "Returns the active shard channels.", Since: "7.0.0", Group: "pubsub"},
+			{Name: "pubsub|shardnumsub", Proc: h.HandlePubSubShardNumSubCommand, Arity: -2, Flags: FlagPubSub | FlagLoading | FlagStale, Categories: []string{"pubsub", "slow"}, Summary: "Returns the count of subscribers of shard channels.", Since: "7.0.0", Group: "pubsub"},
+			{Name: "pubsub|numpat", Proc: h.HandlePubSubNumPatCommand, Arity: 2, Flags: FlagPubSub | FlagLoading | FlagStale, Categories: []string{"pubsub", "slow"}, Summary: "Returns a count of unique pattern subscriptions.", Since: "2.8.0", Group: "pubsub"},
+			help("pubsub"),
+		}},
+
+		// Transactions
+		{Name: "multi", Proc: s.HandleMultiCommand, Arity: 1, Flags: FlagNoScript | FlagLoading | FlagStale | FlagFast | FlagAllowBusy, Categories: []string{"fast", "transaction"}, Summary: "Starts a transaction.", Since: "1.2.0", Group: "transactions"},
+		{Name: "exec", Proc: s.HandleExecCommand, Arity: 1, Exclusive: true, Flags: FlagNoScript | FlagLoading | FlagStale, Categories: []string{"slow", "transaction"}, Summary: "Executes all commands in a transaction.", Since: "1.2.0", Group: "transactions"},
+		{Name: "discard", Proc: s.HandleDiscardCommand, Arity: 1, Flags: FlagNoScript | FlagLoading | FlagStale | FlagFast | FlagAllowBusy, Categories: []string{"fast", "transaction"}, Summary: "Discards a transaction.", Since: "2.0.0", Group: "transactions"},
+
+		{Name: "watch", Proc: s.HandleWatchCommand, Arity: -2, Flags: FlagNoScript | FlagLoading | FlagStale | FlagFast | FlagAllowBusy, FirstKey: 1, LastKey: -1, KeyStep: 1, KeySpecs: []string{"RO"}, Categories: []string{"fast", "transaction"}, Summary: "Monitors changes to keys to determine the execution of a transaction.", Since: "2.2.0", Group: "transactions"},
+		{Name: "unwatch", Proc: s.HandleUnwatchCommand, Arity: 1, Flags: FlagNoScript | FlagLoading | FlagStale | FlagFast | FlagAllowBusy, Categories: []string{"fast", "transaction"}, Summary: "Forgets about watched keys of a transaction.", Since: "2.2.0", Group: "transactions"},
+
+		// Scripting
+		{Name: "eval", Proc: s.HandleEvalCommand, Arity: -3, Exclusive: true, Flags: FlagNoScript | FlagStale | FlagMovableKeys | FlagMayReplicate, GetKeys: ScriptGetKeys, Categories: []string{"slow", "scripting"}, Summary: "Executes a server-side Lua script.", Since: "2.6.0", Group: "scripting"},
+		{Name: "evalsha", Proc: s.HandleEvalShaCommand, Arity: -3, Exclusive: true, Flags: FlagNoScript | FlagStale | FlagMovableKeys | FlagMayReplicate, GetKeys: ScriptGetKeys, Categories: []string{"slow", "scripting"}, Summary: "Executes a server-side Lua script by SHA1 digest.", Since: "2.6.0", Group: "scripting"},
+		{Name: "script", Arity: -2, Categories: []string{"slow"}, Summary: "A container for Lua scripts management commands.", Since: "2.6.0", Group: "scripting", Subcommands: []*RedisCommand{
+			{Name: "script|load", Proc: s.HandleScriptLoadCommand, Arity: 3, Flags: FlagNoScript | FlagStale | FlagMayReplicate, Categories: []string{"slow", "scripting"}, Summary: "Loads a server-side Lua script to the script cache.", Since: "2.6.0", Group: "scripting"},
+			{Name: "script|exists", Proc: s.HandleScriptExistsCommand, Arity: -3, Flags: FlagNoScript, Categories: []string{"slow", "scripting"}, Summary: "Determines whether server-side Lua scripts exist in the script cache.", Since: "2.6.0", Group: "scripting"},
+			{Name: "script|flush", Proc: s.HandleScriptFlushCommand, Arity: -2, Flags: FlagNoScript | FlagMayReplicate, Categories: []string{"slow", "scripting"}, Summary: "Removes all server-side Lua scripts from the script cache.", Since: "2.6.0", Group: "scripting"},
+			{Name: "script|kill", Proc: s.HandleScriptKillCommand, Arity: 2, Flags: FlagNoScript | FlagAllowBusy, Categories: []string{"slow", "scripting"}, Summary: "Terminates a server-side Lua script during execution.", Since: "2.6.0", Group: "scripting"},
+			help("script"),
+		}},
+
+		{Name: "fcall", Proc: s.HandleFcallCommand, Arity: -3, Exclusive: true, Flags: FlagNoScript | FlagStale | FlagMovableKeys | FlagMayReplicate, GetKeys: ScriptGetKeys, Categories: []string{"slow", "scripting"}, Summary: "Invokes a function.", Since: "7.0.0", Group: "scripting"},
+		{Name: "fcall_ro", Proc: s.HandleFcallCommand, Arity: -3, Exclusive: true, Flags: FlagNoScript | FlagStale | FlagReadonly | FlagMovableKeys, GetKeys: ScriptGetKeys, Categories: []string{"slow", "scripting"}, Summary: "Invokes a read-only function.", Since: "7.0.0", Group: "scripting"},
+		{Name: "function", Arity: -2, Categories: []string{"slow"}, Summary: "A container for function commands.", Since: "7.0.0", Group: "scripting", Subcommands: []*RedisCommand{
+			{Name: "function|load", Proc: s.HandleFunctionLoadCommand, Arity: -3, Flags: FlagWrite | FlagDenyOOM | FlagNoScript, Categories: []string{"write", "slow", "scripting"}, Summary: "Creates a library.", Since: "7.0.0", Group: "scripting"},
+			{Name: "function|delete", Proc: s.HandleFunctionDeleteCommand, Arity: 3, Flags: FlagWrite | FlagNoScript, Categories: []string{"write", "slow", "scripting"}, Summary: "Deletes a library and its functions.", Since: "7.0.0", Group: "scripting"},
+			{Name: "function|flush", Proc: s.HandleFunctionFlushCommand, Arity: -2, Flags: FlagWrite | FlagNoScript, Categories: []string{"write", "slow", "scripting"}, Summary: "Deletes all libraries and functions.", Since: "7.0.0", Group: "scripting"},
+			{Name: "function|list", Proc: s.HandleFunctionListCommand, Arity: -2, Flags: FlagNoScript, Categories: []string{"slow", "scripting"}, Summary: "Returns information about all libraries.", Since: "7.0.0", Group: "scripting"},
+			{Name: "function|dump", Proc: s.HandleFunctionDumpCommand, Arity: 2, Flags: FlagNoScript, Categories: []string{"slow", "scripting"}, Summary: "Dumps all libraries into a serialized binary payload.", Since: "7.0.0", Group: "scripting"},
+			{Name: "function|restore", Proc: s.HandleFunctionRestoreCommand, Arity: -3, Flags: FlagWrite | FlagDenyOOM | FlagNoScript, Categories: []string{"write", "slow", "scripting"}, Summary: "Restores all libraries from a payload.", Since: "7.0.0", Group: "scripting"},
+			{Name: "function|kill", Proc: s.HandleFunctionKillCommand, Arity: 2, Flags: FlagNoScript | FlagAllowBusy, Categories: []string{"slow", "scripting"}, Summary: "Terminates a function during execution.", Since: "7.0.0", Group: "scripting"},
+			{Name: "function|stats", Proc: s.HandleFunctionStatsCommand, Arity: 2, Flags: FlagNoScript | FlagAllowBusy, Categories: []string{"slow", "scripting"}, Summary: "Returns information about a function during execution.", Since: "7.0.0", Group: "scripting"},
+			help("function"),
+		}},
+
+		// Strings and keyspace
+		{Name: "get", Proc: h.HandleGetCommand, Arity: 2, Flags: FlagReadonly | FlagFast, FirstKey: 1, LastKey: 1, KeyStep: 1, KeySpecs: []string{"RO", "ACCESS"}, Categories: []string{"read", "string", "fast"}, Summary: "Returns the string value of a key.", Since: "1.0.0", Group: "string"},
+		{Name: "set", Proc: h.HandleSetCommand, Arity: -3, Flags: FlagWrite | FlagDenyOOM, FirstKey: 1, LastKey: 1, KeyStep: 1, KeySpecs: []string{"RW", "ACCESS", "UPDATE"}, Categories: []string{"write", "string", "slow"}, Summary: "Sets the string value of a key, ignoring its type. The key is created if it doesn't exist.", Since: "1.0.0", Group: "string"},
+		{Name: "type", Proc: h.HandleTypeCommand, Arity: 2, Flags: FlagReadonly | FlagFast, FirstKey: 1, LastKey: 1, KeyStep: 1, KeySpecs: []string{"RO"}, Categories: []string{"keyspace", "read", "fast"}, Summary: "Determines the type of value stored at a key.", Since: "1.0.0", Group: "generic"},
+
+		{Name: "move", Proc: h.HandleMoveCommand, Arity: 3, Flags: FlagWrite | FlagFast, FirstKey: 1, LastKey: 1, KeyStep: 1, KeySpecs: []string{"RW", "UPDATE"}, Categories: []string{"keyspace", "write", "fast"}, Summary: "Moves a key to another database.", Since: "1.0.0", Group: "generic"},
+		{Name: "swapdb", Proc: h.HandleSwapDBCommand, Arity: 3, Flags: FlagWrite | FlagFast, Categories: []string{"keyspace", "write", "fast", "dangerous"}, Summary: "Swaps two Redis databases.", Since: "4.0.0", Group: "server"},
+		{Name: "flushdb", Proc: h.HandleFlushDBCommand, Arity: -1, Flags: FlagWrite, Categories: []string{"keyspace", "write", "slow", "dangerous"}, Summary: "Remove all keys from the current database.", Since: "1.0.0", Group: "server"},
+		{Name: "flushall", Proc: h.HandleFlushAllCommand, Arity: -1, Flags: FlagWrite, Categories: []string{"keyspace", "write", "slow", "dangerous"}, Summary: "Removes all keys from all databases.", Since: "1.0.0", Group: "server"},
+
+		// Lists
+		{Name: "lpush", Proc: h.HandleListPushCommand, Arity: -3, Flags: FlagWrite | FlagDenyOOM | FlagFast, FirstKey: 1, LastKey: 1, KeyStep: 1, KeySpecs: []string{"RW", "INSERT"}, Categories: []string{"write", "list", "fast"}, Summary: "Prepends one or more elements to a list. Creates the key if it doesn't exist.", Since: "1.0.0", Group: "list"},
+		{Name: "rpush", Proc: h.HandleListPushCommand, Arity: -3, Flags: FlagWrite | FlagDenyOOM | FlagFast, FirstKey: 1, LastKey: 1, KeyStep: 1, KeySpecs: []string{"RW", "INSERT"}, Categories: []string{"write", "list", "fast"}, Summary: "Appends one or more elements to a list. Creates the key if it doesn't exist.", Since: "1.0.0", Group: "list"},
+		{Name: "lrange", Proc: h.HandleListRangeCommand, Arity: 4, Flags: FlagReadonly, FirstKey: 1, LastKey: 1, KeyStep: 1, KeySpecs: []string{"RO", "ACCESS"}, Categories: []string{"read", "list", "slow"}, Summary: "Returns a range of elements from a list.", Since: "1.0.0", Group: "list"},
+		{Name: "llen", Proc: h.HandleListLengthCommand, Arity: 2, Flags: FlagReadonly | FlagFast, FirstKey: 1, LastKey: 1, KeyStep: 1, KeySpecs: []string{"RO"}, Categories: []string{"read", "list", "fast"}, Summary: "Returns the length of a list.", Since: "1.0.0", Group: "list"},
+		{Name: "lpop", Proc: h.HandleListPopCommand, Arity: -2, Flags: FlagWrite | FlagFast, FirstKey: 1, LastKey: 1, KeyStep: 1, KeySpecs: []string{"RW", "ACCESS", "DELETE"}, Categories: []string{"write", "list", "fast"}, Summary: "Returns the first elements in a list after removing it. Deletes the list if the last element was popped.", Since: "1.0.0", Group: "list"},
+		{Name: "rpop", Proc: h.HandleListPopCommand, Arity: -2, Flags: FlagWrite | FlagFast, FirstKey: 1, LastKey: 1, KeyStep: 1, KeySpecs: []string{"RW", "ACCESS", "DELETE"}, Categories: []string{"write", "list", "fast"}, Summary: "Returns and removes the last elements of a list. Deletes the list if the last element was popped.", Since: "1.0.0", Group: "list"},
+		{Name: "blpop", Proc: h.HandleListBlockingPopCommand, Arity: -3, Flags: FlagWrite | FlagBlocking, FirstKey: 1, LastKey: -2, KeyStep: 1, KeySpecs: []string{"RW", "ACCESS", "DELETE"}, Categories: []string{"write", "list", "slow", "blocking"}, Summary: "Removes and returns the first element in a list. Blocks until an element is available otherwise. Deletes the list if the last element was popped.", Since: "2.0.0", Group: "list"},
+		{Name: "brpop", Proc: h.HandleListBlockingPopCommand, Arity: -3, Flags: FlagWrite | FlagBlocking, FirstKey: 1, LastKey: -2, KeyStep: 1, KeySpecs: []string{"RW", "ACCESS", "DELETE"}, Categories: []string{"write", "list", "slow", "blocking"}, Summary: "Removes and returns the last element in a list. Blocks until an element is available otherwise. Deletes the list if the last element was popped.", Since: "2.0.0", Group: "list"},
+
+		// Server
+		{Name: "info", Proc: h.HandleInfoCommand, Arity: -1, Flags: FlagLoading | FlagStale, Categories: []string{"slow", "dangerous"}, Summary: "Returns information and statistics about the server.", Since: "1.0.0", Group: "server"},
+		{Name: "acl", Arity: -2, Categories: []string{"slow"}, Summary: "A container for Access List Control commands.", Since: "6.0.0", Group: "server", Subcommands: []*RedisCommand{
+			{Name: "acl|cat", Proc: h.HandleACLCatCommand, Arity: -2, Flags: FlagNoScript | FlagLoading | FlagStale, Categories: []string{"slow"}, Summary: "Lists the ACL categories, or the commands inside a category.", Since: "6.0.0", Group: "server"},
+			{Name: "acl|deluser", Proc: h.HandleACLDelUserCommand, Arity: -3, Flags: FlagAdmin | FlagNoScript | FlagLoading | FlagStale, Categories: []string{"admin", "slow", "dangerous"}, Summary: "Deletes ACL users, and terminates their connections.", Since: "6.0.0", Group: "server"},
+			{Name: "acl|dryrun", Proc: h.HandleACLDryRunCommand, Arity: -4, Flags: FlagAdmin | FlagNoScript | FlagLoading | FlagStale, Categories: []string{"admin", "slow", "dangerous"}, Summary: "Simulates the execution of a command by a user, without executing the command.", Since: "7.0.0", Group: "server"},
+			{Name: "acl|genpass", Proc: h.HandleACLGenPassCommand, Arity: -2, Flags: FlagNoScript | FlagLoading | FlagStale, Categories: []string{"slow"}, Summary: "Generates a pseudorandom, secure password that can be used to identify ACL users.", Since: "6.0.0", Group: "server"},
+			{Name: "acl|getuser", Proc: h.HandleACLGetUserCommand, Arity: 3, Flags: FlagAdmin | FlagNoScript | FlagLoading | FlagStale, Categories: []string{"admin", "slow", "dangerous"}, Summary: "Lists the ACL rules of a user.", Since: "6.0.0", Group: "server"},
+			{Name: "acl|list", Proc: h.HandleACLListCommand, Arity: 2, Flags: FlagAdmin | FlagNoScript | FlagLoading | FlagStale, Categories: []string{"admin", "slow", "dangerous"}, Summary: "Dumps the effective rules in ACL file format.", Since: "6.0.0", Group: "server"},
+			{Name: "acl|load", Proc: h.HandleACLLoadCommand, Arity: 2, Flags: FlagAdmin | FlagNoScript | FlagLoading | FlagStale, Categories: []string{"admin", "slow", "dangerous"}, Summary: "Reloads the rules from the configured ACL file.", Since: "6.0.0", Group: "server"},
+			{Name: "acl|log", Proc: h.HandleACLLogCommand, Arity: -2, Flags: FlagAdmin | FlagNoScript | FlagLoading | FlagStale, Categories: []string{"admin", "slow", "dangerous"}, Summary: "Lists recent security events generated due to ACL rules.", Since: "6.0.0", Group: "server"},
+			{Name: "acl|save", Proc: h.HandleACLSaveCommand, Arity: 2, Flags: FlagAdmin | FlagNoScript | FlagLoading | FlagStale, Categories: []string{"admin", "slow", "dangerous"}, Summary: "Saves the effective ACL rules in the configured ACL file.", Since: "6.0.0", Group: "server"},
+			{Name: "acl|setuser", Proc: h.HandleACLSetUserCommand, Arity: -3, Flags: FlagAdmin | FlagNoScript | FlagLoading | FlagStale, Categories: []string{"admin", "slow", "dangerous"}, Summary: "Creates and modifies an ACL user and its rules.", Since: "6.0.0", Group: "server"},
+			{Name: "acl|users", Proc: h.HandleACLUsersCommand, Arity: 2, Flags: FlagAdmin | FlagNoScript | FlagLoading | FlagStale, Categories: []string{"admin", "slow", "dangerous"}, Summary: "Lists all ACL users.", Since: "6.0.0", Group: "server"},
+			{Name: "acl|whoami", Proc: h.HandleACLWhoAmICommand, Arity: 2, Flags: FlagNoScript | FlagLoading | FlagStale, Categories: []string{"slow"}, Summary: "Returns the authenticated username of the current connection.", Since: "6.0.0", Group: "server"},
+			help("acl"),
+		}},
+		{Name: "config", Arity: -2, Categories: []string{"slow"}, Summary: "A container for server configuration commands.", Since: "2.0.0", Group: "server", Subcommands: []*RedisCommand{
+			{Name: "config|get", Proc: h.HandleConfigGetCommand, Arity: -3, Flags: FlagAdmin | FlagNoScript | FlagLoading | FlagStale, Categories: []string{"admin", "slow", "dangerous"}, Summary: "Returns the effective values of configuration parameters.", Since: "2.0.0", Group: "server"},
+			{Name: "config|set", Proc: h.HandleConfigSetCommand, Arity: -4, Flags: FlagAdmin | FlagNoScript | FlagLoading | FlagStale, Categories: []string{"admin", "slow", "dangerous"}, Summary: "Sets configuration parameters in-flight.", Since: "2.0.0", Group: "server"},
+			{Name: "config|resetstat", Proc: h.HandleConfigResetStatCommand, Arity: 2, Flags: FlagAdmin | FlagNoScript | FlagLoading | FlagStale, Categories: []string{"admin", "slow", "dangerous"}, Summary: "Resets the server's statistics.", Since: "2.0.0", Group: "server"},
+			{Name: "config|rewrite", Proc: h.HandleConfigRewriteCommand, Arity: 2, Flags: FlagAdmin | FlagNoScript | FlagLoading | FlagStale, Categories: []string{"admin", "slow", "dangerous"}, Summary: "Persists the effective configuration to file.", Since: "2.8.0", Group: "server"},
+			help("config"),
+		}},
+		{Name: "save", Proc: h.HandleSaveCommand, Arity: 1, Flags: FlagAdmin | FlagNoScript | FlagNoMulti, Categories: []string{"admin", "slow", "dangerous"}, Summary: "Synchronously saves the database(s) to disk.", Since: "1.0.0", Group: "server"},
+		{Name: "lastsave", Proc: h.HandleLastSaveCommand, Arity: 1, Flags: FlagLoading | FlagStale | FlagFast, Categories: []string{"fast", "dangerous"}, Summary: "Returns the Unix timestamp of the last successful save to disk.", Since: "1.0.0", Group: "server"},
+		{Name: "shutdown", Proc: s.HandleShutdownCommand, Arity: -1, Flags: FlagAdmin | FlagNoScript | FlagLoading | FlagStale | FlagNoMulti | FlagAllowBusy, Categories: []string{"admin", "slow", "dangerous"}, Summary: "Synchronously saves the database(s) to disk and shuts down the Redis server.", Since: "1.0.0", Group: "server"},
+		{Name: "command", Proc: h.HandleCommandCommand, Arity: -1, Flags: FlagLoading | FlagStale, Categories: []string{"slow", "connection"}, Summary: "Returns detailed information about all commands.", Since: "2.8.13", Group: "server", Subcommands: []*RedisCommand{
+			{Name: "command|count", Proc: h.HandleCommandCountCommand, Arity: 2, Flags: FlagLoading | FlagStale, Categories: []string{"slow", "connection"}, Summary: "Returns a count of commands.", Since: "2.8.13", Group: "server"},
+			{Name: "command|info", Proc: h.HandleCommandInfoCommand, Arity: -2, Flags: FlagLoading | FlagStale, Categories: []string{"slow", "connection"}, Summary: "Returns information about one, multiple or all commands.", Since: "2.8.13", Group: "server"},
+			{Name: "command|docs", Proc: h.HandleCommandDocsCommand, Arity: -2, Flags: FlagLoading | FlagStale, Categories: []string{"slow", "connection"}, Summary: "Returns documentary information about one, multiple or all commands.", Since: "7.0.0", Group: "server"},
+			{Name: "command|getkeys", Proc: h.HandleCommandGetKeysCommand, Arity: -3, Flags: FlagLoading | FlagStale, Categories: []string{"slow", "connection"}, Summary: "Extracts the key names from an arbitrary command.", Since: "2.8.13", Group: "server"},
+			{Name: "command|list", Proc: h.HandleCommandListCommand, Arity: -2, Flags: FlagLoading | FlagStale, Categories: []string{"slow", "connection"}, Summary: "Returns a list of command names.", Since: "7.0.0", Group: "server"},
+			help("command"),
+		}},
+	})
+}
+
+// Command Commands
+func (h *Handler) HandleCommandCommand(c *Client, cmd Command) []byte {
+	var items [][]byte
+	for _, rc := range h.Commands.All() {
+		items = append(items, h.GenerateCommandInfo(c, rc))
+	}
+	return h.Encoder.GenerateRawArray(items)
+}
+
+func (h *Handler) HandleCommandCountCommand(c *Client, cmd Command) []byte {
+	return h.Encoder.GenerateInt(h.Commands.Count())
+}
+
+func (h *Handler) HandleCommandInfoCommand(c *Client, cmd Command) []byte {
+	if len(cmd.Args) == 1 {
+		return h.HandleCommandCommand(c, cmd)
+	}
+
+	var items [][]byte
+	for _, name := range cmd.Args[1:] {
+		rc := h.LookupCommandOrSubcommand(string(name))
+		if rc == nil {
+			items = append(items, h.Encoder.GetNullArray(c.Protocol))
+			continue
+		}
+		items = append(items, h.GenerateCommandInfo(c, rc))
+	}
+	return h.Encoder.GenerateRawArray(items)
+}
+
+func (h *Handler) HandleCommandDocsCommand(c *Client, cmd Command) []byte {
+	var commands []*RedisCommand
+	if len(cmd.Args) == 1 {
+		commands = h.Commands.All()
+	} else {
+		for _, name := range cmd.Args[1:] {
+			if rc := h.LookupCommandOrSubcommand(string(name)); rc != nil {
+				commands = append(commands, rc)
+			}
+		}
+	}
+
+	var pairs [][]byte
+	for _, rc := range commands {
+		pairs = append(pairs, h.Encoder.GenerateBulkString([]byte(rc.Name)), h.GenerateCommandDocs(c, rc))
+	}
+	return h.Encoder.GenerateMap(c.Protocol, pairs)
+}
+
+func (h *Handler) HandleCommandGetKeysCommand(c *Client, cmd Command) []byte {
+	target := Command{Name: string(cmd.Args[1]), Args: cmd.Args[2:]}
+	rc := h.Commands.Lookup(target.Name)
+	if rc == nil {
+		return h.Encoder.GenerateSimpleError("ERR Invalid command specified")
+	}
+	if len(rc.Subcommands) > 0 && len(target.Args) > 0 {
+		if sub := rc.FindSubcommand(string(target.Args[0])); sub != nil {
+			rc = sub
+		}
+	}
+	if !rc.CheckArity(len(target.Args) + 1) {
+		return h.Encoder.GenerateSimpleError("ERR Invalid number of arguments specified for command")
+	}
+
+	keys := rc.Keys(target)
+	if len(keys) == 0 {
+		return h.Encoder.GenerateSimpleError("ERR The command has no key arguments")
+	}
+	return h.Encoder.GenerateArray(keys)
+}
+
+func (h *Handler) HandleCommandListCommand(c *Client, cmd Command) []byte {
+	var filter func(rc *RedisCommand) bool
+	if len(cmd.Args) > 1 {
+		if len(cmd.Args) != 4 || !strings.EqualFold(string(cmd.Args[1]), "FILTERBY") {
+			return h.Encoder.GenerateSimpleError("ERR syntax error")
+		}
+		value := string(cmd.Args[3])
+		switch strings.ToUpper(string(cmd.Args[2])) {
+		case "ACLCAT":
+			filter = func(rc *RedisCommand) bool { return slices.Contains(rc.Categories, strings.ToLower(value)) }
+		case "PATTERN":
+			filter = func(rc *RedisCommand) bool { return StringMatch(value, rc.Name, true) }
+		case "MODULE":
+			filter = func(rc *RedisCommand) bool { return false }
+		default:
+			return h.Encoder.GenerateSimpleError("ERR syntax error")
+		}
+	}
+
+	var names [][]byte
+	for _, rc := range h.Commands.All() {
+		for _, candidate := range append([]*RedisCommand{rc}, rc.Subcommands...) {
+			if filter == nil && candidate != rc {
+				continue
+			}
+			if filter == nil || filter(candidate) {
+				names = append(names, []byte(candidate.Name))
+			}
+		}
+	}
+	return h.Encoder.GenerateArray(names)
+}
+
+// Accepts both top level names and the "container|sub" form
+func (h *Handler) LookupCommandOrSubcommand(name string) *RedisCommand {
+	container, sub, isSub := strings.Cut(name, "|")
+	rc := h.Commands.Lookup(container)
+	if rc == nil || !isSub {
+		return rc
+	}
+	return rc.FindSubcommand(sub)
+}
+
+func (h *Handler) GenerateCommandInfo(c *Client, rc *RedisCommand) []byte {
+	var flags [][]byte
+	for i, name := range commandFlagNames {
+		if rc.Flags&(1<<i) != 0 {
+			flags = append(flags, h.Encoder.GenerateSimpleString([]byte(name)))
+		}
+	}
+
+	var categories [][]byte
+	for _, cat := range rc.Categories {
+		categories = append(categories, h.Encoder.GenerateSimpleString([]byte("@"+cat)))
+	}
+
+	var keySpecs [][]byte
+	if rc.FirstKey > 0 {
+		var specFlags [][]byte
+		for _, f := range rc.KeySpecs {
+			specFlags = append(specFlags, h.Encoder.GenerateSimpleString([]byte(f)))
+		}
+		lastKey := rc.LastKey
+		if lastKey > 0 {
+			lastKey -= rc.FirstKey
+		}
+		keySpecs = append(keySpecs, h.Encoder.GenerateMap(c.Protocol, [][]byte{
+			h.Encoder.GenerateBulkString([]byte("flags")), h.Encoder.GenerateSet(c.Protocol, specFlags),
+			h.Encoder.GenerateBulkString([]byte("begin_search")), h.Encoder.GenerateMap(c.Protocol, [][]byte{
+				h.Encoder.GenerateBulkString([]byte("type")), h.Encoder.GenerateBulkString([]byte("index")),
+				h.Encoder.GenerateBulkString([]byte("spec")), h.Encoder.GenerateMap(c.Protocol, [][]byte{
+					h.Encoder.GenerateBulkString([]byte("index")), h.Encoder.GenerateInt(rc.FirstKey),
+				}),
+			}),
+			h.Encoder.GenerateBulkString([]byte("find_keys")), h.Encoder.GenerateMap(c.Protocol, [][]byte{
+				h.Encoder.GenerateBulkString([]byte("type")), h.Encoder.GenerateBulkString([]byte("range")),
+				h.Encoder.GenerateBulkString([]byte("spec")), h.Encoder.GenerateMap(c.Protocol, [][]byte{
+					h.Encoder.GenerateBulkString([]byte("lastkey")), h.Encoder.GenerateInt(lastKey),
+					h.Encoder.GenerateBulkString([]byte("keystep")), h.Encoder.GenerateInt(rc.KeyStep),
+					h.Encoder.GenerateBulkString([]byte("limit")), h.Encoder.GenerateInt(0),
+				}),
+			}),
+		}))
+	}
+
+	var subcommands [][]byte
+	for _, sub := range rc.Subcommands {
+		subcommands = append(subcommands, h.GenerateCommandInfo(c, sub))
+	}
+
+	return h.Encoder.GenerateRawArray([][]byte{
+		h.Encoder.GenerateBulkString([]byte(rc.Name)),
+		h.Encoder.GenerateInt(rc.Arity),
+		h.Encoder.GenerateSet(c.Protocol, flags),
+		h.Encoder.GenerateInt(rc.FirstKey),
+		h.Encoder.GenerateInt(rc.LastKey),
+		h.Encoder.GenerateInt(rc.KeyStep),
+		h.Encoder.GenerateSet(c.Protocol, categories),
+		h.Encoder.GenerateSet(c.Protocol, nil),
+		h.Encoder.GenerateRawArray(keySpecs),
+		h.Encoder.GenerateRawArray(subcommands),
+	})
+}
+
+func (h *Handler) GenerateCommandDocs(c *Client, rc *RedisCommand) []byte {
+	pairs := [][]byte{
+		h.Encoder.GenerateBulkString([]byte("summary")), h.Encoder.GenerateBulkString([]byte(rc.Summary)),
+		h.Encoder.GenerateBulkString([]byte("since")), h.Encoder.GenerateBulkString([]byte(rc.Since)),
+		h.Encoder.GenerateBulkString([]byte("group")), h.Encoder.GenerateBulkString([]byte(rc.Group)),
+	}
+	if len(rc.Subcommands) > 0 {
+		var subs [][]byte
+		for _, sub := range rc.Subcommands {
+			subs = append(subs, h.Encoder.GenerateBulkString([]byte(sub.Name)), h.GenerateCommandDocs(c, sub))
+		}
+		pairs = append(pairs, h.Encoder.GenerateBulkString([]byte("subcommands")), h.Encoder.GenerateMap(c.Protocol, subs))
+	}
+	return h.Encoder.GenerateMap(c.Protocol, pairs)
+}
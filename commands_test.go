@@ -0,0 +1,130 @@
+package redisclone
+
+import (
+	"fmt"
+	"math"
+	"slices"
+	"strings"
+	"testing"
+)
+
+func TestCheckArity(t *testing.T) {
+	tests := []struct {
+		arity int
+		argc  int
+		want  bool
+	}{
+		{arity: 2, argc: 2, want: true},
+		{arity: 2, argc: 1, want: false},
+		{arity: 2, argc: 3, want: false},
+		{arity: -3, argc: 3, want: true},
+		{arity: -3, argc: 10, want: true},
+		{arity: -3, argc: 2, want: false},
+	}
+
+	for _, tt := range tests {
+		rc := &RedisCommand{Arity: tt.arity}
+		if got := rc.CheckArity(tt.argc); got != tt.want {
+			t.Errorf("arity %d with %d arguments: got %v, want %v", tt.arity, tt.argc, got, tt.want)
+		}
+	}
+}
+
+func TestKeyPositions(t *testing.T) {
+	commands := (&Server{}).BuildCommandTable()
+	tests := []struct {
+		args []string
+		want []int
+	}{
+		{args: []string{"GET", "k"}, want: []int{1}},
+		{args: []string{"SET", "k", "v", "EX", "10"}, want: []int{1}},
+		{args: []string{"BLPOP", "a", "b", "c", "0"}, want: []int{1, 2, 3}},
+		{args: []string{"EVAL", "return 1", "2", "a", "b", "arg"}, want: []int{3, 4}},
+		{args: []string{"EVAL", "return 1", "0", "arg"}, want: nil},
+		{args: []string{"PING"}, want: nil},
+	}
+
+	for _, tt := range tests {
+		argv := make([][]byte, len(tt.args))
+		for i, a := range tt.args {
+			argv[i] = []byte(a)
+		}
+		rc := commands.Lookup(tt.args[0])
+		if got := rc.KeyPositions(argv); !slices.Equal(got, tt.want) {
+			t.Errorf("%q: got key positions %v, want %v", tt.args, got, tt.want)
+		}
+	}
+}
+
+func TestParseSetOptions(t *testing.T) {
+	tests := []struct {
+		args []string
+		want []Option
+		err  string
+	}{
+		{args: []string{"k", "v"}},
+		{args: []string{"k", "v", "EX", "10"}, want: []Option{{Name: "EX", Arg: 10}}},
+		{args: []string{"k", "v", "ex", "1"}, want: []Option{{Name: "EX", Arg: 1}}},
+		{args: []string{"k", "v", "EX"}, err: "ERR syntax error"},
+		{args: []string{"k", "v", "PX", "10"}, err: "ERR syntax error"},
+		{args: []string{"k", "v", "EX", "10", "EX", "10"}, err: "ERR syntax error"},
+		{args: []string{"k", "v", "EX", "ten"}, err: "ERR value is not an integer or out of range"},
+		{args: []string{"k", "v", "EX", "0"}, err: "ERR invalid expire time in 'set' command"},
+		{args: []string{"k", "v", "EX", "-5"}, err: "ERR invalid expire time in 'set' command"},
+		{args: []string{"k", "v", "EX", fmt.Sprint(math.MaxInt64)}, err: "ERR invalid expire time in 'set' command"},
+	}
+
+	var h Handler
+	for _, tt := range tests {
+		cmd := Command{Name: "SET"}
+		for _, a := range tt.args {
+			cmd.Args = append(cmd.Args, []byte(a))
+		}
+		got, err := h.ParseSetOptions(cmd)
+		if tt.err != "" {
+			if err == nil || err.Error() != tt.err {
+				t.Errorf("%q: got error %v, want %q", tt.args, err, tt.err)
+			}
+			continue
+		}
+		if err != nil || !slices.Equal(got, tt.want) {
+			t.Errorf("%q: got %v, %v, want %v", tt.args, got, err, tt.want)
+		}
+	}
+}
+
+func TestCommandDispatch(t *testing.T) {
+	s := startServer(t)
+	c := dial(t, s.Addr())
+
+	expectReply(t, c.Do("GET"), replyError("ERR wrong number of arguments for 'get' command"))
+	expectReply(t, c.Do("get", "a", "b"), replyError("ERR wrong number of arguments for 'get' command"))
+	expectReply(t, c.Do("CLIENT", "NOPE"), replyError("ERR unknown subcommand 'NOPE'. Try CLIENT HELP."))
+	expectReply(t, c.Do("CLIENT", "SETNAME"), replyError("ERR wrong number of arguments for 'client|setname' command"))
+	expectReply(t, c.Do("SET", "k", "v", "EX", "0"), replyError("ERR invalid expire time in 'set' command"))
+	expectReply(t, c.Do("GET", "k"), nil)
+
+	expectReply(t, c.Do("COMMAND", "COUNT"), int64(s.Handler.Commands.Count()))
+	expectReply(t, c.Do("COMMAND", "GETKEYS", "BLPOP", "a", "b", "0"), []any{"a", "b"})
+	expectReply(t, c.Do("COMMAND", "GETKEYS", "PING"), replyError("ERR The command has no key arguments"))
+	expectReply(t, c.Do("COMMAND", "GETKEYS", "GET"), replyError("ERR Invalid number of arguments specified for command"))
+	expectReply(t, c.Do("COMMAND", "GETKEYS", "NOPE", "k"), replyError("ERR Invalid command specified"))
+
+	info, ok := c.Do("COMMAND", "INFO", "get", "nope").([]any)
+	if !ok || len(info) != 2 || info[1] != nil {
+		t.Fatalf("unexpected COMMAND INFO reply %#v", info)
+	}
+	if get := info[0].([]any); get[0] != "get" || get[1] != int64(2) || get[3] != int64(1) || get[4] != int64(1) || get[5] != int64(1) {
+		t.Fatalf("unexpected COMMAND INFO get %#v", get)
+	}
+
+	list := c.Do("COMMAND", "LIST", "FILTERBY", "PATTERN", "client|*").([]any)
+	if !slices.Contains(list, any("client|setname")) || slices.Contains(list, any("get")) {
+		t.Fatalf("unexpected COMMAND LIST reply %#v", list)
+	}
+	for _, name := range list {
+		if !strings.HasPrefix(name.(string), "client|") {
+			t.Fatalf("%q doesn't match the pattern", name)
+		}
+	}
+}
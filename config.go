@@ -0,0 +1,535 @@
+package redisclone
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"log/slog"
+	"math"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+type ConfigKind int
+
+const (
+	ConfigString ConfigKind = iota
+	ConfigInt
+	ConfigMemory
+	ConfigEnum
+)
+
+const ConfigRewriteSignature = "# Generated by CONFIG REWRITE"
+
+type ConfigParam struct {
+	Name     string
+	Kind     ConfigKind
+	Default  string
+	Mutable  bool     // can be changed with CONFIG SET while the server is running
+	MultiArg bool     // takes several space separated arguments, e.g. save 3600 1 300 100
+	Enum     []string // allowed values for ConfigEnum
+	Min      int64
+	Max      int64
+	Validate func(v ConfigValue) error         // extra checks on top of the kind's own parsing
+	Apply    func(v ConfigValue) error         // runs whenever the value changes, including at startup
+	Merge    func(previous, raw string) string // combines a partial new value with the current one before parsing
+}
+
+type ConfigValue struct {
+	Raw string // normalized text form as returned by CONFIG GET
+	Int int64
+}
+
+type Config struct {
+	File   string
+	params map[string]*ConfigParam
+	values map[string]ConfigValue
+	lock   sync.RWMutex
+	setter sync.Mutex // held for a whole SetMany, so concurrent CONFIG SETs can't interleave their sets and rollbacks
+}
+
+func ConfigParams() []*ConfigParam {
+	return []*ConfigParam{
+		{Name: "bind", Kind: ConfigString, Default: "", MultiArg: true},
+		{Name: "port", Kind: ConfigInt, Default: "6379", Min: 0, Max: 65535},
+		{Name: "dir", Kind: ConfigString, Default: ".", Mutable: true, Validate: ValidateDirectory},
+		{Name: "dbfilename", Kind: ConfigString, Default: "dump.rdb", Mutable: true, Validate: ValidateFilename},
+		{Name: "save", Kind: ConfigString, Default: "3600 1 300 100 60 10000", Mutable: true, MultiArg: true, Validate: ValidateSaveParams},
+		{Name: "proto-max-bulk-len", Kind: ConfigMemory, Default: "512mb", Mutable: true, Min: 1024 * 1024, Max: 1<<63 - 1},
+		{Name: "proto-max-multibulk-len", Kind: ConfigInt, Default: strconv.Itoa(DefaultProtoMaxMultibulkLen), Mutable: true, Min: 1, Max: 1<<63 - 1},
+		{Name: "databases", Kind: ConfigInt, Default: "16", Min: 1, Max: 1<<31 - 1},
+		{Name: "notify-keyspace-events", Kind: ConfigString, Default: "", Mutable: true, Validate: ValidateKeyspaceEvents},
+		{Name: "tls-port", Kind: ConfigInt, Default: "0", Min: 0, Max: 65535},
+		{Name: "tls-cert-file", Kind: ConfigString, Default: "", Mutable: true},
+		{Name: "tls-key-file", Kind: ConfigString, Default: "", Mutable: true},
+		{Name: "tls-ca-cert-file", Kind: ConfigString, Default: "", Mutable: true},
+		{Name: "tls-ca-cert-dir", Kind: ConfigString, Default: "", Mutable: true},
+		{Name: "tls-auth-clients", Kind: ConfigEnum, Default: "yes", Mutable: true, Enum: []string{"yes", "no", "optional"}},
+		{Name: "tls-auth-clients-user", Kind: ConfigEnum, Default: "off", Mutable: true, Enum: []string{"off", "cn"}},
+		{Name: "tls-protocols", Kind: ConfigString, Default: "", Mutable: true, MultiArg: true, Validate: ValidateTLSProtocols},
+		{Name: "tls-ciphers", Kind: ConfigString, Default: "", Mutable: true, Validate: ValidateTLSCiphers},
+		{Name: "requirepass", Kind: ConfigString, Default: "", Mutable: true},
+		{Name: "aclfile", Kind: ConfigString, Default: ""},
+		{Name: "acllog-max-len", Kind: ConfigInt, Default: "128", Mutable: true, Min: 0, Max: 1<<31 - 1},
+		{Name: "timeout", Kind: ConfigInt, Default: "0", Mutable: true, Min: 0, Max: 1<<31 - 1},
+		{Name: "tcp-keepalive", Kind: ConfigInt, Default: "300", Mutable: true, Min: 0, Max: 1<<31 - 1},
+		{Name: "maxclients", Kind: ConfigInt, Default: "10000", Mutable: true, Min: 1, Max: 1<<31 - 1},
+		{Name: "client-output-buffer-limit", Kind: ConfigString, Default: DefaultOutputBufferLimits, Mutable: true, MultiArg: true, Validate: ValidateOutputBufferLimits, Merge: MergeOutputBufferLimits},
+		{Name: "busy-reply-threshold", Kind: ConfigInt, Default: "5000", Mutable: true, Min: 0, Max: 1<<63 - 1},
+		{Name: "loglevel", Kind: ConfigEnum, Default: "notice", Mutable: true, Enum: []string{"debug", "verbose", "notice", "warning"}, Apply: ApplyLogLevel},
+	}
+}
+
+// Creates a config holding every parameter at its default value
+func NewConfig() *Config {
+	cfg := &Config{params: make(map[string]*ConfigParam), values: make(map[string]ConfigValue)}
+	for _, p := range ConfigParams() {
+		cfg.params[p.Name] = p
+		v, err := cfg.ParseValue(p, p.Default)
+		if err != nil {
+			panic(fmt.Sprintf("invalid default for config %s: %v", p.Name, err))
+		}
+		cfg.values[p.Name] = v
+	}
+	return cfg
+}
+
+// Builds a config from redis-server style arguments: an optional config file followed by --name value overrides
+func LoadConfigFromArgs(args []string) (*Config, error) {
+	cfg := NewConfig()
+
+	if len(args) > 0 && !strings.HasPrefix(args[0], "--") {
+		path, err := filepath.Abs(args[0])
+		if err != nil {
+			return nil, err
+		}
+		cfg.File = path
+		args = args[1:]
+
+		contents, err := os.ReadFile(path)
+		if err != nil {
+			return nil, fmt.Errorf("Fatal error, can't open config file '%s': %w", path, err)
+		}
+		if err := cfg.LoadString(string(contents)); err != nil {
+			return nil, err
+		}
+	}
+
+	// each --name starts a new directive, everything up to the next --name are its arguments
+	var options strings.Builder
+	for _, arg := range args {
+		if strings.HasPrefix(arg, "--") {
+			if options.Len() > 0 {
+				options.WriteByte('\n')
+			}
+			options.WriteString(arg[2:])
+			continue
+		}
+		if options.Len() == 0 {
+			return nil, fmt.Errorf("Invalid option '%s', config options must start with --", arg)
+		}
+		options.WriteByte(' ')
+		options.WriteString(QuoteArg(arg))
+	}
+	if err := cfg.LoadString(options.String()); err != nil {
+		return nil, err
+	}
+
+	for _, p := range cfg.params {
+		if p.Apply != nil {
+			if err := p.Apply(cfg.Get(p.Name)); err != nil {
+				return nil, err
+			}
+		}
+	}
+	return cfg, nil
+}
+
+// Applies redis.conf formatted directives, immutable parameters may be set here
+func (cfg *Config) LoadString(contents string) error {
+	for i, line := range strings.Split(contents, "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || line[0] == '#' {
+			continue
+		}
+
+		fail := func(reason string) error {
+			return fmt.Errorf("*** FATAL CONFIG FILE ERROR (Redis %s) ***\nReading the configuration file, at line %d\n>>> '%s'\n%s", RedisVersion, i+1, line, reason)
+		}
+
+		args, ok := SplitArgs([]byte(line))
+		if !ok {
+			return fail("Unbalanced quotes in configuration line")
+		}
+		name := strings.ToLower(string(args[0]))
+		p, ok := cfg.params[name]
+		if !ok || len(args) < 2 || (len(args) > 2 && !p.MultiArg) {
+			return fail("Bad directive or wrong number of arguments")
+		}
+
+		raw := make([]string, 0, len(args)-1)
+		for _, v := range args[1:] {
+			raw = append(raw, string(v))
+		}
+		if err := cfg.set(p, strings.Join(raw, " "), false); err != nil {
+			return fail(err.Error())
+		}
+	}
+	return nil
+}
+
+func (cfg *Config) ParseValue(p *ConfigParam, raw string) (ConfigValue, error) {
+	v := ConfigValue{Raw: raw}
+	switch p.Kind {
+	case ConfigInt, ConfigMemory:
+		var n int64
+		var err error
+		if p.Kind == ConfigMemory {
+			n, err = ParseMemory(raw)
+		} else {
+			n, err = strconv.ParseInt(raw, 10, 64)
+		}
+		if err != nil {
+			return v, errors.New("argument couldn't be parsed into an integer")
+		}
+		if n < p.Min || n > p.Max {
+			return v, fmt.Errorf("argument must be between %d and %d inclusive", p.Min, p.Max)
+		}
+		v.Int = n
+		v.Raw = strconv.FormatInt(n, 10)
+	case ConfigEnum:
+		v.Raw = strings.ToLower(raw)
+		if !slices.Contains(p.Enum, v.Raw) {
+			return v, fmt.Errorf("argument(s) must be one of the following: %s", strings.Join(p.Enum, ", "))
+		}
+	}
+
+	if p.Validate != nil {
+		if err := p.Validate(v); err != nil {
+			return v, err
+		}
+	}
+	return v, nil
+}
+
+func (cfg *Config) set(p *ConfigParam, raw string, runtime bool) error {
+	if runtime && !p.Mutable {
+		return errors.New("can't set immutable config")
+	}
+	if p.Merge != nil {
+		raw = p.Merge(cfg.Get(p.Name).Raw, raw)
+	}
+	v, err := cfg.ParseValue(p, raw)
+	if err != nil {
+		return err
+	}
+
+	cfg.lock.Lock()
+	cfg.values[p.Name] = v
+	cfg.lock.Unlock()
+	return nil
+}
+
+// Sets several parameters atomically: if any of them fails the ones already applied are rolled back.
+// Hooks run once every value is in place, so related parameters like a TLS certificate and its key can change together.
+func (cfg *Config) SetMany(names, values []string) error {
+	cfg.setter.Lock()
+	defer cfg.setter.Unlock()
+
+	params := make([]*ConfigParam, len(names))
+	for i, name := range names {
+		p, ok := cfg.params[strings.ToLower(name)]
+		if !ok {
+			return fmt.Errorf("ERR Unknown option or number of arguments for CONFIG SET - '%s'", name)
+		}
+		if slices.Contains(params[:i], p) {
+			return fmt.Errorf("ERR CONFIG SET failed (possibly related to argument '%s') - duplicate parameter", name)
+		}
+		params[i] = p
+	}
+
+	previous := make([]string, len(params))
+	restore := func(n int) {
+		for j := n - 1; j >= 0; j-- {
+			cfg.set(params[j], previous[j], true)
+		}
+	}
+	for i, p := range params {
+		previous[i] = cfg.Get(p.Name).Raw
+		if err := cfg.set(p, values[i], true); err != nil {
+			restore(i)
+			return fmt.Errorf("ERR CONFIG SET failed (possibly related to argument '%s') - %s", names[i], err.Error())
+		}
+	}
+
+	for i, p := range params {
+		if p.Apply == nil {
+			continue
+		}
+		if err := p.Apply(cfg.Get(p.Name)); err != nil {
+			// hooks that already ran are run again so they pick the restored values back up
+			restore(len(params))
+			for _, applied := range params[:i] {
+				if applied.Apply != nil {
+					applied.Apply(cfg.Get(applied.Name))
+				}
+			}
+			return fmt.Errorf("ERR CONFIG SET failed (possibly related to argument '%s') - %s", names[i], err.Error())
+		}
+	}
+	return nil
+}
+
+// Installs the hook of a parameter whose effect lives outside the config, like notify-keyspace-events on the handler
+func (cfg *Config) SetApply(name string, apply func(v ConfigValue) error) {
+	cfg.params[name].Apply = apply
+}
+
+func (cfg *Config) Get(name string) ConfigValue {
+	cfg.lock.RLock()
+	defer cfg.lock.RUnlock()
+
+	return cfg.values[name]
+}
+
+func (cfg *Config) GetInt(name string) int64 {
+	return cfg.Get(name).Int
+}
+
+func (cfg *Config) GetString(name string) string {
+	return cfg.Get(name).Raw
+}
+
+// Returns the names of all parameters matching the glob pattern, sorted
+func (cfg *Config) Match(pattern string) []string {
+	var names []string
+	for name := range cfg.params {
+		if StringMatch(pattern, name, true) {
+			names = append(names, name)
+		}
+	}
+	slices.Sort(names)
+	return names
+}
+
+// Formats the current value of a parameter as a config file line
+func (cfg *Config) FormatLine(p *ConfigParam) string {
+	raw := cfg.Get(p.Name).Raw
+	if !p.MultiArg {
+		return p.Name + " " + QuoteArg(raw)
+	}
+	if raw == "" {
+		return p.Name + ` ""`
+	}
+
+	var args []string
+	for _, v := range strings.Fields(raw) {
+		args = append(args, QuoteArg(v))
+	}
+	return p.Name + " " + strings.Join(args, " ")
+}
+
+// Persists the running configuration into the config file, keeping comments and unrelated lines in place
+func (cfg *Config) Rewrite() error {
+	if cfg.File == "" {
+		return errors.New("ERR The server is running without a config file")
+	}
+
+	var lines []string
+	contents, err := os.ReadFile(cfg.File)
+	if err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("ERR Rewriting config file: %s", err.Error())
+	}
+	if len(contents) > 0 {
+		lines = strings.Split(strings.TrimRight(string(contents), "\n"), "\n")
+	}
+
+	written := make(map[string]bool)
+	var out []string
+	for _, line := range lines {
+		trimmed := strings.TrimSpace(line)
+		if trimmed == ConfigRewriteSignature {
+			continue
+		}
+		args, ok := SplitArgs([]byte(trimmed))
+		if trimmed == "" || trimmed[0] == '#' || !ok || len(args) == 0 {
+			out = append(out, line)
+			continue
+		}
+
+		p, known := cfg.params[strings.ToLower(string(args[0]))]
+		if !known {
+			out = append(out, line)
+			continue
+		}
+		// the first occurrence is replaced by the current value, any later duplicates are dropped
+		if !written[p.Name] {
+			out = append(out, cfg.FormatLine(p))
+			written[p.Name] = true
+		}
+	}
+
+	var names []string
+	for name := range cfg.params {
+		names = append(names, name)
+	}
+	slices.Sort(names)
+
+	signed := false
+	for _, name := range names {
+		p := cfg.params[name]
+		if written[name] {
+			continue
+		}
+		if v, _ := cfg.ParseValue(p, p.Default); v.Raw == cfg.Get(name).Raw {
+			continue
+		}
+		if !signed {
+			out = append(out, ConfigRewriteSignature)
+			signed = true
+		}
+		out = append(out, cfg.FormatLine(p))
+	}
+
+	// write to a temp file first so a crash mid-rewrite never leaves a truncated config behind
+	tmp, err := os.CreateTemp(filepath.Dir(cfg.File), "redis-config-*.tmp")
+	if err != nil {
+		return fmt.Errorf("ERR Rewriting config file: %s", err.Error())
+	}
+	defer os.Remove(tmp.Name())
+
+	w := bufio.NewWriter(tmp)
+	for _, line := range out {
+		w.WriteString(line)
+		w.WriteByte('\n')
+	}
+	if err := w.Flush(); err != nil {
+		tmp.Close()
+		return fmt.Errorf("ERR Rewriting config file: %s", err.Error())
+	}
+	if info, err := os.Stat(cfg.File); err == nil {
+		tmp.Chmod(info.Mode())
+	}
+	if err := tmp.Close(); err != nil {
+		return fmt.Errorf("ERR Rewriting config file: %s", err.Error())
+	}
+	if err := os.Rename(tmp.Name(), cfg.File); err != nil {
+		return fmt.Errorf("ERR Rewriting config file: %s", err.Error())
+	}
+	return nil
+}
+
+// Parses memory amounts like redis.conf does: 1k = 1000, 1kb = 1024, likewise for m/mb and g/gb
+func ParseMemory(raw string) (int64, error) {
+	lower := strings.ToLower(raw)
+	multiplier := int64(1)
+	for _, unit := range []struct {
+		suffix string
+		mul    int64
+	}{{"kb", 1024}, {"mb", 1024 * 1024}, {"gb", 1024 * 1024 * 1024}, {"k", 1000}, {"m", 1000 * 1000}, {"g", 1000 * 1000 * 1000}, {"b", 1}} {
+		if strings.HasSuffix(lower, unit.suffix) {
+			lower = strings.TrimSuffix(lower, unit.suffix)
+			multiplier = unit.mul
+			break
+		}
+	}
+
+	n, err := strconv.ParseInt(lower, 10, 64)
+	if err != nil || n < 0 || n > math.MaxInt64/multiplier {
+		return 0, errors.New("invalid memory value")
+	}
+	return n * multiplier, nil
+}
+
+func ValidateDirectory(v ConfigValue) error {
+	info, err := os.Stat(v.Raw)
+	if err != nil {
+		return err
+	}
+	if !info.IsDir() {
+		return fmt.Errorf("%s is not a directory", v.Raw)
+	}
+	return nil
+}
+
+func ValidateFilename(v ConfigValue) error {
+	if v.Raw == "" || strings.ContainsRune(v.Raw, os.PathSeparator) {
+		return errors.New("can't be a path, just a filename")
+	}
+	return nil
+}
+
+func ValidateSaveParams(v ConfigValue) error {
+	fields := strings.Fields(v.Raw)
+	if len(fields)%2 != 0 {
+		return errors.New("Invalid save parameters")
+	}
+	for _, f := range fields {
+		if n, err := strconv.Atoi(f); err != nil || n < 0 {
+			return errors.New("Invalid save parameters")
+		}
+	}
+	return nil
+}
+
+func ApplyLogLevel(v ConfigValue) error {
+	switch v.Raw {
+	case "debug", "verbose":
+		slog.SetLogLoggerLevel(slog.LevelDebug)
+	case "notice":
+		slog.SetLogLoggerLevel(slog.LevelInfo)
+	case "warning":
+		slog.SetLogLoggerLevel(slog.LevelWarn)
+	}
+	return nil
+}
+
+// Config Commands
+func (h *Handler) HandleConfigGetCommand(c *Client, cmd Command) []byte {
+	matched := make(map[string]bool)
+	var pairs [][]byte
+	for _, pattern := range cmd.Args[1:] {
+		for _, name := range h.Config.Match(string(pattern)) {
+			if matched[name] {
+				continue
+			}
+			matched[name] = true
+			pairs = append(pairs, h.Encoder.GenerateBulkString([]byte(name)), h.Encoder.GenerateBulkString([]byte(h.Config.GetString(name))))
+		}
+	}
+	return h.Encoder.GenerateMap(c.Protocol, pairs)
+}
+
+func (h *Handler) HandleConfigSetCommand(c *Client, cmd Command) []byte {
+	if len(cmd.Args)%2 != 1 {
+		return h.Encoder.GenerateSimpleError("ERR wrong number of arguments for 'config|set' command")
+	}
+
+	var names, values []string
+	for i := 1; i < len(cmd.Args); i += 2 {
+		names = append(names, string(cmd.Args[i]))
+		values = append(values, string(cmd.Args[i+1]))
+	}
+	if err := h.Config.SetMany(names, values); err != nil {
+		return h.Encoder.GenerateSimpleError(err.Error())
+	}
+	return h.Encoder.GetSimpleStringOk()
+}
+
+func (h *Handler) HandleConfigResetStatCommand(c *Client, cmd Command) []byte {
+	h.Stats.Reset()
+	return h.Encoder.GetSimpleStringOk()
+}
+
+func (h *Handler) HandleConfigRewriteCommand(c *Client, cmd Command) []byte {
+	if err := h.Config.Rewrite(); err != nil {
+		slog.Error("CONFIG REWRITE failed", "err", err)
+		return h.Encoder.GenerateSimpleError(err.Error())
+	}
+	slog.Info("CONFIG REWRITE executed with success.")
+	return h.Encoder.GetSimpleStringOk()
+}
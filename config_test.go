@@ -0,0 +1,304 @@
+package redisclone
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParseMemory(t *testing.T) {
+	tests := []struct {
+		input string
+		want  int64
+		err   bool
+	}{
+		{input: "100", want: 100},
+		{input: "1b", want: 1},
+		{input: "1k", want: 1000},
+		{input: "1kb", want: 1024},
+		{input: "2MB", want: 2 * 1024 * 1024},
+		{input: "3m", want: 3000000},
+		{input: "1gb", want: 1 << 30},
+		{input: "1g", want: 1000000000},
+		{input: "9223372036854775807", want: 1<<63 - 1},
+		{input: "8589934592gb", err: true},
+		{input: "9223372036854775807k", err: true},
+		{input: "-1", err: true},
+		{input: "", err: true},
+		{input: "mb", err: true},
+		{input: "1tb", err: true},
+	}
+
+	for _, tt := range tests {
+		got, err := ParseMemory(tt.input)
+		if (err != nil) != tt.err || got != tt.want {
+			t.Errorf("ParseMemory(%q) = %d, %v, want %d, error %v", tt.input, got, err, tt.want, tt.err)
+		}
+	}
+}
+
+func TestParseValue(t *testing.T) {
+	cfg := NewConfig()
+	tests := []struct {
+		param string
+		input string
+		want  string
+		err   bool
+	}{
+		{param: "port", input: "7000", want: "7000"},
+		{param: "port", input: "70000", err: true},
+		{param: "port", input: "abc", err: true},
+		{param: "proto-max-bulk-len", input: "1mb", want: "1048576"},
+		{param: "proto-max-bulk-len", input: "1k", err: true},
+		{param: "loglevel", input: "WARNING", want: "warning"},
+		{param: "loglevel", input: "loud", err: true},
+		{param: "save", input: "900 1 300 10", want: "900 1 300 10"},
+		{param: "save", input: "900", err: true},
+		{param: "save", input: "", want: ""},
+		{param: "dir", input: "/does/not/exist", err: true},
+		{param: "dbfilename", input: "a/b.rdb", err: true},
+		{param: "notify-keyspace-events", input: "KEA", want: "KEA"},
+		{param: "notify-keyspace-events", input: "Q", err: true},
+	}
+
+	for _, tt := range tests {
+		v, err := cfg.ParseValue(cfg.params[tt.param], tt.input)
+		if (err != nil) != tt.err {
+			t.Errorf("%s %q: got error %v, want error %v", tt.param, tt.input, err, tt.err)
+			continue
+		}
+		if !tt.err && v.Raw != tt.want {
+			t.Errorf("%s %q: got %q, want %q", tt.param, tt.input, v.Raw, tt.want)
+		}
+	}
+}
+
+func TestLoadString(t *testing.T) {
+	tests := []struct {
+		name     string
+		contents string
+		err      string
+	}{
+		{name: "comments and blank lines", contents: "# comment\n\n  port 7000\nsave 60 1 10 100\n"},
+		{name: "quoted argument", contents: `dbfilename "my dump.rdb"`},
+		{name: "unknown directive", contents: "nosuchparam yes", err: "Bad directive or wrong number of arguments"},
+		{name: "missing argument", contents: "port", err: "Bad directive or wrong number of arguments"},
+		{name: "too many arguments", contents: "port 1 2", err: "Bad directive or wrong number of arguments"},
+		{name: "unbalanced quotes", contents: `dbfilename "dump.rdb`, err: "Unbalanced quotes"},
+		{name: "invalid value", contents: "port x", err: "couldn't be parsed into an integer"},
+		{name: "removed aof directive", contents: "appendonly yes", err: "Bad directive"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := NewConfig().LoadString(tt.contents)
+			if tt.err == "" && err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if tt.err != "" && (err == nil || !strings.Contains(err.Error(), tt.err)) {
+				t.Fatalf("got error %v, want one containing %q", err, tt.err)
+			}
+		})
+	}
+}
+
+func TestLoadConfigFromArgs(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "redis.conf")
+	if err := os.WriteFile(path, []byte("port 7000\nloglevel warning\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	cfg, err := LoadConfigFromArgs([]string{path, "--port", "7001", "--save", "60", "1", "--bind", "127.0.0.1", "::1"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for name, want := range map[string]string{"port": "7001", "loglevel": "warning", "save": "60 1", "bind": "127.0.0.1 ::1"} {
+		if got := cfg.GetString(name); got != want {
+			t.Errorf("%s = %q, want %q", name, got, want)
+		}
+	}
+	if cfg.File != path {
+		t.Errorf("File = %q, want %q", cfg.File, path)
+	}
+
+	if _, err := LoadConfigFromArgs([]string{path, "stray"}); err == nil {
+		t.Error("expected an argument without an option to be rejected")
+	}
+}
+
+func TestSetManyIsAtomic(t *testing.T) {
+	cfg := NewConfig()
+	if err := cfg.SetMany([]string{"timeout", "maxclients"}, []string{"10", "0"}); err == nil {
+		t.Fatal("expected maxclients 0 to be rejected")
+	}
+	if got := cfg.GetInt("timeout"); got != 0 {
+		t.Fatalf("timeout = %d after a failed SetMany, want it rolled back to 0", got)
+	}
+
+	if err := cfg.SetMany([]string{"port"}, []string{"1"}); err == nil || !strings.Contains(err.Error(), "immutable") {
+		t.Fatalf("got %v, want an immutable parameter error", err)
+	}
+	if err := cfg.SetMany([]string{"timeout", "TIMEOUT"}, []string{"1", "2"}); err == nil {
+		t.Fatal("expected a duplicate parameter to be rejected")
+	}
+
+	// hooks see every new value at once, and a failing hook restores everything without being run again
+	var seen []string
+	cfg.SetApply("tls-cert-file", func(v ConfigValue) error {
+		seen = append(seen, v.Raw+"|"+cfg.GetString("tls-key-file"))
+		if v.Raw == "bad" {
+			return errors.New("rejected")
+		}
+		return nil
+	})
+	if err := cfg.SetMany([]string{"tls-cert-file", "tls-key-file"}, []string{"c", "k"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := cfg.SetMany([]string{"tls-key-file", "tls-cert-file"}, []string{"k2", "bad"}); err == nil {
+		t.Fatal("expected the failing hook to fail SetMany")
+	}
+	if cfg.GetString("tls-cert-file") != "c" || cfg.GetString("tls-key-file") != "k" {
+		t.Fatalf("got %q and %q, want the previous values restored", cfg.GetString("tls-cert-file"), cfg.GetString("tls-key-file"))
+	}
+	if want := []string{"c|k", "bad|k2"}; strings.Join(seen, ",") != strings.Join(want, ",") {
+		t.Fatalf("hook saw %q, want %q", seen, want)
+	}
+}
+
+func TestConcurrentSetMany(t *testing.T) {
+	// a failing SetMany rolls back to the values it saw, which must not undo a concurrent successful one
+	cfg := NewConfig()
+	failing := make(chan struct{})
+	cfg.SetApply("tls-cert-file", func(v ConfigValue) error {
+		if v.Raw != "bad" {
+			return nil
+		}
+		close(failing)
+		time.Sleep(50 * time.Millisecond)
+		return errors.New("rejected")
+	})
+
+	done := make(chan struct{})
+	go func() {
+		cfg.SetMany([]string{"timeout", "tls-cert-file"}, []string{"1", "bad"})
+		close(done)
+	}()
+	<-failing
+	if err := cfg.SetMany([]string{"timeout"}, []string{"2"}); err != nil {
+		t.Fatal(err)
+	}
+	<-done
+	if got := cfg.GetInt("timeout"); got != 2 {
+		t.Fatalf("timeout = %d, want the successful CONFIG SET to stick", got)
+	}
+}
+
+func TestClientOutputBufferLimitMerge(t *testing.T) {
+	cfg := NewConfig()
+	if err := cfg.SetMany([]string{"client-output-buffer-limit"}, []string{"pubsub 64mb 32mb 30"}); err != nil {
+		t.Fatal(err)
+	}
+	want := "normal 0 0 0 slave 268435456 67108864 60 pubsub 67108864 33554432 30"
+	if got := cfg.GetString("client-output-buffer-limit"); got != want {
+		t.Fatalf("got %q, want %q", got, want)
+	}
+}
+
+func TestRewrite(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "redis.conf")
+	original := "# my settings\nport 7000\ntimeout 5\ntimeout 6\n"
+	if err := os.WriteFile(path, []byte(original), 0600); err != nil {
+		t.Fatal(err)
+	}
+	cfg, err := LoadConfigFromArgs([]string{path})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := cfg.SetMany([]string{"timeout", "maxclients"}, []string{"10", "50"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := cfg.Rewrite(); err != nil {
+		t.Fatal(err)
+	}
+
+	contents, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := "# my settings\nport 7000\ntimeout 10\n" + ConfigRewriteSignature + "\nmaxclients 50\n"
+	if string(contents) != want {
+		t.Fatalf("rewritten config:\n%s\nwant:\n%s", contents, want)
+	}
+
+	if err := NewConfig().Rewrite(); err == nil {
+		t.Fatal("expected rewriting without a config file to fail")
+	}
+}
+
+func TestSavePointReached(t *testing.T) {
+	h := &Handler{Config: NewConfig(), Stats: NewStats()}
+	if err := h.Config.LoadString("save 60 2 5 100"); err != nil {
+		t.Fatal(err)
+	}
+	last := time.Unix(h.Stats.LastSave.Load(), 0)
+
+	tests := []struct {
+		dirty   int64
+		elapsed time.Duration
+		want    bool
+	}{
+		{dirty: 0, elapsed: time.Hour, want: false},
+		{dirty: 1, elapsed: time.Hour, want: false},
+		{dirty: 2, elapsed: 61 * time.Second, want: true},
+		{dirty: 2, elapsed: 60 * time.Second, want: false},
+		{dirty: 100, elapsed: 6 * time.Second, want: true},
+		{dirty: 99, elapsed: 6 * time.Second, want: false},
+	}
+	for _, tt := range tests {
+		h.Stats.Dirty.Store(tt.dirty)
+		if got := h.SavePointReached(last.Add(tt.elapsed)); got != tt.want {
+			t.Errorf("dirty %d after %v: got %v, want %v", tt.dirty, tt.elapsed, got, tt.want)
+		}
+	}
+
+	h.Config.LoadString(`save ""`)
+	h.Stats.Dirty.Store(1000)
+	if h.SavePointReached(last.Add(time.Hour)) {
+		t.Error("no save point is ever reached with save disabled")
+	}
+}
+
+func TestConfigCommands(t *testing.T) {
+	s := startServer(t)
+	c := dial(t, s.Addr())
+
+	expectReply(t, c.Do("CONFIG", "SET", "timeout", "30", "maxclients", "100"), "OK")
+	expectReply(t, c.Do("CONFIG", "GET", "timeout"), []any{"timeout", "30"})
+	expectReply(t, c.Do("CONFIG", "GET", "maxclient*"), []any{"maxclients", "100"})
+	expectReply(t, c.Do("CONFIG", "SET", "port", "1"), replyError("ERR CONFIG SET failed (possibly related to argument 'port') - can't set immutable config"))
+	expectReply(t, c.Do("CONFIG", "SET", "appendonly", "yes"), replyError("ERR Unknown option or number of arguments for CONFIG SET - 'appendonly'"))
+	expectReply(t, c.Do("CONFIG", "REWRITE"), replyError("ERR The server is running without a config file"))
+}
+
+func TestSavePointWritesSnapshot(t *testing.T) {
+	s := startServer(t, "save 1 1")
+	c := dial(t, s.Addr())
+	expectReply(t, c.Do("SET", "k", "v"), "OK")
+
+	path := s.Handler.SnapshotPath()
+	deadline := time.Now().Add(5 * time.Second)
+	for s.Stats.Dirty.Load() != 0 || !fileExists(path) {
+		if time.Now().After(deadline) {
+			t.Fatal("the save point never triggered a save")
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+}
+
+func fileExists(path string) bool {
+	_, err := os.Stat(path)
+	return err == nil
+}
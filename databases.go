@@ -0,0 +1,116 @@
+package redisclone
+
+import (
+	"strconv"
+	"strings"
+)
+
+// Database the client currently has selected
+func (h *Handler) DB(c *Client) *Store {
+	return h.Databases[c.DB()]
+}
+
+// Holds blocked client handoffs in every database until the returned release is called
+func (h *Handler) HoldHandoffs() func() {
+	for _, db := range h.Databases {
+		db.HoldHandoffs()
+	}
+	return func() {
+		for _, db := range h.Databases {
+			db.ReleaseHandoffs()
+		}
+	}
+}
+
+// Parses a database index argument, the error is the reply to send back
+func (h *Handler) ParseDBIndex(arg []byte) (int, []byte) {
+	id, err := strconv.Atoi(string(arg))
+	if err != nil {
+		return 0, h.Encoder.GenerateSimpleError("ERR value is not an integer or out of range")
+	}
+	if id < 0 || id >= len(h.Databases) {
+		return 0, h.Encoder.GenerateSimpleError("ERR DB index is out of range")
+	}
+	return id, nil
+}
+
+// Empties every given database and tells tracking clients to drop their whole cache
+func (h *Handler) FlushDatabases(dbs []*Store) {
+	for _, db := range dbs {
+		db.Flush()
+	}
+	h.InvalidateAll()
+}
+
+// Parses the optional ASYNC|SYNC argument of FLUSHDB and FLUSHALL
+func ParseFlushMode(args [][]byte) bool {
+	if len(args) == 0 {
+		return true
+	}
+	if len(args) > 1 {
+		return false
+	}
+	switch strings.ToUpper(string(args[0])) {
+	case "ASYNC", "SYNC":
+		// both free the old keyspace straight away, the garbage collector does the actual work
+		return true
+	}
+	return false
+}
+
+// Database Commands
+func (h *Handler) HandleSelectCommand(c *Client, cmd Command) []byte {
+	id, errReply := h.ParseDBIndex(cmd.Args[0])
+	if errReply != nil {
+		return errReply
+	}
+	c.SelectDB(id)
+	return h.Encoder.GetSimpleStringOk()
+}
+
+func (h *Handler) HandleMoveCommand(c *Client, cmd Command) []byte {
+	id, errReply := h.ParseDBIndex(cmd.Args[1])
+	if errReply != nil {
+		return errReply
+	}
+	src, dst := h.DB(c), h.Databases[id]
+	if src == dst {
+		return h.Encoder.GenerateSimpleError("ERR source and destination objects are the same")
+	}
+	return h.Encoder.GenerateInt(BoolToInt(src.MoveKey(dst, string(cmd.Args[0]))))
+}
+
+func (h *Handler) HandleSwapDBCommand(c *Client, cmd Command) []byte {
+	first, err1 := strconv.Atoi(string(cmd.Args[0]))
+	if err1 != nil {
+		return h.Encoder.GenerateSimpleError("ERR invalid first DB index")
+	}
+	second, err2 := strconv.Atoi(string(cmd.Args[1]))
+	if err2 != nil {
+		return h.Encoder.GenerateSimpleError("ERR invalid second DB index")
+	}
+	if first < 0 || first >= len(h.Databases) || second < 0 || second >= len(h.Databases) {
+		return h.Encoder.GenerateSimpleError("ERR DB index is out of range")
+	}
+
+	if first != second {
+		h.Databases[first].SwapDB(h.Databases[second])
+	}
+	return h.Encoder.GetSimpleStringOk()
+}
+
+func (h *Handler) HandleFlushDBCommand(c *Client, cmd Command) []byte {
+	if !ParseFlushMode(cmd.Args) {
+		return h.Encoder.GenerateSimpleError("ERR syntax error")
+	}
+	h.FlushDatabases([]*Store{h.DB(c)})
+	return h.Encoder.GetSimpleStringOk()
+}
+
+func (h *Handler) HandleFlushAllCommand(c *Client, cmd Command) []byte {
+	if !ParseFlushMode(cmd.Args) {
+		return h.Encoder.GenerateSimpleError("ERR syntax error")
+	}
+	h.FlushDatabases(h.Databases)
+	return h.Encoder.GetSimpleStringOk()
+}
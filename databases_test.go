@@ -0,0 +1,109 @@
+package redisclone
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestParseFlushMode(t *testing.T) {
+	tests := []struct {
+		args []string
+		ok   bool
+	}{
+		{args: nil, ok: true},
+		{args: []string{"ASYNC"}, ok: true},
+		{args: []string{"sync"}, ok: true},
+		{args: []string{"LATER"}},
+		{args: []string{"SYNC", "ASYNC"}},
+	}
+
+	for _, tt := range tests {
+		var args [][]byte
+		for _, arg := range tt.args {
+			args = append(args, []byte(arg))
+		}
+		if got := ParseFlushMode(args); got != tt.ok {
+			t.Errorf("ParseFlushMode(%q) = %v, want %v", tt.args, got, tt.ok)
+		}
+	}
+}
+
+func TestSelectAndMove(t *testing.T) {
+	s := startServer(t, "databases 4")
+	c := dial(t, s.Addr())
+
+	expectReply(t, c.Do("SELECT", "4"), replyError("ERR DB index is out of range"))
+	expectReply(t, c.Do("SELECT", "-1"), replyError("ERR DB index is out of range"))
+	expectReply(t, c.Do("SELECT", "one"), replyError("ERR value is not an integer or out of range"))
+
+	expectReply(t, c.Do("SET", "k", "0"), "OK")
+	expectReply(t, c.Do("SELECT", "1"), "OK")
+	expectReply(t, c.Do("GET", "k"), nil)
+	expectReply(t, c.Do("SET", "k", "1"), "OK")
+	// other connections keep their own selection
+	expectReply(t, dial(t, s.Addr()).Do("GET", "k"), "0")
+
+	expectReply(t, c.Do("MOVE", "k", "1"), replyError("ERR source and destination objects are the same"))
+	expectReply(t, c.Do("MOVE", "k", "9"), replyError("ERR DB index is out of range"))
+	expectReply(t, c.Do("MOVE", "k", "0"), int64(0))
+	expectReply(t, c.Do("MOVE", "missing", "2"), int64(0))
+	expectReply(t, c.Do("MOVE", "k", "2"), int64(1))
+	expectReply(t, c.Do("GET", "k"), nil)
+	expectReply(t, c.Do("SELECT", "2"), "OK")
+	expectReply(t, c.Do("GET", "k"), "1")
+
+	// RESET goes back to database 0
+	expectReply(t, c.Do("RESET"), "RESET")
+	expectReply(t, c.Do("GET", "k"), "0")
+}
+
+func TestSwapDB(t *testing.T) {
+	s := startServer(t, "databases 4")
+	c, blocked := dial(t, s.Addr()), dial(t, s.Addr())
+
+	expectReply(t, c.Do("SWAPDB", "0", "4"), replyError("ERR DB index is out of range"))
+	expectReply(t, c.Do("SWAPDB", "x", "1"), replyError("ERR invalid first DB index"))
+	expectReply(t, c.Do("SWAPDB", "0", "x"), replyError("ERR invalid second DB index"))
+	expectReply(t, c.Do("SWAPDB", "1", "1"), "OK")
+
+	expectReply(t, c.Do("SELECT", "1"), "OK")
+	expectReply(t, c.Do("RPUSH", "l", "a"), int64(1))
+	expectReply(t, c.Do("SET", "k", "1"), "OK")
+
+	// a client blocked on an empty key in db 0 is served once the swap gives it data
+	blocked.Send("BLPOP", "l", "0")
+	waitForBlockedClients(t, c, 1)
+	expectReply(t, c.Do("SWAPDB", "0", "1"), "OK")
+	expectReply(t, blocked.Read(), []any{"l", "a"})
+
+	expectReply(t, c.Do("GET", "k"), nil)
+	expectReply(t, blocked.Do("GET", "k"), "1")
+}
+
+func TestFlush(t *testing.T) {
+	s := startServer(t, "databases 4")
+	c := dial(t, s.Addr())
+
+	for _, db := range []string{"0", "1", "2"} {
+		expectReply(t, c.Do("SELECT", db), "OK")
+		expectReply(t, c.Do("SET", "k", db), "OK")
+	}
+	expectReply(t, c.Do("SET", "t", "x", "EX", "100"), "OK")
+	info := c.Do("INFO", "keyspace").(string)
+	if !strings.Contains(info, "db0:keys=1,expires=0,") || !strings.Contains(info, "db2:keys=2,expires=1,") || strings.Contains(info, "db3:") {
+		t.Fatalf("unexpected keyspace info %q", info)
+	}
+
+	expectReply(t, c.Do("FLUSHDB", "LATER"), replyError("ERR syntax error"))
+	expectReply(t, c.Do("FLUSHDB", "ASYNC"), "OK")
+	expectReply(t, c.Do("GET", "k"), nil)
+	expectReply(t, c.Do("SELECT", "1"), "OK")
+	expectReply(t, c.Do("GET", "k"), "1")
+
+	expectReply(t, c.Do("FLUSHALL", "SYNC", "ASYNC"), replyError("ERR syntax error"))
+	expectReply(t, c.Do("FLUSHALL"), "OK")
+	expectReply(t, c.Do("GET", "k"), nil)
+	if info := c.Do("INFO", "keyspace").(string); strings.Contains(info, "db") {
+		t.Fatalf("unexpected keyspace info %q after FLUSHALL", info)
+	}
+}
@@ -1,7 +1,15 @@
-package main
+package redisclone
 
 import (
+	"math"
 	"strconv"
+	"strings"
+)
+
+// Protocol versions negotiated with HELLO
+const (
+	RESP2 = 2
+	RESP3 = 3
 )
 
 type Encoder struct {
@@ -12,6 +20,8 @@ func (e *Encoder) InitalizeEncodingMap() {
 	e.EncodingMap = make(map[string][]byte)
 	e.EncodingMap["OK"] = e.GenerateSimpleString([]byte("OK"))
 	e.EncodingMap["nil"] = e.GenerateNilBulkString()
+	e.EncodingMap["nilArray"] = []byte("*-1\r\n")
+	e.EncodingMap["null"] = []byte("_\r\n")
 
 }
 
@@ -23,6 +33,22 @@ func (e *Encoder) GetNilBulkString() []byte {
 	return e.EncodingMap["nil"]
 }
 
+// RESP3 has a single null type, RESP2 clients expect a nil bulk string
+func (e *Encoder) GetNull(proto int) []byte {
+	if proto == RESP3 {
+		return e.EncodingMap["null"]
+	}
+	return e.EncodingMap["nil"]
+}
+
+// RESP3 has a single null type, RESP2 clients expect a nil multi bulk
+func (e *Encoder) GetNullArray(proto int) []byte {
+	if proto == RESP3 {
+		return e.EncodingMap["null"]
+	}
+	return e.EncodingMap["nilArray"]
+}
+
 func (e *Encoder) GenerateTypeString(t NativeType) []byte {
 	var response []byte
 	switch t {
@@ -86,10 +112,93 @@ func (e *Encoder) GenerateSimpleString(bytes []byte) []byte {
 }
 
 func (e *Encoder) GenerateSimpleError(err string) []byte {
-	bytes := []byte(err)
+	// a newline inside the message would end the reply early, so replace them like Redis does
+	bytes := []byte(strings.NewReplacer("\r", " ", "\n", " ").Replace(err))
 	out := make([]byte, 0, len(bytes)+32)
 	out = append(out, '-')
 	out = append(out, bytes...)
 	out = append(out, '\r', '\n')
 	return out
 }
+
+// Wraps already encoded replies in an array header, used for nested or mixed type arrays
+func (e *Encoder) GenerateRawArray(items [][]byte) []byte {
+	return e.GenerateAggregate('*', len(items), items)
+}
+
+// pairs holds already encoded keys and values interleaved, RESP2 clients receive a flat array
+func (e *Encoder) GenerateMap(proto int, pairs [][]byte) []byte {
+	if proto == RESP3 {
+		return e.GenerateAggregate('%', len(pairs)/2, pairs)
+	}
+	return e.GenerateAggregate('*', len(pairs), pairs)
+}
+
+func (e *Encoder) GenerateSet(proto int, items [][]byte) []byte {
+	if proto == RESP3 {
+		return e.GenerateAggregate('~', len(items), items)
+	}
+	return e.GenerateAggregate('*', len(items), items)
+}
+
+// Out of band data (e.g. pub/sub messages, invalidations), RESP2 clients receive a plain array
+func (e *Encoder) GeneratePush(proto int, items [][]byte) []byte {
+	if proto == RESP3 {
+		return e.GenerateAggregate('>', len(items), items)
+	}
+	return e.GenerateAggregate('*', len(items), items)
+}
+
+func (e *Encoder) GenerateAggregate(prefix byte, length int, items [][]byte) []byte {
+	size := 32
+	for _, v := range items {
+		size += len(v)
+	}
+	out := make([]byte, 0, size)
+	out = append(out, prefix)
+	out = strconv.AppendInt(out, int64(length), 10)
+	out = append(out, '\r', '\n')
+	for _, v := range items {
+		out = append(out, v...)
+	}
+	return out
+}
+
+func (e *Encoder) GenerateDouble(proto int, f float64) []byte {
+	var text []byte
+	switch {
+	case math.IsInf(f, 1):
+		text = []byte("inf")
+	case math.IsInf(f, -1):
+		text = []byte("-inf")
+	case math.IsNaN(f):
+		text = []byte("nan")
+	default:
+		text = strconv.AppendFloat(nil, f, 'g', 17, 64)
+	}
+
+	if proto != RESP3 {
+		return e.GenerateBulkString(text)
+	}
+	out := make([]byte, 0, len(text)+3)
+	out = append(out, ',')
+	out = append(out, text...)
+	out = append(out, '\r', '\n')
+	return out
+}
+
+// format is the three letter hint for the text, e.g. "txt" or "mkd"
+func (e *Encoder) GenerateVerbatimString(proto int, format string, text []byte) []byte {
+	if proto != RESP3 {
+		return e.GenerateBulkString(text)
+	}
+	out := make([]byte, 0, len(text)+32)
+	out = append(out, '=')
+	out = strconv.AppendInt(out, int64(len(text)+4), 10)
+	out = append(out, '\r', '\n')
+	out = append(out, format...)
+	out = append(out, ':')
+	out = append(out, text...)
+	out = append(out, '\r', '\n')
+	return out
+}
@@ -0,0 +1,68 @@
+package redisclone
+
+import (
+	"math"
+	"testing"
+)
+
+func TestEncoderProtocolVersions(t *testing.T) {
+	var e Encoder
+	e.InitalizeEncodingMap()
+	pair := [][]byte{e.GenerateBulkString([]byte("k")), e.GenerateInt(1)}
+
+	tests := []struct {
+		name  string
+		resp2 []byte
+		resp3 []byte
+		want2 string
+		want3 string
+	}{
+		{"null", e.GetNull(RESP2), e.GetNull(RESP3), "$-1\r\n", "_\r\n"},
+		{"null array", e.GetNullArray(RESP2), e.GetNullArray(RESP3), "*-1\r\n", "_\r\n"},
+		{"map", e.GenerateMap(RESP2, pair), e.GenerateMap(RESP3, pair), "*2\r\n$1\r\nk\r\n:1\r\n", "%1\r\n$1\r\nk\r\n:1\r\n"},
+		{"set", e.GenerateSet(RESP2, pair[:1]), e.GenerateSet(RESP3, pair[:1]), "*1\r\n$1\r\nk\r\n", "~1\r\n$1\r\nk\r\n"},
+		{"push", e.GeneratePush(RESP2, pair[:1]), e.GeneratePush(RESP3, pair[:1]), "*1\r\n$1\r\nk\r\n", ">1\r\n$1\r\nk\r\n"},
+		{"double", e.GenerateDouble(RESP2, 1.5), e.GenerateDouble(RESP3, 1.5), "$3\r\n1.5\r\n", ",1.5\r\n"},
+		{"infinity", e.GenerateDouble(RESP2, math.Inf(-1)), e.GenerateDouble(RESP3, math.Inf(-1)), "$4\r\n-inf\r\n", ",-inf\r\n"},
+		{"verbatim", e.GenerateVerbatimString(RESP2, "txt", []byte("hi")), e.GenerateVerbatimString(RESP3, "txt", []byte("hi")), "$2\r\nhi\r\n", "=6\r\ntxt:hi\r\n"},
+	}
+	for _, tt := range tests {
+		if string(tt.resp2) != tt.want2 {
+			t.Errorf("%s: RESP2 encoding %q, want %q", tt.name, tt.resp2, tt.want2)
+		}
+		if string(tt.resp3) != tt.want3 {
+			t.Errorf("%s: RESP3 encoding %q, want %q", tt.name, tt.resp3, tt.want3)
+		}
+	}
+}
+
+func TestGenerateSimpleErrorStripsNewlines(t *testing.T) {
+	var e Encoder
+	if got := string(e.GenerateSimpleError("ERR a\r\nb")); got != "-ERR a  b\r\n" {
+		t.Fatalf("got %q", got)
+	}
+}
+
+func TestHelloNegotiatesProtocol(t *testing.T) {
+	s := startServer(t)
+	c := dial(t, s.Addr())
+
+	expectReply(t, c.Do("HELLO", "4"), replyError("NOPROTO unsupported protocol version"))
+	hello, ok := c.Do("HELLO", "3", "SETNAME", "conn").([]any)
+	if !ok || len(hello) != 14 || hello[4] != "proto" || hello[5] != int64(3) {
+		t.Fatalf("unexpected HELLO reply %#v", hello)
+	}
+
+	// RESP3 clients get the null type, RESP2 clients a nil bulk string
+	c.Send("GET", "missing")
+	if line, _ := c.r.ReadString('\n'); line != "_\r\n" {
+		t.Fatalf("got %q for a missing key over RESP3", line)
+	}
+	expectReply(t, c.Do("CLIENT", "GETNAME"), "conn")
+
+	c.Do("HELLO", "2")
+	c.Send("GET", "missing")
+	if line, _ := c.r.ReadString('\n'); line != "$-1\r\n" {
+		t.Fatalf("got %q for a missing key over RESP2", line)
+	}
+}
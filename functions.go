@@ -0,0 +1,573 @@
+package redisclone
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"maps"
+	"slices"
+	"strings"
+	"time"
+
+	lua "github.com/yuin/gopher-lua"
+)
+
+// Opcode real Redis uses to persist function libraries in RDB files and FUNCTION DUMP payloads
+const RDBOpcodeFunction2 = 245
+
+// Library code gets this long to register its functions
+const FunctionLoadTimeout = 500 * time.Millisecond
+
+var functionFlagNames = []string{"no-writes", "allow-oom", "allow-stale", "no-cluster", "allow-cross-slot-keys"}
+
+// A library loaded with FUNCTION LOAD, every library keeps its own interpreter alive for its functions
+type FunctionLibrary struct {
+	Name      string
+	Code      string
+	Functions map[string]*ScriptFunction
+	state     *lua.LState
+	redis     *lua.LTable
+}
+
+type ScriptFunction struct {
+	Name        string
+	Description string
+	Flags       []string
+	Library     *FunctionLibrary
+	callback    *lua.LFunction
+}
+
+func (f *ScriptFunction) HasFlag(flag string) bool {
+	return slices.Contains(f.Flags, flag)
+}
+
+// Only letters, numbers and underscores are allowed in library and function names
+func IsValidFunctionName(name string) bool {
+	if name == "" {
+		return false
+	}
+	for _, r := range name {
+		if !(r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9' || r == '_') {
+			return false
+		}
+	}
+	return true
+}
+
+// Parses the "#!lua name=<library>" shebang every library starts with, returning the library name and the code after it
+func ParseLibraryMetadata(code string) (string, string, error) {
+	if !strings.HasPrefix(code, "#!") {
+		return "", "", errors.New("ERR Missing library metadata")
+	}
+	shebang, body, _ := strings.Cut(code, "\n")
+	parts := strings.Fields(strings.TrimPrefix(shebang, "#!"))
+	if len(parts) == 0 || !strings.EqualFold(parts[0], "lua") {
+		engine := ""
+		if len(parts) > 0 {
+			engine = parts[0]
+		}
+		return "", "", fmt.Errorf("ERR Engine '%s' not found", engine)
+	}
+
+	name := ""
+	for _, part := range parts[1:] {
+		value, ok := strings.CutPrefix(part, "name=")
+		if !ok {
+			return "", "", fmt.Errorf("ERR Invalid metadata value given: %s", part)
+		}
+		name = value
+	}
+	if name == "" {
+		return "", "", errors.New("ERR Library name was not given")
+	}
+	if !IsValidFunctionName(name) {
+		return "", "", errors.New("ERR Library names can only contain letters, numbers, or underscores(_) and must be at least one character long")
+	}
+	// the shebang line is kept as an empty line so error line numbers still match the source
+	return name, "\n" + body, nil
+}
+
+// Runs the library code in a fresh interpreter and collects the functions it registers
+func NewFunctionLibrary(code string) (*FunctionLibrary, error) {
+	name, body, err := ParseLibraryMetadata(code)
+	if err != nil {
+		return nil, err
+	}
+	proto, err := CompileLua([]byte(body), "user_function")
+	if err != nil {
+		return nil, fmt.Errorf("ERR Error compiling function: %s", err)
+	}
+
+	lib := &FunctionLibrary{Name: name, Code: code, Functions: make(map[string]*ScriptFunction)}
+	L := NewSandboxState()
+	lib.state = L
+	lib.redis = NewRedisLuaTable(L)
+	L.SetField(lib.redis, "register_function", L.NewFunction(lib.LuaRegisterFunction))
+	L.SetGlobal("redis", lib.redis)
+	ProtectGlobals(L)
+
+	ctx, cancel := context.WithTimeout(context.Background(), FunctionLoadTimeout)
+	defer cancel()
+	L.SetContext(ctx)
+	L.Push(L.NewFunctionFromProto(proto))
+	err = L.PCall(0, 0, nil)
+	L.RemoveContext()
+	// functions may only be registered while the library loads
+	L.SetField(lib.redis, "register_function", lua.LNil)
+
+	if err != nil {
+		L.Close()
+		var apiErr *lua.ApiError
+		if errors.As(err, &apiErr) {
+			return nil, fmt.Errorf("ERR Error registering functions: %s", apiErr.Object.String())
+		}
+		return nil, fmt.Errorf("ERR Error registering functions: %s", err)
+	}
+	if len(lib.Functions) == 0 {
+		L.Close()
+		return nil, errors.New("ERR No functions registered")
+	}
+	return lib, nil
+}
+
+func (lib *FunctionLibrary) Close() {
+	lib.state.Close()
+}
+
+// Backs redis.register_function, called either as (name, callback) or with a table of named arguments
+func (lib *FunctionLibrary) LuaRegisterFunction(L *lua.LState) int {
+	fn := &ScriptFunction{Library: lib}
+	switch L.GetTop() {
+	case 1:
+		args := L.CheckTable(1)
+		var err error
+		args.ForEach(func(k, v lua.LValue) {
+			if err != nil {
+				return
+			}
+			switch k.String() {
+			case "function_name":
+				fn.Name = v.String()
+			case "callback":
+				fn.callback, _ = v.(*lua.LFunction)
+			case "description":
+				fn.Description = v.String()
+			case "flags":
+				t, ok := v.(*lua.LTable)
+				if !ok {
+					err = errors.New("flags argument to redis.register_function must be a table representing function flags")
+					return
+				}
+				t.ForEach(func(_, flag lua.LValue) {
+					if !slices.Contains(functionFlagNames, flag.String()) {
+						err = errors.New("unknown flag given")
+						return
+					}
+					fn.Flags = append(fn.Flags, flag.String())
+				})
+			default:
+				err = errors.New("unknown argument given to redis.register_function")
+			}
+		})
+		if err != nil {
+			L.RaiseError("%s", err)
+		}
+	case 2:
+		fn.Name = L.CheckString(1)
+		fn.callback = L.CheckFunction(2)
+	default:
+		L.RaiseError("wrong number of arguments to redis.register_function")
+	}
+
+	if fn.callback == nil {
+		L.RaiseError("redis.register_function must get a callback argument")
+	}
+	if !IsValidFunctionName(fn.Name) {
+		L.RaiseError("Function names can only contain letters, numbers, or underscores(_) and must be at least one character long")
+	}
+	if _, ok := lib.Functions[fn.Name]; ok {
+		L.RaiseError("Function already exists in the library")
+	}
+	lib.Functions[fn.Name] = fn
+	return 0
+}
+
+// Registers a library, with replace an existing library of the same name is swapped out
+func (se *ScriptEngine) LoadLibrary(code string, replace bool) (string, error) {
+	lib, err := NewFunctionLibrary(code)
+	if err != nil {
+		return "", err
+	}
+
+	se.lock.Lock()
+	defer se.lock.Unlock()
+
+	old, exists := se.libraries[lib.Name]
+	if exists && !replace {
+		lib.Close()
+		return "", fmt.Errorf("ERR Library '%s' already exists", lib.Name)
+	}
+	for name := range lib.Functions {
+		if fn, ok := se.functions[name]; ok && fn.Library != old {
+			lib.Close()
+			return "", fmt.Errorf("ERR Function %s already exists", name)
+		}
+	}
+
+	if exists {
+		se.UnsafeRemoveLibrary(old)
+	}
+	se.libraries[lib.Name] = lib
+	for name, fn := range lib.Functions {
+		se.functions[name] = fn
+	}
+	return lib.Name, nil
+}
+
+// Note: This function is unsafe, it should only ever be called by a function who holds a lock
+func (se *ScriptEngine) UnsafeRemoveLibrary(lib *FunctionLibrary) {
+	for name := range lib.Functions {
+		delete(se.functions, name)
+	}
+	delete(se.libraries, lib.Name)
+	lib.Close()
+}
+
+func (se *ScriptEngine) DeleteLibrary(name string) error {
+	se.lock.Lock()
+	defer se.lock.Unlock()
+
+	lib, ok := se.libraries[name]
+	if !ok {
+		return errors.New("ERR Library not found")
+	}
+	se.UnsafeRemoveLibrary(lib)
+	return nil
+}
+
+func (se *ScriptEngine) FlushLibraries() {
+	se.lock.Lock()
+	defer se.lock.Unlock()
+
+	for _, lib := range se.libraries {
+		se.UnsafeRemoveLibrary(lib)
+	}
+}
+
+func (se *ScriptEngine) LookupFunction(name string) (*ScriptFunction, bool) {
+	se.lock.Lock()
+	defer se.lock.Unlock()
+
+	fn, ok := se.functions[name]
+	return fn, ok
+}
+
+// Returns every library sorted by name
+func (se *ScriptEngine) Libraries() []*FunctionLibrary {
+	se.lock.Lock()
+	defer se.lock.Unlock()
+
+	return slices.SortedFunc(maps.Values(se.libraries), func(a, b *FunctionLibrary) int { return strings.Compare(a.Name, b.Name) })
+}
+
+// Writes every library as a FUNCTION2 entry holding its code
+func (se *ScriptEngine) WriteRDBFunctions(rw *RDBWriter) error {
+	for _, lib := range se.Libraries() {
+		if err := rw.WriteByte(RDBOpcodeFunction2); err != nil {
+			return err
+		}
+		if err := rw.WriteString([]byte(lib.Code)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Serializes every library like Redis does for FUNCTION DUMP: FUNCTION2 entries, the RDB version and a CRC64 footer
+func (se *ScriptEngine) Dump() ([]byte, error) {
+	var buf bytes.Buffer
+	rw := NewRDBWriter(&buf)
+	if err := se.WriteRDBFunctions(rw); err != nil {
+		return nil, err
+	}
+	if err := rw.Write([]byte{byte(RDBVersion), byte(RDBVersion >> 8)}); err != nil {
+		return nil, err
+	}
+	if err := rw.w.Flush(); err != nil {
+		return nil, err
+	}
+	return binary.LittleEndian.AppendUint64(buf.Bytes(), rw.crc), nil
+}
+
+// Parses a FUNCTION DUMP payload back into library codes
+func ParseFunctionDump(payload []byte) ([]string, error) {
+	if len(payload) < 10 {
+		return nil, errors.New("ERR payload version or checksum are wrong")
+	}
+	body, footer := payload[:len(payload)-8], payload[len(payload)-8:]
+	version := int(binary.LittleEndian.Uint16(body[len(body)-2:]))
+	if version > RDBVersion || binary.LittleEndian.Uint64(footer) != UpdateCRC64(0, body) {
+		return nil, errors.New("ERR payload version or checksum are wrong")
+	}
+
+	rr := NewRDBReader(bytes.NewReader(body[:len(body)-2]), int64(len(body)-2))
+	var codes []string
+	for {
+		opcode, err := rr.ReadByte()
+		if err != nil {
+			return codes, nil
+		}
+		if opcode != RDBOpcodeFunction2 {
+			return nil, errors.New("ERR given type is not a function")
+		}
+		code, err := rr.ReadString()
+		if err != nil {
+			return nil, errors.New("ERR payload version or checksum are wrong")
+		}
+		codes = append(codes, string(code))
+	}
+}
+
+// Restores dumped libraries with the FLUSH, APPEND or REPLACE policy, nothing changes if any library fails
+func (se *ScriptEngine) Restore(codes []string, policy string) error {
+	var libs []*FunctionLibrary
+	closeAll := func() {
+		for _, lib := range libs {
+			lib.Close()
+		}
+	}
+	for _, code := range codes {
+		lib, err := NewFunctionLibrary(code)
+		if err != nil {
+			closeAll()
+			return err
+		}
+		libs = append(libs, lib)
+	}
+
+	se.lock.Lock()
+	defer se.lock.Unlock()
+
+	// work out the resulting function namespace before touching anything
+	libraries := maps.Clone(se.libraries)
+	if policy == "FLUSH" {
+		clear(libraries)
+	}
+	for _, lib := range libs {
+		if _, exists := libraries[lib.Name]; exists && policy == "APPEND" {
+			closeAll()
+			return fmt.Errorf("ERR Library %s already exists", lib.Name)
+		}
+		libraries[lib.Name] = lib
+	}
+	functions := make(map[string]*ScriptFunction)
+	for _, lib := range libraries {
+		for name, fn := range lib.Functions {
+			if _, ok := functions[name]; ok {
+				closeAll()
+				return fmt.Errorf("ERR Function %s already exists", name)
+			}
+			functions[name] = fn
+		}
+	}
+
+	for name, lib := range se.libraries {
+		if libraries[name] != lib {
+			lib.Close()
+		}
+	}
+	se.libraries = libraries
+	se.functions = functions
+	return nil
+}
+
+// Function Commands
+func (s *Server) HandleFunctionLoadCommand(c *Client, cmd Command) []byte {
+	replace := false
+	if len(cmd.Args) == 3 {
+		if !strings.EqualFold(string(cmd.Args[1]), "REPLACE") {
+			return s.Handler.Encoder.GenerateSimpleError(fmt.Sprintf("ERR Unknown option given: %s", cmd.Args[1]))
+		}
+		replace = true
+	} else if len(cmd.Args) > 3 {
+		return s.Handler.Encoder.GenerateSimpleError("ERR syntax error")
+	}
+
+	name, err := s.Scripts.LoadLibrary(string(cmd.Args[len(cmd.Args)-1]), replace)
+	if err != nil {
+		return s.Handler.Encoder.GenerateSimpleError(err.Error())
+	}
+	return s.Handler.Encoder.GenerateBulkString([]byte(name))
+}
+
+func (s *Server) HandleFunctionDeleteCommand(c *Client, cmd Command) []byte {
+	if err := s.Scripts.DeleteLibrary(string(cmd.Args[1])); err != nil {
+		return s.Handler.Encoder.GenerateSimpleError(err.Error())
+	}
+	return s.Handler.Encoder.GetSimpleStringOk()
+}
+
+func (s *Server) HandleFunctionFlushCommand(c *Client, cmd Command) []byte {
+	if len(cmd.Args) > 2 {
+		return s.Handler.Encoder.GenerateSimpleError("ERR syntax error")
+	}
+	if len(cmd.Args) == 2 {
+		mode := strings.ToUpper(string(cmd.Args[1]))
+		if mode != "SYNC" && mode != "ASYNC" {
+			return s.Handler.Encoder.GenerateSimpleError("ERR FUNCTION FLUSH only supports SYNC|ASYNC option")
+		}
+	}
+	s.Scripts.FlushLibraries()
+	return s.Handler.Encoder.GetSimpleStringOk()
+}
+
+func (s *Server) HandleFunctionListCommand(c *Client, cmd Command) []byte {
+	pattern, withCode := "", false
+	for i := 1; i < len(cmd.Args); i++ {
+		switch strings.ToUpper(string(cmd.Args[i])) {
+		case "WITHCODE":
+			withCode = true
+		case "LIBRARYNAME":
+			if i+1 >= len(cmd.Args) || pattern != "" {
+				return s.Handler.Encoder.GenerateSimpleError("ERR library name argument was not given")
+			}
+			pattern = string(cmd.Args[i+1])
+			i += 1
+		default:
+			return s.Handler.Encoder.GenerateSimpleError(fmt.Sprintf("ERR Unknown argument %s", cmd.Args[i]))
+		}
+	}
+
+	e := &s.Handler.Encoder
+	var items [][]byte
+	for _, lib := range s.Scripts.Libraries() {
+		if pattern != "" && !StringMatch(pattern, lib.Name, false) {
+			continue
+		}
+
+		var functions [][]byte
+		for _, name := range slices.Sorted(maps.Keys(lib.Functions)) {
+			fn := lib.Functions[name]
+			description := e.GetNull(c.Protocol)
+			if fn.Description != "" {
+				description = e.GenerateBulkString([]byte(fn.Description))
+			}
+			var flags [][]byte
+			for _, flag := range fn.Flags {
+				flags = append(flags, e.GenerateBulkString([]byte(flag)))
+			}
+			functions = append(functions, e.GenerateMap(c.Protocol, [][]byte{
+				e.GenerateBulkString([]byte("name")), e.GenerateBulkString([]byte(fn.Name)),
+				e.GenerateBulkString([]byte("description")), description,
+				e.GenerateBulkString([]byte("flags")), e.GenerateSet(c.Protocol, flags),
+			}))
+		}
+
+		pairs := [][]byte{
+			e.GenerateBulkString([]byte("library_name")), e.GenerateBulkString([]byte(lib.Name)),
+			e.GenerateBulkString([]byte("engine")), e.GenerateBulkString([]byte("LUA")),
+			e.GenerateBulkString([]byte("functions")), e.GenerateRawArray(functions),
+		}
+		if withCode {
+			pairs = append(pairs, e.GenerateBulkString([]byte("library_code")), e.GenerateBulkString([]byte(lib.Code)))
+		}
+		items = append(items, e.GenerateMap(c.Protocol, pairs))
+	}
+	return e.GenerateRawArray(items)
+}
+
+func (s *Server) HandleFunctionDumpCommand(c *Client, cmd Command) []byte {
+	payload, err := s.Scripts.Dump()
+	if err != nil {
+		return s.Handler.Encoder.GenerateSimpleError("ERR " + err.Error())
+	}
+	return s.Handler.Encoder.GenerateBulkString(payload)
+}
+
+func (s *Server) HandleFunctionRestoreCommand(c *Client, cmd Command) []byte {
+	policy := "APPEND"
+	if len(cmd.Args) == 3 {
+		policy = strings.ToUpper(string(cmd.Args[2]))
+		if policy != "APPEND" && policy != "REPLACE" && policy != "FLUSH" {
+			return s.Handler.Encoder.GenerateSimpleError("ERR Wrong restore policy given, value should be either FLUSH, APPEND or REPLACE.")
+		}
+	} else if len(cmd.Args) > 3 {
+		return s.Handler.Encoder.GenerateSimpleError("ERR syntax error")
+	}
+
+	codes, err := ParseFunctionDump(cmd.Args[1])
+	if err != nil {
+		return s.Handler.Encoder.GenerateSimpleError(err.Error())
+	}
+	if err := s.Scripts.Restore(codes, policy); err != nil {
+		return s.Handler.Encoder.GenerateSimpleError(err.Error())
+	}
+	return s.Handler.Encoder.GetSimpleStringOk()
+}
+
+func (s *Server) HandleFunctionKillCommand(c *Client, cmd Command) []byte {
+	if err := s.Scripts.Kill(false); err != nil {
+		return s.Handler.Encoder.GenerateSimpleError(err.Error())
+	}
+	return s.Handler.Encoder.GetSimpleStringOk()
+}
+
+func (s *Server) HandleFunctionStatsCommand(c *Client, cmd Command) []byte {
+	e := &s.Handler.Encoder
+	runningScript := e.GetNull(c.Protocol)
+	if running := s.Scripts.Running(); running != nil {
+		var command [][]byte
+		for _, arg := range running.Command {
+			command = append(command, []byte(arg))
+		}
+		runningScript = e.GenerateMap(c.Protocol, [][]byte{
+			e.GenerateBulkString([]byte("name")), e.GenerateBulkString([]byte(running.Name)),
+			e.GenerateBulkString([]byte("command")), e.GenerateArray(command),
+			e.GenerateBulkString([]byte("duration_ms")), e.GenerateInt(int(time.Since(running.Start).Milliseconds())),
+		})
+	}
+
+	libraries, functions := 0, 0
+	for _, lib := range s.Scripts.Libraries() {
+		libraries += 1
+		functions += len(lib.Functions)
+	}
+	return e.GenerateMap(c.Protocol, [][]byte{
+		e.GenerateBulkString([]byte("running_script")), runningScript,
+		e.GenerateBulkString([]byte("engines")), e.GenerateMap(c.Protocol, [][]byte{
+			e.GenerateBulkString([]byte("LUA")), e.GenerateMap(c.Protocol, [][]byte{
+				e.GenerateBulkString([]byte("libraries_count")), e.GenerateInt(libraries),
+				e.GenerateBulkString([]byte("functions_count")), e.GenerateInt(functions),
+			}),
+		}),
+	})
+}
+
+// Backs FCALL and FCALL_RO, the caller holds the exec lock exclusively
+func (s *Server) HandleFcallCommand(c *Client, cmd Command) []byte {
+	keys, args, err := ParseScriptKeys(cmd.Args[1:])
+	if err != nil {
+		return s.Handler.Encoder.GenerateSimpleError(err.Error())
+	}
+	fn, ok := s.Scripts.LookupFunction(string(cmd.Args[0]))
+	if !ok {
+		return s.Handler.Encoder.GenerateSimpleError("ERR Function not found")
+	}
+
+	readOnly := fn.HasFlag("no-writes")
+	if cmd.Name == "FCALL_RO" && !readOnly {
+		return s.Handler.Encoder.GenerateSimpleError("ERR Can not execute a script with write flag using *_ro command.")
+	}
+
+	L := fn.Library.state
+	s.SetRedisCall(L, fn.Library.redis)
+	defer func() {
+		L.SetField(fn.Library.redis, "call", lua.LNil)
+		L.SetField(fn.Library.redis, "pcall", lua.LNil)
+	}()
+
+	callArgs := []lua.LValue{NewLuaStringArray(L, keys), NewLuaStringArray(L, args)}
+	return s.CallLua(c, L, fn.callback, callArgs, &RunningScript{Name: fn.Name, Command: CommandStrings(cmd), ReadOnly: readOnly})
+}
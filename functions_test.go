@@ -0,0 +1,139 @@
+package redisclone
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestParseLibraryMetadata(t *testing.T) {
+	tests := []struct {
+		code string
+		name string
+		err  string
+	}{
+		{code: "#!lua name=mylib\nreturn 1", name: "mylib"},
+		{code: "#!LUA name=a_1\n", name: "a_1"},
+		{code: "return 1", err: "ERR Missing library metadata"},
+		{code: "#!python name=lib\n", err: "ERR Engine 'python' not found"},
+		{code: "#!\n", err: "ERR Engine '' not found"},
+		{code: "#!lua\n", err: "ERR Library name was not given"},
+		{code: "#!lua name=lib version=1\n", err: "ERR Invalid metadata value given: version=1"},
+		{code: "#!lua name=my-lib\n", err: "ERR Library names can only contain letters, numbers, or underscores(_) and must be at least one character long"},
+	}
+
+	for _, tt := range tests {
+		name, body, err := ParseLibraryMetadata(tt.code)
+		if tt.err != "" {
+			if err == nil || err.Error() != tt.err {
+				t.Errorf("%q: got error %v, want %q", tt.code, err, tt.err)
+			}
+			continue
+		}
+		if err != nil || name != tt.name || !strings.HasPrefix(body, "\n") {
+			t.Errorf("%q: got %q, %q, %v, want library %q", tt.code, name, body, err, tt.name)
+		}
+	}
+}
+
+func TestNewFunctionLibrary(t *testing.T) {
+	tests := []struct {
+		name string
+		body string
+		err  string
+	}{
+		{name: "positional", body: "redis.register_function('f', function() return 1 end)"},
+		{name: "named arguments", body: "redis.register_function{function_name='f', callback=function() return 1 end, flags={'no-writes'}, description='d'}"},
+		{name: "nothing registered", body: "local x = 1", err: "ERR No functions registered"},
+		{name: "compile error", body: "redis.register_function(", err: "ERR Error compiling function: "},
+		{name: "unknown flag", body: "redis.register_function{function_name='f', callback=function() end, flags={'fast'}}", err: "unknown flag given"},
+		{name: "unknown argument", body: "redis.register_function{function_name='f', callback=function() end, other=1}", err: "unknown argument given to redis.register_function"},
+		{name: "missing callback", body: "redis.register_function{function_name='f'}", err: "redis.register_function must get a callback argument"},
+		{name: "invalid name", body: "redis.register_function('f-1', function() end)", err: "Function names can only contain letters"},
+		{name: "duplicate", body: "redis.register_function('f', function() end) redis.register_function('f', function() end)", err: "Function already exists in the library"},
+		{name: "redis.call while loading", body: "redis.call('PING')", err: "ERR Error registering functions: "},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			lib, err := NewFunctionLibrary("#!lua name=lib\n" + tt.body)
+			if tt.err != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.err) {
+					t.Fatalf("got error %v, want one containing %q", err, tt.err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer lib.Close()
+			if _, ok := lib.Functions["f"]; !ok {
+				t.Fatal("function f wasn't registered")
+			}
+		})
+	}
+}
+
+const testLibrary = `#!lua name=lib
+redis.register_function('set', function(keys, args) return redis.call('SET', keys[1], args[1]) end)
+redis.register_function{function_name='get', callback=function(keys) return redis.call('GET', keys[1]) end, flags={'no-writes'}, description='reads a key'}
+redis.register_function{function_name='sneaky', callback=function(keys) return redis.call('SET', keys[1], 'x') end, flags={'no-writes'}}
+`
+
+func TestFunctionCommands(t *testing.T) {
+	s := startServer(t)
+	c := dial(t, s.Addr())
+
+	expectReply(t, c.Do("FCALL", "set", "1", "k", "v"), replyError("ERR Function not found"))
+	expectReply(t, c.Do("FUNCTION", "LOAD", testLibrary), "lib")
+	expectReply(t, c.Do("FUNCTION", "LOAD", testLibrary), replyError("ERR Library 'lib' already exists"))
+	expectReply(t, c.Do("FUNCTION", "LOAD", "REPLACE", testLibrary), "lib")
+	expectReply(t, c.Do("FUNCTION", "LOAD", "#!lua name=other\nredis.register_function('get', function() end)"), replyError("ERR Function get already exists"))
+	expectReply(t, c.Do("FUNCTION", "LOAD", "UPSERT", testLibrary), replyError("ERR Unknown option given: UPSERT"))
+
+	expectReply(t, c.Do("FCALL", "set", "1", "k", "v"), "OK")
+	expectReply(t, c.Do("FCALL_RO", "get", "1", "k"), "v")
+	expectReply(t, c.Do("FCALL_RO", "set", "1", "k", "v"), replyError("ERR Can not execute a script with write flag using *_ro command."))
+	if got, ok := c.Do("FCALL", "sneaky", "1", "k").(replyError); !ok || !strings.HasPrefix(string(got), "ERR Write commands are not allowed from read-only scripts.") {
+		t.Fatalf("got %#v, want a read-only script error", got)
+	}
+	expectReply(t, c.Do("FCALL", "get", "2", "k"), replyError("ERR Number of keys can't be greater than number of args"))
+
+	expectReply(t, c.Do("FUNCTION", "LIST", "LIBRARYNAME", "nomatch*"), []any{})
+	list := c.Do("FUNCTION", "LIST", "WITHCODE").([]any)
+	lib := list[0].([]any)
+	expectReply(t, lib[:4], []any{"library_name", "lib", "engine", "LUA"})
+	expectReply(t, lib[5].([]any)[0], []any{"name", "get", "description", "reads a key", "flags", []any{"no-writes"}})
+	expectReply(t, lib[6:], []any{"library_code", testLibrary})
+
+	expectReply(t, c.Do("FUNCTION", "DELETE", "nope"), replyError("ERR Library not found"))
+	expectReply(t, c.Do("FUNCTION", "DELETE", "lib"), "OK")
+	expectReply(t, c.Do("FCALL", "get", "1", "k"), replyError("ERR Function not found"))
+}
+
+func TestFunctionDumpRestore(t *testing.T) {
+	s := startServer(t)
+	c := dial(t, s.Addr())
+	other := "#!lua name=other\nredis.register_function('ping', function() return 'pong' end)"
+
+	expectReply(t, c.Do("FUNCTION", "LOAD", testLibrary), "lib")
+	payload := c.Do("FUNCTION", "DUMP").(string)
+
+	expectReply(t, c.Do("FUNCTION", "RESTORE", payload), replyError("ERR Library lib already exists"))
+	expectReply(t, c.Do("FUNCTION", "RESTORE", payload, "MERGE"), replyError("ERR Wrong restore policy given, value should be either FLUSH, APPEND or REPLACE."))
+	expectReply(t, c.Do("FUNCTION", "RESTORE", payload[:len(payload)-1]+"x"), replyError("ERR payload version or checksum are wrong"))
+	expectReply(t, c.Do("FUNCTION", "RESTORE", "short"), replyError("ERR payload version or checksum are wrong"))
+
+	// REPLACE keeps libraries that aren't in the payload, FLUSH drops them
+	expectReply(t, c.Do("FUNCTION", "LOAD", other), "other")
+	expectReply(t, c.Do("FUNCTION", "RESTORE", payload, "REPLACE"), "OK")
+	expectReply(t, c.Do("FCALL", "ping", "0"), "pong")
+	expectReply(t, c.Do("FUNCTION", "RESTORE", payload, "FLUSH"), "OK")
+	expectReply(t, c.Do("FCALL", "ping", "0"), replyError("ERR Function not found"))
+	expectReply(t, c.Do("FCALL", "set", "1", "k", "v"), "OK")
+
+	expectReply(t, c.Do("FUNCTION", "FLUSH", "LATER"), replyError("ERR FUNCTION FLUSH only supports SYNC|ASYNC option"))
+	expectReply(t, c.Do("FUNCTION", "FLUSH"), "OK")
+	expectReply(t, c.Do("FUNCTION", "LIST"), []any{})
+	expectReply(t, c.Do("FUNCTION", "RESTORE", payload), "OK")
+	expectReply(t, c.Do("FCALL_RO", "get", "1", "k"), "v")
+}
@@ -1,3 +1,5 @@
 module RedisClone
 
 go 1.24.3
+
+require github.com/yuin/gopher-lua v1.1.1
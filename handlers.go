@@ -1,16 +1,29 @@
-package main
+package redisclone
 
 import (
-	"bytes"
-	"log/slog"
+	"errors"
+	"fmt"
+	"math"
 	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
 )
 
-//TODO handle error check for incorrect arg length for a given command
-
 type Handler struct {
-	Store   *Store
-	Encoder Encoder
+	Databases []*Store
+	Clients   *ClientList
+	Config    *Config
+	Stats     *Stats
+	Commands  *CommandTable
+	Scripts   *ScriptEngine
+	PubSub    *PubSub
+	Tracking  *Tracking
+	Pause     *PauseState
+	ACL       *ACL
+	Encoder   Encoder
+
+	keyspaceEvents atomic.Int64 // parsed notify-keyspace-events, kept current by its config hook
 }
 
 type Option struct {
@@ -26,9 +39,22 @@ type SetRequest struct {
 
 func (h *Handler) InitalizeHandler() {
 	h.Encoder.InitalizeEncodingMap()
+	for _, db := range h.Databases {
+		db.Notify = h.NotifyKeyspaceEvent
+		db.Expired = func(key string) { h.InvalidateKeys(nil, []string{key}) }
+		db.ExpiryPaused = h.Pause.ExpiryPaused
+	}
 }
 
-func (h *Handler) HandlePingCommand(cmd Command) []byte {
+func (h *Handler) HandlePingCommand(c *Client, cmd Command) []byte {
+	// subscribed RESP2 clients can only read pushes shaped like arrays
+	if c.Protocol == RESP2 && c.SubscriptionCount() > 0 {
+		message := []byte{}
+		if len(cmd.Args) > 0 {
+			message = cmd.Args[0]
+		}
+		return h.Encoder.GenerateArray([][]byte{[]byte("pong"), message})
+	}
 	if len(cmd.Args) == 0 {
 		return h.Encoder.GenerateSimpleString([]byte("PONG"))
 	}
@@ -36,20 +62,90 @@ func (h *Handler) HandlePingCommand(cmd Command) []byte {
 
 }
 
-func (h *Handler) HandleEchoCommand(cmd Command) []byte {
+func (h *Handler) HandleHelloCommand(c *Client, cmd Command) []byte {
+	proto := c.Protocol
+	if len(cmd.Args) > 0 {
+		v, err := strconv.Atoi(string(cmd.Args[0]))
+		if err != nil {
+			return h.Encoder.GenerateSimpleError("ERR Protocol version is not an integer or out of range")
+		}
+		if v != RESP2 && v != RESP3 {
+			return h.Encoder.GenerateSimpleError("NOPROTO unsupported protocol version")
+		}
+		proto = v
+	}
+
+	name, setName := "", false
+	var username, password []byte
+	for i := 1; i < len(cmd.Args); i++ {
+		option := strings.ToUpper(string(cmd.Args[i]))
+		remaining := len(cmd.Args) - i - 1
+		switch {
+		case option == "AUTH" && remaining >= 2:
+			username, password = cmd.Args[i+1], cmd.Args[i+2]
+			i += 2
+		case option == "SETNAME" && remaining >= 1:
+			if !IsValidClientName(cmd.Args[i+1]) {
+				return h.Encoder.GenerateSimpleError("ERR Client names cannot contain spaces, newlines or special characters.")
+			}
+			name, setName = string(cmd.Args[i+1]), true
+			i += 1
+		default:
+			return h.Encoder.GenerateSimpleError(fmt.Sprintf("ERR Syntax error in HELLO option '%s'", cmd.Args[i]))
+		}
+	}
+
+	// credentials are checked only once the whole command parsed, a syntax error must not count as a failed login
+	if username != nil && !h.Authenticate(c, username, password) {
+		return h.Encoder.GenerateSimpleError(WrongPassError)
+	}
+	if h.AuthRequired(c) {
+		return h.Encoder.GenerateSimpleError("NOAUTH HELLO must be called with the client already authenticated, otherwise the HELLO <proto> AUTH <user> <pass> option can be used to authenticate the client and select the RESP protocol version at the same time")
+	}
+
+	c.SetProtocol(proto)
+	if setName {
+		c.SetName(name)
+	}
+
+	return h.Encoder.GenerateMap(c.Protocol, [][]byte{
+		h.Encoder.GenerateBulkString([]byte("server")), h.Encoder.GenerateBulkString([]byte("redis")),
+		h.Encoder.GenerateBulkString([]byte("version")), h.Encoder.GenerateBulkString([]byte(RedisVersion)),
+		h.Encoder.GenerateBulkString([]byte("proto")), h.Encoder.GenerateInt(c.Protocol),
+		h.Encoder.GenerateBulkString([]byte("id")), h.Encoder.GenerateInt(int(c.ID)),
+		h.Encoder.GenerateBulkString([]byte("mode")), h.Encoder.GenerateBulkString([]byte("standalone")),
+		h.Encoder.GenerateBulkString([]byte("role")), h.Encoder.GenerateBulkString([]byte("master")),
+		h.Encoder.GenerateBulkString([]byte("modules")), h.Encoder.GenerateRawArray(nil),
+	})
+}
+
+// Client names are shown in CLIENT LIST, so they can't contain spaces or non printable characters
+func IsValidClientName(name []byte) bool {
+	for _, b := range name {
+		if b < '!' || b > '~' {
+			return false
+		}
+	}
+	return true
+}
+
+func (h *Handler) HandleEchoCommand(c *Client, cmd Command) []byte {
 	return h.Encoder.GenerateBulkString(cmd.Args[0])
 }
 
-func (h *Handler) HandleTypeCommand(cmd Command) []byte {
+func (h *Handler) HandleTypeCommand(c *Client, cmd Command) []byte {
 	key := string(cmd.Args[0])
-	nativeType := h.Store.DetermineDataType(key)
+	nativeType := h.DB(c).DetermineDataType(key)
 	return h.Encoder.GenerateTypeString(nativeType)
 }
 
-func (h *Handler) HandleSetCommand(cmd Command) []byte {
-	options := h.ParseOptions(cmd)
+func (h *Handler) HandleSetCommand(c *Client, cmd Command) []byte {
+	options, err := h.ParseSetOptions(cmd)
+	if err != nil {
+		return h.Encoder.GenerateSimpleError(err.Error())
+	}
 	sr := SetRequest{Key: string(cmd.Args[0]), Value: cmd.Args[1], Options: options}
-	_, err := h.Store.SetKeyVal(sr)
+	_, err = h.DB(c).SetKeyVal(sr)
 	if err != nil {
 		return h.Encoder.GenerateSimpleError(err.Error())
 	}
@@ -57,44 +153,48 @@ func (h *Handler) HandleSetCommand(cmd Command) []byte {
 	return h.Encoder.GetSimpleStringOk()
 }
 
-func (h *Handler) ParseOptions(cmd Command) []Option {
+// Parses the options following SET key value, EX is the only one supported
+func (h *Handler) ParseSetOptions(cmd Command) ([]Option, error) {
 	var options []Option
-	switch cmd.Name {
-	case "SET":
-		exOption := []byte("EX")
-		optionPortion := cmd.Args[2:]
-		for i := 0; i < len(optionPortion); i++ {
-			if bytes.Equal(optionPortion[i], exOption) {
-				ttl, _ := strconv.Atoi(string(optionPortion[i+1])) //TODO handle potential error
-				o := Option{Name: "EX", Arg: ttl}
-				options = append(options, o)
-			}
+	optionPortion := cmd.Args[2:]
+	for i := 0; i < len(optionPortion); i++ {
+		if !strings.EqualFold(string(optionPortion[i]), "EX") || i+1 >= len(optionPortion) || len(options) > 0 {
+			return nil, errors.New("ERR syntax error")
+		}
+		ttl, err := strconv.Atoi(string(optionPortion[i+1]))
+		if err != nil {
+			return nil, errors.New("ERR value is not an integer or out of range")
+		}
+		if ttl <= 0 || ttl > math.MaxInt64/int(time.Second) {
+			return nil, errors.New("ERR invalid expire time in 'set' command")
 		}
+		options = append(options, Option{Name: "EX", Arg: ttl})
+		i += 1
 	}
-	return options
+	return options, nil
 }
 
-func (h *Handler) HandleGetCommand(cmd Command) []byte {
+func (h *Handler) HandleGetCommand(c *Client, cmd Command) []byte {
 	key := string(cmd.Args[0])
-	v, err := h.Store.GetKeyVal(key)
+	v, err := h.DB(c).GetKeyVal(key)
 	if err != nil {
 		return h.Encoder.GenerateSimpleError(err.Error())
 	}
 	if v == nil {
-		return h.Encoder.GetNilBulkString()
+		return h.Encoder.GetNull(c.Protocol)
 	}
 	return h.Encoder.GenerateBulkString(v)
 
 }
 
 // List Commands
-func (h *Handler) HandleListPushCommand(cmd Command) []byte {
+func (h *Handler) HandleListPushCommand(c *Client, cmd Command) []byte {
 	var lc ListModificationRequest
 	lc.Name = cmd.Name
 	lc.Key = string(cmd.Args[0])
 	lc.Values = append(lc.Values, cmd.Args[1:]...)
 
-	listLength, err := h.Store.ListPush(lc)
+	listLength, err := h.DB(c).ListPush(lc)
 	if err != nil {
 		return h.Encoder.GenerateSimpleError(err.Error())
 	}
@@ -103,18 +203,17 @@ func (h *Handler) HandleListPushCommand(cmd Command) []byte {
 	return resp
 }
 
-func (h *Handler) HandleListRangeCommand(cmd Command) []byte {
+func (h *Handler) HandleListRangeCommand(c *Client, cmd Command) []byte {
 	var lc ListRangeRequest
 	lc.Name = cmd.Name
 	lc.Key = string(cmd.Args[0])
 	start, err1 := strconv.Atoi(string(cmd.Args[1]))
 	end, err2 := strconv.Atoi(string(cmd.Args[2]))
 	if err1 != nil || err2 != nil {
-		slog.Error("Error converting start and end range to ints", "err1", err1, "err2", err2)
-		return nil
+		return h.Encoder.GenerateSimpleError("ERR value is not an integer or out of range")
 	}
 
-	listLength, err := h.Store.ListLength(lc.Key)
+	listLength, err := h.DB(c).ListLength(lc.Key)
 	if err != nil {
 		return h.Encoder.GenerateSimpleError(err.Error())
 	}
@@ -122,7 +221,7 @@ func (h *Handler) HandleListRangeCommand(cmd Command) []byte {
 	lc.Start = h.FormatListRangeIndex(start, listLength)
 	lc.End = h.FormatListRangeIndex(end, listLength)
 
-	listArray, err := h.Store.ListRange(lc)
+	listArray, err := h.DB(c).ListRange(lc)
 	if err != nil {
 		return h.Encoder.GenerateSimpleError(err.Error())
 	}
@@ -139,10 +238,10 @@ func (h *Handler) FormatListRangeIndex(i, len int) int {
 	return min(len-1, i)
 }
 
-func (h *Handler) HandleListLengthCommand(cmd Command) []byte {
+func (h *Handler) HandleListLengthCommand(c *Client, cmd Command) []byte {
 	key := string(cmd.Args[0])
 
-	listLength, err := h.Store.ListLength(key)
+	listLength, err := h.DB(c).ListLength(key)
 	if err != nil {
 		return h.Encoder.GenerateSimpleError(err.Error())
 	}
@@ -151,7 +250,7 @@ func (h *Handler) HandleListLengthCommand(cmd Command) []byte {
 	return resp
 }
 
-func (h *Handler) HandleListPopCommand(cmd Command) []byte {
+func (h *Handler) HandleListPopCommand(c *Client, cmd Command) []byte {
 	var lc ListPopRequest
 	key := string(cmd.Args[0])
 	lc.Name = cmd.Name
@@ -159,20 +258,20 @@ func (h *Handler) HandleListPopCommand(cmd Command) []byte {
 	lc.Count = 1
 	if len(cmd.Args) > 1 {
 		count, err := strconv.Atoi(string(cmd.Args[1]))
-		if err != nil {
-			slog.Error("Error converting pop count to int", "err", err)
+		if err != nil || count < 0 {
+			return h.Encoder.GenerateSimpleError("ERR value is out of range, must be positive")
 		}
 		lc.Count = count
 	}
 
-	listArray, err := h.Store.ListPop(lc)
+	listArray, err := h.DB(c).ListPop(lc)
 	if err != nil {
 		return h.Encoder.GenerateSimpleError(err.Error())
 	}
 
 	var resp []byte
 	if listArray == nil {
-		resp = h.Encoder.GenerateNilBulkString()
+		resp = h.Encoder.GetNull(c.Protocol)
 	} else if len(listArray) == 1 {
 		resp = h.Encoder.GenerateBulkString(listArray[0])
 	} else {
@@ -182,27 +281,329 @@ func (h *Handler) HandleListPopCommand(cmd Command) []byte {
 	return resp
 }
 
-func (h *Handler) HandleListBlockingPopCommand(cmd Command) []byte {
+func (h *Handler) HandleListBlockingPopCommand(c *Client, cmd Command) []byte {
 	var keys []string
 	for _, v := range cmd.Args[:len(cmd.Args)-1] {
 		keys = append(keys, string(v))
 	}
 	timeout, err := strconv.ParseFloat(string(cmd.Args[len(cmd.Args)-1]), 64)
 	if err != nil {
-		slog.Error("Error converting timeout to float64", "err", err)
+		return h.Encoder.GenerateSimpleError("ERR timeout is not a float or out of range")
+	}
+	if timeout < 0 {
+		return h.Encoder.GenerateSimpleError("ERR timeout is negative")
+	}
+
+	// inside a transaction or script the pop either succeeds right away or replies as if the timeout expired
+	if c.InExec() || c.Script {
+		for _, key := range keys {
+			popped, err := h.DB(c).ListPop(ListPopRequest{Name: cmd.Name[1:], Key: key, Count: 1})
+			if err != nil {
+				return h.Encoder.GenerateSimpleError(err.Error())
+			}
+			if popped != nil {
+				return h.Encoder.GenerateArray([][]byte{[]byte(key), popped[0]})
+			}
+		}
+		return h.Encoder.GetNullArray(c.Protocol)
 	}
 
-	listArray, err := h.Store.ListBlockedPop(BlockedListPopRequest{Name: cmd.Name, Keys: keys, Timeout: timeout})
+	w := NewWaiter(c.DB(), cmd.Name[1:], keys)
+	w.OnBlock = c.ReleaseExecLock
+	c.SetBlockingWaiter(w)
+	defer c.SetBlockingWaiter(nil)
+
+	listArray, err := h.DB(c).ListBlockedPop(BlockedListPopRequest{Name: cmd.Name, Keys: keys, Timeout: timeout}, w)
 	if err != nil {
 		return h.Encoder.GenerateSimpleError(err.Error())
 	}
 
 	var resp []byte
 	if listArray == nil {
-		resp = h.Encoder.GenerateNilBulkString()
+		resp = h.Encoder.GetNullArray(c.Protocol)
 	} else {
 		resp = h.Encoder.GenerateArray(listArray)
 	}
 
 	return resp
 }
+
+// One CLIENT LIST line describing client, without the trailing newline
+func (h *Handler) ClientInfoLine(client *Client) string {
+	d := client.Describe()
+	flags := ""
+	var blockedKeys []string
+	if w := client.BlockingWaiter(); w != nil && h.Databases[w.DB].IsWaiterBlocked(w) {
+		flags += "b"
+		blockedKeys = w.Keys
+	}
+	if client.Watch.Dirty.Load() {
+		flags += "d"
+	}
+	if d.NoEvict {
+		flags += "e"
+	}
+	sub, psub, ssub := h.PubSub.ClientSubscriptions(client)
+	if sub+psub+ssub > 0 {
+		flags += "P"
+	}
+	redirect := -1
+	if opts := h.Tracking.Options(client); opts != nil {
+		flags += "t"
+		redirect = int(opts.Redirect)
+		if _, ok := h.Clients.Get(opts.Redirect); opts.Redirect != 0 && !ok {
+			flags += "R"
+		}
+	}
+	if d.NoTouch {
+		flags += "T"
+	}
+	if d.Queued >= 0 {
+		flags += "x"
+	}
+	if flags == "" {
+		flags = "N"
+	}
+
+	return fmt.Sprintf("id=%d addr=%s laddr=%s name=%s age=%d idle=%d flags=%s db=%d sub=%d psub=%d ssub=%d multi=%d bkeys=%s cmd=%s user=%s redir=%d resp=%d",
+		client.ID, client.Conn.RemoteAddr(), client.Conn.LocalAddr(), d.Name, int64(d.Age.Seconds()), int64(d.Idle.Seconds()), flags, d.DB,
+		sub, psub, ssub, d.Queued, strings.Join(blockedKeys, ","), d.LastCommand, d.User, redirect, d.Protocol)
+}
+
+// Connections are either normal or in pub/sub mode, this server has no replication links
+func (h *Handler) ClientType(client *Client) string {
+	if sub, psub, ssub := h.PubSub.ClientSubscriptions(client); sub+psub+ssub > 0 {
+		return "pubsub"
+	}
+	return "normal"
+}
+
+// Validates a CLIENT LIST or CLIENT KILL TYPE argument, replica is accepted under its old name too
+func ParseClientType(arg []byte) (string, error) {
+	switch t := strings.ToLower(string(arg)); t {
+	case "normal", "master", "replica", "pubsub":
+		return t, nil
+	case "slave":
+		return "replica", nil
+	}
+	return "", fmt.Errorf("ERR Unknown client type '%s'", arg)
+}
+
+// Disconnects another client: a blocked command is woken first, then closing the connection ends its read loop
+func (h *Handler) KillClient(target *Client) {
+	if w := target.BlockingWaiter(); w != nil {
+		h.Databases[w.DB].UnblockWaiter(w, errors.New("UNBLOCKED client was killed"))
+	}
+	target.Kill()
+}
+
+// Client Commands
+func (h *Handler) HandleClientListCommand(c *Client, cmd Command) []byte {
+	clientType := ""
+	var ids map[int64]bool
+	for i := 1; i < len(cmd.Args); i++ {
+		switch strings.ToUpper(string(cmd.Args[i])) {
+		case "TYPE":
+			if i+1 >= len(cmd.Args) {
+				return h.Encoder.GenerateSimpleError("ERR syntax error")
+			}
+			i++
+			t, err := ParseClientType(cmd.Args[i])
+			if err != nil {
+				return h.Encoder.GenerateSimpleError(err.Error())
+			}
+			clientType = t
+		case "ID":
+			if i+1 >= len(cmd.Args) {
+				return h.Encoder.GenerateSimpleError("ERR syntax error")
+			}
+			ids = make(map[int64]bool)
+			for i+1 < len(cmd.Args) {
+				i++
+				id, err := strconv.ParseInt(string(cmd.Args[i]), 10, 64)
+				if err != nil || id <= 0 {
+					return h.Encoder.GenerateSimpleError("ERR Invalid client ID")
+				}
+				ids[id] = true
+			}
+		default:
+			return h.Encoder.GenerateSimpleError("ERR syntax error")
+		}
+	}
+
+	var out strings.Builder
+	for _, client := range h.Clients.All() {
+		if clientType != "" && h.ClientType(client) != clientType {
+			continue
+		}
+		if ids != nil && !ids[client.ID] {
+			continue
+		}
+		out.WriteString(h.ClientInfoLine(client))
+		out.WriteString("\n")
+	}
+
+	return h.Encoder.GenerateVerbatimString(c.Protocol, "txt", []byte(out.String()))
+}
+
+func (h *Handler) HandleClientInfoCommand(c *Client, cmd Command) []byte {
+	return h.Encoder.GenerateVerbatimString(c.Protocol, "txt", []byte(h.ClientInfoLine(c)+"\n"))
+}
+
+func (h *Handler) HandleClientIDCommand(c *Client, cmd Command) []byte {
+	return h.Encoder.GenerateInt(int(c.ID))
+}
+
+func (h *Handler) HandleClientSetNameCommand(c *Client, cmd Command) []byte {
+	if !IsValidClientName(cmd.Args[1]) {
+		return h.Encoder.GenerateSimpleError("ERR Client names cannot contain spaces, newlines or special characters.")
+	}
+	c.SetName(string(cmd.Args[1]))
+	return h.Encoder.GetSimpleStringOk()
+}
+
+func (h *Handler) HandleClientGetNameCommand(c *Client, cmd Command) []byte {
+	name, _ := c.Identity()
+	if name == "" {
+		return h.Encoder.GetNull(c.Protocol)
+	}
+	return h.Encoder.GenerateBulkString([]byte(name))
+}
+
+// CLIENT KILL addr:port closes one connection, the filter form closes every match and returns the count
+func (h *Handler) HandleClientKillCommand(c *Client, cmd Command) []byte {
+	if len(cmd.Args) == 2 {
+		for _, client := range h.Clients.All() {
+			if client.Conn.RemoteAddr().String() == string(cmd.Args[1]) {
+				if client == c {
+					c.CloseAfterReply = true
+				} else {
+					h.KillClient(client)
+				}
+				return h.Encoder.GetSimpleStringOk()
+			}
+		}
+		return h.Encoder.GenerateSimpleError("ERR No such client")
+	}
+	if len(cmd.Args)%2 == 0 {
+		return h.Encoder.GenerateSimpleError("ERR syntax error")
+	}
+
+	var id int64
+	addr, laddr, user, clientType := "", "", "", ""
+	skipMe := true
+	for i := 1; i < len(cmd.Args); i += 2 {
+		value := cmd.Args[i+1]
+		switch strings.ToUpper(string(cmd.Args[i])) {
+		case "ID":
+			n, err := strconv.ParseInt(string(value), 10, 64)
+			if err != nil || n <= 0 {
+				return h.Encoder.GenerateSimpleError("ERR client-id should be greater than 0")
+			}
+			id = n
+		case "ADDR":
+			addr = string(value)
+		case "LADDR":
+			laddr = string(value)
+		case "USER":
+			if h.ACL.Get(string(value)) == nil {
+				return h.Encoder.GenerateSimpleError(fmt.Sprintf("ERR No such user '%s'", value))
+			}
+			user = string(value)
+		case "TYPE":
+			t, err := ParseClientType(value)
+			if err != nil {
+				return h.Encoder.GenerateSimpleError(err.Error())
+			}
+			clientType = t
+		case "SKIPME":
+			switch strings.ToLower(string(value)) {
+			case "yes":
+				skipMe = true
+			case "no":
+				skipMe = false
+			default:
+				return h.Encoder.GenerateSimpleError("ERR syntax error")
+			}
+		default:
+			return h.Encoder.GenerateSimpleError("ERR syntax error")
+		}
+	}
+
+	killed := 0
+	for _, client := range h.Clients.All() {
+		switch {
+		case id != 0 && client.ID != id,
+			addr != "" && client.Conn.RemoteAddr().String() != addr,
+			laddr != "" && client.Conn.LocalAddr().String() != laddr,
+			user != "" && client.User() != user,
+			clientType != "" && h.ClientType(client) != clientType,
+			skipMe && client == c:
+			continue
+		}
+		if client == c {
+			c.CloseAfterReply = true
+		} else {
+			h.KillClient(client)
+		}
+		killed += 1
+	}
+	return h.Encoder.GenerateInt(killed)
+}
+
+func (h *Handler) HandleClientNoEvictCommand(c *Client, cmd Command) []byte {
+	switch strings.ToUpper(string(cmd.Args[1])) {
+	case "ON":
+		c.SetNoEvict(true)
+	case "OFF":
+		c.SetNoEvict(false)
+	default:
+		return h.Encoder.GenerateSimpleError("ERR syntax error")
+	}
+	return h.Encoder.GetSimpleStringOk()
+}
+
+func (h *Handler) HandleClientNoTouchCommand(c *Client, cmd Command) []byte {
+	switch strings.ToUpper(string(cmd.Args[1])) {
+	case "ON":
+		c.SetNoTouch(true)
+	case "OFF":
+		c.SetNoTouch(false)
+	default:
+		return h.Encoder.GenerateSimpleError("ERR syntax error")
+	}
+	return h.Encoder.GetSimpleStringOk()
+}
+
+func (h *Handler) HandleClientUnblockCommand(c *Client, cmd Command) []byte {
+	if len(cmd.Args) > 3 {
+		return h.Encoder.GenerateSimpleError("ERR syntax error")
+	}
+
+	id, err := strconv.ParseInt(string(cmd.Args[1]), 10, 64)
+	if err != nil {
+		return h.Encoder.GenerateSimpleError("ERR value is not an integer or out of range")
+	}
+
+	var unblockErr error
+	if len(cmd.Args) == 3 {
+		switch strings.ToUpper(string(cmd.Args[2])) {
+		case "TIMEOUT":
+		case "ERROR":
+			unblockErr = errors.New("UNBLOCKED client unblocked via CLIENT UNBLOCK")
+		default:
+			return h.Encoder.GenerateSimpleError("ERR CLIENT UNBLOCK reason should be TIMEOUT or ERROR")
+		}
+	}
+
+	target, ok := h.Clients.Get(id)
+	if !ok {
+		return h.Encoder.GenerateInt(0)
+	}
+	w := target.BlockingWaiter()
+	if w == nil || !h.Databases[w.DB].UnblockWaiter(w, unblockErr) {
+		return h.Encoder.GenerateInt(0)
+	}
+
+	return h.Encoder.GenerateInt(1)
+}
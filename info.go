@@ -0,0 +1,195 @@
+package redisclone
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"maps"
+	"os"
+	"runtime"
+	"slices"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Server wide counters reported by INFO, reset with CONFIG RESETSTAT
+type Stats struct {
+	StartTime                       time.Time
+	RunID                           string
+	TotalConnectionsReceived        atomic.Int64
+	TotalCommandsProcessed          atomic.Int64
+	LastSave                        atomic.Int64 // unix time of the last successful snapshot
+	Dirty                           atomic.Int64 // writes since the last successful snapshot, not reset by RESETSTAT
+	TotalErrorReplies               atomic.Int64
+	CommandPanics                   atomic.Int64
+	RejectedConnections             atomic.Int64 // turned away by maxclients
+	OutputBufferLimitDisconnections atomic.Int64
+	AuthFailures                    atomic.Int64
+	ACLDeniedCommand                atomic.Int64
+	ACLDeniedKey                    atomic.Int64
+	ACLDeniedChannel                atomic.Int64
+	errorCounts                     map[string]int64 // error replies keyed by their prefix, e.g. ERR or WRONGTYPE
+	errorLock                       sync.Mutex
+}
+
+func NewStats() *Stats {
+	id := make([]byte, 20)
+	rand.Read(id)
+	st := &Stats{StartTime: time.Now(), RunID: hex.EncodeToString(id), errorCounts: make(map[string]int64)}
+	st.LastSave.Store(st.StartTime.Unix())
+	return st
+}
+
+func (st *Stats) Reset() {
+	st.TotalConnectionsReceived.Store(0)
+	st.TotalCommandsProcessed.Store(0)
+	st.TotalErrorReplies.Store(0)
+	st.CommandPanics.Store(0)
+	st.RejectedConnections.Store(0)
+	st.OutputBufferLimitDisconnections.Store(0)
+	st.AuthFailures.Store(0)
+	st.ACLDeniedCommand.Store(0)
+	st.ACLDeniedKey.Store(0)
+	st.ACLDeniedChannel.Store(0)
+
+	st.errorLock.Lock()
+	defer st.errorLock.Unlock()
+	clear(st.errorCounts)
+}
+
+// Counts an error reply under its prefix, the first word of the error
+func (st *Stats) RecordErrorReply(reply []byte) {
+	prefix, _, _ := strings.Cut(strings.TrimPrefix(string(reply), "-"), " ")
+	prefix = strings.TrimSpace(prefix)
+
+	st.TotalErrorReplies.Add(1)
+	st.errorLock.Lock()
+	defer st.errorLock.Unlock()
+	st.errorCounts[prefix] += 1
+}
+
+// Returns a copy of the per prefix error counts
+func (st *Stats) ErrorCounts() map[string]int64 {
+	st.errorLock.Lock()
+	defer st.errorLock.Unlock()
+	return maps.Clone(st.errorCounts)
+}
+
+type InfoSection struct {
+	Name     string
+	Default  bool // included by a bare INFO
+	Generate func(out *strings.Builder)
+}
+
+func (h *Handler) InfoSections() []InfoSection {
+	return []InfoSection{
+		{Name: "server", Default: true, Generate: h.GenerateServerInfo},
+		{Name: "clients", Default: true, Generate: h.GenerateClientsInfo},
+		{Name: "persistence", Default: true, Generate: h.GeneratePersistenceInfo},
+		{Name: "stats", Default: true, Generate: h.GenerateStatsInfo},
+		{Name: "errorstats", Default: false, Generate: h.GenerateErrorStatsInfo},
+		{Name: "keyspace", Default: true, Generate: h.GenerateKeyspaceInfo},
+	}
+}
+
+// Server Commands
+func (h *Handler) HandleInfoCommand(c *Client, cmd Command) []byte {
+	requested := map[string]bool{}
+	for _, v := range cmd.Args {
+		requested[strings.ToLower(string(v))] = true
+	}
+	all := requested["all"] || requested["everything"]
+	defaults := len(requested) == 0 || requested["default"]
+
+	var out strings.Builder
+	for _, section := range h.InfoSections() {
+		if !all && !requested[section.Name] && !(defaults && section.Default) {
+			continue
+		}
+		if out.Len() > 0 {
+			out.WriteString("\r\n")
+		}
+		fmt.Fprintf(&out, "# %s%s\r\n", strings.ToUpper(section.Name[:1]), section.Name[1:])
+		section.Generate(&out)
+	}
+
+	return h.Encoder.GenerateVerbatimString(c.Protocol, "txt", []byte(out.String()))
+}
+
+func (h *Handler) GenerateServerInfo(out *strings.Builder) {
+	uptime := time.Since(h.Stats.StartTime)
+	executable, _ := os.Executable()
+
+	fmt.Fprintf(out, "redis_version:%s\r\n", RedisVersion)
+	fmt.Fprintf(out, "redis_mode:standalone\r\n")
+	fmt.Fprintf(out, "os:%s %s\r\n", runtime.GOOS, runtime.GOARCH)
+	fmt.Fprintf(out, "go_version:%s\r\n", runtime.Version())
+	fmt.Fprintf(out, "process_id:%d\r\n", os.Getpid())
+	fmt.Fprintf(out, "run_id:%s\r\n", h.Stats.RunID)
+	fmt.Fprintf(out, "tcp_port:%d\r\n", h.Config.GetInt("port"))
+	fmt.Fprintf(out, "uptime_in_seconds:%d\r\n", int64(uptime.Seconds()))
+	fmt.Fprintf(out, "uptime_in_days:%d\r\n", int64(uptime.Hours()/24))
+	fmt.Fprintf(out, "executable:%s\r\n", executable)
+	fmt.Fprintf(out, "config_file:%s\r\n", h.Config.File)
+}
+
+func (h *Handler) GenerateClientsInfo(out *strings.Builder) {
+	connected, blocked := 0, 0
+	for _, c := range h.Clients.All() {
+		connected += 1
+		if w := c.BlockingWaiter(); w != nil && h.Databases[w.DB].IsWaiterBlocked(w) {
+			blocked += 1
+		}
+	}
+
+	fmt.Fprintf(out, "connected_clients:%d\r\n", connected)
+	fmt.Fprintf(out, "maxclients:%d\r\n", h.Config.GetInt("maxclients"))
+	fmt.Fprintf(out, "blocked_clients:%d\r\n", blocked)
+}
+
+func (h *Handler) GenerateStatsInfo(out *strings.Builder) {
+	fmt.Fprintf(out, "total_connections_received:%d\r\n", h.Stats.TotalConnectionsReceived.Load())
+	fmt.Fprintf(out, "total_commands_processed:%d\r\n", h.Stats.TotalCommandsProcessed.Load())
+	fmt.Fprintf(out, "rejected_connections:%d\r\n", h.Stats.RejectedConnections.Load())
+	fmt.Fprintf(out, "client_output_buffer_limit_disconnections:%d\r\n", h.Stats.OutputBufferLimitDisconnections.Load())
+	fmt.Fprintf(out, "pubsub_channels:%d\r\n", len(h.PubSub.Channels("")))
+	fmt.Fprintf(out, "pubsub_patterns:%d\r\n", h.PubSub.NumPat())
+	fmt.Fprintf(out, "pubsubshard_channels:%d\r\n", len(h.PubSub.ShardChannels("")))
+	fmt.Fprintf(out, "total_error_replies:%d\r\n", h.Stats.TotalErrorReplies.Load())
+	fmt.Fprintf(out, "acl_access_denied_auth:%d\r\n", h.Stats.AuthFailures.Load())
+	fmt.Fprintf(out, "acl_access_denied_cmd:%d\r\n", h.Stats.ACLDeniedCommand.Load())
+	fmt.Fprintf(out, "acl_access_denied_key:%d\r\n", h.Stats.ACLDeniedKey.Load())
+	fmt.Fprintf(out, "acl_access_denied_channel:%d\r\n", h.Stats.ACLDeniedChannel.Load())
+	fmt.Fprintf(out, "total_command_panics:%d\r\n", h.Stats.CommandPanics.Load())
+}
+
+func (h *Handler) GenerateErrorStatsInfo(out *strings.Builder) {
+	counts := h.Stats.ErrorCounts()
+	for _, prefix := range slices.Sorted(maps.Keys(counts)) {
+		fmt.Fprintf(out, "errorstat_%s:count=%d\r\n", prefix, counts[prefix])
+	}
+}
+
+func (h *Handler) GenerateKeyspaceInfo(out *strings.Builder) {
+	for i, db := range h.Databases {
+		keys, expires, avgTTL := db.KeyspaceStats()
+		if keys > 0 {
+			fmt.Fprintf(out, "db%d:keys=%d,expires=%d,avg_ttl=%d\r\n", i, keys, expires, avgTTL)
+		}
+	}
+}
+
+func (h *Handler) GeneratePersistenceInfo(out *strings.Builder) {
+	fmt.Fprintf(out, "rdb_changes_since_last_save:%d\r\n", h.Stats.Dirty.Load())
+	fmt.Fprintf(out, "rdb_last_save_time:%d\r\n", h.Stats.LastSave.Load())
+	fmt.Fprintf(out, "aof_enabled:0\r\n")
+}
+
+func BoolToInt(b bool) int {
+	if b {
+		return 1
+	}
+	return 0
+}
@@ -0,0 +1,195 @@
+package redisclone
+
+import (
+	"crypto/tls"
+	"errors"
+	"log/slog"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const DefaultOutputBufferLimits = "normal 0 0 0 slave 268435456 67108864 60 pubsub 33554432 8388608 60"
+
+// Client classes of client-output-buffer-limit in the order CONFIG GET lists them
+var outputBufferClasses = []string{"normal", "slave", "pubsub"}
+
+// Pending output over Hard closes the client at once, over Soft only once it stayed there for SoftSeconds; 0 disables a limit
+type OutputBufferLimit struct {
+	Hard        int64
+	Soft        int64
+	SoftSeconds int64
+}
+
+// Parses class hard soft soft-seconds groups, replica is accepted as the new name of slave
+func ParseOutputBufferLimits(raw string) (map[string]OutputBufferLimit, error) {
+	fields := strings.Fields(raw)
+	if len(fields)%4 != 0 {
+		return nil, errors.New("Wrong number of arguments in buffer limit configuration.")
+	}
+
+	limits := make(map[string]OutputBufferLimit)
+	for i := 0; i < len(fields); i += 4 {
+		class := strings.ToLower(fields[i])
+		if class == "replica" {
+			class = "slave"
+		}
+		if class != "normal" && class != "slave" && class != "pubsub" {
+			return nil, errors.New("Invalid client class specified in buffer limit configuration.")
+		}
+
+		hard, err1 := ParseMemory(fields[i+1])
+		soft, err2 := ParseMemory(fields[i+2])
+		seconds, err3 := strconv.ParseInt(fields[i+3], 10, 64)
+		if err1 != nil || err2 != nil || err3 != nil || hard < 0 || soft < 0 || seconds < 0 {
+			return nil, errors.New("Error in hard, soft or soft_seconds setting in buffer limit configuration.")
+		}
+		limits[class] = OutputBufferLimit{Hard: hard, Soft: soft, SoftSeconds: seconds}
+	}
+	return limits, nil
+}
+
+func FormatOutputBufferLimits(limits map[string]OutputBufferLimit) string {
+	var parts []string
+	for _, class := range outputBufferClasses {
+		l := limits[class]
+		parts = append(parts, class, strconv.FormatInt(l.Hard, 10), strconv.FormatInt(l.Soft, 10), strconv.FormatInt(l.SoftSeconds, 10))
+	}
+	return strings.Join(parts, " ")
+}
+
+func ValidateOutputBufferLimits(v ConfigValue) error {
+	_, err := ParseOutputBufferLimits(v.Raw)
+	return err
+}
+
+// Classes missing from raw keep their current limits, invalid input is passed through for the validator to reject
+func MergeOutputBufferLimits(previous, raw string) string {
+	updates, err := ParseOutputBufferLimits(raw)
+	if err != nil {
+		return raw
+	}
+	limits, err := ParseOutputBufferLimits(previous)
+	if err != nil {
+		limits, _ = ParseOutputBufferLimits(DefaultOutputBufferLimits)
+	}
+	for class, l := range updates {
+		limits[class] = l
+	}
+	return FormatOutputBufferLimits(limits)
+}
+
+// Shared by every client, client-output-buffer-limit is only parsed again after it changes
+type OutputLimits struct {
+	cfg    *Config
+	stats  *Stats
+	raw    string
+	limits map[string]OutputBufferLimit
+	lock   sync.Mutex
+}
+
+func NewOutputLimits(cfg *Config, stats *Stats) *OutputLimits {
+	return &OutputLimits{cfg: cfg, stats: stats}
+}
+
+func (ol *OutputLimits) Get(class string) OutputBufferLimit {
+	raw := ol.cfg.GetString("client-output-buffer-limit")
+
+	ol.lock.Lock()
+	defer ol.lock.Unlock()
+
+	if ol.limits == nil || raw != ol.raw {
+		ol.limits, _ = ParseOutputBufferLimits(raw)
+		ol.raw = raw
+	}
+	return ol.limits[class]
+}
+
+// Note: This function is unsafe, it should only ever be called by a function who holds the client's outputLock
+func (c *Client) UnsafeOutputLimitReached() bool {
+	class := "normal"
+	if c.subscribed.Load() {
+		class = "pubsub"
+	}
+	limit := c.Limits.Get(class)
+	pending := int64(len(c.output))
+
+	switch {
+	case limit.Hard > 0 && pending >= limit.Hard:
+		return true
+	case limit.Soft > 0 && pending >= limit.Soft:
+		if c.softLimitSince.IsZero() {
+			c.softLimitSince = time.Now()
+			return false
+		}
+		return time.Since(c.softLimitSince) >= time.Duration(limit.SoftSeconds)*time.Second
+	}
+	c.softLimitSince = time.Time{}
+	return false
+}
+
+// Drops the pending output and closes the connection of a client whose replies pile up faster than it reads them
+// Note: This function is unsafe, it should only ever be called by a function who holds the client's outputLock
+func (c *Client) UnsafeDisconnectForOutputLimit() {
+	slog.Warn("Client scheduled to be closed ASAP for overcoming of output buffer limits.", "id", c.ID, "addr", c.Conn.RemoteAddr().String(), "pending", len(c.output))
+	c.Limits.stats.OutputBufferLimitDisconnections.Add(1)
+	c.output = nil
+	c.outputClosed = true
+	c.Kill()
+}
+
+// Applies tcp-keepalive to a freshly accepted connection
+func (s *Server) ConfigureKeepAlive(conn net.Conn) {
+	if tlsConn, ok := conn.(*tls.Conn); ok {
+		conn = tlsConn.NetConn()
+	}
+	tcp, ok := conn.(*net.TCPConn)
+	if !ok {
+		return
+	}
+	seconds := s.Config.GetInt("tcp-keepalive")
+	if seconds == 0 {
+		tcp.SetKeepAlive(false)
+		return
+	}
+	tcp.SetKeepAlive(true)
+	tcp.SetKeepAlivePeriod(time.Duration(seconds) * time.Second)
+}
+
+// Turns away a connection over maxclients, the error is written straight away since the client never gets a writer
+func (s *Server) RejectConnection(conn net.Conn) {
+	s.Stats.RejectedConnections.Add(1)
+	conn.Write([]byte("-ERR max number of clients reached\r\n"))
+	conn.Close()
+}
+
+// Closes clients idle for longer than timeout once a second, blocked, paused and subscribed clients are left alone
+func (s *Server) ClientsCron() {
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-s.done:
+			return
+		case <-ticker.C:
+		}
+
+		timeout := time.Duration(s.Config.GetInt("timeout")) * time.Second
+		if timeout == 0 {
+			continue
+		}
+		if mode, _ := s.Handler.Pause.State(); mode != PauseOff {
+			continue
+		}
+		for _, c := range s.Clients.All() {
+			if c.BlockingWaiter() != nil || c.subscribed.Load() || c.Describe().Idle <= timeout {
+				continue
+			}
+			slog.Debug("Closing idle client", "id", c.ID, "addr", c.Conn.RemoteAddr().String())
+			c.Kill()
+		}
+	}
+}
@@ -0,0 +1,128 @@
+package redisclone
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParseOutputBufferLimits(t *testing.T) {
+	tests := []struct {
+		raw  string
+		want map[string]OutputBufferLimit
+		err  string
+	}{
+		{raw: "", want: map[string]OutputBufferLimit{}},
+		{raw: "normal 0 0 0", want: map[string]OutputBufferLimit{"normal": {}}},
+		{raw: "pubsub 32mb 8mb 60", want: map[string]OutputBufferLimit{"pubsub": {Hard: 32 << 20, Soft: 8 << 20, SoftSeconds: 60}}},
+		{raw: "replica 1gb 0 0 NORMAL 10 5 1", want: map[string]OutputBufferLimit{"slave": {Hard: 1 << 30}, "normal": {Hard: 10, Soft: 5, SoftSeconds: 1}}},
+		{raw: "normal 0 0", err: "Wrong number of arguments in buffer limit configuration."},
+		{raw: "monitor 0 0 0", err: "Invalid client class specified in buffer limit configuration."},
+		{raw: "normal 1x 0 0", err: "Error in hard, soft or soft_seconds setting in buffer limit configuration."},
+		{raw: "normal 0 0 -1", err: "Error in hard, soft or soft_seconds setting in buffer limit configuration."},
+	}
+
+	for _, tt := range tests {
+		got, err := ParseOutputBufferLimits(tt.raw)
+		if tt.err != "" {
+			if err == nil || err.Error() != tt.err {
+				t.Errorf("%q: got error %v, want %q", tt.raw, err, tt.err)
+			}
+			continue
+		}
+		if err != nil || len(got) != len(tt.want) {
+			t.Errorf("%q: got %v, %v, want %v", tt.raw, got, err, tt.want)
+			continue
+		}
+		for class, limit := range tt.want {
+			if got[class] != limit {
+				t.Errorf("%q: got %v for %s, want %v", tt.raw, got[class], class, limit)
+			}
+		}
+	}
+}
+
+func TestMergeOutputBufferLimits(t *testing.T) {
+	tests := []struct {
+		previous string
+		raw      string
+		want     string
+	}{
+		{previous: DefaultOutputBufferLimits, raw: "pubsub 1mb 0 0", want: "normal 0 0 0 slave 268435456 67108864 60 pubsub 1048576 0 0"},
+		{previous: DefaultOutputBufferLimits, raw: "normal 10 5 1 replica 1 1 1", want: "normal 10 5 1 slave 1 1 1 pubsub 33554432 8388608 60"},
+		{previous: "broken", raw: "normal 10 0 0", want: "normal 10 0 0 slave 268435456 67108864 60 pubsub 33554432 8388608 60"},
+		// invalid input is left for the validator to reject
+		{previous: DefaultOutputBufferLimits, raw: "normal 1", want: "normal 1"},
+	}
+
+	for _, tt := range tests {
+		if got := MergeOutputBufferLimits(tt.previous, tt.raw); got != tt.want {
+			t.Errorf("MergeOutputBufferLimits(%q, %q) = %q, want %q", tt.previous, tt.raw, got, tt.want)
+		}
+	}
+}
+
+func TestMaxClients(t *testing.T) {
+	s := startServer(t, "maxclients 2")
+	c := dial(t, s.Addr())
+	other := dial(t, s.Addr())
+	expectReply(t, other.Do("PING"), "PONG")
+
+	rejected := dial(t, s.Addr())
+	expectReply(t, rejected.Read(), replyError("ERR max number of clients reached"))
+	if _, err := readReply(rejected.r); err == nil {
+		t.Fatal("the rejected connection is still open")
+	}
+	if info := c.Do("INFO", "stats").(string); !strings.Contains(info, "rejected_connections:1\r\n") {
+		t.Fatalf("unexpected stats %q", info)
+	}
+
+	// a freed slot can be taken again, and the limit can be raised at runtime
+	other.conn.Close()
+	waitFor(t, func() bool { return strings.Contains(c.Do("INFO", "clients").(string), "connected_clients:1\r\n") })
+	expectReply(t, dial(t, s.Addr()).Do("PING"), "PONG")
+	expectReply(t, c.Do("CONFIG", "SET", "maxclients", "3"), "OK")
+	expectReply(t, dial(t, s.Addr()).Do("PING"), "PONG")
+}
+
+func TestIdleTimeout(t *testing.T) {
+	s := startServer(t, "timeout 1")
+	idle, blocked, sub := dial(t, s.Addr()), dial(t, s.Addr()), dial(t, s.Addr())
+	expectReply(t, idle.Do("PING"), "PONG")
+	expectReply(t, sub.Do("SUBSCRIBE", "ch"), []any{"subscribe", "ch", int64(1)})
+	blocked.Send("BLPOP", "l", "0")
+
+	start := time.Now()
+	if _, err := readReply(idle.r); err == nil {
+		t.Fatal("the idle client got a reply instead of being closed")
+	}
+	if elapsed := time.Since(start); elapsed < 500*time.Millisecond {
+		t.Fatalf("the idle client was closed after only %v", elapsed)
+	}
+
+	// blocked and subscribed clients outlive the timeout
+	time.Sleep(time.Second)
+	c := dial(t, s.Addr())
+	expectReply(t, c.Do("RPUSH", "l", "a"), int64(1))
+	expectReply(t, blocked.Read(), []any{"l", "a"})
+	expectReply(t, c.Do("PUBLISH", "ch", "m"), int64(1))
+	expectReply(t, sub.Read(), []any{"message", "ch", "m"})
+}
+
+func TestOutputBufferLimit(t *testing.T) {
+	s := startServer(t, "client-output-buffer-limit pubsub 64kb 0 0")
+	c, sub := dial(t, s.Addr()), dial(t, s.Addr())
+	expectReply(t, sub.Do("SUBSCRIBE", "ch"), []any{"subscribe", "ch", int64(1)})
+
+	// the subscriber never reads, so once the socket buffers fill up its replies pile up in the server
+	message := strings.Repeat("x", 64<<10)
+	for i := 0; c.Do("PUBLISH", "ch", message) == int64(1); i++ {
+		if i == 10000 {
+			t.Fatal("the subscriber wasn't disconnected")
+		}
+	}
+	if info := c.Do("INFO", "stats").(string); !strings.Contains(info, "client_output_buffer_limit_disconnections:1\r\n") {
+		t.Fatalf("unexpected stats %q", info)
+	}
+	expectReply(t, c.Do("PUBSUB", "NUMSUB", "ch"), []any{"ch", int64(0)})
+}
@@ -1,4 +1,4 @@
-package main
+package redisclone
 
 import (
 	"container/list"
@@ -68,8 +68,25 @@ type BlockedPopQueueItem struct {
 }
 
 type Waiter struct {
+	DB              int // database the waiter is queued in
 	ResponseChan    chan ([][]byte)
+	UnblockChan     chan (error)
 	PopType         string
+	Keys            []string
+	Blocked         bool
 	Satisfied       bool
 	CleanUpPointers map[string]*list.Element
+	OnBlock         func() // called without the store lock once the waiter is queued, right before it starts waiting
+}
+
+// Both channels are buffered so whoever satisfies the waiter (a push, CLIENT UNBLOCK) never blocks while holding the store lock
+func NewWaiter(db int, popType string, keys []string) *Waiter {
+	return &Waiter{
+		DB:              db,
+		ResponseChan:    make(chan ([][]byte), 1),
+		UnblockChan:     make(chan (error), 1),
+		PopType:         popType,
+		Keys:            keys,
+		CleanUpPointers: make(map[string]*list.Element),
+	}
 }
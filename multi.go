@@ -0,0 +1,188 @@
+package redisclone
+
+import (
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// Commands queued by a client between MULTI and EXEC
+type MultiState struct {
+	Queued     []Command
+	Dirty      bool // a queued command failed validation, so EXEC must abort
+	Executing  bool // set while EXEC runs the queue, blocking commands must not block then
+	Subscribed bool // a queued command subscribed, so EXEC queues its reply before releasing the exec lock
+}
+
+// Keys a client watches for optimistic locking, Keys is only touched by the client's own goroutine
+type WatchState struct {
+	Keys  map[WatchedKey]time.Time // watched key to the expiry it had when watched, zero if none
+	Dirty atomic.Bool              // set by the store as soon as any watched key is touched
+}
+
+type WatchedKey struct {
+	DB  int
+	Key string
+}
+
+func NewWatchState() *WatchState {
+	return &WatchState{Keys: make(map[WatchedKey]time.Time)}
+}
+
+// True when a watched key was modified, deleted or expired since it was watched
+func (w *WatchState) IsDirty() bool {
+	if w.Dirty.Load() {
+		return true
+	}
+	now := time.Now()
+	for _, expiresAt := range w.Keys {
+		if !expiresAt.IsZero() && now.After(expiresAt) {
+			return true
+		}
+	}
+	return false
+}
+
+// Forgets every watched key, in whichever database it was watched
+func (h *Handler) Unwatch(w *WatchState) {
+	dbs := make(map[int]struct{})
+	for watched := range w.Keys {
+		dbs[watched.DB] = struct{}{}
+	}
+	for db := range dbs {
+		h.Databases[db].Unwatch(w)
+	}
+	clear(w.Keys)
+	w.Dirty.Store(false)
+}
+
+// Commands that act on the transaction (or the whole connection) instead of being queued
+func IsTransactionControlCommand(name string) bool {
+	switch strings.ToUpper(name) {
+	case "MULTI", "EXEC", "DISCARD", "WATCH", "RESET", "QUIT":
+		return true
+	}
+	return false
+}
+
+// Validates a command sent inside MULTI and queues it, failures mark the transaction dirty
+func (s *Server) QueueCommand(c *Client, cmd Command) []byte {
+	rc, errReply := s.Handler.ResolveCommand(cmd)
+	if errReply == nil && rc.HasFlag(FlagNoMulti) {
+		errReply = s.Handler.Encoder.GenerateSimpleError("ERR Command not allowed inside a transaction")
+	}
+	if errReply == nil {
+		errReply = s.Handler.CheckPermissions(c, rc, cmd, ACLContextMulti)
+	}
+	if errReply != nil {
+		c.Multi.Dirty = true
+		return errReply
+	}
+
+	cmd.Name = strings.ToUpper(cmd.Name)
+	c.Multi.Queued = append(c.Multi.Queued, cmd)
+	return s.Handler.Encoder.GenerateSimpleString([]byte("QUEUED"))
+}
+
+// Transaction Commands
+func (s *Server) HandleMultiCommand(c *Client, cmd Command) []byte {
+	if c.Multi != nil {
+		return s.Handler.Encoder.GenerateSimpleError("ERR MULTI calls can not be nested")
+	}
+	c.Multi = &MultiState{}
+	return s.Handler.Encoder.GetSimpleStringOk()
+}
+
+func (s *Server) HandleDiscardCommand(c *Client, cmd Command) []byte {
+	if c.Multi == nil {
+		return s.Handler.Encoder.GenerateSimpleError("ERR DISCARD without MULTI")
+	}
+	c.Multi = nil
+	s.Handler.Unwatch(c.Watch)
+	return s.Handler.Encoder.GetSimpleStringOk()
+}
+
+func (s *Server) HandleWatchCommand(c *Client, cmd Command) []byte {
+	if c.Multi != nil {
+		return s.Handler.Encoder.GenerateSimpleError("ERR WATCH inside MULTI is not allowed")
+	}
+	for _, key := range cmd.Args {
+		s.Handler.DB(c).Watch(c.Watch, string(key))
+	}
+	return s.Handler.Encoder.GetSimpleStringOk()
+}
+
+func (s *Server) HandleUnwatchCommand(c *Client, cmd Command) []byte {
+	s.Handler.Unwatch(c.Watch)
+	return s.Handler.Encoder.GetSimpleStringOk()
+}
+
+// Runs the queue with the exec lock held exclusively (see RedisCommand.Exclusive), so no other client's command interleaves with it
+func (s *Server) HandleExecCommand(c *Client, cmd Command) []byte {
+	multi := c.Multi
+	if multi == nil {
+		return s.Handler.Encoder.GenerateSimpleError("ERR EXEC without MULTI")
+	}
+	c.Multi = nil
+	if multi.Dirty {
+		s.Handler.Unwatch(c.Watch)
+		return s.Handler.Encoder.GenerateSimpleError("EXECABORT Transaction discarded because of previous errors.")
+	}
+
+	// checked under the exec lock so no other command can touch a watched key before the queue runs
+	dirty := c.Watch.IsDirty()
+	s.Handler.Unwatch(c.Watch)
+	if dirty {
+		return s.Handler.Encoder.GetNullArray(c.Protocol)
+	}
+
+	multi.Executing = true
+	c.Multi = multi
+	defer func() { c.Multi = nil }()
+
+	replies := make([][]byte, 0, len(multi.Queued))
+	for _, queued := range multi.Queued {
+		replies = append(replies, s.CallCommand(c, queued))
+	}
+	reply := s.Handler.Encoder.GenerateRawArray(replies)
+	if multi.Subscribed {
+		// queued while the exec lock is still held, so no message on a new subscription can get ahead of the confirmation
+		c.Write(reply)
+		return nil
+	}
+	return reply
+}
+
+// Runs a command on behalf of EXEC or a script, the caller already holds the exec lock.
+// A panic becomes the command's reply so the rest of the transaction or script still runs.
+func (s *Server) CallCommand(c *Client, cmd Command) (reply []byte) {
+	defer func() {
+		if len(reply) > 0 && reply[0] == '-' {
+			s.Stats.RecordErrorReply(reply)
+		}
+	}()
+	defer s.RecoverCommandPanic(c, cmd, &reply)
+
+	s.Stats.TotalCommandsProcessed.Add(1)
+	rc, errReply := s.Handler.ResolveCommand(cmd)
+	if errReply != nil {
+		return errReply
+	}
+	// permissions may have changed since the command was queued
+	context := ACLContextMulti
+	if c.Script {
+		context = ACLContextLua
+	}
+	if errReply := s.Handler.CheckPermissions(c, rc, cmd, context); errReply != nil {
+		return errReply
+	}
+	reply = rc.Proc(c, cmd)
+	s.Handler.TrackCommand(c, rc, cmd, reply)
+	s.Handler.RecordDirty(rc, reply)
+	return reply
+}
+
+// True while EXEC is running the client's queued commands
+func (c *Client) InExec() bool {
+	return c.Multi != nil && c.Multi.Executing
+}
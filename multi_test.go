@@ -0,0 +1,172 @@
+package redisclone
+
+import (
+	"testing"
+	"time"
+)
+
+func TestMultiExec(t *testing.T) {
+	s := startServer(t)
+	c := dial(t, s.Addr())
+
+	expectReply(t, c.Do("MULTI"), "OK")
+	expectReply(t, c.Do("SET", "k", "v"), "QUEUED")
+	expectReply(t, c.Do("RPUSH", "list", "a"), "QUEUED")
+	expectReply(t, c.Do("GET", "list"), "QUEUED")
+	expectReply(t, c.Do("GET", "k"), "QUEUED")
+	// BLPOP doesn't block inside a transaction
+	expectReply(t, c.Do("BLPOP", "empty", "0"), "QUEUED")
+	expectReply(t, c.Do("EXEC"), []any{
+		"OK",
+		int64(1),
+		replyError("WRONGTYPE Operation against a key holding the wrong kind of value"),
+		"v",
+		nil,
+	})
+
+	expectReply(t, c.Do("MULTI"), "OK")
+	expectReply(t, c.Do("SET", "k", "discarded"), "QUEUED")
+	expectReply(t, c.Do("DISCARD"), "OK")
+	expectReply(t, c.Do("GET", "k"), "v")
+
+	expectReply(t, c.Do("MULTI"), "OK")
+	expectReply(t, c.Do("EXEC"), []any{})
+}
+
+func TestMultiErrors(t *testing.T) {
+	tests := []struct {
+		name   string
+		args   []string
+		reply  any
+		aborts bool // only errors while queueing abort the transaction, misplaced MULTI and WATCH don't
+	}{
+		{name: "unknown command", args: []string{"NOPE"}, reply: replyError("ERR unknown command 'NOPE', with args beginning with: "), aborts: true},
+		{name: "wrong arity", args: []string{"GET"}, reply: replyError("ERR wrong number of arguments for 'get' command"), aborts: true},
+		{name: "not allowed", args: []string{"SAVE"}, reply: replyError("ERR Command not allowed inside a transaction"), aborts: true},
+		{name: "nested multi", args: []string{"MULTI"}, reply: replyError("ERR MULTI calls can not be nested")},
+		{name: "watch inside multi", args: []string{"WATCH", "k"}, reply: replyError("ERR WATCH inside MULTI is not allowed")},
+	}
+
+	s := startServer(t)
+	c := dial(t, s.Addr())
+	expectReply(t, c.Do("EXEC"), replyError("ERR EXEC without MULTI"))
+	expectReply(t, c.Do("DISCARD"), replyError("ERR DISCARD without MULTI"))
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			expectReply(t, c.Do("MULTI"), "OK")
+			expectReply(t, c.Do("SET", "k", tt.name), "QUEUED")
+			expectReply(t, c.Do(tt.args...), tt.reply)
+			if !tt.aborts {
+				expectReply(t, c.Do("EXEC"), []any{"OK"})
+				return
+			}
+			expectReply(t, c.Do("EXEC"), replyError("EXECABORT Transaction discarded because of previous errors."))
+			if got := c.Do("GET", "k"); got == tt.name {
+				t.Fatal("an aborted transaction ran its commands")
+			}
+		})
+	}
+}
+
+func TestExecServesBlockedClientsAfterwards(t *testing.T) {
+	s := startServer(t)
+	c, blocked := dial(t, s.Addr()), dial(t, s.Addr())
+
+	blocked.Send("BLPOP", "q", "0")
+	waitForBlockedClients(t, c, 1)
+
+	// the blocked client sees the list as EXEC left it, not the element pushed first
+	expectReply(t, c.Do("MULTI"), "OK")
+	expectReply(t, c.Do("RPUSH", "q", "x"), "QUEUED")
+	expectReply(t, c.Do("LPUSH", "q", "y"), "QUEUED")
+	expectReply(t, c.Do("EXEC"), []any{int64(1), int64(2)})
+	expectReply(t, blocked.Read(), []any{"q", "y"})
+	expectReply(t, c.Do("LRANGE", "q", "0", "-1"), []any{"x"})
+
+	// an element pushed and popped within the same transaction is never handed off
+	blocked.Send("BLPOP", "q2", "0")
+	waitForBlockedClients(t, c, 1)
+	expectReply(t, c.Do("MULTI"), "OK")
+	expectReply(t, c.Do("RPUSH", "q2", "x"), "QUEUED")
+	expectReply(t, c.Do("LPOP", "q2"), "QUEUED")
+	expectReply(t, c.Do("EXEC"), []any{int64(1), "x"})
+	expectReply(t, c.Do("RPUSH", "q2", "z"), int64(1))
+	expectReply(t, blocked.Read(), []any{"q2", "z"})
+}
+
+func TestBlockingPopWaitsForScripts(t *testing.T) {
+	s := startServer(t)
+	c, popper := dial(t, s.Addr()), dial(t, s.Addr())
+
+	// the element only exists while the script runs, a blocking pop must never see it
+	script := "redis.call('RPUSH', KEYS[1], 'a') local n = 0 for i = 1, 1000000 do n = n + i end return redis.call('LPOP', KEYS[1])"
+	c.Send("EVAL", script, "1", "q")
+	time.Sleep(20 * time.Millisecond)
+	popper.Send("BLPOP", "q", "0.2")
+
+	expectReply(t, c.Read(), "a")
+	expectReply(t, popper.Read(), nil)
+}
+
+func TestWatch(t *testing.T) {
+	tests := []struct {
+		name   string
+		setup  [][]string
+		modify [][]string
+		abort  bool
+	}{
+		{name: "untouched", setup: [][]string{{"SET", "k", "1"}}, abort: false},
+		{name: "set", modify: [][]string{{"SET", "k", "2"}}, abort: true},
+		{name: "list push", modify: [][]string{{"RPUSH", "k", "a"}}, abort: true},
+		{name: "list pop", setup: [][]string{{"RPUSH", "k", "a"}}, modify: [][]string{{"LPOP", "k"}}, abort: true},
+		{name: "flushdb", setup: [][]string{{"SET", "k", "1"}}, modify: [][]string{{"FLUSHDB"}}, abort: true},
+		{name: "flushdb of a missing key", modify: [][]string{{"FLUSHDB"}}, abort: false},
+		{name: "move", setup: [][]string{{"SET", "k", "1"}}, modify: [][]string{{"MOVE", "k", "1"}}, abort: true},
+		{name: "swapdb", setup: [][]string{{"SELECT", "1"}, {"SET", "k", "1"}, {"SELECT", "0"}}, modify: [][]string{{"SWAPDB", "0", "1"}}, abort: true},
+		{name: "other key", modify: [][]string{{"SET", "other", "1"}}, abort: false},
+		{name: "other database", modify: [][]string{{"SELECT", "2"}, {"SET", "k", "1"}}, abort: false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := startServer(t)
+			c, other := dial(t, s.Addr()), dial(t, s.Addr())
+			for _, args := range tt.setup {
+				c.Do(args...)
+			}
+
+			expectReply(t, c.Do("WATCH", "k"), "OK")
+			for _, args := range tt.modify {
+				other.Do(args...)
+			}
+			expectReply(t, c.Do("MULTI"), "OK")
+			expectReply(t, c.Do("SET", "done", "1"), "QUEUED")
+			if tt.abort {
+				expectReply(t, c.Do("EXEC"), nil)
+			} else {
+				expectReply(t, c.Do("EXEC"), []any{"OK"})
+			}
+		})
+	}
+}
+
+func TestWatchIsClearedAfterExec(t *testing.T) {
+	s := startServer(t)
+	c, other := dial(t, s.Addr()), dial(t, s.Addr())
+
+	for _, end := range [][]string{{"EXEC"}, {"DISCARD"}, {"UNWATCH"}} {
+		expectReply(t, c.Do("WATCH", "k"), "OK")
+		if end[0] == "UNWATCH" {
+			expectReply(t, c.Do("UNWATCH"), "OK")
+		} else {
+			expectReply(t, c.Do("MULTI"), "OK")
+			c.Do(end...)
+		}
+		expectReply(t, other.Do("SET", "k", end[0]), "OK")
+
+		expectReply(t, c.Do("MULTI"), "OK")
+		expectReply(t, c.Do("GET", "k"), "QUEUED")
+		expectReply(t, c.Do("EXEC"), []any{end[0]})
+	}
+}
@@ -0,0 +1,93 @@
+package redisclone
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// Keyspace event classes, as selected by the characters of notify-keyspace-events
+const (
+	NotifyKeyspace = 1 << iota // K, published to __keyspace@<db>__:<key>
+	NotifyKeyevent             // E, published to __keyevent@<db>__:<event>
+	NotifyGeneric              // g, type independent commands like DEL or EXPIRE
+	NotifyString               // $
+	NotifyList                 // l
+	NotifySet                  // s
+	NotifyHash                 // h
+	NotifyZSet                 // z
+	NotifyExpired              // x
+	NotifyEvicted              // e
+	NotifyStream               // t
+	NotifyKeyMiss              // m, excluded from A
+	NotifyModule               // d
+	NotifyNew                  // n, excluded from A
+
+	NotifyAll = NotifyGeneric | NotifyString | NotifyList | NotifySet | NotifyHash | NotifyZSet | NotifyExpired | NotifyEvicted | NotifyStream | NotifyModule
+)
+
+var keyspaceEventFlags = []struct {
+	char  byte
+	class int
+}{
+	{'g', NotifyGeneric}, {'$', NotifyString}, {'l', NotifyList}, {'s', NotifySet}, {'h', NotifyHash}, {'z', NotifyZSet},
+	{'x', NotifyExpired}, {'e', NotifyEvicted}, {'t', NotifyStream}, {'d', NotifyModule},
+	{'K', NotifyKeyspace}, {'E', NotifyKeyevent}, {'m', NotifyKeyMiss}, {'n', NotifyNew},
+}
+
+// Parses the notify-keyspace-events value, classes are only enabled when K or E picks a channel type
+func ParseKeyspaceEvents(raw string) (int, error) {
+	flags := 0
+outer:
+	for i := 0; i < len(raw); i++ {
+		if raw[i] == 'A' {
+			flags |= NotifyAll
+			continue
+		}
+		for _, f := range keyspaceEventFlags {
+			if f.char == raw[i] {
+				flags |= f.class
+				continue outer
+			}
+		}
+		return 0, errors.New("Invalid event class character. Use 'Ag$lshzxeKEtmdn'.")
+	}
+	return flags, nil
+}
+
+func ValidateKeyspaceEvents(v ConfigValue) error {
+	_, err := ParseKeyspaceEvents(v.Raw)
+	return err
+}
+
+// Config hook for notify-keyspace-events, events are raised with a store lock held so they only read the parsed flags
+func (h *Handler) ApplyKeyspaceEvents(v ConfigValue) error {
+	flags, err := ParseKeyspaceEvents(v.Raw)
+	if err != nil {
+		return err
+	}
+	h.keyspaceEvents.Store(int64(flags))
+	return nil
+}
+
+// Publishes the keyspace and keyevent messages for a key modification if its class is enabled
+func (h *Handler) NotifyKeyspaceEvent(db, class int, event, key string) {
+	flags := int(h.keyspaceEvents.Load())
+	if flags&class == 0 {
+		return
+	}
+
+	if flags&NotifyKeyspace != 0 {
+		h.Publish(fmt.Sprintf("__keyspace@%d__:%s", db, key), []byte(event))
+	}
+	if flags&NotifyKeyevent != 0 {
+		h.Publish(fmt.Sprintf("__keyevent@%d__:%s", db, event), []byte(key))
+	}
+}
+
+// Note: This function is unsafe, it should only ever be called by a function who holds a lock
+func (s *Store) NotifyKeyspaceEvent(class int, event, key string) {
+	if s.Notify != nil {
+		s.Notify(s.id, class, strings.ToLower(event), key)
+	}
+}
@@ -0,0 +1,112 @@
+package redisclone
+
+import "testing"
+
+func TestParseKeyspaceEvents(t *testing.T) {
+	tests := []struct {
+		raw  string
+		want int
+		err  bool
+	}{
+		{raw: "", want: 0},
+		{raw: "KEA", want: NotifyKeyspace | NotifyKeyevent | NotifyAll},
+		{raw: "El", want: NotifyKeyevent | NotifyList},
+		{raw: "K$g", want: NotifyKeyspace | NotifyString | NotifyGeneric},
+		{raw: "Am", want: NotifyAll | NotifyKeyMiss},
+		{raw: "En", want: NotifyKeyevent | NotifyNew},
+		{raw: "KEQ", err: true},
+		{raw: "a", err: true},
+	}
+
+	for _, tt := range tests {
+		got, err := ParseKeyspaceEvents(tt.raw)
+		if (err != nil) != tt.err || got != tt.want {
+			t.Errorf("ParseKeyspaceEvents(%q) = %b, %v, want %b, error %v", tt.raw, got, err, tt.want, tt.err)
+		}
+	}
+	if NotifyAll&(NotifyKeyMiss|NotifyNew) != 0 {
+		t.Error("A must not include key miss and new key events")
+	}
+}
+
+func TestKeyspaceNotifications(t *testing.T) {
+	tests := []struct {
+		name   string
+		events string
+		cmds   [][]string
+		want   [][2]string // channel and message, in order
+	}{
+		{
+			name:   "disabled",
+			events: `""`,
+			cmds:   [][]string{{"SET", "k", "v"}},
+		},
+		{
+			name:   "string events on both channels",
+			events: "KEA",
+			cmds:   [][]string{{"SET", "k", "v", "EX", "100"}},
+			want: [][2]string{
+				{"__keyspace@0__:k", "set"}, {"__keyevent@0__:set", "k"},
+				{"__keyspace@0__:k", "expire"}, {"__keyevent@0__:expire", "k"},
+			},
+		},
+		{
+			name:   "list events, the last pop deletes the key",
+			events: "Kgl",
+			cmds:   [][]string{{"RPUSH", "l", "a"}, {"LPOP", "l"}},
+			want:   [][2]string{{"__keyspace@0__:l", "rpush"}, {"__keyspace@0__:l", "lpop"}, {"__keyspace@0__:l", "del"}},
+		},
+		{
+			name:   "only the selected class",
+			events: "El",
+			cmds:   [][]string{{"SET", "k", "v"}, {"RPUSH", "l", "a"}},
+			want:   [][2]string{{"__keyevent@0__:rpush", "l"}},
+		},
+		{
+			name:   "new keys",
+			events: "En",
+			cmds:   [][]string{{"SET", "k", "v"}, {"SET", "k", "w"}},
+			want:   [][2]string{{"__keyevent@0__:new", "k"}},
+		},
+		{
+			name:   "move between databases",
+			events: "Eg",
+			cmds:   [][]string{{"SET", "k", "v"}, {"MOVE", "k", "3"}},
+			want:   [][2]string{{"__keyevent@0__:move_from", "k"}, {"__keyevent@3__:move_to", "k"}},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := startServer(t, "notify-keyspace-events "+tt.events)
+			c, sub := dial(t, s.Addr()), dial(t, s.Addr())
+			expectReply(t, sub.Do("PSUBSCRIBE", "__key*__:*"), []any{"psubscribe", "__key*__:*", int64(1)})
+
+			for _, args := range tt.cmds {
+				c.Do(args...)
+			}
+			// the marker shows no other event was published in between
+			c.Do("PUBLISH", "__keyspace@0__:end", "marker")
+			for _, want := range append(tt.want, [2]string{"__keyspace@0__:end", "marker"}) {
+				expectReply(t, sub.Read(), []any{"pmessage", "__key*__:*", want[0], want[1]})
+			}
+		})
+	}
+}
+
+func TestKeyspaceEventsConfigSet(t *testing.T) {
+	s := startServer(t)
+	c, sub := dial(t, s.Addr()), dial(t, s.Addr())
+	expectReply(t, sub.Do("SUBSCRIBE", "__keyevent@0__:set"), []any{"subscribe", "__keyevent@0__:set", int64(1)})
+
+	expectReply(t, c.Do("SET", "k", "v"), "OK")
+	expectReply(t, c.Do("CONFIG", "SET", "notify-keyspace-events", "E$"), "OK")
+	expectReply(t, c.Do("CONFIG", "SET", "notify-keyspace-events", "Q"), replyError("ERR CONFIG SET failed (possibly related to argument 'notify-keyspace-events') - Invalid event class character. Use 'Ag$lshzxeKEtmdn'."))
+	expectReply(t, c.Do("SET", "k", "w"), "OK")
+	// only the SET after the change is published, and the rejected value left it in place
+	expectReply(t, sub.Read(), []any{"message", "__keyevent@0__:set", "k"})
+	expectReply(t, c.Do("CONFIG", "SET", "notify-keyspace-events", ""), "OK")
+	expectReply(t, c.Do("SET", "k", "x"), "OK")
+	expectReply(t, c.Do("PUBLISH", "__keyevent@0__:set", "marker"), int64(1))
+	expectReply(t, sub.Read(), []any{"message", "__keyevent@0__:set", "marker"})
+}
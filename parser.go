@@ -1,71 +1,254 @@
-package main
+package redisclone
 
-import "strconv"
+import (
+	"bytes"
+	"fmt"
+	"math"
+	"strconv"
+)
+
+const (
+	DefaultProtoMaxMultibulkLen = math.MaxInt32
+	ProtoInlineMaxSize          = 64 * 1024 // longest *<count> or $<len> line we are willing to buffer
+	QueryBufInitialSize         = 4096
+)
 
 type Command struct {
 	Name string
 	Args [][]byte
 }
-type Parser struct{}
+
+// Request size limits come from proto-max-bulk-len and proto-max-multibulk-len
+type Parser struct {
+	Config *Config
+}
+
+// Returned for malformed requests, the connection can't be resynchronized afterwards so it must be closed
+type ProtocolError struct {
+	Msg string
+}
+
+func (e ProtocolError) Error() string {
+	return "ERR Protocol error: " + e.Msg
+}
+
+func NewParser(cfg *Config) Parser {
+	return Parser{Config: cfg}
+}
 
 func (p Parser) ReadLine(buf []byte) ([]byte, int, bool) {
-	var line []byte
-	for i, v := range buf {
-		if v == '\r' && (i+1) < len(buf) && buf[i+1] == '\n' { // delimiter found...
-			line = buf[:i]           //extract chunk of slice up to but not including delimter
-			return line, i + 2, true //TODO may need to return i + 1 not i + 2!!!
-		}
+	i := bytes.Index(buf, []byte("\r\n"))
+	if i < 0 {
+		return nil, 0, false
 	}
-	return nil, 0, false
+	return buf[:i], i + 2, true
 }
 
-func (p Parser) TryParsingCommand(buf []byte) (Command, int, bool) {
+// Attempts to parse a single request (multibulk, or inline when buf doesn't start with '*') from the front of buf.
+// ok is false with a nil error when buf does not yet hold a complete request.
+// A request with a zero or negative count is consumed but yields a Command with an empty Name.
+func (p Parser) TryParsingCommand(buf []byte) (Command, int, bool, error) {
+	if len(buf) > 0 && buf[0] != '*' {
+		return p.TryParsingInlineCommand(buf)
+	}
+
 	var cmd Command
 	offset := 0
-	line, consumed, ok := p.ReadLine(buf[offset:])
+	line, consumed, ok := p.ReadLine(buf)
 	if !ok {
-		return Command{}, 0, false
+		if len(buf) > ProtoInlineMaxSize {
+			return Command{}, 0, false, ProtocolError{Msg: "too big mbulk count string"}
+		}
+		return Command{}, 0, false, nil
+	}
+	if len(line) == 0 || line[0] != '*' {
+		return Command{}, 0, false, ProtocolError{Msg: fmt.Sprintf("expected '*', got '%s'", p.FirstChar(line))}
 	}
 
+	cmdArrayLen, ok := p.ParseLength(line[1:])
+	if !ok || cmdArrayLen > p.Config.GetInt("proto-max-multibulk-len") {
+		return Command{}, 0, false, ProtocolError{Msg: "invalid multibulk length"}
+	}
 	offset += consumed
-	cmdArrayLen := p.ReadPrefixLength(line)
+	if cmdArrayLen <= 0 {
+		return Command{}, offset, true, nil
+	}
 
-	for i := 0; i < cmdArrayLen; i++ {
+	maxBulkLen := p.Config.GetInt("proto-max-bulk-len")
+	for i := int64(0); i < cmdArrayLen; i++ {
 		line, consumed, ok := p.ReadLine(buf[offset:])
 		if !ok {
-			return Command{}, 0, false
+			if len(buf[offset:]) > ProtoInlineMaxSize {
+				return Command{}, 0, false, ProtocolError{Msg: "too big bulk count string"}
+			}
+			return Command{}, 0, false, nil
+		}
+		if len(line) == 0 || line[0] != '$' {
+			return Command{}, 0, false, ProtocolError{Msg: fmt.Sprintf("expected '$', got '%s'", p.FirstChar(line))}
+		}
+
+		prefixLen, ok := p.ParseLength(line[1:])
+		if !ok || prefixLen < 0 || prefixLen > maxBulkLen {
+			return Command{}, 0, false, ProtocolError{Msg: "invalid bulk length"}
 		}
 		offset += consumed
-		prefixLen := p.ReadPrefixLength(line)
-		if len(buf[offset:]) < prefixLen+2 {
-			return Command{}, 0, false
+
+		// the payload is length prefixed, so it may itself contain \r\n
+		if int64(len(buf[offset:])) < prefixLen+2 {
+			return Command{}, 0, false, nil
 		}
 
-		bulkString := buf[offset : offset+prefixLen]
-		offset += prefixLen + 2
+		bulkString := buf[offset : offset+int(prefixLen)]
+		offset += int(prefixLen)
+		if buf[offset] != '\r' || buf[offset+1] != '\n' {
+			return Command{}, 0, false, ProtocolError{Msg: "expected CRLF after bulk data"}
+		}
+		offset += 2
 
 		if i == 0 {
 			cmd.Name = string(bulkString)
 		} else {
-			cmd.Args = append(cmd.Args, bulkString)
+			// copy out of the query buffer, args outlive it (e.g. values stored by SET) and the buffer gets compacted
+			cmd.Args = append(cmd.Args, bytes.Clone(bulkString))
 		}
 
 	}
-	return cmd, offset, true
+	return cmd, offset, true, nil
 }
 
-func (p Parser) ReadPrefixLength(b []byte) int {
+// Strictly parses a length prefix: an optional minus sign followed by digits only
+func (p Parser) ParseLength(b []byte) (int64, bool) {
+	if len(b) == 0 || b[0] == '+' {
+		return 0, false
+	}
 
-	var numElements int
-	multiplier := 1
+	n, err := strconv.ParseInt(string(b), 10, 64)
+	if err != nil {
+		return 0, false
+	}
+	return n, true
+}
+
+func (p Parser) FirstChar(line []byte) string {
+	if len(line) == 0 {
+		return "\\r"
+	}
+	return string(line[:1])
+}
 
-	for i := len(b) - 1; i >= 0; i-- {
-		digit, err := strconv.Atoi(string(b[i]))
-		if err != nil {
-			continue
+// Parses the inline protocol used by telnet and health checks: space separated words terminated by a newline
+func (p Parser) TryParsingInlineCommand(buf []byte) (Command, int, bool, error) {
+	i := bytes.IndexByte(buf, '\n')
+	if i < 0 {
+		if len(buf) > ProtoInlineMaxSize {
+			return Command{}, 0, false, ProtocolError{Msg: "too big inline request"}
 		}
-		numElements += (digit * multiplier)
-		multiplier *= 10
+		return Command{}, 0, false, nil
 	}
-	return numElements
+
+	line := bytes.TrimSuffix(buf[:i], []byte("\r"))
+	args, ok := SplitArgs(line)
+	if !ok {
+		return Command{}, 0, false, ProtocolError{Msg: "unbalanced quotes in request"}
+	}
+	if len(args) == 0 {
+		return Command{}, i + 1, true, nil
+	}
+
+	return Command{Name: string(args[0]), Args: args[1:]}, i + 1, true, nil
+}
+
+// Splits a line into arguments the way redis-cli and the inline protocol do, honouring
+// "double quoted" strings with \n \r \t \b \a \xHH escapes and 'single quoted' strings with \' escapes.
+// Returns false if the quotes are unbalanced or a closing quote isn't followed by a space.
+func SplitArgs(line []byte) ([][]byte, bool) {
+	var args [][]byte
+	i := 0
+	for {
+		for i < len(line) && IsSpace(line[i]) {
+			i++
+		}
+		if i == len(line) {
+			return args, true
+		}
+
+		current := []byte{}
+		inDoubleQuotes, inSingleQuotes, done := false, false, false
+		for !done {
+			if inDoubleQuotes {
+				switch {
+				case i == len(line):
+					return nil, false
+				case line[i] == '\\' && i+3 < len(line) && line[i+1] == 'x' && IsHexDigit(line[i+2]) && IsHexDigit(line[i+3]):
+					b, _ := strconv.ParseUint(string(line[i+2:i+4]), 16, 8)
+					current = append(current, byte(b))
+					i += 3
+				case line[i] == '\\' && i+1 < len(line):
+					i++
+					switch line[i] {
+					case 'n':
+						current = append(current, '\n')
+					case 'r':
+						current = append(current, '\r')
+					case 't':
+						current = append(current, '\t')
+					case 'b':
+						current = append(current, '\b')
+					case 'a':
+						current = append(current, '\a')
+					default:
+						current = append(current, line[i])
+					}
+				case line[i] == '"':
+					// closing quote must be followed by a space or nothing at all
+					if i+1 < len(line) && !IsSpace(line[i+1]) {
+						return nil, false
+					}
+					done = true
+				default:
+					current = append(current, line[i])
+				}
+			} else if inSingleQuotes {
+				switch {
+				case i == len(line):
+					return nil, false
+				case line[i] == '\\' && i+1 < len(line) && line[i+1] == '\'':
+					i++
+					current = append(current, '\'')
+				case line[i] == '\'':
+					if i+1 < len(line) && !IsSpace(line[i+1]) {
+						return nil, false
+					}
+					done = true
+				default:
+					current = append(current, line[i])
+				}
+			} else {
+				switch {
+				case i == len(line):
+					done = true
+				case IsSpace(line[i]):
+					done = true
+				case line[i] == '"':
+					inDoubleQuotes = true
+				case line[i] == '\'':
+					inSingleQuotes = true
+				default:
+					current = append(current, line[i])
+				}
+			}
+			if i < len(line) {
+				i++
+			}
+		}
+		args = append(args, current)
+	}
+}
+
+func IsSpace(b byte) bool {
+	return b == ' ' || b == '\t' || b == '\n' || b == '\r' || b == '\v' || b == '\f'
+}
+
+func IsHexDigit(b byte) bool {
+	return (b >= '0' && b <= '9') || (b >= 'a' && b <= 'f') || (b >= 'A' && b <= 'F')
 }
@@ -0,0 +1,154 @@
+package redisclone
+
+import (
+	"errors"
+	"slices"
+	"strings"
+	"testing"
+)
+
+func TestTryParsingCommand(t *testing.T) {
+	tests := []struct {
+		name     string
+		input    string
+		want     Command
+		consumed int
+		ok       bool
+		err      string
+	}{
+		{name: "complete", input: "*2\r\n$3\r\nGET\r\n$1\r\nk\r\n", want: Command{Name: "GET", Args: [][]byte{[]byte("k")}}, consumed: 20, ok: true},
+		{name: "no args", input: "*1\r\n$4\r\nPING\r\n", want: Command{Name: "PING"}, consumed: 14, ok: true},
+		{name: "payload with crlf", input: "*2\r\n$4\r\nECHO\r\n$4\r\na\r\nb\r\n", want: Command{Name: "ECHO", Args: [][]byte{[]byte("a\r\nb")}}, consumed: 24, ok: true},
+		{name: "empty bulk", input: "*2\r\n$4\r\nECHO\r\n$0\r\n\r\n", want: Command{Name: "ECHO", Args: [][]byte{{}}}, consumed: 20, ok: true},
+		{name: "only the first of two", input: "*1\r\n$4\r\nPING\r\n*1\r\n$4\r\nPING\r\n", want: Command{Name: "PING"}, consumed: 14, ok: true},
+		{name: "zero count", input: "*0\r\n", consumed: 4, ok: true},
+		{name: "negative count", input: "*-1\r\n", consumed: 5, ok: true},
+		{name: "empty buffer", input: ""},
+		{name: "partial count line", input: "*2\r"},
+		{name: "partial bulk length", input: "*2\r\n$3\r\nGET\r\n$1"},
+		{name: "partial payload", input: "*2\r\n$3\r\nGET\r\n$5\r\nab"},
+		{name: "missing final crlf", input: "*1\r\n$4\r\nPING"},
+		{name: "bad count", input: "*x\r\n", err: "invalid multibulk length"},
+		{name: "plus sign count", input: "*+1\r\n", err: "invalid multibulk length"},
+		{name: "missing dollar", input: "*1\r\n:4\r\nPING\r\n", err: "expected '$', got ':'"},
+		{name: "negative bulk length", input: "*1\r\n$-1\r\n", err: "invalid bulk length"},
+		{name: "bulk longer than declared", input: "*1\r\n$3\r\nPING\r\n", err: "expected CRLF after bulk data"},
+		{name: "oversized count line", input: "*" + strings.Repeat("1", ProtoInlineMaxSize+1), err: "too big mbulk count string"},
+	}
+
+	p := NewParser(NewConfig())
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cmd, consumed, ok, err := p.TryParsingCommand([]byte(tt.input))
+			if tt.err != "" {
+				var perr ProtocolError
+				if !errors.As(err, &perr) || perr.Msg != tt.err {
+					t.Fatalf("got error %v, want protocol error %q", err, tt.err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if ok != tt.ok || consumed != tt.consumed {
+				t.Fatalf("got ok=%v consumed=%d, want ok=%v consumed=%d", ok, consumed, tt.ok, tt.consumed)
+			}
+			if cmd.Name != tt.want.Name || !slices.EqualFunc(cmd.Args, tt.want.Args, slices.Equal) {
+				t.Fatalf("got %q %q, want %q %q", cmd.Name, cmd.Args, tt.want.Name, tt.want.Args)
+			}
+		})
+	}
+}
+
+func TestTryParsingCommandLimits(t *testing.T) {
+	cfg := NewConfig()
+	if err := cfg.LoadString("proto-max-multibulk-len 2"); err != nil {
+		t.Fatal(err)
+	}
+	p := NewParser(cfg)
+
+	if _, _, _, err := p.TryParsingCommand([]byte("*3\r\n")); err == nil {
+		t.Fatal("expected a count over proto-max-multibulk-len to be rejected")
+	}
+	if _, _, ok, err := p.TryParsingCommand([]byte("*2\r\n$4\r\nECHO\r\n$1\r\na\r\n")); !ok || err != nil {
+		t.Fatalf("got ok=%v err=%v for a request within the limit", ok, err)
+	}
+}
+
+func TestParseLength(t *testing.T) {
+	tests := []struct {
+		input string
+		want  int64
+		ok    bool
+	}{
+		{"0", 0, true},
+		{"42", 42, true},
+		{"-1", -1, true},
+		{"", 0, false},
+		{"+1", 0, false},
+		{"1x", 0, false},
+		{" 1", 0, false},
+		{"99999999999999999999", 0, false},
+	}
+
+	var p Parser
+	for _, tt := range tests {
+		got, ok := p.ParseLength([]byte(tt.input))
+		if got != tt.want || ok != tt.ok {
+			t.Errorf("ParseLength(%q) = %d, %v, want %d, %v", tt.input, got, ok, tt.want, tt.ok)
+		}
+	}
+}
+
+func TestTryParsingInlineCommand(t *testing.T) {
+	tests := []struct {
+		name     string
+		input    string
+		want     []string
+		consumed int
+		ok       bool
+		err      bool
+	}{
+		{name: "plain words", input: "SET k v\r\n", want: []string{"SET", "k", "v"}, consumed: 9, ok: true},
+		{name: "bare newline", input: "PING\n", want: []string{"PING"}, consumed: 5, ok: true},
+		{name: "extra spaces", input: "  GET   k \r\n", want: []string{"GET", "k"}, consumed: 12, ok: true},
+		{name: "double quotes", input: "SET k \"a b\\n\\x41\"\r\n", want: []string{"SET", "k", "a b\nA"}, consumed: 19, ok: true},
+		{name: "single quotes", input: "SET k 'it\\'s'\r\n", want: []string{"SET", "k", "it's"}, consumed: 15, ok: true},
+		{name: "empty quoted arg", input: "ECHO \"\"\r\n", want: []string{"ECHO", ""}, consumed: 9, ok: true},
+		{name: "blank line", input: "\r\n", consumed: 2, ok: true},
+		{name: "incomplete", input: "PING"},
+		{name: "unbalanced quotes", input: "ECHO \"a\r\n", err: true},
+		{name: "text after closing quote", input: "ECHO \"a\"b\r\n", err: true},
+		{name: "oversized", input: strings.Repeat("a", ProtoInlineMaxSize+1), err: true},
+	}
+
+	p := NewParser(NewConfig())
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cmd, consumed, ok, err := p.TryParsingCommand([]byte(tt.input))
+			if tt.err {
+				if err == nil {
+					t.Fatal("expected a protocol error")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if ok != tt.ok || consumed != tt.consumed {
+				t.Fatalf("got ok=%v consumed=%d, want ok=%v consumed=%d", ok, consumed, tt.ok, tt.consumed)
+			}
+
+			var got []string
+			if cmd.Name != "" {
+				got = append(got, cmd.Name)
+			}
+			for _, arg := range cmd.Args {
+				got = append(got, string(arg))
+			}
+			if !slices.Equal(got, tt.want) {
+				t.Fatalf("got %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,178 @@
+package redisclone
+
+import (
+	"math"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// What CLIENT PAUSE suspends, a stronger pause also covers the weaker ones
+const (
+	PauseOff   = iota
+	PauseWrite // write commands and commands that may write, like EVAL or PUBLISH
+	PauseAll   // every client command
+)
+
+// Pause set by CLIENT PAUSE, paused clients wait on unpaused which is closed whenever the pause is lifted
+type PauseState struct {
+	mode     int
+	until    time.Time
+	unpaused chan struct{}
+	timer    *time.Timer
+	lock     sync.Mutex
+}
+
+func NewPauseState() *PauseState {
+	return &PauseState{unpaused: make(chan struct{})}
+}
+
+// Pauses until the given deadline, overlapping pauses keep the stronger mode and the later deadline
+func (p *PauseState) Pause(mode int, until time.Time) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	if p.mode == PauseOff || until.After(p.until) {
+		p.until = until
+	}
+	p.mode = max(p.mode, mode)
+
+	if p.timer != nil {
+		p.timer.Stop()
+	}
+	p.timer = time.AfterFunc(time.Until(p.until), p.expire)
+}
+
+// Timer callback, a pause extended after the timer fired is left alone
+func (p *PauseState) expire() {
+	p.lock.Lock()
+	expired := p.mode != PauseOff && !time.Now().Before(p.until)
+	p.lock.Unlock()
+	if expired {
+		p.Unpause()
+	}
+}
+
+// Lifts the pause and wakes every client waiting on it
+func (p *PauseState) Unpause() {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	if p.mode == PauseOff {
+		return
+	}
+	if p.timer != nil {
+		p.timer.Stop()
+		p.timer = nil
+	}
+	p.mode = PauseOff
+	p.until = time.Time{}
+	close(p.unpaused)
+	p.unpaused = make(chan struct{})
+}
+
+// Current mode and the channel closed once it's lifted
+func (p *PauseState) State() (int, <-chan struct{}) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	return p.mode, p.unpaused
+}
+
+// Expiring keys is a write, so it's held back while writes are paused
+func (p *PauseState) ExpiryPaused() bool {
+	mode, _ := p.State()
+	return mode != PauseOff
+}
+
+// Whether a pause in mode holds rc back, CLIENT UNPAUSE always runs so a pause can be lifted early
+func (h *Handler) IsPausedCommand(mode int, c *Client, rc *RedisCommand) bool {
+	switch {
+	case mode == PauseOff || rc.Name == "client|unpause":
+		return false
+	case mode == PauseAll:
+		return true
+	}
+	return IsWriteCommand(rc) || (rc.Name == "exec" && h.QueuedWrite(c))
+}
+
+func IsWriteCommand(rc *RedisCommand) bool {
+	return rc.HasFlag(FlagWrite) || rc.HasFlag(FlagMayReplicate)
+}
+
+// EXEC counts as a write when its transaction queued one
+func (h *Handler) QueuedWrite(c *Client) bool {
+	if c.Multi == nil {
+		return false
+	}
+	for _, queued := range c.Multi.Queued {
+		if rc, errReply := h.ResolveCommand(queued); errReply == nil && IsWriteCommand(rc) {
+			return true
+		}
+	}
+	return false
+}
+
+// Holds the client's command back while a pause covers it, earlier replies are flushed first so the client sees them.
+// Returns false if the client was killed or the server shut down while waiting.
+func (s *Server) WaitWhilePaused(c *Client, cmd Command) bool {
+	rc, errReply := s.Handler.ResolveCommand(cmd)
+	if errReply != nil {
+		return true
+	}
+
+	flushed := false
+	for {
+		mode, unpaused := s.Handler.Pause.State()
+		if !s.Handler.IsPausedCommand(mode, c, rc) {
+			return true
+		}
+		if !flushed {
+			c.Flush()
+			flushed = true
+		}
+
+		select {
+		case <-unpaused:
+		case <-c.Killed():
+			return false
+		case <-s.done:
+			return false
+		}
+	}
+}
+
+func (h *Handler) HandleClientPauseCommand(c *Client, cmd Command) []byte {
+	timeout, err := strconv.ParseInt(string(cmd.Args[1]), 10, 64)
+	if err != nil {
+		return h.Encoder.GenerateSimpleError("ERR timeout is not an integer or out of range")
+	}
+	if timeout < 0 {
+		return h.Encoder.GenerateSimpleError("ERR timeout is negative")
+	}
+	if timeout > math.MaxInt64/int64(time.Millisecond) {
+		return h.Encoder.GenerateSimpleError("ERR timeout is out of range")
+	}
+
+	mode := PauseAll
+	if len(cmd.Args) > 3 {
+		return h.Encoder.GenerateSimpleError("ERR syntax error")
+	}
+	if len(cmd.Args) == 3 {
+		switch strings.ToUpper(string(cmd.Args[2])) {
+		case "WRITE":
+			mode = PauseWrite
+		case "ALL":
+		default:
+			return h.Encoder.GenerateSimpleError("ERR syntax error")
+		}
+	}
+
+	h.Pause.Pause(mode, time.Now().Add(time.Duration(timeout)*time.Millisecond))
+	return h.Encoder.GetSimpleStringOk()
+}
+
+func (h *Handler) HandleClientUnpauseCommand(c *Client, cmd Command) []byte {
+	h.Pause.Unpause()
+	return h.Encoder.GetSimpleStringOk()
+}
@@ -0,0 +1,149 @@
+package redisclone
+
+import (
+	"testing"
+	"time"
+)
+
+func TestPauseState(t *testing.T) {
+	p := NewPauseState()
+	if mode, _ := p.State(); mode != PauseOff || p.ExpiryPaused() {
+		t.Fatalf("a new pause state is in mode %d", mode)
+	}
+
+	// overlapping pauses keep the stronger mode and the later deadline
+	p.Pause(PauseAll, time.Now().Add(time.Hour))
+	p.Pause(PauseWrite, time.Now().Add(time.Millisecond))
+	time.Sleep(20 * time.Millisecond)
+	mode, unpaused := p.State()
+	if mode != PauseAll || !p.ExpiryPaused() {
+		t.Fatalf("got mode %d, want the earlier ALL pause to still hold", mode)
+	}
+
+	p.Unpause()
+	select {
+	case <-unpaused:
+	default:
+		t.Fatal("UNPAUSE didn't wake the waiting clients")
+	}
+	p.Unpause()
+
+	p.Pause(PauseWrite, time.Now().Add(10*time.Millisecond))
+	mode, unpaused = p.State()
+	if mode != PauseWrite {
+		t.Fatalf("got mode %d, want a WRITE pause", mode)
+	}
+	select {
+	case <-unpaused:
+	case <-time.After(5 * time.Second):
+		t.Fatal("the pause didn't expire")
+	}
+	if mode, _ := p.State(); mode != PauseOff {
+		t.Fatalf("got mode %d after the pause expired", mode)
+	}
+}
+
+func TestIsPausedCommand(t *testing.T) {
+	h := &Handler{Commands: (&Server{}).BuildCommandTable()}
+	writeQueued := &Client{Multi: &MultiState{Queued: []Command{{Name: "set", Args: [][]byte{[]byte("k"), []byte("v")}}}}}
+	readQueued := &Client{Multi: &MultiState{Queued: []Command{{Name: "get", Args: [][]byte{[]byte("k")}}}}}
+	tests := []struct {
+		args  []string
+		c     *Client
+		write bool
+		all   bool
+	}{
+		{args: []string{"get", "k"}, all: true},
+		{args: []string{"ping"}, all: true},
+		{args: []string{"set", "k", "v"}, write: true, all: true},
+		{args: []string{"flushall"}, write: true, all: true},
+		{args: []string{"eval", "return 1", "0"}, write: true, all: true},
+		{args: []string{"publish", "ch", "m"}, write: true, all: true},
+		{args: []string{"exec"}, c: writeQueued, write: true, all: true},
+		{args: []string{"exec"}, c: readQueued, all: true},
+		{args: []string{"client", "unpause"}},
+	}
+
+	for _, tt := range tests {
+		cmd := Command{Name: tt.args[0]}
+		for _, arg := range tt.args[1:] {
+			cmd.Args = append(cmd.Args, []byte(arg))
+		}
+		rc, errReply := h.ResolveCommand(cmd)
+		if errReply != nil {
+			t.Fatalf("%q: %s", tt.args, errReply)
+		}
+		c := tt.c
+		if c == nil {
+			c = &Client{}
+		}
+		for _, mode := range []struct {
+			mode int
+			want bool
+		}{{PauseOff, false}, {PauseWrite, tt.write}, {PauseAll, tt.all}} {
+			if got := h.IsPausedCommand(mode.mode, c, rc); got != mode.want {
+				t.Errorf("%q in mode %d: got paused %v, want %v", tt.args, mode.mode, got, mode.want)
+			}
+		}
+	}
+}
+
+// Gives a command sent to a paused server time to reach it, so a reply that shows up is known to be early
+func expectHeld(t *testing.T, c *testClient) {
+	t.Helper()
+	time.Sleep(50 * time.Millisecond)
+	c.conn.SetReadDeadline(time.Now().Add(50 * time.Millisecond))
+	if _, err := c.r.Peek(1); err == nil {
+		t.Fatal("a paused command got a reply")
+	}
+	c.conn.SetDeadline(time.Now().Add(10 * time.Second))
+}
+
+func TestClientPause(t *testing.T) {
+	s := startServer(t)
+	admin, c := dial(t, s.Addr()), dial(t, s.Addr())
+
+	// a write pause lets reads through and holds writes until it's lifted
+	expectReply(t, admin.Do("CLIENT", "PAUSE", "100000", "WRITE"), "OK")
+	expectReply(t, c.Do("GET", "k"), nil)
+	c.Send("SET", "k", "v")
+	expectHeld(t, c)
+	expectReply(t, admin.Do("GET", "k"), nil)
+	expectReply(t, admin.Do("CLIENT", "UNPAUSE"), "OK")
+	expectReply(t, c.Read(), "OK")
+
+	// an ALL pause holds every command, except the UNPAUSE lifting it
+	expectReply(t, admin.Do("CLIENT", "PAUSE", "100000"), "OK")
+	c.Send("GET", "k")
+	expectHeld(t, c)
+	expectReply(t, admin.Do("CLIENT", "UNPAUSE"), "OK")
+	expectReply(t, c.Read(), "v")
+
+	// and a pause ends by itself once the timeout passes
+	expectReply(t, admin.Do("CLIENT", "PAUSE", "100", "WRITE"), "OK")
+	start := time.Now()
+	expectReply(t, c.Do("SET", "k", "w"), "OK")
+	if elapsed := time.Since(start); elapsed < 50*time.Millisecond {
+		t.Fatalf("SET returned after %v, during the pause", elapsed)
+	}
+}
+
+func TestClientPauseErrors(t *testing.T) {
+	tests := []struct {
+		args  []string
+		reply any
+	}{
+		{args: []string{"soon"}, reply: replyError("ERR timeout is not an integer or out of range")},
+		{args: []string{"-1"}, reply: replyError("ERR timeout is negative")},
+		{args: []string{"9223372036854775807"}, reply: replyError("ERR timeout is out of range")},
+		{args: []string{"100", "READ"}, reply: replyError("ERR syntax error")},
+		{args: []string{"100", "WRITE", "ALL"}, reply: replyError("ERR syntax error")},
+		{args: []string{"0", "write"}, reply: "OK"},
+	}
+
+	s := startServer(t)
+	c := dial(t, s.Addr())
+	for _, tt := range tests {
+		expectReply(t, c.Do(append([]string{"CLIENT", "PAUSE"}, tt.args...)...), tt.reply)
+	}
+}
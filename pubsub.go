@@ -0,0 +1,463 @@
+package redisclone
+
+import (
+	"errors"
+	"fmt"
+	"maps"
+	"slices"
+	"strings"
+	"sync"
+)
+
+// Channel, pattern and shard channel subscribers, messages are queued on each subscriber's output so publishers never wait
+type PubSub struct {
+	channels      map[string]map[*Client]struct{}
+	patterns      map[string]map[*Client]struct{}
+	shardChannels map[string]map[*Client]struct{} // scoped to the hash slot of the channel name, never matched by patterns
+	lock          sync.RWMutex
+}
+
+func NewPubSub() *PubSub {
+	return &PubSub{
+		channels:      make(map[string]map[*Client]struct{}),
+		patterns:      make(map[string]map[*Client]struct{}),
+		shardChannels: make(map[string]map[*Client]struct{}),
+	}
+}
+
+// Note: This function is unsafe, it should only ever be called by a function who holds a lock
+func UnsafeAddSubscriber(subscribers map[string]map[*Client]struct{}, name string, c *Client) {
+	clients := subscribers[name]
+	if clients == nil {
+		clients = make(map[*Client]struct{})
+		subscribers[name] = clients
+	}
+	clients[c] = struct{}{}
+}
+
+// Note: This function is unsafe, it should only ever be called by a function who holds a lock
+func UnsafeRemoveSubscriber(subscribers map[string]map[*Client]struct{}, name string, c *Client) {
+	delete(subscribers[name], c)
+	if len(subscribers[name]) == 0 {
+		delete(subscribers, name)
+	}
+}
+
+// Returns whether c wasn't subscribed to channel yet, confirm runs before the lock is released so no message is published to c ahead of it
+func (ps *PubSub) Subscribe(c *Client, channel string, confirm func()) bool {
+	ps.lock.Lock()
+	defer ps.lock.Unlock()
+	defer confirm()
+
+	if _, ok := c.channels[channel]; ok {
+		return false
+	}
+	c.channels[channel] = struct{}{}
+	UnsafeAddSubscriber(ps.channels, channel, c)
+	return true
+}
+
+func (ps *PubSub) Unsubscribe(c *Client, channel string) bool {
+	ps.lock.Lock()
+	defer ps.lock.Unlock()
+
+	if _, ok := c.channels[channel]; !ok {
+		return false
+	}
+	delete(c.channels, channel)
+	UnsafeRemoveSubscriber(ps.channels, channel, c)
+	return true
+}
+
+func (ps *PubSub) PSubscribe(c *Client, pattern string, confirm func()) bool {
+	ps.lock.Lock()
+	defer ps.lock.Unlock()
+	defer confirm()
+
+	if _, ok := c.patterns[pattern]; ok {
+		return false
+	}
+	c.patterns[pattern] = struct{}{}
+	UnsafeAddSubscriber(ps.patterns, pattern, c)
+	return true
+}
+
+func (ps *PubSub) PUnsubscribe(c *Client, pattern string) bool {
+	ps.lock.Lock()
+	defer ps.lock.Unlock()
+
+	if _, ok := c.patterns[pattern]; !ok {
+		return false
+	}
+	delete(c.patterns, pattern)
+	UnsafeRemoveSubscriber(ps.patterns, pattern, c)
+	return true
+}
+
+func (ps *PubSub) SSubscribe(c *Client, channel string, confirm func()) bool {
+	ps.lock.Lock()
+	defer ps.lock.Unlock()
+	defer confirm()
+
+	if _, ok := c.shardChannels[channel]; ok {
+		return false
+	}
+	c.shardChannels[channel] = struct{}{}
+	UnsafeAddSubscriber(ps.shardChannels, channel, c)
+	return true
+}
+
+func (ps *PubSub) SUnsubscribe(c *Client, channel string) bool {
+	ps.lock.Lock()
+	defer ps.lock.Unlock()
+
+	if _, ok := c.shardChannels[channel]; !ok {
+		return false
+	}
+	delete(c.shardChannels, channel)
+	UnsafeRemoveSubscriber(ps.shardChannels, channel, c)
+	return true
+}
+
+// Drops every subscription of a client, used when it disconnects or sends RESET
+func (ps *PubSub) UnsubscribeAll(c *Client) {
+	ps.lock.Lock()
+	defer ps.lock.Unlock()
+
+	for channel := range c.channels {
+		UnsafeRemoveSubscriber(ps.channels, channel, c)
+	}
+	for pattern := range c.patterns {
+		UnsafeRemoveSubscriber(ps.patterns, pattern, c)
+	}
+	for channel := range c.shardChannels {
+		UnsafeRemoveSubscriber(ps.shardChannels, channel, c)
+	}
+	clear(c.channels)
+	clear(c.patterns)
+	clear(c.shardChannels)
+}
+
+// Returns the channel, pattern and shard channel subscription counts of any client
+func (ps *PubSub) ClientSubscriptions(c *Client) (int, int, int) {
+	ps.lock.RLock()
+	defer ps.lock.RUnlock()
+
+	return len(c.channels), len(c.patterns), len(c.shardChannels)
+}
+
+// Note: This function is unsafe, it should only ever be called by a function who holds a lock
+func UnsafeMatchingChannels(subscribers map[string]map[*Client]struct{}, pattern string) []string {
+	var channels []string
+	for _, channel := range slices.Sorted(maps.Keys(subscribers)) {
+		if pattern == "" || StringMatch(pattern, channel, false) {
+			channels = append(channels, channel)
+		}
+	}
+	return channels
+}
+
+// Channels with at least one subscriber whose name matches pattern, every channel when pattern is empty
+func (ps *PubSub) Channels(pattern string) []string {
+	ps.lock.RLock()
+	defer ps.lock.RUnlock()
+
+	return UnsafeMatchingChannels(ps.channels, pattern)
+}
+
+func (ps *PubSub) ShardChannels(pattern string) []string {
+	ps.lock.RLock()
+	defer ps.lock.RUnlock()
+
+	return UnsafeMatchingChannels(ps.shardChannels, pattern)
+}
+
+func (ps *PubSub) NumSub(channel string) int {
+	ps.lock.RLock()
+	defer ps.lock.RUnlock()
+
+	return len(ps.channels[channel])
+}
+
+func (ps *PubSub) ShardNumSub(channel string) int {
+	ps.lock.RLock()
+	defer ps.lock.RUnlock()
+
+	return len(ps.shardChannels[channel])
+}
+
+func (ps *PubSub) NumPat() int {
+	ps.lock.RLock()
+	defer ps.lock.RUnlock()
+
+	return len(ps.patterns)
+}
+
+// Queues message on every subscriber of channel and every matching pattern subscriber, returning the number of receivers
+func (h *Handler) Publish(channel string, message []byte) int {
+	h.PubSub.lock.RLock()
+	defer h.PubSub.lock.RUnlock()
+
+	receivers := 0
+	for c := range h.PubSub.channels[channel] {
+		_, proto := c.Identity()
+		c.Push(h.Encoder.GeneratePush(proto, [][]byte{
+			h.Encoder.GenerateBulkString([]byte("message")),
+			h.Encoder.GenerateBulkString([]byte(channel)),
+			h.Encoder.GenerateBulkString(message),
+		}))
+		receivers += 1
+	}
+	for pattern, clients := range h.PubSub.patterns {
+		if !StringMatch(pattern, channel, false) {
+			continue
+		}
+		for c := range clients {
+			_, proto := c.Identity()
+			c.Push(h.Encoder.GeneratePush(proto, [][]byte{
+				h.Encoder.GenerateBulkString([]byte("pmessage")),
+				h.Encoder.GenerateBulkString([]byte(pattern)),
+				h.Encoder.GenerateBulkString([]byte(channel)),
+				h.Encoder.GenerateBulkString(message),
+			}))
+			receivers += 1
+		}
+	}
+	return receivers
+}
+
+// Queues message on every subscriber of the shard channel, pattern subscribers never see shard messages
+func (h *Handler) SPublish(channel string, message []byte) int {
+	h.PubSub.lock.RLock()
+	defer h.PubSub.lock.RUnlock()
+
+	for c := range h.PubSub.shardChannels[channel] {
+		_, proto := c.Identity()
+		c.Push(h.Encoder.GeneratePush(proto, [][]byte{
+			h.Encoder.GenerateBulkString([]byte("smessage")),
+			h.Encoder.GenerateBulkString([]byte(channel)),
+			h.Encoder.GenerateBulkString(message),
+		}))
+	}
+	return len(h.PubSub.shardChannels[channel])
+}
+
+// Shard channels given together must live in one hash slot, as they would in a cluster
+func CheckSameSlot(channels [][]byte) error {
+	for _, channel := range channels[1:] {
+		if KeyHashSlot(string(channel)) != KeyHashSlot(string(channels[0])) {
+			return errors.New("CROSSSLOT Keys in request don't hash to the same slot")
+		}
+	}
+	return nil
+}
+
+// Commands a RESP2 client may still send once it has subscriptions
+func IsAllowedInPubSubContext(name string) bool {
+	switch strings.ToUpper(name) {
+	case "SUBSCRIBE", "PSUBSCRIBE", "SSUBSCRIBE", "UNSUBSCRIBE", "PUNSUBSCRIBE", "SUNSUBSCRIBE", "PING", "QUIT", "RESET":
+		return true
+	}
+	return false
+}
+
+// Builds the confirmation pushed for every (un)subscribed channel or pattern, count is the client's remaining subscriptions
+func (h *Handler) GenerateSubscriptionReply(c *Client, kind string, name []byte, count int) []byte {
+	nameReply := h.Encoder.GetNull(c.Protocol)
+	if name != nil {
+		nameReply = h.Encoder.GenerateBulkString(name)
+	}
+	return h.Encoder.GeneratePush(c.Protocol, [][]byte{
+		h.Encoder.GenerateBulkString([]byte(kind)),
+		nameReply,
+		h.Encoder.GenerateInt(count),
+	})
+}
+
+// Queues a subscribe confirmation on the client's output straight away, so it can't be overtaken by a message on the new subscription.
+// Inside EXEC it joins the transaction's replies instead, which EXEC queues before releasing the exec lock
+func (h *Handler) ConfirmSubscription(c *Client, out []byte, reply []byte) []byte {
+	if c.InExec() {
+		c.Multi.Subscribed = true
+		return append(out, reply...)
+	}
+	c.Write(reply)
+	return out
+}
+
+// Pub/Sub Commands
+func (h *Handler) HandleSubscribeCommand(c *Client, cmd Command) []byte {
+	var out []byte
+	for _, channel := range cmd.Args {
+		h.PubSub.Subscribe(c, string(channel), func() {
+			out = h.ConfirmSubscription(c, out, h.GenerateSubscriptionReply(c, "subscribe", channel, c.SubscriptionCount()))
+		})
+	}
+	return out
+}
+
+func (h *Handler) HandleUnsubscribeCommand(c *Client, cmd Command) []byte {
+	channels := cmd.Args
+	if len(channels) == 0 {
+		for _, channel := range slices.Sorted(maps.Keys(c.channels)) {
+			channels = append(channels, []byte(channel))
+		}
+	}
+	if len(channels) == 0 {
+		return h.GenerateSubscriptionReply(c, "unsubscribe", nil, c.SubscriptionCount())
+	}
+
+	var out []byte
+	for _, channel := range channels {
+		h.PubSub.Unsubscribe(c, string(channel))
+		out = append(out, h.GenerateSubscriptionReply(c, "unsubscribe", channel, c.SubscriptionCount())...)
+	}
+	return out
+}
+
+func (h *Handler) HandlePSubscribeCommand(c *Client, cmd Command) []byte {
+	var out []byte
+	for _, pattern := range cmd.Args {
+		h.PubSub.PSubscribe(c, string(pattern), func() {
+			out = h.ConfirmSubscription(c, out, h.GenerateSubscriptionReply(c, "psubscribe", pattern, c.SubscriptionCount()))
+		})
+	}
+	return out
+}
+
+func (h *Handler) HandlePUnsubscribeCommand(c *Client, cmd Command) []byte {
+	patterns := cmd.Args
+	if len(patterns) == 0 {
+		for _, pattern := range slices.Sorted(maps.Keys(c.patterns)) {
+			patterns = append(patterns, []byte(pattern))
+		}
+	}
+	if len(patterns) == 0 {
+		return h.GenerateSubscriptionReply(c, "punsubscribe", nil, c.SubscriptionCount())
+	}
+
+	var out []byte
+	for _, pattern := range patterns {
+		h.PubSub.PUnsubscribe(c, string(pattern))
+		out = append(out, h.GenerateSubscriptionReply(c, "punsubscribe", pattern, c.SubscriptionCount())...)
+	}
+	return out
+}
+
+func (h *Handler) HandlePublishCommand(c *Client, cmd Command) []byte {
+	return h.Encoder.GenerateInt(h.Publish(string(cmd.Args[0]), cmd.Args[1]))
+}
+
+func (h *Handler) HandleSSubscribeCommand(c *Client, cmd Command) []byte {
+	if err := CheckSameSlot(cmd.Args); err != nil {
+		return h.Encoder.GenerateSimpleError(err.Error())
+	}
+
+	var out []byte
+	for _, channel := range cmd.Args {
+		h.PubSub.SSubscribe(c, string(channel), func() {
+			out = h.ConfirmSubscription(c, out, h.GenerateSubscriptionReply(c, "ssubscribe", channel, c.ShardSubscriptionCount()))
+		})
+	}
+	return out
+}
+
+func (h *Handler) HandleSUnsubscribeCommand(c *Client, cmd Command) []byte {
+	channels := cmd.Args
+	if len(channels) == 0 {
+		for _, channel := range slices.Sorted(maps.Keys(c.shardChannels)) {
+			channels = append(channels, []byte(channel))
+		}
+	} else if err := CheckSameSlot(channels); err != nil {
+		return h.Encoder.GenerateSimpleError(err.Error())
+	}
+	if len(channels) == 0 {
+		return h.GenerateSubscriptionReply(c, "sunsubscribe", nil, c.ShardSubscriptionCount())
+	}
+
+	var out []byte
+	for _, channel := range channels {
+		h.PubSub.SUnsubscribe(c, string(channel))
+		out = append(out, h.GenerateSubscriptionReply(c, "sunsubscribe", channel, c.ShardSubscriptionCount())...)
+	}
+	return out
+}
+
+func (h *Handler) HandleSPublishCommand(c *Client, cmd Command) []byte {
+	return h.Encoder.GenerateInt(h.SPublish(string(cmd.Args[0]), cmd.Args[1]))
+}
+
+func (h *Handler) HandlePubSubChannelsCommand(c *Client, cmd Command) []byte {
+	if len(cmd.Args) > 2 {
+		return h.Encoder.GenerateSimpleError("ERR syntax error")
+	}
+	pattern := ""
+	if len(cmd.Args) == 2 {
+		pattern = string(cmd.Args[1])
+	}
+
+	var channels [][]byte
+	for _, channel := range h.PubSub.Channels(pattern) {
+		channels = append(channels, []byte(channel))
+	}
+	return h.Encoder.GenerateArray(channels)
+}
+
+func (h *Handler) HandlePubSubShardChannelsCommand(c *Client, cmd Command) []byte {
+	if len(cmd.Args) > 2 {
+		return h.Encoder.GenerateSimpleError("ERR syntax error")
+	}
+	pattern := ""
+	if len(cmd.Args) == 2 {
+		pattern = string(cmd.Args[1])
+	}
+
+	var channels [][]byte
+	for _, channel := range h.PubSub.ShardChannels(pattern) {
+		channels = append(channels, []byte(channel))
+	}
+	return h.Encoder.GenerateArray(channels)
+}
+
+func (h *Handler) HandlePubSubNumSubCommand(c *Client, cmd Command) []byte {
+	var pairs [][]byte
+	for _, channel := range cmd.Args[1:] {
+		pairs = append(pairs, h.Encoder.GenerateBulkString(channel), h.Encoder.GenerateInt(h.PubSub.NumSub(string(channel))))
+	}
+	return h.Encoder.GenerateRawArray(pairs)
+}
+
+func (h *Handler) HandlePubSubShardNumSubCommand(c *Client, cmd Command) []byte {
+	var pairs [][]byte
+	for _, channel := range cmd.Args[1:] {
+		pairs = append(pairs, h.Encoder.GenerateBulkString(channel), h.Encoder.GenerateInt(h.PubSub.ShardNumSub(string(channel))))
+	}
+	return h.Encoder.GenerateRawArray(pairs)
+}
+
+func (h *Handler) HandlePubSubNumPatCommand(c *Client, cmd Command) []byte {
+	return h.Encoder.GenerateInt(h.PubSub.NumPat())
+}
+
+// Brings the connection back to its initial state: no transaction, watched keys, subscriptions or name, and RESP2
+func (h *Handler) HandleResetCommand(c *Client, cmd Command) []byte {
+	c.Multi = nil
+	h.Unwatch(c.Watch)
+	h.PubSub.UnsubscribeAll(c)
+	h.Tracking.Disable(c)
+	c.SetName("")
+	c.SetProtocol(RESP2)
+	c.SelectDB(0)
+	h.SetDefaultAuth(c)
+	return h.Encoder.GenerateSimpleString([]byte("RESET"))
+}
+
+func (h *Handler) HandleQuitCommand(c *Client, cmd Command) []byte {
+	c.CloseAfterReply = true
+	return h.Encoder.GetSimpleStringOk()
+}
+
+// Error returned to RESP2 clients sending a regular command while subscribed
+func PubSubContextError(name string) string {
+	return fmt.Sprintf("ERR Can't execute '%s': only (P|S)SUBSCRIBE / (P|S)UNSUBSCRIBE / PING / QUIT / RESET are allowed in this context", strings.ToLower(name))
+}
@@ -0,0 +1,126 @@
+package redisclone
+
+import "testing"
+
+func TestSubscribePublish(t *testing.T) {
+	s := startServer(t)
+	pub, sub, psub := dial(t, s.Addr()), dial(t, s.Addr()), dial(t, s.Addr())
+
+	sub.Send("SUBSCRIBE", "news", "sport")
+	expectReply(t, sub.Read(), []any{"subscribe", "news", int64(1)})
+	expectReply(t, sub.Read(), []any{"subscribe", "sport", int64(2)})
+	psub.Send("PSUBSCRIBE", "n*")
+	expectReply(t, psub.Read(), []any{"psubscribe", "n*", int64(1)})
+
+	expectReply(t, pub.Do("PUBLISH", "news", "hi"), int64(2))
+	expectReply(t, sub.Read(), []any{"message", "news", "hi"})
+	expectReply(t, psub.Read(), []any{"pmessage", "n*", "news", "hi"})
+	expectReply(t, pub.Do("PUBLISH", "sport", "goal"), int64(1))
+	expectReply(t, sub.Read(), []any{"message", "sport", "goal"})
+	expectReply(t, pub.Do("PUBLISH", "nobody", "x"), int64(1))
+	expectReply(t, psub.Read(), []any{"pmessage", "n*", "nobody", "x"})
+	expectReply(t, pub.Do("PUBLISH", "weather", "x"), int64(0))
+
+	expectReply(t, pub.Do("PUBSUB", "CHANNELS"), []any{"news", "sport"})
+	expectReply(t, pub.Do("PUBSUB", "CHANNELS", "s*"), []any{"sport"})
+	expectReply(t, pub.Do("PUBSUB", "NUMSUB", "news", "weather"), []any{"news", int64(1), "weather", int64(0)})
+	expectReply(t, pub.Do("PUBSUB", "NUMPAT"), int64(1))
+
+	// without arguments every subscription is dropped
+	sub.Send("UNSUBSCRIBE")
+	expectReply(t, sub.Read(), []any{"unsubscribe", "news", int64(1)})
+	expectReply(t, sub.Read(), []any{"unsubscribe", "sport", int64(0)})
+	expectReply(t, sub.Do("UNSUBSCRIBE"), []any{"unsubscribe", nil, int64(0)})
+	expectReply(t, sub.Do("GET", "k"), nil)
+	expectReply(t, pub.Do("PUBSUB", "CHANNELS"), []any{})
+}
+
+func TestSubscribedContext(t *testing.T) {
+	s := startServer(t)
+	c := dial(t, s.Addr())
+
+	expectReply(t, c.Do("SUBSCRIBE", "ch"), []any{"subscribe", "ch", int64(1)})
+	expectReply(t, c.Do("GET", "k"), replyError("ERR Can't execute 'get': only (P|S)SUBSCRIBE / (P|S)UNSUBSCRIBE / PING / QUIT / RESET are allowed in this context"))
+	expectReply(t, c.Do("PING"), []any{"pong", ""})
+	expectReply(t, c.Do("PING", "hi"), []any{"pong", "hi"})
+	expectReply(t, c.Do("RESET"), "RESET")
+	expectReply(t, c.Do("PING"), "PONG")
+
+	// RESP3 clients get messages as push replies and can keep running commands
+	c.Do("HELLO", "3")
+	expectReply(t, c.Do("SUBSCRIBE", "ch"), []any{"subscribe", "ch", int64(1)})
+	expectReply(t, c.Do("SET", "k", "v"), "OK")
+	expectReply(t, dial(t, s.Addr()).Do("PUBLISH", "ch", "m"), int64(1))
+	if line, _ := c.r.ReadString('\n'); line != ">3\r\n" {
+		t.Fatalf("got %q, want a push reply", line)
+	}
+	expectReply(t, []any{c.Read(), c.Read(), c.Read()}, []any{"message", "ch", "m"})
+}
+
+func TestSubscribeConfirmedFirst(t *testing.T) {
+	h := &Handler{PubSub: NewPubSub()}
+	c := NewClient(1, nil)
+
+	// a message published between the handler returning and the server writing its reply must not overtake the confirmation
+	for _, sub := range []func(*Client, Command) []byte{h.HandleSubscribeCommand, h.HandlePSubscribeCommand} {
+		reply := sub(c, Command{Args: [][]byte{[]byte("ch")}})
+		h.Publish("ch", []byte("m"))
+		c.Write(reply)
+	}
+	want := "*3\r\n$9\r\nsubscribe\r\n$2\r\nch\r\n:1\r\n" +
+		"*3\r\n$7\r\nmessage\r\n$2\r\nch\r\n$1\r\nm\r\n" +
+		"*3\r\n$10\r\npsubscribe\r\n$2\r\nch\r\n:2\r\n" +
+		"*3\r\n$7\r\nmessage\r\n$2\r\nch\r\n$1\r\nm\r\n" +
+		"*4\r\n$8\r\npmessage\r\n$2\r\nch\r\n$2\r\nch\r\n$1\r\nm\r\n"
+	if got := string(c.output); got != want {
+		t.Fatalf("got output %q, want %q", got, want)
+	}
+
+	// inside a transaction the confirmation is part of the EXEC reply
+	s := startServer(t)
+	tx := dial(t, s.Addr())
+	expectReply(t, tx.Do("MULTI"), "OK")
+	expectReply(t, tx.Do("SUBSCRIBE", "other"), "QUEUED")
+	expectReply(t, tx.Do("EXEC"), []any{[]any{"subscribe", "other", int64(1)}})
+}
+
+func TestDisconnectDropsSubscriptions(t *testing.T) {
+	s := startServer(t)
+	c := dial(t, s.Addr())
+	sub := dial(t, s.Addr())
+	expectReply(t, sub.Do("SUBSCRIBE", "ch"), []any{"subscribe", "ch", int64(1)})
+	expectReply(t, sub.Do("PSUBSCRIBE", "c*"), []any{"psubscribe", "c*", int64(2)})
+	sub.conn.Close()
+
+	waitFor(t, func() bool { return c.Do("PUBLISH", "ch", "m") == int64(0) })
+	expectReply(t, c.Do("PUBSUB", "NUMPAT"), int64(0))
+}
+
+func TestShardedPubSub(t *testing.T) {
+	s := startServer(t)
+	pub, sub, psub := dial(t, s.Addr()), dial(t, s.Addr()), dial(t, s.Addr())
+
+	expectReply(t, sub.Do("SSUBSCRIBE", "a", "b"), replyError("CROSSSLOT Keys in request don't hash to the same slot"))
+	sub.Send("SSUBSCRIBE", "{user}a", "{user}b")
+	expectReply(t, sub.Read(), []any{"ssubscribe", "{user}a", int64(1)})
+	expectReply(t, sub.Read(), []any{"ssubscribe", "{user}b", int64(2)})
+	// shard messages never reach pattern or regular subscribers
+	expectReply(t, psub.Do("PSUBSCRIBE", "*"), []any{"psubscribe", "*", int64(1)})
+
+	expectReply(t, pub.Do("SPUBLISH", "{user}a", "hi"), int64(1))
+	expectReply(t, sub.Read(), []any{"smessage", "{user}a", "hi"})
+	expectReply(t, pub.Do("PUBLISH", "{user}a", "plain"), int64(1))
+	expectReply(t, psub.Read(), []any{"pmessage", "*", "{user}a", "plain"})
+
+	expectReply(t, pub.Do("PUBSUB", "SHARDCHANNELS"), []any{"{user}a", "{user}b"})
+	expectReply(t, pub.Do("PUBSUB", "SHARDCHANNELS", "*b"), []any{"{user}b"})
+	expectReply(t, pub.Do("PUBSUB", "SHARDNUMSUB", "{user}a", "x"), []any{"{user}a", int64(1), "x", int64(0)})
+	expectReply(t, pub.Do("PUBSUB", "CHANNELS"), []any{})
+
+	expectReply(t, sub.Do("SUNSUBSCRIBE", "a", "b"), replyError("CROSSSLOT Keys in request don't hash to the same slot"))
+	sub.Send("SUNSUBSCRIBE")
+	expectReply(t, sub.Read(), []any{"sunsubscribe", "{user}a", int64(1)})
+	expectReply(t, sub.Read(), []any{"sunsubscribe", "{user}b", int64(0)})
+	expectReply(t, pub.Do("SPUBLISH", "{user}a", "hi"), int64(0))
+	expectReply(t, sub.Do("GET", "k"), nil)
+}
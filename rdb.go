@@ -0,0 +1,487 @@
+package redisclone
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Snapshots use the RDB file format so dumps stay readable by redis-check-rdb and real Redis servers
+const (
+	RDBVersion = 11
+
+	RDBTypeString = 0
+	RDBTypeList   = 1 // plain linked list encoding, still understood by every Redis version
+
+	RDBOpcodeAux          = 0xFA
+	RDBOpcodeResizeDB     = 0xFB
+	RDBOpcodeExpireTimeMs = 0xFC
+	RDBOpcodeExpireTime   = 0xFD
+	RDBOpcodeSelectDB     = 0xFE
+	RDBOpcodeEOF          = 0xFF
+
+	RDBEncInt8  = 0
+	RDBEncInt16 = 1
+	RDBEncInt32 = 2
+)
+
+// A save point that failed is only attempted again after this delay
+const SaveRetryDelay = 5 * time.Second
+
+var crc64Table = MakeCRC64Table()
+
+// Redis checksums RDB files with the Jones CRC-64 polynomial (reflected, no initial or final xor)
+func MakeCRC64Table() [256]uint64 {
+	const poly = 0x95ac9329ac4bc9b5
+	var table [256]uint64
+	for i := range table {
+		crc := uint64(i)
+		for range 8 {
+			if crc&1 == 1 {
+				crc = (crc >> 1) ^ poly
+			} else {
+				crc >>= 1
+			}
+		}
+		table[i] = crc
+	}
+	return table
+}
+
+func UpdateCRC64(crc uint64, b []byte) uint64 {
+	for _, v := range b {
+		crc = crc64Table[byte(crc)^v] ^ (crc >> 8)
+	}
+	return crc
+}
+
+type RDBWriter struct {
+	w   *bufio.Writer
+	crc uint64
+}
+
+func NewRDBWriter(w io.Writer) *RDBWriter {
+	return &RDBWriter{w: bufio.NewWriter(w)}
+}
+
+func (rw *RDBWriter) Write(b []byte) error {
+	rw.crc = UpdateCRC64(rw.crc, b)
+	_, err := rw.w.Write(b)
+	return err
+}
+
+func (rw *RDBWriter) WriteByte(b byte) error {
+	return rw.Write([]byte{b})
+}
+
+func (rw *RDBWriter) WriteLength(n uint64) error {
+	switch {
+	case n < 1<<6:
+		return rw.WriteByte(byte(n))
+	case n < 1<<14:
+		return rw.Write([]byte{byte(n>>8) | 0x40, byte(n)})
+	case n <= 0xFFFFFFFF:
+		buf := []byte{0x80, 0, 0, 0, 0}
+		binary.BigEndian.PutUint32(buf[1:], uint32(n))
+		return rw.Write(buf)
+	default:
+		buf := []byte{0x81, 0, 0, 0, 0, 0, 0, 0, 0}
+		binary.BigEndian.PutUint64(buf[1:], n)
+		return rw.Write(buf)
+	}
+}
+
+func (rw *RDBWriter) WriteString(b []byte) error {
+	if err := rw.WriteLength(uint64(len(b))); err != nil {
+		return err
+	}
+	return rw.Write(b)
+}
+
+func (rw *RDBWriter) WriteAux(key, value string) error {
+	if err := rw.WriteByte(RDBOpcodeAux); err != nil {
+		return err
+	}
+	if err := rw.WriteString([]byte(key)); err != nil {
+		return err
+	}
+	return rw.WriteString([]byte(value))
+}
+
+func (rw *RDBWriter) WriteHeader() error {
+	if err := rw.Write(fmt.Appendf(nil, "REDIS%04d", RDBVersion)); err != nil {
+		return err
+	}
+	if err := rw.WriteAux("redis-ver", RedisVersion); err != nil {
+		return err
+	}
+	if err := rw.WriteAux("redis-bits", strconv.Itoa(strconv.IntSize)); err != nil {
+		return err
+	}
+	return rw.WriteAux("ctime", strconv.FormatInt(time.Now().Unix(), 10))
+}
+
+func (rw *RDBWriter) WriteSelectDB(db int, size, expires int) error {
+	if err := rw.WriteByte(RDBOpcodeSelectDB); err != nil {
+		return err
+	}
+	if err := rw.WriteLength(uint64(db)); err != nil {
+		return err
+	}
+	if err := rw.WriteByte(RDBOpcodeResizeDB); err != nil {
+		return err
+	}
+	if err := rw.WriteLength(uint64(size)); err != nil {
+		return err
+	}
+	return rw.WriteLength(uint64(expires))
+}
+
+func (rw *RDBWriter) WriteExpireTime(ttl time.Time) error {
+	buf := []byte{RDBOpcodeExpireTimeMs, 0, 0, 0, 0, 0, 0, 0, 0}
+	binary.LittleEndian.PutUint64(buf[1:], uint64(ttl.UnixMilli()))
+	return rw.Write(buf)
+}
+
+// Writes the EOF opcode and checksum, then flushes everything to the underlying writer
+func (rw *RDBWriter) Finish() error {
+	if err := rw.WriteByte(RDBOpcodeEOF); err != nil {
+		return err
+	}
+	buf := make([]byte, 8)
+	binary.LittleEndian.PutUint64(buf, rw.crc)
+	if _, err := rw.w.Write(buf); err != nil {
+		return err
+	}
+	return rw.w.Flush()
+}
+
+type RDBReader struct {
+	r         *bufio.Reader
+	crc       uint64
+	remaining uint64 // bytes left in the input, lengths read from a corrupt file can't be trusted beyond it
+}
+
+// size is the number of bytes r holds
+func NewRDBReader(r io.Reader, size int64) *RDBReader {
+	return &RDBReader{r: bufio.NewReader(r), remaining: uint64(max(size, 0))}
+}
+
+func (rr *RDBReader) Read(n uint64) ([]byte, error) {
+	if n > rr.remaining {
+		return nil, fmt.Errorf("%w reading %d bytes, only %d left", io.ErrUnexpectedEOF, n, rr.remaining)
+	}
+	buf := make([]byte, n)
+	if _, err := io.ReadFull(rr.r, buf); err != nil {
+		return nil, err
+	}
+	rr.remaining -= n
+	rr.crc = UpdateCRC64(rr.crc, buf)
+	return buf, nil
+}
+
+func (rr *RDBReader) ReadByte() (byte, error) {
+	b, err := rr.Read(1)
+	if err != nil {
+		return 0, err
+	}
+	return b[0], nil
+}
+
+// Returns the decoded length, or the special string encoding type when encoded is true
+func (rr *RDBReader) ReadLength() (n uint64, encoded bool, err error) {
+	first, err := rr.ReadByte()
+	if err != nil {
+		return 0, false, err
+	}
+
+	switch first >> 6 {
+	case 0:
+		return uint64(first & 0x3F), false, nil
+	case 1:
+		next, err := rr.ReadByte()
+		return uint64(first&0x3F)<<8 | uint64(next), false, err
+	case 2:
+		switch first {
+		case 0x80:
+			buf, err := rr.Read(4)
+			if err != nil {
+				return 0, false, err
+			}
+			return uint64(binary.BigEndian.Uint32(buf)), false, nil
+		case 0x81:
+			buf, err := rr.Read(8)
+			if err != nil {
+				return 0, false, err
+			}
+			return binary.BigEndian.Uint64(buf), false, nil
+		}
+		return 0, false, fmt.Errorf("unknown length encoding %#x", first)
+	default:
+		return uint64(first & 0x3F), true, nil
+	}
+}
+
+func (rr *RDBReader) ReadString() ([]byte, error) {
+	n, encoded, err := rr.ReadLength()
+	if err != nil {
+		return nil, err
+	}
+	if !encoded {
+		return rr.Read(n)
+	}
+
+	switch n {
+	case RDBEncInt8:
+		b, err := rr.Read(1)
+		if err != nil {
+			return nil, err
+		}
+		return strconv.AppendInt(nil, int64(int8(b[0])), 10), nil
+	case RDBEncInt16:
+		b, err := rr.Read(2)
+		if err != nil {
+			return nil, err
+		}
+		return strconv.AppendInt(nil, int64(int16(binary.LittleEndian.Uint16(b))), 10), nil
+	case RDBEncInt32:
+		b, err := rr.Read(4)
+		if err != nil {
+			return nil, err
+		}
+		return strconv.AppendInt(nil, int64(int32(binary.LittleEndian.Uint32(b))), 10), nil
+	}
+	return nil, fmt.Errorf("unsupported string encoding %d", n)
+}
+
+// Writes the whole keyspace to path through a temp file, so a failed save never clobbers the previous dump
+func (h *Handler) SaveSnapshot() error {
+	path := h.SnapshotPath()
+	dirty := h.Stats.Dirty.Load()
+	tmp, err := os.CreateTemp(filepath.Dir(path), "temp-*.rdb")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	if err := h.WriteSnapshot(NewRDBWriter(tmp)); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp.Name(), path); err != nil {
+		return err
+	}
+
+	h.Stats.Dirty.Add(-dirty)
+	h.Stats.LastSave.Store(time.Now().Unix())
+	return nil
+}
+
+// Every database stays locked until the last one is written, so the dump is a single point in time
+func (h *Handler) WriteSnapshot(rw *RDBWriter) error {
+	if err := rw.WriteHeader(); err != nil {
+		return err
+	}
+	if err := h.Scripts.WriteRDBFunctions(rw); err != nil {
+		return err
+	}
+
+	unlock := RLockAll(h.Databases)
+	defer unlock()
+	for i, db := range h.Databases {
+		if err := db.UnsafeWriteRDB(rw, i); err != nil {
+			return err
+		}
+	}
+	return rw.Finish()
+}
+
+// Counts a successful write command towards the save points
+func (h *Handler) RecordDirty(rc *RedisCommand, reply []byte) {
+	if rc.HasFlag(FlagWrite) && (len(reply) == 0 || reply[0] != '-') {
+		h.Stats.Dirty.Add(1)
+	}
+}
+
+// Whether a save point "seconds changes" of the save parameter is reached, e.g. "3600 1 300 100"
+func (h *Handler) SavePointReached(now time.Time) bool {
+	fields := strings.Fields(h.Config.GetString("save"))
+	dirty, elapsed := h.Stats.Dirty.Load(), now.Unix()-h.Stats.LastSave.Load()
+	for i := 0; i+1 < len(fields); i += 2 {
+		seconds, _ := strconv.ParseInt(fields[i], 10, 64)
+		changes, _ := strconv.ParseInt(fields[i+1], 10, 64)
+		if dirty >= changes && elapsed > seconds {
+			return true
+		}
+	}
+	return false
+}
+
+// Checks the save points once a second and saves when one is reached, a failed save is retried after SaveRetryDelay
+func (s *Server) SaveCron() {
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+
+	var retryAt time.Time
+	for {
+		select {
+		case <-s.done:
+			return
+		case now := <-ticker.C:
+			if now.Before(retryAt) || !s.Handler.SavePointReached(now) {
+				continue
+			}
+		}
+
+		slog.Info("Changes reached a save point. Saving...", "changes", s.Stats.Dirty.Load())
+		if err := s.CronSave(); err != nil {
+			slog.Error("Error saving the DB", "err", err)
+			retryAt = time.Now().Add(SaveRetryDelay)
+			continue
+		}
+		slog.Info("DB saved on disk")
+	}
+}
+
+// Saves between commands, the in-flight lock keeps a shutdown from closing the server underneath it
+// and the exec lock keeps a transaction or script from being saved half done
+func (s *Server) CronSave() error {
+	s.inflight.RLock()
+	defer s.inflight.RUnlock()
+	if s.closed.Load() {
+		return nil
+	}
+
+	s.exec.Lock()
+	defer s.exec.Unlock()
+	return s.Handler.SaveSnapshot()
+}
+
+// Loads the dump at startup, a missing file simply means an empty dataset
+func (h *Handler) LoadSnapshot() error {
+	f, err := os.Open(h.SnapshotPath())
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	info, err := f.Stat()
+	if err != nil {
+		return err
+	}
+	rr := NewRDBReader(f, info.Size())
+	magic, err := rr.Read(9)
+	if err != nil || string(magic[:5]) != "REDIS" {
+		return errors.New("wrong signature trying to load DB from file")
+	}
+	version, err := strconv.Atoi(string(magic[5:]))
+	if err != nil || version < 1 || version > RDBVersion {
+		return fmt.Errorf("can't handle RDB format version %s", magic[5:])
+	}
+
+	var ttl time.Time
+	selected := 0
+	for {
+		opcode, err := rr.ReadByte()
+		if err != nil {
+			return err
+		}
+
+		switch opcode {
+		case RDBOpcodeAux:
+			if _, err := rr.ReadString(); err != nil {
+				return err
+			}
+			if _, err := rr.ReadString(); err != nil {
+				return err
+			}
+		case RDBOpcodeResizeDB:
+			if _, _, err := rr.ReadLength(); err != nil {
+				return err
+			}
+			if _, _, err := rr.ReadLength(); err != nil {
+				return err
+			}
+		case RDBOpcodeSelectDB:
+			db, _, err := rr.ReadLength()
+			if err != nil {
+				return err
+			}
+			if db >= uint64(len(h.Databases)) {
+				return fmt.Errorf("snapshot contains keys for database %d, but only %d databases are configured", db, len(h.Databases))
+			}
+			selected = int(db)
+		case RDBOpcodeExpireTime:
+			b, err := rr.Read(4)
+			if err != nil {
+				return err
+			}
+			ttl = time.Unix(int64(binary.LittleEndian.Uint32(b)), 0)
+		case RDBOpcodeExpireTimeMs:
+			b, err := rr.Read(8)
+			if err != nil {
+				return err
+			}
+			ttl = time.UnixMilli(int64(binary.LittleEndian.Uint64(b)))
+		case RDBOpcodeFunction2:
+			code, err := rr.ReadString()
+			if err != nil {
+				return err
+			}
+			if _, err := h.Scripts.LoadLibrary(string(code), false); err != nil {
+				return fmt.Errorf("loading function library: %w", err)
+			}
+		case RDBOpcodeEOF:
+			expected := rr.crc
+			b, err := io.ReadAll(rr.r)
+			if err != nil {
+				return err
+			}
+			// a zero checksum means the file was written with rdbchecksum disabled
+			if version >= 5 && len(b) == 8 && binary.LittleEndian.Uint64(b) != 0 && binary.LittleEndian.Uint64(b) != expected {
+				return errors.New("wrong RDB checksum")
+			}
+			return nil
+		default:
+			if err := h.Databases[selected].ReadRDBObject(rr, opcode, ttl); err != nil {
+				return err
+			}
+			ttl = time.Time{}
+		}
+	}
+}
+
+func (h *Handler) SnapshotPath() string {
+	return filepath.Join(h.Config.GetString("dir"), h.Config.GetString("dbfilename"))
+}
+
+// Persistence Commands
+func (h *Handler) HandleSaveCommand(c *Client, cmd Command) []byte {
+	if err := h.SaveSnapshot(); err != nil {
+		slog.Error("Failed saving the DB", "err", err)
+		return h.Encoder.GenerateSimpleError("ERR " + err.Error())
+	}
+	return h.Encoder.GetSimpleStringOk()
+}
+
+func (h *Handler) HandleLastSaveCommand(c *Client, cmd Command) []byte {
+	return h.Encoder.GenerateInt(int(h.Stats.LastSave.Load()))
+}
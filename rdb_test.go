@@ -0,0 +1,225 @@
+package redisclone
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestCRC64(t *testing.T) {
+	// the check value of the Jones polynomial used by Redis
+	if got := UpdateCRC64(0, []byte("123456789")); got != 0xe9c6d914c4b8d9ca {
+		t.Fatalf("got %#x", got)
+	}
+}
+
+func TestRDBLengthRoundTrip(t *testing.T) {
+	tests := []struct {
+		n    uint64
+		size int
+	}{
+		{0, 1},
+		{63, 1},
+		{64, 2},
+		{1<<14 - 1, 2},
+		{1 << 14, 5},
+		{0xFFFFFFFF, 5},
+		{1 << 32, 9},
+	}
+
+	for _, tt := range tests {
+		var buf bytes.Buffer
+		rw := NewRDBWriter(&buf)
+		if err := rw.WriteLength(tt.n); err != nil {
+			t.Fatal(err)
+		}
+		rw.w.Flush()
+		if buf.Len() != tt.size {
+			t.Errorf("length %d encoded in %d bytes, want %d", tt.n, buf.Len(), tt.size)
+		}
+		got, encoded, err := NewRDBReader(&buf, int64(buf.Len())).ReadLength()
+		if err != nil || encoded || got != tt.n {
+			t.Errorf("length %d read back as %d, encoded %v, error %v", tt.n, got, encoded, err)
+		}
+	}
+}
+
+func TestRDBReadIntegerStrings(t *testing.T) {
+	tests := []struct {
+		input []byte
+		want  string
+	}{
+		{[]byte{0xC0, 0xFE}, "-2"},
+		{[]byte{0xC1, 0x39, 0x30}, "12345"},
+		{[]byte{0xC2, 0x00, 0x00, 0x00, 0x80}, "-2147483648"},
+		{[]byte{0x03, 'a', 'b', 'c'}, "abc"},
+	}
+
+	for _, tt := range tests {
+		got, err := NewRDBReader(bytes.NewReader(tt.input), int64(len(tt.input))).ReadString()
+		if err != nil || string(got) != tt.want {
+			t.Errorf("%x read as %q, error %v, want %q", tt.input, got, err, tt.want)
+		}
+	}
+	if _, err := NewRDBReader(bytes.NewReader([]byte{0xC3}), 1).ReadString(); err == nil {
+		t.Error("expected compressed strings to be rejected")
+	}
+	// a corrupt length is refused before anything is allocated for it
+	huge := []byte{0x81, 0x7F, 0xFF, 0xFF, 0xFF, 0xFF, 0xFF, 0xFF, 0xFF, 'a'}
+	if _, err := NewRDBReader(bytes.NewReader(huge), int64(len(huge))).ReadString(); !errors.Is(err, io.ErrUnexpectedEOF) {
+		t.Errorf("got error %v for a length past the end of the input", err)
+	}
+}
+
+// Starts a server on dir loading whatever snapshot is there
+func loadServer(t *testing.T, dir string, directives ...string) *Server {
+	t.Helper()
+	cfg := NewConfig()
+	if err := cfg.LoadString(fmt.Sprintf("dir %q\n", dir)); err != nil {
+		t.Fatal(err)
+	}
+	for _, d := range directives {
+		if err := cfg.LoadString(d); err != nil {
+			t.Fatal(err)
+		}
+	}
+	s, err := NewServer(Options{Config: cfg, Addr: "127.0.0.1:0", LoadSnapshot: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { s.Close() })
+	return s
+}
+
+func TestSnapshotRoundTrip(t *testing.T) {
+	dir := t.TempDir()
+	s := startServer(t, fmt.Sprintf("dir %q", dir))
+	c := dial(t, s.Addr())
+
+	expectReply(t, c.Do("SET", "plain", "v"), "OK")
+	expectReply(t, c.Do("SET", "number", "12345"), "OK")
+	expectReply(t, c.Do("SET", "ttl", "v", "EX", "1000"), "OK")
+	expectReply(t, c.Do("RPUSH", "list", "a", "b", "c"), int64(3))
+	expectReply(t, c.Do("SELECT", "3"), "OK")
+	expectReply(t, c.Do("SET", "other", "db3"), "OK")
+	expectReply(t, c.Do("FUNCTION", "LOAD", "#!lua name=lib\nredis.register_function('f', function() return 1 end)"), "lib")
+	// a key that expired but wasn't reclaimed yet is left out of the dump
+	db := s.Handler.Databases[0]
+	db.lock.Lock()
+	db.store["expired"] = RedisObject{NativeType: Bytes, Data: KV_Data{Data: []byte("v"), TTL: time.Now().Add(-time.Second)}}
+	db.lock.Unlock()
+	expectReply(t, c.Do("SAVE"), "OK")
+	if s.Stats.Dirty.Load() != 0 {
+		t.Fatalf("dirty = %d after SAVE, want 0", s.Stats.Dirty.Load())
+	}
+
+	loaded := loadServer(t, dir)
+	lc := dial(t, loaded.Addr())
+	expectReply(t, lc.Do("GET", "plain"), "v")
+	expectReply(t, lc.Do("GET", "number"), "12345")
+	expectReply(t, lc.Do("GET", "expired"), nil)
+	expectReply(t, lc.Do("LRANGE", "list", "0", "-1"), []any{"a", "b", "c"})
+	expectReply(t, lc.Do("GET", "other"), nil)
+	expectReply(t, lc.Do("FCALL", "f", "0"), int64(1))
+	expectReply(t, lc.Do("SELECT", "3"), "OK")
+	expectReply(t, lc.Do("GET", "other"), "db3")
+
+	kv := loaded.Handler.Databases[0].store["ttl"].Data.(KV_Data)
+	if remaining := time.Until(kv.TTL); remaining <= 990*time.Second || remaining > 1000*time.Second {
+		t.Fatalf("ttl key expires in %v, want about 1000s", remaining)
+	}
+}
+
+func TestLoadSnapshotErrors(t *testing.T) {
+	tests := []struct {
+		name     string
+		contents []byte
+		err      string
+	}{
+		{name: "bad signature", contents: []byte("NOTREDIS0011"), err: "wrong signature"},
+		{name: "newer version", contents: []byte("REDIS0099"), err: "can't handle RDB format version 0099"},
+		{name: "truncated", contents: []byte("REDIS0011\xfe"), err: "EOF"},
+		{name: "bad checksum", contents: []byte("REDIS0011\xff\x01\x02\x03\x04\x05\x06\x07\x08"), err: "wrong RDB checksum"},
+		{name: "string longer than the file", contents: []byte("REDIS0011\x00\x80\xff\xff\xff\xffkey"), err: "unexpected EOF reading 4294967295 bytes, only 3 left"},
+		{name: "database out of range", contents: []byte("REDIS0011\xfe\x20"), err: "only 16 databases are configured"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			h := &Handler{Config: NewConfig(), Databases: NewDatabases(16), Scripts: NewScriptEngine()}
+			h.Config.LoadString(fmt.Sprintf("dir %q", t.TempDir()))
+			if err := os.WriteFile(h.SnapshotPath(), tt.contents, 0644); err != nil {
+				t.Fatal(err)
+			}
+			err := h.LoadSnapshot()
+			if err == nil || !strings.Contains(err.Error(), tt.err) {
+				t.Fatalf("got error %v, want one containing %q", err, tt.err)
+			}
+		})
+	}
+}
+
+func TestShutdownSaves(t *testing.T) {
+	tests := []struct {
+		name      string
+		save      string
+		args      []string
+		wantSaved bool
+	}{
+		{name: "save points configured", save: "3600 1", args: nil, wantSaved: true},
+		{name: "no save points", save: `""`, args: nil, wantSaved: false},
+		{name: "SAVE without save points", save: `""`, args: []string{"SAVE"}, wantSaved: true},
+		{name: "NOSAVE with save points", save: "3600 1", args: []string{"NOSAVE"}, wantSaved: false},
+		{name: "NOW SAVE", save: `""`, args: []string{"NOW", "SAVE"}, wantSaved: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := startServer(t, "save "+tt.save)
+			c := dial(t, s.Addr())
+			expectReply(t, c.Do("SET", "k", "v"), "OK")
+
+			c.Send(append([]string{"SHUTDOWN"}, tt.args...)...)
+			if _, err := readReply(c.r); err == nil {
+				t.Fatal("expected SHUTDOWN to close the connection without a reply")
+			}
+			s.Wait()
+			if saved := fileExists(s.Handler.SnapshotPath()); saved != tt.wantSaved {
+				t.Fatalf("snapshot written: %v, want %v", saved, tt.wantSaved)
+			}
+		})
+	}
+}
+
+func TestShutdownSyntax(t *testing.T) {
+	s := startServer(t)
+	c := dial(t, s.Addr())
+	expectReply(t, c.Do("SHUTDOWN", "SAVE", "NOSAVE"), replyError("ERR syntax error"))
+	expectReply(t, c.Do("SHUTDOWN", "LATER"), replyError("ERR syntax error"))
+	expectReply(t, c.Do("SHUTDOWN", "ABORT"), replyError("ERR No shutdown in progress."))
+	expectReply(t, c.Do("PING"), "PONG")
+}
+
+func TestFailedShutdownSaveKeepsServing(t *testing.T) {
+	dir := t.TempDir()
+	s := startServer(t, fmt.Sprintf("dir %q", dir), "save 3600 1")
+	c := dial(t, s.Addr())
+
+	// the dump can't be written once its directory is gone
+	if err := os.RemoveAll(dir); err != nil {
+		t.Fatal(err)
+	}
+	expectReply(t, c.Do("SHUTDOWN"), replyError("ERR Errors trying to SHUTDOWN. Check logs."))
+	expectReply(t, c.Do("PING"), "PONG")
+
+	c.Send("SHUTDOWN", "FORCE")
+	if _, err := readReply(c.r); err == nil {
+		t.Fatal("expected SHUTDOWN FORCE to exit despite the failed save")
+	}
+	s.Wait()
+}
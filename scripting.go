@@ -0,0 +1,564 @@
+package redisclone
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha1"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log/slog"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	lua "github.com/yuin/gopher-lua"
+	"github.com/yuin/gopher-lua/parse"
+)
+
+// Compiled scripts keyed by the SHA1 of their body, function libraries, and the script currently running (if any)
+type ScriptEngine struct {
+	scripts   map[string]*lua.FunctionProto
+	bodies    map[string]string
+	libraries map[string]*FunctionLibrary
+	functions map[string]*ScriptFunction // every registered function across libraries
+	running   *RunningScript
+	client    *Client // fake client every redis.call runs through
+	lock      sync.Mutex
+}
+
+type RunningScript struct {
+	Name     string // SHA1 of the script or name of the function
+	Command  []string
+	Start    time.Time
+	ReadOnly bool
+	Wrote    bool // a script that already wrote can't be killed without leaving a partial update behind
+	Killed   bool
+	cancel   context.CancelFunc
+}
+
+func NewScriptEngine() *ScriptEngine {
+	return &ScriptEngine{
+		scripts:   make(map[string]*lua.FunctionProto),
+		bodies:    make(map[string]string),
+		libraries: make(map[string]*FunctionLibrary),
+		functions: make(map[string]*ScriptFunction),
+		client:    &Client{Protocol: RESP2, Watch: NewWatchState(), Script: true},
+	}
+}
+
+func ScriptSHA1(body []byte) string {
+	sum := sha1.Sum(body)
+	return hex.EncodeToString(sum[:])
+}
+
+// Compiles body and caches it under its SHA1, compiling an already cached script is a no-op
+func (se *ScriptEngine) Load(body []byte) (string, error) {
+	sha := ScriptSHA1(body)
+
+	se.lock.Lock()
+	defer se.lock.Unlock()
+
+	if _, ok := se.scripts[sha]; ok {
+		return sha, nil
+	}
+	proto, err := CompileLua(body, "user_script")
+	if err != nil {
+		return "", fmt.Errorf("ERR Error compiling script (new function): %s", err)
+	}
+	se.scripts[sha] = proto
+	se.bodies[sha] = string(body)
+	return sha, nil
+}
+
+func (se *ScriptEngine) Lookup(sha string) (*lua.FunctionProto, bool) {
+	se.lock.Lock()
+	defer se.lock.Unlock()
+
+	proto, ok := se.scripts[strings.ToLower(sha)]
+	return proto, ok
+}
+
+func (se *ScriptEngine) Flush() {
+	se.lock.Lock()
+	defer se.lock.Unlock()
+
+	clear(se.scripts)
+	clear(se.bodies)
+}
+
+// True once a script has been running for longer than threshold milliseconds
+func (se *ScriptEngine) IsBusy(threshold int64) bool {
+	se.lock.Lock()
+	defer se.lock.Unlock()
+
+	return se.running != nil && time.Since(se.running.Start) > time.Duration(threshold)*time.Millisecond
+}
+
+func (se *ScriptEngine) begin(running *RunningScript) {
+	se.lock.Lock()
+	defer se.lock.Unlock()
+
+	running.Start = time.Now()
+	se.running = running
+}
+
+// Returns a copy of the running script's state, or nil when idle
+func (se *ScriptEngine) Running() *RunningScript {
+	se.lock.Lock()
+	defer se.lock.Unlock()
+
+	if se.running == nil {
+		return nil
+	}
+	running := *se.running
+	return &running
+}
+
+func (se *ScriptEngine) end() {
+	se.lock.Lock()
+	defer se.lock.Unlock()
+
+	se.running = nil
+}
+
+// Called before a script runs a write command, read-only scripts get an error instead
+func (se *ScriptEngine) BeginWrite() error {
+	se.lock.Lock()
+	defer se.lock.Unlock()
+
+	if se.running == nil {
+		return nil
+	}
+	if se.running.ReadOnly {
+		return errors.New("ERR Write commands are not allowed from read-only scripts.")
+	}
+	se.running.Wrote = true
+	return nil
+}
+
+// Stops the running script, refusing if it already wrote unless force is set
+func (se *ScriptEngine) Kill(force bool) error {
+	se.lock.Lock()
+	defer se.lock.Unlock()
+
+	if se.running == nil {
+		return errors.New("NOTBUSY No scripts in execution right now.")
+	}
+	if se.running.Wrote && !force {
+		return errors.New("UNKILLABLE Sorry the script already executed write commands against the dataset. You can either wait the script termination or kill the server in a hard way using the SHUTDOWN NOSAVE command.")
+	}
+	se.running.Killed = true
+	se.running.cancel()
+	return nil
+}
+
+func CompileLua(body []byte, name string) (*lua.FunctionProto, error) {
+	chunk, err := parse.Parse(bytes.NewReader(body), name)
+	if err != nil {
+		return nil, err
+	}
+	return lua.Compile(chunk, name)
+}
+
+// Creates an interpreter with only the libraries scripts are allowed to use
+func NewSandboxState() *lua.LState {
+	L := lua.NewState(lua.Options{SkipOpenLibs: true})
+	for _, lib := range []struct {
+		name string
+		open lua.LGFunction
+	}{{lua.BaseLibName, lua.OpenBase}, {lua.TabLibName, lua.OpenTable}, {lua.StringLibName, lua.OpenString}, {lua.MathLibName, lua.OpenMath}} {
+		L.Push(L.NewFunction(lib.open))
+		L.Push(lua.LString(lib.name))
+		L.Call(1, 0)
+	}
+	for _, name := range []string{"dofile", "loadfile", "load", "loadstring", "collectgarbage", "module", "require"} {
+		L.SetGlobal(name, lua.LNil)
+	}
+	return L
+}
+
+// Global variables can't be created once the script starts, like in Redis they usually are a typo for a local
+func ProtectGlobals(L *lua.LState) {
+	mt := L.NewTable()
+	L.SetField(mt, "__newindex", L.NewFunction(func(L *lua.LState) int {
+		L.RaiseError("Script attempted to create global variable '%s'", L.CheckString(2))
+		return 0
+	}))
+	L.SetField(mt, "__index", L.NewFunction(func(L *lua.LState) int {
+		L.RaiseError("Script attempted to access nonexistent global variable '%s'", L.CheckString(2))
+		return 0
+	}))
+	L.SetMetatable(L.Get(lua.GlobalsIndex), mt)
+}
+
+// The parts of the redis table that don't touch the dataset, redis.call and redis.pcall are added by SetRedisCall
+func NewRedisLuaTable(L *lua.LState) *lua.LTable {
+	redis := L.NewTable()
+	L.SetField(redis, "sha1hex", L.NewFunction(func(L *lua.LState) int {
+		L.Push(lua.LString(ScriptSHA1([]byte(L.CheckString(1)))))
+		return 1
+	}))
+	L.SetField(redis, "error_reply", L.NewFunction(func(L *lua.LState) int {
+		msg := L.CheckString(1)
+		if !strings.HasPrefix(msg, "-") {
+			msg = "-" + msg
+		}
+		t := L.NewTable()
+		t.RawSetString("err", lua.LString(msg))
+		L.Push(t)
+		return 1
+	}))
+	L.SetField(redis, "status_reply", L.NewFunction(func(L *lua.LState) int {
+		t := L.NewTable()
+		t.RawSetString("ok", lua.LString(L.CheckString(1)))
+		L.Push(t)
+		return 1
+	}))
+	L.SetField(redis, "log", L.NewFunction(func(L *lua.LState) int {
+		level := L.CheckInt(1)
+		var parts []string
+		for i := 2; i <= L.GetTop(); i++ {
+			parts = append(parts, L.ToStringMeta(L.Get(i)).String())
+		}
+		msg := strings.Join(parts, " ")
+		switch level {
+		case 0:
+			slog.Debug(msg)
+		case 1, 2:
+			slog.Info(msg)
+		default:
+			slog.Warn(msg)
+		}
+		return 0
+	}))
+	for name, level := range map[string]int{"LOG_DEBUG": 0, "LOG_VERBOSE": 1, "LOG_NOTICE": 2, "LOG_WARNING": 3} {
+		L.SetField(redis, name, lua.LNumber(level))
+	}
+	return redis
+}
+
+func (s *Server) SetRedisCall(L *lua.LState, redis *lua.LTable) {
+	L.SetField(redis, "call", L.NewFunction(func(L *lua.LState) int { return s.LuaRedisCall(L, true) }))
+	L.SetField(redis, "pcall", L.NewFunction(func(L *lua.LState) int { return s.LuaRedisCall(L, false) }))
+}
+
+// Backs redis.call and redis.pcall: errors are raised by call and returned as an error table by pcall
+func (s *Server) LuaRedisCall(L *lua.LState, raise bool) int {
+	fail := func(msg string) int {
+		if !strings.HasPrefix(msg, "-") {
+			msg = "-" + msg
+		}
+		t := L.NewTable()
+		t.RawSetString("err", lua.LString(msg))
+		if raise {
+			L.Error(t, 1)
+		}
+		L.Push(t)
+		return 1
+	}
+
+	if L.GetTop() == 0 {
+		return fail("ERR Please specify at least one argument for this redis lib call")
+	}
+	argv := make([][]byte, 0, L.GetTop())
+	for i := 1; i <= L.GetTop(); i++ {
+		switch v := L.Get(i).(type) {
+		case lua.LString:
+			argv = append(argv, []byte(v))
+		case lua.LNumber:
+			argv = append(argv, []byte(v.String()))
+		default:
+			return fail("ERR Lua redis lib command arguments must be strings or integers")
+		}
+	}
+	cmd := Command{Name: string(argv[0]), Args: argv[1:]}
+
+	rc, errReply := s.Handler.ResolveCommand(cmd)
+	if errReply != nil {
+		return fail(strings.TrimSuffix(string(errReply), "\r\n"))
+	}
+	if rc.HasFlag(FlagNoScript) {
+		return fail("ERR This Redis command is not allowed from script")
+	}
+	if rc.HasFlag(FlagWrite) {
+		if err := s.Scripts.BeginWrite(); err != nil {
+			return fail(err.Error())
+		}
+	}
+
+	cmd.Name = strings.ToUpper(cmd.Name)
+	reply := s.CallCommand(s.Scripts.client, cmd)
+	if len(reply) > 0 && reply[0] == '-' {
+		return fail(strings.TrimSuffix(string(reply), "\r\n"))
+	}
+
+	v, _, err := ReplyToLua(L, reply)
+	if err != nil {
+		return fail("ERR " + err.Error())
+	}
+	L.Push(v)
+	return 1
+}
+
+// Converts one RESP2 reply into a Lua value following the Redis conversion rules, returns the bytes consumed
+func ReplyToLua(L *lua.LState, reply []byte) (lua.LValue, int, error) {
+	end := bytes.Index(reply, []byte("\r\n"))
+	if len(reply) == 0 || end < 0 {
+		return nil, 0, errors.New("truncated reply")
+	}
+	line := string(reply[1:end])
+	consumed := end + 2
+
+	switch reply[0] {
+	case '+':
+		t := L.NewTable()
+		t.RawSetString("ok", lua.LString(line))
+		return t, consumed, nil
+	case '-':
+		t := L.NewTable()
+		t.RawSetString("err", lua.LString(line))
+		return t, consumed, nil
+	case ':':
+		n, err := strconv.ParseInt(line, 10, 64)
+		return lua.LNumber(n), consumed, err
+	case '$':
+		n, err := strconv.Atoi(line)
+		if err != nil {
+			return nil, 0, err
+		}
+		if n < 0 {
+			return lua.LFalse, consumed, nil
+		}
+		if len(reply) < consumed+n+2 {
+			return nil, 0, errors.New("truncated reply")
+		}
+		return lua.LString(reply[consumed : consumed+n]), consumed + n + 2, nil
+	case '*':
+		n, err := strconv.Atoi(line)
+		if err != nil {
+			return nil, 0, err
+		}
+		if n < 0 {
+			return lua.LFalse, consumed, nil
+		}
+		t := L.CreateTable(n, 0)
+		for range n {
+			v, used, err := ReplyToLua(L, reply[consumed:])
+			if err != nil {
+				return nil, 0, err
+			}
+			t.Append(v)
+			consumed += used
+		}
+		return t, consumed, nil
+	}
+	return nil, 0, fmt.Errorf("unsupported reply type '%c'", reply[0])
+}
+
+// Converts a script's return value into a reply following the Redis conversion rules
+func (h *Handler) LuaToReply(c *Client, v lua.LValue) []byte {
+	switch v := v.(type) {
+	case lua.LString:
+		return h.Encoder.GenerateBulkString([]byte(v))
+	case lua.LNumber:
+		// numbers are truncated to integers, return a string to keep the fraction
+		return h.Encoder.GenerateInt(int(v))
+	case lua.LBool:
+		if v {
+			return h.Encoder.GenerateInt(1)
+		}
+		return h.Encoder.GetNull(c.Protocol)
+	case *lua.LTable:
+		if msg, ok := v.RawGetString("err").(lua.LString); ok {
+			return h.Encoder.GenerateSimpleError(strings.TrimPrefix(string(msg), "-"))
+		}
+		if msg, ok := v.RawGetString("ok").(lua.LString); ok {
+			return h.Encoder.GenerateSimpleString([]byte(msg))
+		}
+		// arrays stop at the first nil, just like in Redis
+		var items [][]byte
+		for i := 1; ; i++ {
+			item := v.RawGetInt(i)
+			if item == lua.LNil {
+				break
+			}
+			items = append(items, h.LuaToReply(c, item))
+		}
+		return h.Encoder.GenerateRawArray(items)
+	}
+	return h.Encoder.GetNull(c.Protocol)
+}
+
+// Runs a compiled script with KEYS and ARGV set, the caller holds the exec lock exclusively
+func (s *Server) RunScript(c *Client, cmd Command, sha string, proto *lua.FunctionProto, keys, args [][]byte) []byte {
+	L := NewSandboxState()
+	defer L.Close()
+
+	redis := NewRedisLuaTable(L)
+	s.SetRedisCall(L, redis)
+	L.SetGlobal("redis", redis)
+	L.SetGlobal("KEYS", NewLuaStringArray(L, keys))
+	L.SetGlobal("ARGV", NewLuaStringArray(L, args))
+	ProtectGlobals(L)
+
+	return s.CallLua(c, L, L.NewFunctionFromProto(proto), nil, &RunningScript{Name: sha, Command: CommandStrings(cmd)})
+}
+
+// Calls fn and converts its result into a reply, the script can be stopped through SCRIPT KILL or FUNCTION KILL meanwhile
+func (s *Server) CallLua(c *Client, L *lua.LState, fn *lua.LFunction, args []lua.LValue, running *RunningScript) []byte {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	running.cancel = cancel
+	// scripts start in the caller's database, a SELECT inside the script doesn't leak back to the caller
+	s.Scripts.client.SelectDB(c.DB())
+	// commands called by the script are subject to the caller's ACL user
+	s.Scripts.client.SetAuthenticated(c.User())
+	s.Scripts.client.Caller = c
+	s.Scripts.begin(running)
+	defer s.Scripts.end()
+
+	L.SetContext(ctx)
+	defer L.RemoveContext()
+
+	L.Push(fn)
+	for _, arg := range args {
+		L.Push(arg)
+	}
+	if err := L.PCall(len(args), 1, nil); err != nil {
+		return s.Handler.Encoder.GenerateSimpleError(s.ScriptErrorMessage(running.Name, running, err))
+	}
+	defer L.Pop(1)
+	return s.Handler.LuaToReply(c, L.Get(-1))
+}
+
+func NewLuaStringArray(L *lua.LState, values [][]byte) *lua.LTable {
+	t := L.CreateTable(len(values), 0)
+	for _, v := range values {
+		t.Append(lua.LString(v))
+	}
+	return t
+}
+
+func CommandStrings(cmd Command) []string {
+	argv := []string{strings.ToLower(cmd.Name)}
+	for _, v := range cmd.Args {
+		argv = append(argv, string(v))
+	}
+	return argv
+}
+
+func (s *Server) ScriptErrorMessage(source string, running *RunningScript, err error) string {
+	if running.Killed {
+		return "ERR Script killed by user with SCRIPT KILL..."
+	}
+
+	var apiErr *lua.ApiError
+	if errors.As(err, &apiErr) {
+		// errors raised by redis.call keep their own prefix
+		if t, ok := apiErr.Object.(*lua.LTable); ok {
+			if msg, ok := t.RawGetString("err").(lua.LString); ok {
+				return fmt.Sprintf("%s script: %s", strings.TrimPrefix(string(msg), "-"), source)
+			}
+		}
+		return fmt.Sprintf("ERR %s script: %s", apiErr.Object.String(), source)
+	}
+	return fmt.Sprintf("ERR %s script: %s", err, source)
+}
+
+// Splits EVAL style arguments (numkeys key [key ...] arg [arg ...]) into keys and args
+func ParseScriptKeys(args [][]byte) ([][]byte, [][]byte, error) {
+	numKeys, err := strconv.Atoi(string(args[0]))
+	if err != nil {
+		return nil, nil, errors.New("ERR value is not an integer or out of range")
+	}
+	if numKeys < 0 {
+		return nil, nil, errors.New("ERR Number of keys can't be negative")
+	}
+	if numKeys > len(args)-1 {
+		return nil, nil, errors.New("ERR Number of keys can't be greater than number of args")
+	}
+	return args[1 : 1+numKeys], args[1+numKeys:], nil
+}
+
+// Key positions for EVAL style commands, where argv[2] holds the number of keys
+func ScriptGetKeys(argv [][]byte) []int {
+	if len(argv) < 3 {
+		return nil
+	}
+	numKeys, err := strconv.Atoi(string(argv[2]))
+	if err != nil || numKeys < 0 || numKeys > len(argv)-3 {
+		return nil
+	}
+	var positions []int
+	for i := range numKeys {
+		positions = append(positions, 3+i)
+	}
+	return positions
+}
+
+// Scripting Commands
+func (s *Server) HandleEvalCommand(c *Client, cmd Command) []byte {
+	keys, args, err := ParseScriptKeys(cmd.Args[1:])
+	if err != nil {
+		return s.Handler.Encoder.GenerateSimpleError(err.Error())
+	}
+	sha, err := s.Scripts.Load(cmd.Args[0])
+	if err != nil {
+		return s.Handler.Encoder.GenerateSimpleError(err.Error())
+	}
+	proto, _ := s.Scripts.Lookup(sha)
+	return s.RunScript(c, cmd, sha, proto, keys, args)
+}
+
+func (s *Server) HandleEvalShaCommand(c *Client, cmd Command) []byte {
+	keys, args, err := ParseScriptKeys(cmd.Args[1:])
+	if err != nil {
+		return s.Handler.Encoder.GenerateSimpleError(err.Error())
+	}
+	sha := strings.ToLower(string(cmd.Args[0]))
+	proto, ok := s.Scripts.Lookup(sha)
+	if !ok {
+		return s.Handler.Encoder.GenerateSimpleError("NOSCRIPT No matching script. Please use EVAL.")
+	}
+	return s.RunScript(c, cmd, sha, proto, keys, args)
+}
+
+func (s *Server) HandleScriptLoadCommand(c *Client, cmd Command) []byte {
+	sha, err := s.Scripts.Load(cmd.Args[1])
+	if err != nil {
+		return s.Handler.Encoder.GenerateSimpleError(err.Error())
+	}
+	return s.Handler.Encoder.GenerateBulkString([]byte(sha))
+}
+
+func (s *Server) HandleScriptExistsCommand(c *Client, cmd Command) []byte {
+	var items [][]byte
+	for _, sha := range cmd.Args[1:] {
+		_, ok := s.Scripts.Lookup(string(sha))
+		items = append(items, s.Handler.Encoder.GenerateInt(BoolToInt(ok)))
+	}
+	return s.Handler.Encoder.GenerateRawArray(items)
+}
+
+func (s *Server) HandleScriptFlushCommand(c *Client, cmd Command) []byte {
+	if len(cmd.Args) > 2 {
+		return s.Handler.Encoder.GenerateSimpleError("ERR SCRIPT FLUSH only support SYNC|ASYNC option")
+	}
+	if len(cmd.Args) == 2 {
+		mode := strings.ToUpper(string(cmd.Args[1]))
+		if mode != "SYNC" && mode != "ASYNC" {
+			return s.Handler.Encoder.GenerateSimpleError("ERR SCRIPT FLUSH only support SYNC|ASYNC option")
+		}
+	}
+	s.Scripts.Flush()
+	return s.Handler.Encoder.GetSimpleStringOk()
+}
+
+func (s *Server) HandleScriptKillCommand(c *Client, cmd Command) []byte {
+	if err := s.Scripts.Kill(false); err != nil {
+		return s.Handler.Encoder.GenerateSimpleError(err.Error())
+	}
+	return s.Handler.Encoder.GetSimpleStringOk()
+}
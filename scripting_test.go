@@ -0,0 +1,177 @@
+package redisclone
+
+import (
+	"slices"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParseScriptKeys(t *testing.T) {
+	tests := []struct {
+		args []string
+		keys []string
+		rest []string
+		err  string
+	}{
+		{args: []string{"0"}},
+		{args: []string{"0", "a"}, rest: []string{"a"}},
+		{args: []string{"2", "k1", "k2", "a"}, keys: []string{"k1", "k2"}, rest: []string{"a"}},
+		{args: []string{"1", "k"}, keys: []string{"k"}},
+		{args: []string{"x"}, err: "ERR value is not an integer or out of range"},
+		{args: []string{"-1"}, err: "ERR Number of keys can't be negative"},
+		{args: []string{"2", "k"}, err: "ERR Number of keys can't be greater than number of args"},
+	}
+
+	for _, tt := range tests {
+		var args [][]byte
+		for _, a := range tt.args {
+			args = append(args, []byte(a))
+		}
+		keys, rest, err := ParseScriptKeys(args)
+		if tt.err != "" {
+			if err == nil || err.Error() != tt.err {
+				t.Errorf("%q: got error %v, want %q", tt.args, err, tt.err)
+			}
+			continue
+		}
+		if err != nil || !slices.Equal(byteStrings(keys), tt.keys) || !slices.Equal(byteStrings(rest), tt.rest) {
+			t.Errorf("%q: got keys %q args %q error %v, want keys %q args %q", tt.args, keys, rest, err, tt.keys, tt.rest)
+		}
+	}
+}
+
+func byteStrings(values [][]byte) []string {
+	var out []string
+	for _, v := range values {
+		out = append(out, string(v))
+	}
+	return out
+}
+
+func TestEvalReplyConversion(t *testing.T) {
+	tests := []struct {
+		script string
+		want   any
+	}{
+		{script: "return 'hello'", want: "hello"},
+		{script: "return 42", want: int64(42)},
+		{script: "return 3.99", want: int64(3)},
+		{script: "return true", want: int64(1)},
+		{script: "return false", want: nil},
+		{script: "return nil", want: nil},
+		{script: "return {1, 'two', {3}}", want: []any{int64(1), "two", []any{int64(3)}}},
+		{script: "return {1, nil, 3}", want: []any{int64(1)}},
+		{script: "return redis.status_reply('FINE')", want: "FINE"},
+		{script: "return redis.error_reply('MY error')", want: replyError("MY error")},
+		{script: "return {KEYS[1], ARGV[1], #KEYS, #ARGV}", want: []any{"k", "a", int64(1), int64(1)}},
+		{script: "return redis.sha1hex('')", want: "da39a3ee5e6b4b0d3255bfef95601890afd80709"},
+		// replies of redis.call come back converted the other way
+		{script: "return redis.call('SET', KEYS[1], 'v')", want: "OK"},
+		{script: "return redis.call('GET', 'missing') == false", want: int64(1)},
+		{script: "return redis.call('RPUSH', 'list', 'a', 'b')", want: int64(2)},
+		{script: "return redis.call('LRANGE', 'list', 0, -1)", want: []any{"a", "b"}},
+		{script: "return redis.pcall('GET', 'list')", want: replyError("WRONGTYPE Operation against a key holding the wrong kind of value")},
+	}
+
+	s := startServer(t)
+	c := dial(t, s.Addr())
+	for _, tt := range tests {
+		expectReply(t, c.Do("EVAL", tt.script, "1", "k", "a"), tt.want)
+	}
+}
+
+func TestEvalErrors(t *testing.T) {
+	tests := []struct {
+		script string
+		err    string
+	}{
+		{script: "return (", err: "ERR Error compiling script (new function): "},
+		{script: "return redis.call('GET', 'list')", err: "WRONGTYPE Operation against a key holding the wrong kind of value script: "},
+		{script: "return redis.call('NOPE')", err: "ERR unknown command 'NOPE'"},
+		{script: "return redis.call('SAVE')", err: "ERR This Redis command is not allowed from script script: "},
+		{script: "return redis.call()", err: "ERR Please specify at least one argument for this redis lib call script: "},
+		{script: "return redis.call('GET', {})", err: "ERR Lua redis lib command arguments must be strings or integers script: "},
+		{script: "x = 1", err: "Script attempted to create global variable 'x'"},
+		{script: "return undefined_name", err: "Script attempted to access nonexistent global variable 'undefined_name'"},
+		{script: "return loadstring('return 1')", err: "Script attempted to access nonexistent global variable 'loadstring'"},
+		{script: "error('boom')", err: "boom"},
+	}
+
+	s := startServer(t)
+	c := dial(t, s.Addr())
+	expectReply(t, c.Do("RPUSH", "list", "a"), int64(1))
+	for _, tt := range tests {
+		got, ok := c.Do("EVAL", tt.script, "0").(replyError)
+		if !ok || !strings.Contains(string(got), tt.err) {
+			t.Errorf("%q: got %#v, want an error containing %q", tt.script, got, tt.err)
+		}
+	}
+
+	expectReply(t, c.Do("EVAL", "return 1", "x"), replyError("ERR value is not an integer or out of range"))
+	expectReply(t, c.Do("EVAL", "return 1", "2", "k"), replyError("ERR Number of keys can't be greater than number of args"))
+}
+
+func TestScriptCache(t *testing.T) {
+	s := startServer(t)
+	c := dial(t, s.Addr())
+	script := "return ARGV[1]"
+	sha := ScriptSHA1([]byte(script))
+
+	expectReply(t, c.Do("EVALSHA", sha, "0", "x"), replyError("NOSCRIPT No matching script. Please use EVAL."))
+	expectReply(t, c.Do("SCRIPT", "LOAD", script), sha)
+	expectReply(t, c.Do("EVALSHA", strings.ToUpper(sha), "0", "x"), "x")
+	expectReply(t, c.Do("SCRIPT", "EXISTS", sha, "0000"), []any{int64(1), int64(0)})
+	if got, ok := c.Do("SCRIPT", "LOAD", "return (").(replyError); !ok || !strings.HasPrefix(string(got), "ERR Error compiling script") {
+		t.Fatalf("got %#v, want a compile error", got)
+	}
+
+	expectReply(t, c.Do("SCRIPT", "FLUSH", "NOW"), replyError("ERR SCRIPT FLUSH only support SYNC|ASYNC option"))
+	expectReply(t, c.Do("SCRIPT", "FLUSH", "ASYNC"), "OK")
+	expectReply(t, c.Do("SCRIPT", "EXISTS", sha), []any{int64(0)})
+
+	// EVAL caches the script too
+	expectReply(t, c.Do("EVAL", script, "0", "y"), "y")
+	expectReply(t, c.Do("EVALSHA", sha, "0", "z"), "z")
+}
+
+func TestScriptKill(t *testing.T) {
+	s := startServer(t, "busy-reply-threshold 0")
+	c, other := dial(t, s.Addr()), dial(t, s.Addr())
+	expectReply(t, other.Do("SCRIPT", "KILL"), replyError("NOTBUSY No scripts in execution right now."))
+
+	c.Send("EVAL", "while true do end", "0")
+	deadline := time.Now().Add(5 * time.Second)
+	for other.Do("PING") == "PONG" {
+		if time.Now().After(deadline) {
+			t.Fatal("the script never made the server busy")
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	expectReply(t, other.Do("GET", "k"), replyError("BUSY Redis is busy running a script. You can only call SCRIPT KILL or SHUTDOWN NOSAVE."))
+
+	expectReply(t, other.Do("SCRIPT", "KILL"), "OK")
+	expectReply(t, c.Read(), replyError("ERR Script killed by user with SCRIPT KILL..."))
+	expectReply(t, other.Do("PING"), "PONG")
+}
+
+func TestScriptKillAfterWrite(t *testing.T) {
+	se := NewScriptEngine()
+	running := &RunningScript{cancel: func() {}}
+	se.begin(running)
+	if err := se.BeginWrite(); err != nil {
+		t.Fatal(err)
+	}
+	if err := se.Kill(false); err == nil || !strings.HasPrefix(err.Error(), "UNKILLABLE") {
+		t.Fatalf("got %v, want an UNKILLABLE error", err)
+	}
+	if err := se.Kill(true); err != nil || !running.Killed {
+		t.Fatalf("got %v, want a forced kill to succeed", err)
+	}
+	se.end()
+
+	se.begin(&RunningScript{ReadOnly: true})
+	if err := se.BeginWrite(); err == nil {
+		t.Fatal("expected a read-only script to be refused writes")
+	}
+}
@@ -1,119 +1,429 @@
-package main
+package redisclone
 
 import (
+	"crypto/tls"
+	"errors"
 	"fmt"
 	"log/slog"
 	"net"
-	"os"
+	"runtime/debug"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
 )
 
+// Version reported to clients through HELLO and INFO
+const RedisVersion = "7.2.0"
+
 type Server struct {
-	Parser    Parser
-	Handler   Handler
-	connSet   map[net.Conn]bool
-	joinChan  chan (net.Conn)
-	leaveChan chan (net.Conn)
+	Parser       Parser
+	Handler      Handler
+	Clients      *ClientList
+	Config       *Config
+	Stats        *Stats
+	listeners    []net.Listener
+	tlsListeners []net.Listener // also in listeners, serve tls-port
+	tlsConfig    atomic.Pointer[tls.Config]
+	done         chan struct{}
+	inflight     sync.RWMutex // held for reading by every executing command, shutdown takes it exclusively
+	exec         sync.RWMutex // held for reading by most commands, EXEC and scripts take it exclusively
+	Scripts      *ScriptEngine
+	OutputLimits *OutputLimits
+	shuttingDown atomic.Bool
+	closed       atomic.Bool // set under the in-flight lock, unless SHUTDOWN NOW skips waiting for it
 }
 
-//TODO instead of having a generate nil string function or using generate bulk string for an "OK" response, just have they pre-made before hand maybe in a map and then use them multiple times
-//TODO improve error handling
+type Options struct {
+	Config        *Config      // nil runs with the default configuration
+	Addr          string       // listen on this address instead of bind/port, "127.0.0.1:0" picks a free port
+	Listener      net.Listener // serve on an existing listener, takes precedence over Addr
+	TLSAddr       string       // accept TLS connections on this address instead of bind/tls-port
+	LoadSnapshot  bool         // load dir/dbfilename before accepting connections
+	HandleSignals bool         // shut down gracefully on SIGTERM/SIGINT, only wanted by the standalone binary
+}
 
-// Bind to port, start new tcp server, and listen for client connections
-func (s *Server) StartServer() {
-	ln, err := net.Listen("tcp", ":6379") //binds to port localhost 6379
-	if err != nil {
-		slog.Error(err.Error())
-		os.Exit(1)
+// Creates a server and starts accepting client connections in the background.
+// Use Addr to find where it listens, Wait to block until it shuts down and Close to tear it down.
+func NewServer(opts Options) (*Server, error) {
+	cfg := opts.Config
+	if cfg == nil {
+		cfg = NewConfig()
 	}
 
-	slog.Info("Now listening on port 6793")
+	clients := NewClientList()
+	stats := NewStats()
+	scripts := NewScriptEngine()
+	pubsub := NewPubSub()
+	s := &Server{
+		Parser:  NewParser(cfg),
+		Handler: Handler{Databases: NewDatabases(int(cfg.GetInt("databases"))), Clients: clients, Config: cfg, Stats: stats, Scripts: scripts, PubSub: pubsub, Tracking: NewTracking(), Pause: NewPauseState()},
+		Clients: clients,
+		Config:  cfg,
+		Stats:   stats,
+		Scripts: scripts,
+		done:    make(chan struct{}),
 
+		OutputLimits: NewOutputLimits(cfg, stats),
+	}
 	s.Handler.InitalizeHandler()
-	go s.RegisterNewConnections()
-	go s.DisconnectConnections()
+	s.Handler.Commands = s.BuildCommandTable()
+	s.Handler.ACL = NewACL(s.Handler.Commands)
+	cfg.SetApply("notify-keyspace-events", s.Handler.ApplyKeyspaceEvents)
+	if err := s.Handler.ApplyKeyspaceEvents(cfg.Get("notify-keyspace-events")); err != nil {
+		return nil, err
+	}
+	cfg.SetApply("requirepass", s.Handler.ACL.ApplyRequirePass)
+	if err := s.Handler.ACL.ApplyRequirePass(cfg.Get("requirepass")); err != nil {
+		return nil, err
+	}
+	if path := cfg.GetString("aclfile"); path != "" {
+		if _, err := s.Handler.ACL.LoadFile(path); err != nil {
+			return nil, fmt.Errorf("loading the ACL file: %w", err)
+		}
+	}
 
-	for {
-		conn, err := ln.Accept()
+	if opts.LoadSnapshot {
+		if err := s.Handler.LoadSnapshot(); err != nil {
+			return nil, fmt.Errorf("loading the DB: %w", err)
+		}
+	}
+
+	switch {
+	case opts.Listener != nil:
+		s.listeners = []net.Listener{opts.Listener}
+	case opts.Addr != "":
+		ln, err := net.Listen("tcp", opts.Addr)
 		if err != nil {
-			slog.Error(err.Error())
-			continue
+			return nil, err
 		}
+		s.listeners = []net.Listener{ln}
+	case cfg.GetInt("port") != 0 || cfg.GetInt("tls-port") == 0:
+		// port 0 turns the plain TCP port off when TLS is enabled
+		if err := s.Listen(s.ListenAddresses(cfg.GetInt("port")), false); err != nil {
+			return nil, err
+		}
+	}
 
-		s.joinChan <- conn
-		go s.HandleClientStream(conn)
+	if opts.TLSAddr != "" || cfg.GetInt("tls-port") != 0 {
+		config, err := BuildTLSConfig(cfg)
+		if err != nil {
+			s.CloseListeners()
+			return nil, fmt.Errorf("configuring TLS: %w", err)
+		}
+		s.tlsConfig.Store(config)
 
+		addrs := s.ListenAddresses(cfg.GetInt("tls-port"))
+		if opts.TLSAddr != "" {
+			addrs = []string{opts.TLSAddr}
+		}
+		if err := s.Listen(addrs, true); err != nil {
+			return nil, err
+		}
+	}
+	for _, name := range TLSReloadParams {
+		cfg.SetApply(name, s.ReloadTLS)
 	}
+
+	for _, ln := range s.listeners {
+		slog.Info("Now listening", "addr", ln.Addr().String())
+		go s.AcceptConnections(ln)
+	}
+	go s.ClientsCron()
+	go s.SaveCron()
+	if opts.HandleSignals {
+		go s.HandleSignals()
+	}
+	return s, nil
 }
 
-func (s *Server) RegisterNewConnections() {
-	for c := range s.joinChan {
-		s.connSet[c] = true
+// Returns the address of the first listener, useful when listening on an ephemeral port
+func (s *Server) Addr() string {
+	return s.listeners[0].Addr().String()
+}
+
+// Returns the address of the first TLS listener, empty when TLS is disabled
+func (s *Server) TLSAddr() string {
+	if len(s.tlsListeners) == 0 {
+		return ""
 	}
+	return s.tlsListeners[0].Addr().String()
 }
 
-func (s *Server) DisconnectConnections() {
-	for c := range s.leaveChan {
-		delete(s.connSet, c)
+// Opens a listener for every address, wrapped in TLS when secure. On failure every listener opened so far is closed.
+func (s *Server) Listen(addrs []string, secure bool) error {
+	for _, addr := range addrs {
+		ln, err := net.Listen("tcp", addr)
+		if err != nil {
+			s.CloseListeners()
+			return err
+		}
+		if secure {
+			ln = tls.NewListener(ln, &tls.Config{GetConfigForClient: s.CurrentTLSConfig})
+			s.tlsListeners = append(s.tlsListeners, ln)
+		}
+		s.listeners = append(s.listeners, ln)
+	}
+	return nil
+}
+
+func (s *Server) CloseListeners() {
+	for _, ln := range s.listeners {
+		ln.Close()
+	}
+}
+
+// Blocks until the server has shut down, either through SHUTDOWN, a signal or Close
+func (s *Server) Wait() {
+	<-s.done
+}
+
+// Tears the server down without saving: listeners and every client connection are closed
+func (s *Server) Close() error {
+	select {
+	case <-s.done:
+		return nil
+	default:
+	}
+
+	return s.Shutdown(ShutdownOptions{NoSave: true})
+}
+
+// Translates the bind directive into listen addresses on port, "*" and "::*" are the IPv4 and IPv6 wildcards
+func (s *Server) ListenAddresses(portNumber int64) []string {
+	port := strconv.FormatInt(portNumber, 10)
+	binds := strings.Fields(s.Config.GetString("bind"))
+	if len(binds) == 0 {
+		return []string{net.JoinHostPort("", port)}
+	}
+
+	var addrs []string
+	for _, b := range binds {
+		switch strings.TrimPrefix(b, "-") {
+		case "*":
+			addrs = append(addrs, net.JoinHostPort("0.0.0.0", port))
+		case "::*":
+			addrs = append(addrs, net.JoinHostPort("::", port))
+		default:
+			addrs = append(addrs, net.JoinHostPort(strings.TrimPrefix(b, "-"), port))
+		}
+	}
+	return addrs
+}
+
+func (s *Server) AcceptConnections(ln net.Listener) {
+	for {
+		conn, err := ln.Accept()
+		if errors.Is(err, net.ErrClosed) {
+			return
+		}
+		if err != nil {
+			slog.Error(err.Error())
+			continue
+		}
+
+		c := s.Clients.Add(conn, int(s.Config.GetInt("maxclients")))
+		if c == nil {
+			// a TLS client has to finish its handshake before it can read the error, so don't hold up the accept loop
+			go s.RejectConnection(conn)
+			continue
+		}
+		s.Stats.TotalConnectionsReceived.Add(1)
+		s.ConfigureKeepAlive(conn)
+		c.Limits = s.OutputLimits
+		s.Handler.SetDefaultAuth(c)
+		go s.HandleClientStream(c)
+
 	}
 }
 
-func (s *Server) HandleClientStream(conn net.Conn) {
-	buf := make([]byte, 4096)
+func (s *Server) HandleClientStream(c *Client) {
+	conn := c.Conn
+	buf := make([]byte, 0, QueryBufInitialSize)
 	temp := make([]byte, 4096)
+	go c.WriteLoop()
+
+	if tlsConn, ok := conn.(*tls.Conn); ok {
+		if err := s.TLSHandshake(c, tlsConn); err != nil {
+			slog.Debug("Error accepting a client connection", "addr", conn.RemoteAddr().String(), "err", err)
+			s.FreeClient(c)
+			return
+		}
+	}
 
 	for {
 		n, err := conn.Read(temp)
 		if err != nil {
 			slog.Error(err.Error())
-			s.leaveChan <- conn
+			s.FreeClient(c)
 			return
 		}
 
 		buf = append(buf, temp[:n]...)
-		cmd, consumed, ok := s.Parser.TryParsingCommand(buf)
-		if !ok {
-			continue
+
+		// process every complete command in the buffer, a client may pipeline many in one packet
+		offset := 0
+		for offset < len(buf) {
+			cmd, consumed, ok, err := s.Parser.TryParsingCommand(buf[offset:])
+			if err != nil {
+				// a malformed request leaves the stream in an unknown state, so reply once and hang up
+				slog.Error("Closing client after protocol error", "id", c.ID, "err", err)
+				c.Write(s.Handler.Encoder.GenerateSimpleError(err.Error()))
+				s.FreeClient(c)
+				return
+			}
+			if !ok {
+				break
+			}
+			offset += consumed
+			if cmd.Name == "" {
+				continue
+			}
+
+			// replies to earlier pipelined commands shouldn't wait on a command that may block
+			if rc := s.Handler.Commands.Lookup(cmd.Name); rc != nil && rc.HasFlag(FlagBlocking) {
+				c.Flush()
+			}
+			c.RecordCommand(s.Handler.Commands.FullName(cmd))
+			c.Write(s.ExecuteCommand(c, cmd))
+			c.RecordState()
+			if c.CloseAfterReply {
+				s.FreeClient(c)
+				return
+			}
 		}
-		buf = buf[consumed:]
-
-		resp := s.HandleParsedCommands(cmd)
-		conn.Write(resp)
-
-	}
-}
-
-func (s *Server) HandleParsedCommands(cmd Command) []byte {
-	var response []byte
-	switch cmd.Name {
-	case "PING":
-		response = s.Handler.HandlePingCommand(cmd)
-	case "ECHO":
-		response = s.Handler.HandleEchoCommand(cmd)
-	case "TYPE":
-		response = s.Handler.HandleTypeCommand(cmd)
-	case "SET":
-		response = s.Handler.HandleSetCommand(cmd)
-	case "GET":
-		response = s.Handler.HandleGetCommand(cmd)
-	case "LPUSH":
-		response = s.Handler.HandleListPushCommand(cmd)
-	case "RPUSH":
-		response = s.Handler.HandleListPushCommand(cmd)
-	case "LRANGE":
-		response = s.Handler.HandleListRangeCommand(cmd)
-	case "LLEN":
-		response = s.Handler.HandleListLengthCommand(cmd)
-	case "LPOP":
-		response = s.Handler.HandleListPopCommand(cmd)
-	case "RPOP":
-		response = s.Handler.HandleListPopCommand(cmd)
-	case "BLPOP":
-		response = s.Handler.HandleListBlockingPopCommand(cmd)
-	case "BRPOP":
-		response = s.Handler.HandleListBlockingPopCommand(cmd)
-	default:
-		response = s.Handler.Encoder.GenerateSimpleError(fmt.Sprintf("ERR unknown command '%s'", cmd.Name))
+
+		c.Flush()
+		buf = s.CompactQueryBuffer(buf, offset)
 	}
+}
 
-	return response
+// Forgets a disconnected client along with its watched keys and subscriptions, pending output is still written
+func (s *Server) FreeClient(c *Client) {
+	s.Handler.Unwatch(c.Watch)
+	s.Handler.PubSub.UnsubscribeAll(c)
+	s.Handler.Tracking.Disable(c)
+	s.Clients.Remove(c)
+	c.Close()
+}
+
+// Drops the consumed prefix so the buffer only ever holds the trailing partial request
+func (s *Server) CompactQueryBuffer(buf []byte, consumed int) []byte {
+	if consumed == 0 {
+		return buf
+	}
+	if consumed == len(buf) && cap(buf) > QueryBufInitialSize {
+		// release the memory of an earlier oversized request
+		return make([]byte, 0, QueryBufInitialSize)
+	}
+
+	n := copy(buf, buf[consumed:])
+	return buf[:n]
+}
+
+// Runs a command while holding the in-flight lock so a shutdown waits for it to finish
+func (s *Server) ExecuteCommand(c *Client, cmd Command) (reply []byte) {
+	defer func() {
+		if len(reply) > 0 && reply[0] == '-' {
+			s.Stats.RecordErrorReply(reply)
+		}
+	}()
+	defer s.RecoverCommandPanic(c, cmd, &reply)
+
+	if strings.EqualFold(cmd.Name, "SHUTDOWN") && c.Multi == nil {
+		// shutdown waits for the in-flight lock itself, so it can't go through HandleParsedCommands
+		rc, errReply := s.Handler.ResolveCommand(cmd)
+		if errReply == nil {
+			errReply = s.Handler.CheckAuth(c, rc)
+		}
+		if errReply == nil {
+			errReply = s.Handler.CheckPermissions(c, rc, cmd, ACLContextTopLevel)
+		}
+		if errReply != nil {
+			return errReply
+		}
+		return s.HandleShutdownCommand(c, cmd)
+	}
+	if !s.WaitWhilePaused(c, cmd) {
+		c.CloseAfterReply = true
+		return nil
+	}
+
+	s.inflight.RLock()
+	defer s.inflight.RUnlock()
+
+	if s.closed.Load() {
+		return nil
+	}
+	return s.HandleParsedCommands(c, cmd)
+}
+
+// A panicking handler only fails its own command, the client and the rest of the server keep running
+func (s *Server) RecoverCommandPanic(c *Client, cmd Command, reply *[]byte) {
+	r := recover()
+	if r == nil {
+		return
+	}
+
+	s.Stats.CommandPanics.Add(1)
+	args := make([]string, 0, len(cmd.Args))
+	for _, v := range cmd.Args {
+		args = append(args, QuoteArg(string(v)))
+	}
+	slog.Error("Recovered from panic while executing command", "id", c.ID, "command", cmd.Name, "args", strings.Join(args, " "), "panic", r, "stack", string(debug.Stack()))
+
+	*reply = s.Handler.Encoder.GenerateSimpleError(fmt.Sprintf("ERR internal error while executing '%s' command", strings.ToLower(cmd.Name)))
+}
+
+func (s *Server) HandleParsedCommands(c *Client, cmd Command) []byte {
+	if c.SubscriptionCount() > 0 && c.Protocol == RESP2 && !IsAllowedInPubSubContext(cmd.Name) {
+		return s.Handler.Encoder.GenerateSimpleError(PubSubContextError(cmd.Name))
+	}
+	if c.Multi != nil && !IsTransactionControlCommand(cmd.Name) {
+		return s.QueueCommand(c, cmd)
+	}
+	s.Stats.TotalCommandsProcessed.Add(1)
+
+	rc, errReply := s.Handler.ResolveCommand(cmd)
+	if errReply != nil {
+		return errReply
+	}
+	if errReply := s.Handler.CheckAuth(c, rc); errReply != nil {
+		return errReply
+	}
+	if errReply := s.Handler.CheckPermissions(c, rc, cmd, ACLContextTopLevel); errReply != nil {
+		return errReply
+	}
+	// handlers compare against the canonical upper case name
+	cmd.Name = strings.ToUpper(cmd.Name)
+
+	if !rc.HasFlag(FlagAllowBusy) && s.Scripts.IsBusy(s.Config.GetInt("busy-reply-threshold")) {
+		return s.Handler.Encoder.GenerateSimpleError("BUSY Redis is busy running a script. You can only call SCRIPT KILL or SHUTDOWN NOSAVE.")
+	}
+
+	switch {
+	case rc.Exclusive:
+		s.exec.Lock()
+		defer s.exec.Unlock()
+		// clients blocked on a list the transaction or script pushes to are served once it's done
+		release := s.Handler.HoldHandoffs()
+		defer release()
+	case rc.HasFlag(FlagBlocking):
+		// the immediate attempt runs under the lock like any other command, a blocked client releases it before waiting
+		s.exec.RLock()
+		c.ReleaseExecLock = sync.OnceFunc(s.exec.RUnlock)
+		defer func() {
+			c.ReleaseExecLock()
+			c.ReleaseExecLock = nil
+		}()
+	case rc.HasFlag(FlagAllowBusy):
+		// allow_busy commands must get through while a script runs
+	default:
+		s.exec.RLock()
+		defer s.exec.RUnlock()
+	}
+	reply := rc.Proc(c, cmd)
+	s.Handler.TrackCommand(c, rc, cmd, reply)
+	s.Handler.RecordDirty(rc, reply)
+	return reply
 }
@@ -0,0 +1,289 @@
+package redisclone
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+// An error reply, kept apart from simple strings so tests can tell them apart
+type replyError string
+
+// Starts a server on a free loopback port with directives applied on top of the defaults, it's closed when the test ends
+func startServer(t *testing.T, directives ...string) *Server {
+	t.Helper()
+	cfg := NewConfig()
+	base := []string{fmt.Sprintf("dir %q", t.TempDir()), `save ""`}
+	if err := cfg.LoadString(strings.Join(append(base, directives...), "\n")); err != nil {
+		t.Fatal(err)
+	}
+
+	s, err := NewServer(Options{Config: cfg, Addr: "127.0.0.1:0"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { s.Close() })
+	return s
+}
+
+type testClient struct {
+	t    *testing.T
+	conn net.Conn
+	r    *bufio.Reader
+}
+
+func dial(t *testing.T, addr string) *testClient {
+	t.Helper()
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	return newTestClient(t, conn)
+}
+
+func newTestClient(t *testing.T, conn net.Conn) *testClient {
+	conn.SetDeadline(time.Now().Add(10 * time.Second))
+	return &testClient{t: t, conn: conn, r: bufio.NewReader(conn)}
+}
+
+// Sends a command and returns its reply
+func (tc *testClient) Do(args ...string) any {
+	tc.t.Helper()
+	tc.Send(args...)
+	return tc.Read()
+}
+
+func (tc *testClient) Send(args ...string) {
+	tc.t.Helper()
+	var b strings.Builder
+	fmt.Fprintf(&b, "*%d\r\n", len(args))
+	for _, a := range args {
+		fmt.Fprintf(&b, "$%d\r\n%s\r\n", len(a), a)
+	}
+	if _, err := tc.conn.Write([]byte(b.String())); err != nil {
+		tc.t.Fatal(err)
+	}
+}
+
+// Reads one reply: strings for simple, bulk, double and verbatim replies, int64, nil, replyError or []any for aggregates
+func (tc *testClient) Read() any {
+	tc.t.Helper()
+	v, err := readReply(tc.r)
+	if err != nil {
+		tc.t.Fatal(err)
+	}
+	return v
+}
+
+func readReply(r *bufio.Reader) (any, error) {
+	line, err := r.ReadString('\n')
+	if err != nil {
+		return nil, err
+	}
+	line = strings.TrimSuffix(line, "\r\n")
+	if line == "" {
+		return nil, fmt.Errorf("empty reply line")
+	}
+
+	body := line[1:]
+	switch line[0] {
+	case '+', ',':
+		return body, nil
+	case '-':
+		return replyError(body), nil
+	case ':':
+		return strconv.ParseInt(body, 10, 64)
+	case '_':
+		return nil, nil
+	case '$', '=':
+		n, err := strconv.Atoi(body)
+		if err != nil || n < 0 {
+			return nil, err
+		}
+		data := make([]byte, n+2)
+		if _, err := io.ReadFull(r, data); err != nil {
+			return nil, err
+		}
+		if line[0] == '=' {
+			return string(data[4:n]), nil
+		}
+		return string(data[:n]), nil
+	case '*', '%', '~', '>':
+		n, err := strconv.Atoi(body)
+		if err != nil || n < 0 {
+			return nil, err
+		}
+		if line[0] == '%' {
+			n *= 2
+		}
+		items := make([]any, n)
+		for i := range items {
+			if items[i], err = readReply(r); err != nil {
+				return nil, err
+			}
+		}
+		return items, nil
+	}
+	return nil, fmt.Errorf("unexpected reply %q", line)
+}
+
+// Fails the test unless got equals want, comparing aggregates element by element
+func expectReply(t *testing.T, got, want any) {
+	t.Helper()
+	if fmt.Sprintf("%#v", got) != fmt.Sprintf("%#v", want) {
+		t.Fatalf("got reply %#v, want %#v", got, want)
+	}
+}
+
+// Polls cond until it holds, failing the test after a few seconds
+func waitFor(t *testing.T, cond func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatal("timed out waiting for the condition")
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+// Waits until n clients are blocked on a key
+func waitForBlockedClients(t *testing.T, c *testClient, n int) {
+	t.Helper()
+	want := fmt.Sprintf("blocked_clients:%d\r\n", n)
+	waitFor(t, func() bool { return strings.Contains(c.Do("INFO", "clients").(string), want) })
+}
+
+func TestNewServerServesClients(t *testing.T) {
+	s := startServer(t)
+	c := dial(t, s.Addr())
+
+	expectReply(t, c.Do("PING"), "PONG")
+	expectReply(t, c.Do("SET", "k", "v"), "OK")
+	expectReply(t, c.Do("GET", "k"), "v")
+	expectReply(t, c.Do("GET", "missing"), nil)
+	expectReply(t, c.Do("NOSUCHCOMMAND"), replyError("ERR unknown command 'NOSUCHCOMMAND', with args beginning with: "))
+}
+
+func TestNewServerOnExistingListener(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s, err := NewServer(Options{Listener: ln})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { s.Close() })
+
+	if s.Addr() != ln.Addr().String() {
+		t.Fatalf("got address %s, want %s", s.Addr(), ln.Addr())
+	}
+	expectReply(t, dial(t, s.Addr()).Do("PING"), "PONG")
+}
+
+func TestCloseDisconnectsClients(t *testing.T) {
+	s := startServer(t)
+	c := dial(t, s.Addr())
+	expectReply(t, c.Do("PING"), "PONG")
+
+	if err := s.Close(); err != nil {
+		t.Fatal(err)
+	}
+	s.Wait()
+	if _, err := readReply(c.r); err == nil {
+		t.Fatal("expected the connection to be closed")
+	}
+	if _, err := net.Dial("tcp", s.Addr()); err == nil {
+		t.Fatal("expected the listener to be closed")
+	}
+	// closing twice is harmless
+	if err := s.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestTwoServersAreIndependent(t *testing.T) {
+	a, b := startServer(t), startServer(t)
+	expectReply(t, dial(t, a.Addr()).Do("SET", "k", "a"), "OK")
+	expectReply(t, dial(t, b.Addr()).Do("GET", "k"), nil)
+}
+
+func TestPipelinedCommands(t *testing.T) {
+	s := startServer(t)
+	c := dial(t, s.Addr())
+
+	// several commands in one write, including an inline one, are answered in order
+	pipeline := "*3\r\n$3\r\nSET\r\n$1\r\nk\r\n$1\r\n1\r\nPING\r\n*2\r\n$3\r\nGET\r\n$1\r\nk\r\n*2\r\n$4\r\nECHO\r\n$2\r\nhi\r\n"
+	if _, err := c.conn.Write([]byte(pipeline)); err != nil {
+		t.Fatal(err)
+	}
+	for _, want := range []any{"OK", "PONG", "1", "hi"} {
+		expectReply(t, c.Read(), want)
+	}
+
+	// a request split over several writes is only run once complete
+	for _, part := range []string{"*2\r\n$4\r\nEC", "HO\r\n$5\r\nhel", "lo\r\n"} {
+		if _, err := c.conn.Write([]byte(part)); err != nil {
+			t.Fatal(err)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	expectReply(t, c.Read(), "hello")
+}
+
+func TestProtocolErrorClosesConnection(t *testing.T) {
+	s := startServer(t)
+	c := dial(t, s.Addr())
+
+	if _, err := c.conn.Write([]byte("*1\r\n$4\r\nPINGxx\r\n")); err != nil {
+		t.Fatal(err)
+	}
+	expectReply(t, c.Read(), replyError("ERR Protocol error: expected CRLF after bulk data"))
+	if _, err := readReply(c.r); err == nil {
+		t.Fatal("expected the connection to be closed after a protocol error")
+	}
+}
+
+func TestCommandPanicIsRecovered(t *testing.T) {
+	s := startServer(t)
+	s.Handler.Commands.Lookup("echo").Proc = func(c *Client, cmd Command) []byte {
+		panic("boom")
+	}
+	c := dial(t, s.Addr())
+
+	expectReply(t, c.Do("ECHO", "x"), replyError("ERR internal error while executing 'echo' command"))
+	expectReply(t, c.Do("PING"), "PONG")
+	if got := s.Stats.CommandPanics.Load(); got != 1 {
+		t.Fatalf("counted %d panics, want 1", got)
+	}
+}
+
+func TestErrorStats(t *testing.T) {
+	s := startServer(t)
+	c := dial(t, s.Addr())
+
+	expectReply(t, c.Do("RPUSH", "list", "a"), int64(1))
+	expectReply(t, c.Do("TYPE", "list"), "list")
+	expectReply(t, c.Do("TYPE", "missing"), "none")
+	expectReply(t, c.Do("GET", "list"), replyError("WRONGTYPE Operation against a key holding the wrong kind of value"))
+	expectReply(t, c.Do("GET"), replyError("ERR wrong number of arguments for 'get' command"))
+	expectReply(t, c.Do("GET"), replyError("ERR wrong number of arguments for 'get' command"))
+
+	info := c.Do("INFO", "errorstats").(string)
+	for _, want := range []string{"errorstat_ERR:count=2", "errorstat_WRONGTYPE:count=1"} {
+		if !strings.Contains(info, want) {
+			t.Fatalf("INFO errorstats lacks %q:\n%s", want, info)
+		}
+	}
+	expectReply(t, c.Do("CONFIG", "RESETSTAT"), "OK")
+	if info := c.Do("INFO", "errorstats").(string); strings.Contains(info, "errorstat_") {
+		t.Fatalf("INFO errorstats not reset:\n%s", info)
+	}
+}
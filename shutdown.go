@@ -0,0 +1,165 @@
+package redisclone
+
+import (
+	"errors"
+	"log/slog"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+	"time"
+)
+
+type ShutdownOptions struct {
+	Save   bool // save even if no save points are configured
+	NoSave bool // skip saving even if save points are configured
+	Now    bool // don't wait for in-flight commands to finish, their replies are lost
+	Force  bool // exit even if the final save fails
+}
+
+func (s *Server) HandleSignals() {
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, syscall.SIGTERM, syscall.SIGINT)
+	defer signal.Stop(sigs)
+
+	for {
+		select {
+		case sig := <-sigs:
+			slog.Info("Received signal, scheduling shutdown...", "signal", sig.String())
+			if err := s.Shutdown(ShutdownOptions{}); err != nil {
+				slog.Error("SIGTERM received but errors trying to shut down the server, check the logs for more information")
+				continue
+			}
+			return
+		case <-s.done:
+			return
+		}
+	}
+}
+
+func (s *Server) HandleShutdownCommand(c *Client, cmd Command) []byte {
+	var opts ShutdownOptions
+	abort := false
+	for _, arg := range cmd.Args {
+		switch strings.ToUpper(string(arg)) {
+		case "NOSAVE":
+			opts.NoSave = true
+		case "SAVE":
+			opts.Save = true
+		case "NOW":
+			opts.Now = true
+		case "FORCE":
+			opts.Force = true
+		case "ABORT":
+			abort = true
+		default:
+			return s.Handler.Encoder.GenerateSimpleError("ERR syntax error")
+		}
+	}
+	if (opts.Save && opts.NoSave) || (abort && len(cmd.Args) > 1) {
+		return s.Handler.Encoder.GenerateSimpleError("ERR syntax error")
+	}
+
+	// shutdown never waits on replicas here, so there is never a pending shutdown left to abort
+	if abort {
+		return s.Handler.Encoder.GenerateSimpleError("ERR No shutdown in progress.")
+	}
+
+	if err := s.Shutdown(opts); err != nil {
+		return s.Handler.Encoder.GenerateSimpleError(err.Error())
+	}
+	return nil
+}
+
+// Stops the server: blocked clients are woken with an error, in-flight commands are allowed to finish unless Now is set,
+// the dataset is saved if configured and finally listeners and client connections are closed.
+// If the final save fails (and FORCE wasn't given) the server keeps running and an error is returned.
+func (s *Server) Shutdown(opts ShutdownOptions) error {
+	if !s.shuttingDown.CompareAndSwap(false, true) {
+		return errors.New("ERR Shutdown already in progress")
+	}
+	slog.Info("User requested shutdown...")
+
+	s.WakeBlockedClients(errors.New("UNBLOCKED server is shutting down"))
+	if opts.NoSave {
+		// nothing will be persisted, so even a script that already wrote can be stopped
+		s.Scripts.Kill(true)
+	}
+	if opts.Now {
+		// commands already running are left to finish on their own, new ones are turned away
+		s.closed.Store(true)
+	} else {
+		s.DrainCommands(opts)
+	}
+
+	if opts.Save || (!opts.NoSave && s.Config.GetString("save") != "") {
+		slog.Info("Saving the final RDB snapshot before exiting.")
+		if err := s.FinalSave(opts); err != nil {
+			if !opts.Force {
+				slog.Error("Error trying to save the DB, can't exit.", "err", err)
+				s.closed.Store(false)
+				if !opts.Now {
+					s.inflight.Unlock()
+				}
+				s.shuttingDown.Store(false)
+				return errors.New("ERR Errors trying to SHUTDOWN. Check logs.")
+			}
+			slog.Warn("Error trying to save the DB, exiting anyway (FORCE).", "err", err)
+		} else {
+			slog.Info("DB saved on disk")
+		}
+	}
+
+	s.closed.Store(true)
+	s.CloseListeners()
+	for _, c := range s.Clients.All() {
+		c.Conn.Close()
+	}
+	if !opts.Now {
+		s.inflight.Unlock()
+	}
+
+	slog.Info("Redis is now ready to exit, bye bye...")
+	close(s.done)
+	return nil
+}
+
+// Waits until every in-flight command has finished and returns holding the in-flight lock.
+// Blocked clients are woken again meanwhile since a client may block right before the lock is taken.
+func (s *Server) DrainCommands(opts ShutdownOptions) {
+	drained := make(chan struct{})
+	go func() {
+		s.inflight.Lock()
+		close(drained)
+	}()
+	ticker := time.NewTicker(10 * time.Millisecond)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-drained:
+			return
+		case <-ticker.C:
+		}
+		s.WakeBlockedClients(errors.New("UNBLOCKED server is shutting down"))
+		if opts.NoSave {
+			s.Scripts.Kill(true)
+		}
+	}
+}
+
+// Without Now nothing runs during the save, with it the exec lock keeps a transaction or script from being saved half done
+func (s *Server) FinalSave(opts ShutdownOptions) error {
+	if opts.Now {
+		s.exec.Lock()
+		defer s.exec.Unlock()
+	}
+	return s.Handler.SaveSnapshot()
+}
+
+func (s *Server) WakeBlockedClients(err error) {
+	for _, c := range s.Clients.All() {
+		if w := c.BlockingWaiter(); w != nil {
+			s.Handler.Databases[w.DB].UnblockWaiter(w, err)
+		}
+	}
+}
@@ -1,20 +1,73 @@
-package main
+package redisclone
 
 import (
 	"container/list"
 	"context"
 	"errors"
+	"fmt"
 	"sync"
 	"time"
 )
 
+// One logical database, the server holds the number configured by databases
 type Store struct {
+	id              int
 	store           map[string]RedisObject
 	listClientQueue map[string]*list.List
+	holdHandoffs    bool                                   // set while a transaction or script runs, see HoldHandoffs
+	readyKeys       map[string]struct{}                    // lists pushed to while handoffs were held
+	watchers        map[string]map[*WatchState]struct{}    // clients watching each key
+	Notify          func(db, class int, event, key string) // called with the lock held for every keyspace event
+	Expired         func(key string)                       // called with the lock held when a key expires, writes are invalidated by their command
+	ExpiryPaused    func() bool                            // expired keys are kept, though hidden from reads, while it returns true
 	lock            sync.RWMutex
 }
 
+func NewStore(id int) *Store {
+	return &Store{id: id, store: make(map[string]RedisObject), listClientQueue: make(map[string]*list.List), readyKeys: make(map[string]struct{}), watchers: make(map[string]map[*WatchState]struct{})}
+}
+
+func (s *Store) IsExpiryPaused() bool {
+	return s.ExpiryPaused != nil && s.ExpiryPaused()
+}
+
+func NewDatabases(n int) []*Store {
+	dbs := make([]*Store, n)
+	for i := range dbs {
+		dbs[i] = NewStore(i)
+	}
+	return dbs
+}
+
+// Locks two databases in index order so commands touching both never deadlock, returns the matching unlock
+func LockPair(a, b *Store) func() {
+	if a.id > b.id {
+		a, b = b, a
+	}
+	a.lock.Lock()
+	b.lock.Lock()
+	return func() {
+		b.lock.Unlock()
+		a.lock.Unlock()
+	}
+}
+
+// Read locks every database in index order, for a view that is consistent across all of them. Returns the matching unlock.
+func RLockAll(dbs []*Store) func() {
+	for _, db := range dbs {
+		db.lock.RLock()
+	}
+	return func() {
+		for i := len(dbs) - 1; i >= 0; i-- {
+			dbs[i].lock.RUnlock()
+		}
+	}
+}
+
 func (s *Store) DetermineDataType(key string) NativeType {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+
 	obj, ok := s.store[key]
 	if !ok {
 		return None
@@ -57,32 +110,51 @@ func (s *Store) SetKeyVal(r SetRequest) (bool, error) {
 	s.lock.Lock()
 	defer s.lock.Unlock()
 
-	kv, _, err := s.GetAsBytes(r.Key)
+	kv, exists, err := s.GetAsBytes(r.Key)
 	if err != nil {
 		return false, err
 	}
 
 	kv.Data = r.Value
+	expire := false
 	for _, v := range r.Options {
 		switch v.Name {
 		case "EX":
 			kv.TTL = time.Now().Add(time.Duration(v.Arg.(int)) * time.Second)
+			expire = true
 		}
 	}
 
 	obj := RedisObject{NativeType: Bytes, Data: kv}
 	s.store[r.Key] = obj
+	s.SignalModifiedKey(r.Key)
+	if !exists {
+		s.NotifyKeyspaceEvent(NotifyNew, "new", r.Key)
+	}
+	s.NotifyKeyspaceEvent(NotifyString, "set", r.Key)
+	if expire {
+		s.NotifyKeyspaceEvent(NotifyGeneric, "expire", r.Key)
+	}
 	return true, nil
 }
 
 // Note: This function is unsafe, it should only ever be called by a function who holds a lock
 func (s *Store) DeleteKey(key string) {
 	delete(s.store, key)
+	s.SignalModifiedKey(key)
+}
+
+// Note: This function is unsafe, it should only ever be called by a function who holds a lock
+func (s *Store) SignalModifiedKey(key string) {
+	for w := range s.watchers[key] {
+		w.Dirty.Store(true)
+	}
 }
 
+// takes the write lock since an expired key is deleted on access
 func (s *Store) GetKeyVal(key string) ([]byte, error) {
-	s.lock.RLock()
-	defer s.lock.RUnlock()
+	s.lock.Lock()
+	defer s.lock.Unlock()
 
 	kvData, ok, err := s.GetAsBytes(key)
 
@@ -94,7 +166,14 @@ func (s *Store) GetKeyVal(key string) ([]byte, error) {
 	}
 
 	if !kvData.TTL.IsZero() && time.Now().After(kvData.TTL) {
+		if s.IsExpiryPaused() {
+			return nil, nil
+		}
 		s.DeleteKey(key)
+		s.NotifyKeyspaceEvent(NotifyExpired, "expired", key)
+		if s.Expired != nil {
+			s.Expired(key)
+		}
 		return nil, nil
 	} // Passive expiry logic
 
@@ -143,12 +222,16 @@ func (s *Store) ListPush(lc ListModificationRequest) (int, error) {
 		list.Length += 1
 	}
 
-	//Handle client queue and possibly update the local list
-	list = s.HandleClientQueue(lc.Key, list)
+	if !ok {
+		s.NotifyKeyspaceEvent(NotifyNew, "new", lc.Key)
+	}
+	s.NotifyKeyspaceEvent(NotifyList, lc.Name, lc.Key)
 
 	//store list back into map
 	s.store[lc.Key] = RedisObject{NativeType: List, Data: list}
+	s.SignalModifiedKey(lc.Key)
 
+	s.UnsafeServeBlockedClients(lc.Key)
 	return list.Length, nil
 }
 
@@ -166,10 +249,9 @@ func (s *Store) HandleClientQueue(key string, list ListData) ListData {
 
 			//only once we have confirmed that an element was popped from the list do we pop from the client queue...
 			clientQueue.Remove(elt)
-			clientChan := waiter.ResponseChan
-
-			clientChan <- [][]byte{[]byte(key), poppedElt[0]}
-			close(clientChan)
+			s.NotifyKeyspaceEvent(NotifyList, waiter.PopType, key)
+			waiter.Satisfied = true
+			waiter.ResponseChan <- [][]byte{[]byte(key), poppedElt[0]}
 
 			s.CleanUpQueueWaiters(waiter) //clean up waiters from all other queues it is in
 		}
@@ -192,12 +274,19 @@ func (s *Store) ListPop(lc ListPopRequest) ([][]byte, error) {
 
 	// Evoke internal list pop (unsafe, does not hold any lock)
 	updatedList, elements := s.UnsafeInternalListPop(list, lc.Count, lc.Name)
+	if len(elements) > 0 {
+		s.NotifyKeyspaceEvent(NotifyList, lc.Name, lc.Key)
+	}
 	if updatedList.Length == 0 {
 		s.DeleteKey(lc.Key)
+		s.NotifyKeyspaceEvent(NotifyGeneric, "del", lc.Key)
 		return elements, nil
 	}
 
 	s.store[lc.Key] = RedisObject{NativeType: List, Data: updatedList}
+	if len(elements) > 0 {
+		s.SignalModifiedKey(lc.Key)
+	}
 	return elements, nil
 }
 
@@ -254,16 +343,9 @@ func (s *Store) CleanUpQueueWaiters(w *Waiter) {
 	}
 }
 
-func (s *Store) ListBlockedPop(lc BlockedListPopRequest) ([][]byte, error) {
+func (s *Store) ListBlockedPop(lc BlockedListPopRequest, w *Waiter) ([][]byte, error) {
 	s.lock.Lock()
 
-	var elements [][]byte
-
-	clientChan := make(chan ([][]byte))
-	popCommandName := lc.Name[1:]
-
-	w := &Waiter{ResponseChan: clientChan, PopType: popCommandName, Satisfied: false, CleanUpPointers: make(map[string]*list.Element)}
-
 	for _, key := range lc.Keys {
 		list, ok, err := s.GetAsList(key)
 		if err != nil {
@@ -276,7 +358,14 @@ func (s *Store) ListBlockedPop(lc BlockedListPopRequest) ([][]byte, error) {
 		// there is data in one of the requested lists...
 		if ok {
 			list, popped := s.UnsafeInternalListPop(list, 1, w.PopType)
-			s.store[key] = RedisObject{NativeType: List, Data: list}
+			s.NotifyKeyspaceEvent(NotifyList, w.PopType, key)
+			if list.Length == 0 {
+				s.DeleteKey(key)
+				s.NotifyKeyspaceEvent(NotifyGeneric, "del", key)
+			} else {
+				s.store[key] = RedisObject{NativeType: List, Data: list}
+				s.SignalModifiedKey(key)
+			}
 			s.CleanUpQueueWaiters(w)
 
 			s.lock.Unlock()
@@ -287,34 +376,248 @@ func (s *Store) ListBlockedPop(lc BlockedListPopRequest) ([][]byte, error) {
 			w.CleanUpPointers[key] = nodePtr
 		}
 	}
+	w.Blocked = true
 
 	// dont continue holding lock after manipulating map
 	s.lock.Unlock()
+	if w.OnBlock != nil {
+		w.OnBlock()
+	}
 
+	var timeout <-chan struct{}
 	if lc.Timeout != 0 {
-		ctx, cancel := context.WithTimeout(context.TODO(), time.Duration(lc.Timeout)*time.Second)
+		ctx, cancel := context.WithTimeout(context.TODO(), time.Duration(lc.Timeout*float64(time.Second)))
 		defer cancel()
+		timeout = ctx.Done()
+	}
 
+	select {
+	case elements := <-w.ResponseChan:
+		return elements, nil
+	case err := <-w.UnblockChan:
+		return nil, err
+	case <-timeout:
+		return s.ExpireWaiter(w)
+	}
+}
+
+// Called once a blocked pop times out, the waiter may have been satisfied right before the lock was aquired
+func (s *Store) ExpireWaiter(w *Waiter) ([][]byte, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if w.Satisfied {
 		select {
-		case elements = <-clientChan:
-			s.CallCleanUpWaiters(w)
+		case elements := <-w.ResponseChan:
 			return elements, nil
-		case <-ctx.Done():
-			s.CallCleanUpWaiters(w)
-			return nil, nil
+		case err := <-w.UnblockChan:
+			return nil, err
 		}
-	} else {
-		elements := <-clientChan
-		return elements, nil
 	}
+
+	w.Satisfied = true
+	s.CleanUpQueueWaiters(w)
+	return nil, nil
 }
 
-// Helper function to call clean up queue waiters (must aquire lock since CleanUpQueueWaiters() is unsafe)
-func (s *Store) CallCleanUpWaiters(w *Waiter) {
+// Wake a blocked waiter without handing it an element, err is delivered as the client's reply (nil behaves like a timeout)
+func (s *Store) UnblockWaiter(w *Waiter, err error) bool {
 	s.lock.Lock()
 	defer s.lock.Unlock()
 
+	if !w.Blocked || w.Satisfied {
+		return false
+	}
+
+	w.Satisfied = true
 	s.CleanUpQueueWaiters(w)
+	w.UnblockChan <- err
+	return true
+}
+
+func (s *Store) IsWaiterBlocked(w *Waiter) bool {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+
+	return w.Blocked && !w.Satisfied
+}
+
+// Registers w as watching key, remembering when the key expires so EXEC can notice a lapsed TTL
+func (s *Store) Watch(w *WatchState, key string) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	watched := WatchedKey{DB: s.id, Key: key}
+	if _, ok := w.Keys[watched]; ok {
+		return
+	}
+	var expiresAt time.Time
+	if kv, ok := s.store[key].Data.(KV_Data); ok && !kv.TTL.IsZero() && time.Now().Before(kv.TTL) {
+		expiresAt = kv.TTL
+	}
+	w.Keys[watched] = expiresAt
+
+	watchers := s.watchers[key]
+	if watchers == nil {
+		watchers = make(map[*WatchState]struct{})
+		s.watchers[key] = watchers
+	}
+	watchers[w] = struct{}{}
+}
+
+// Drops w from the watchers of this database, the caller resets w once every database is done
+func (s *Store) Unwatch(w *WatchState) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	for watched := range w.Keys {
+		if watched.DB != s.id {
+			continue
+		}
+		delete(s.watchers[watched.Key], w)
+		if len(s.watchers[watched.Key]) == 0 {
+			delete(s.watchers, watched.Key)
+		}
+	}
+}
+
+// Note: This function is unsafe, it should only ever be called by a function who holds a lock
+func (s *Store) UnsafeKeyExists(key string) bool {
+	_, ok := s.store[key]
+	return ok
+}
+
+// Hands elements of key to the clients blocked on it, deferred until ReleaseHandoffs while handoffs are held
+// Note: This function is unsafe, it should only ever be called by a function who holds a lock
+func (s *Store) UnsafeServeBlockedClients(key string) {
+	if queue := s.listClientQueue[key]; queue == nil || queue.Len() == 0 {
+		return
+	}
+	if s.holdHandoffs {
+		s.readyKeys[key] = struct{}{}
+		return
+	}
+
+	list, ok, err := s.GetAsList(key)
+	if !ok || err != nil {
+		return
+	}
+	length := list.Length
+	list = s.HandleClientQueue(key, list)
+	if list.Length == 0 {
+		// every element was handed to a blocked client
+		s.DeleteKey(key)
+		s.NotifyKeyspaceEvent(NotifyGeneric, "del", key)
+		return
+	}
+	s.store[key] = RedisObject{NativeType: List, Data: list}
+	if list.Length != length {
+		s.SignalModifiedKey(key)
+	}
+}
+
+// Holds back handing pushed elements to blocked clients, so they only see the outcome of a whole transaction or script
+func (s *Store) HoldHandoffs() {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	s.holdHandoffs = true
+}
+
+// Serves the clients blocked on lists pushed to while handoffs were held
+func (s *Store) ReleaseHandoffs() {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	s.holdHandoffs = false
+	for key := range s.readyKeys {
+		s.UnsafeServeBlockedClients(key)
+	}
+	clear(s.readyKeys)
+}
+
+// Deletes every key, watchers of keys that existed are notified
+func (s *Store) Flush() {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	for key := range s.watchers {
+		if s.UnsafeKeyExists(key) {
+			s.SignalModifiedKey(key)
+		}
+	}
+	s.store = make(map[string]RedisObject)
+}
+
+// Moves key into dst unless dst already holds it, returns whether the key was moved
+func (s *Store) MoveKey(dst *Store, key string) bool {
+	unlock := LockPair(s, dst)
+	defer unlock()
+
+	obj, ok := s.store[key]
+	if !ok {
+		return false
+	}
+	if kv, isKV := obj.Data.(KV_Data); isKV && !kv.TTL.IsZero() && time.Now().After(kv.TTL) {
+		if s.IsExpiryPaused() {
+			return false
+		}
+		s.DeleteKey(key)
+		s.NotifyKeyspaceEvent(NotifyExpired, "expired", key)
+		return false
+	}
+	if dst.UnsafeKeyExists(key) {
+		return false
+	}
+
+	s.DeleteKey(key)
+	dst.store[key] = obj
+	dst.SignalModifiedKey(key)
+	s.NotifyKeyspaceEvent(NotifyGeneric, "move_from", key)
+	dst.NotifyKeyspaceEvent(NotifyGeneric, "move_to", key)
+	dst.UnsafeServeBlockedClients(key)
+	return true
+}
+
+// Exchanges the data of two databases, clients stay connected to the same index and blocked ones are served from the new data
+func (s *Store) SwapDB(other *Store) {
+	unlock := LockPair(s, other)
+	defer unlock()
+
+	for _, db := range []*Store{s, other} {
+		for key := range db.watchers {
+			if s.UnsafeKeyExists(key) || other.UnsafeKeyExists(key) {
+				db.SignalModifiedKey(key)
+			}
+		}
+	}
+	s.store, other.store = other.store, s.store
+
+	for _, db := range []*Store{s, other} {
+		for key := range db.listClientQueue {
+			db.UnsafeServeBlockedClients(key)
+		}
+	}
+}
+
+// Number of keys and of keys with an expiry, plus the average remaining time to live in milliseconds
+func (s *Store) KeyspaceStats() (int, int, int64) {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+
+	now := time.Now()
+	expires := 0
+	var ttl int64
+	for _, obj := range s.store {
+		if kv, ok := obj.Data.(KV_Data); ok && !kv.TTL.IsZero() {
+			expires += 1
+			ttl += max(kv.TTL.Sub(now).Milliseconds(), 0)
+		}
+	}
+	if expires > 0 {
+		ttl /= int64(expires)
+	}
+	return len(s.store), expires, ttl
 }
 
 func (s *Store) ListRange(lc ListRangeRequest) ([][]byte, error) {
@@ -362,3 +665,114 @@ func (s *Store) ListLength(key string) (int, error) {
 
 	return list.Length, nil
 }
+
+// Serializes every live key of this store into rw as database db
+// Note: This function is unsafe, it should only ever be called by a function who holds a lock
+func (s *Store) UnsafeWriteRDB(rw *RDBWriter, db int) error {
+	now := time.Now()
+	size, expires := 0, 0
+	for _, obj := range s.store {
+		if kv, ok := obj.Data.(KV_Data); ok && !kv.TTL.IsZero() {
+			expires += 1
+		}
+		size += 1
+	}
+	if size == 0 {
+		return nil
+	}
+	if err := rw.WriteSelectDB(db, size, expires); err != nil {
+		return err
+	}
+
+	for key, obj := range s.store {
+		switch obj.NativeType {
+		case Bytes:
+			kv := obj.Data.(KV_Data)
+			if !kv.TTL.IsZero() {
+				if now.After(kv.TTL) {
+					continue
+				}
+				if err := rw.WriteExpireTime(kv.TTL); err != nil {
+					return err
+				}
+			}
+			if err := rw.WriteByte(RDBTypeString); err != nil {
+				return err
+			}
+			if err := rw.WriteString([]byte(key)); err != nil {
+				return err
+			}
+			if err := rw.WriteString(kv.Data); err != nil {
+				return err
+			}
+		case List:
+			list := obj.Data.(ListData)
+			if err := rw.WriteByte(RDBTypeList); err != nil {
+				return err
+			}
+			if err := rw.WriteString([]byte(key)); err != nil {
+				return err
+			}
+			if err := rw.WriteLength(uint64(list.Length)); err != nil {
+				return err
+			}
+			for node := list.Head; node != nil; node = node.Next {
+				if err := rw.WriteString(node.Data); err != nil {
+					return err
+				}
+			}
+		}
+	}
+	return nil
+}
+
+// Reads one key of type objType from rr into the store, keys that already expired are dropped
+func (s *Store) ReadRDBObject(rr *RDBReader, objType byte, ttl time.Time) error {
+	key, err := rr.ReadString()
+	if err != nil {
+		return err
+	}
+
+	var obj RedisObject
+	switch objType {
+	case RDBTypeString:
+		value, err := rr.ReadString()
+		if err != nil {
+			return err
+		}
+		obj = RedisObject{NativeType: Bytes, Data: KV_Data{Data: value, TTL: ttl}}
+	case RDBTypeList:
+		length, _, err := rr.ReadLength()
+		if err != nil {
+			return err
+		}
+		list := ListData{}
+		for range length {
+			value, err := rr.ReadString()
+			if err != nil {
+				return err
+			}
+			node := &ListNode{Data: value, Prev: list.Tail}
+			if list.Tail != nil {
+				list.Tail.Next = node
+			} else {
+				list.Head = node
+			}
+			list.Tail = node
+			list.Length += 1
+		}
+		obj = RedisObject{NativeType: List, Data: list}
+	default:
+		return fmt.Errorf("unsupported RDB object type %d", objType)
+	}
+
+	if !ttl.IsZero() && time.Now().After(ttl) {
+		return nil
+	}
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	s.store[string(key)] = obj
+	return nil
+}
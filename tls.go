@@ -0,0 +1,191 @@
+package redisclone
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// Clients that don't finish the TLS handshake within this time are dropped
+const TLSHandshakeTimeout = 10 * time.Second
+
+// Parameters that rebuild the TLS configuration when set, setting one to its current value reloads the files
+var TLSReloadParams = []string{"tls-cert-file", "tls-key-file", "tls-ca-cert-file", "tls-ca-cert-dir", "tls-auth-clients", "tls-protocols", "tls-ciphers"}
+
+var tlsProtocols = map[string]uint16{
+	"tlsv1":   tls.VersionTLS10,
+	"tlsv1.1": tls.VersionTLS11,
+	"tlsv1.2": tls.VersionTLS12,
+	"tlsv1.3": tls.VersionTLS13,
+}
+
+// Lowest and highest enabled version of a tls-protocols list like "TLSv1.2 TLSv1.3", both 1.2 and 1.3 when empty
+func ParseTLSProtocols(raw string) (uint16, uint16, error) {
+	if strings.TrimSpace(raw) == "" {
+		return tls.VersionTLS12, tls.VersionTLS13, nil
+	}
+
+	var lowest, highest uint16
+	for _, name := range strings.Fields(raw) {
+		version, ok := tlsProtocols[strings.ToLower(name)]
+		if !ok {
+			return 0, 0, errors.New("Invalid tls-protocols specified. Use a combination of 'TLSv1', 'TLSv1.1', 'TLSv1.2' and 'TLSv1.3'.")
+		}
+		if lowest == 0 || version < lowest {
+			lowest = version
+		}
+		highest = max(highest, version)
+	}
+	return lowest, highest, nil
+}
+
+// Cipher suites of a colon separated tls-ciphers list, nil leaves the choice to crypto/tls. TLS 1.3 suites aren't configurable.
+func ParseTLSCiphers(raw string) ([]uint16, error) {
+	if raw == "" {
+		return nil, nil
+	}
+
+	known := make(map[string]uint16)
+	for _, suite := range tls.CipherSuites() {
+		known[suite.Name] = suite.ID
+	}
+	var ids []uint16
+	for _, name := range strings.Split(raw, ":") {
+		id, ok := known[strings.ToUpper(strings.TrimSpace(name))]
+		if !ok {
+			return nil, fmt.Errorf("Unknown or insecure cipher suite '%s'", name)
+		}
+		ids = append(ids, id)
+	}
+	return ids, nil
+}
+
+func ValidateTLSProtocols(v ConfigValue) error {
+	_, _, err := ParseTLSProtocols(v.Raw)
+	return err
+}
+
+func ValidateTLSCiphers(v ConfigValue) error {
+	_, err := ParseTLSCiphers(v.Raw)
+	return err
+}
+
+// Adds every PEM certificate of the CA file and of the files inside the CA directory
+func LoadCertPool(file, dir string) (*x509.CertPool, error) {
+	pool := x509.NewCertPool()
+	var paths []string
+	if file != "" {
+		paths = append(paths, file)
+	}
+	if dir != "" {
+		entries, err := os.ReadDir(dir)
+		if err != nil {
+			return nil, fmt.Errorf("Failed to configure CA certificate(s) directory '%s': %s", dir, err.Error())
+		}
+		for _, e := range entries {
+			if e.Type().IsRegular() {
+				paths = append(paths, filepath.Join(dir, e.Name()))
+			}
+		}
+	}
+
+	for _, path := range paths {
+		contents, err := os.ReadFile(path)
+		if err != nil {
+			return nil, fmt.Errorf("Failed to load CA certificate(s) file '%s': %s", path, err.Error())
+		}
+		if !pool.AppendCertsFromPEM(contents) && path == file {
+			return nil, fmt.Errorf("Failed to load CA certificate(s) file '%s': no PEM certificates found", path)
+		}
+	}
+	return pool, nil
+}
+
+// Builds the server side TLS configuration from the tls-* parameters, reading the certificate files again
+func BuildTLSConfig(cfg *Config) (*tls.Config, error) {
+	certFile, keyFile := cfg.GetString("tls-cert-file"), cfg.GetString("tls-key-file")
+	if certFile == "" || keyFile == "" {
+		return nil, errors.New("tls-cert-file and tls-key-file must be specified to enable TLS")
+	}
+	cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to load certificate '%s' with private key '%s': %s", certFile, keyFile, err.Error())
+	}
+
+	minVersion, maxVersion, err := ParseTLSProtocols(cfg.GetString("tls-protocols"))
+	if err != nil {
+		return nil, err
+	}
+	ciphers, err := ParseTLSCiphers(cfg.GetString("tls-ciphers"))
+	if err != nil {
+		return nil, err
+	}
+
+	config := &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		MinVersion:   minVersion,
+		MaxVersion:   maxVersion,
+		CipherSuites: ciphers,
+	}
+
+	authClients := cfg.GetString("tls-auth-clients")
+	caFile, caDir := cfg.GetString("tls-ca-cert-file"), cfg.GetString("tls-ca-cert-dir")
+	if authClients == "no" {
+		return config, nil
+	}
+	if caFile == "" && caDir == "" {
+		return nil, errors.New("Either tls-ca-cert-file or tls-ca-cert-dir must be specified when tls-auth-clients is enabled")
+	}
+	config.ClientCAs, err = LoadCertPool(caFile, caDir)
+	if err != nil {
+		return nil, err
+	}
+	config.ClientAuth = tls.RequireAndVerifyClientCert
+	if authClients == "optional" {
+		config.ClientAuth = tls.VerifyClientCertIfGiven
+	}
+	return config, nil
+}
+
+// Config hook for TLSReloadParams, new connections use the rebuilt configuration while established ones keep theirs
+func (s *Server) ReloadTLS(v ConfigValue) error {
+	if s.tlsConfig.Load() == nil {
+		return nil
+	}
+	config, err := BuildTLSConfig(s.Config)
+	if err != nil {
+		return err
+	}
+	s.tlsConfig.Store(config)
+	return nil
+}
+
+// Looked up per handshake so a reload applies to every later connection
+func (s *Server) CurrentTLSConfig(*tls.ClientHelloInfo) (*tls.Config, error) {
+	return s.tlsConfig.Load(), nil
+}
+
+// Completes the handshake of a TLS client, with tls-auth-clients-user cn a verified certificate logs the client in as the user named by its CN
+func (s *Server) TLSHandshake(c *Client, conn *tls.Conn) error {
+	ctx, cancel := context.WithTimeout(context.Background(), TLSHandshakeTimeout)
+	defer cancel()
+	if err := conn.HandshakeContext(ctx); err != nil {
+		return err
+	}
+
+	certs := conn.ConnectionState().PeerCertificates
+	if s.Config.GetString("tls-auth-clients-user") != "cn" || len(certs) == 0 {
+		return nil
+	}
+	name := certs[0].Subject.CommonName
+	if u := s.Handler.ACL.Get(name); u != nil && u.Enabled {
+		c.SetAuthenticated(name)
+	}
+	return nil
+}
@@ -0,0 +1,304 @@
+package redisclone
+
+import (
+	"bufio"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"fmt"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParseTLSProtocols(t *testing.T) {
+	tests := []struct {
+		raw      string
+		min, max uint16
+		err      bool
+	}{
+		{raw: "", min: tls.VersionTLS12, max: tls.VersionTLS13},
+		{raw: "TLSv1.2", min: tls.VersionTLS12, max: tls.VersionTLS12},
+		{raw: "tlsv1.3 TLSv1.1", min: tls.VersionTLS11, max: tls.VersionTLS13},
+		{raw: "TLSv1 TLSv1.2", min: tls.VersionTLS10, max: tls.VersionTLS12},
+		{raw: "SSLv3", err: true},
+		{raw: "TLSv1.2,TLSv1.3", err: true},
+	}
+
+	for _, tt := range tests {
+		lowest, highest, err := ParseTLSProtocols(tt.raw)
+		if (err != nil) != tt.err || lowest != tt.min || highest != tt.max {
+			t.Errorf("ParseTLSProtocols(%q) = %x, %x, %v, want %x, %x, error %v", tt.raw, lowest, highest, err, tt.min, tt.max, tt.err)
+		}
+	}
+}
+
+func TestParseTLSCiphers(t *testing.T) {
+	tests := []struct {
+		raw  string
+		want []uint16
+		err  string
+	}{
+		{raw: "", want: nil},
+		{raw: "TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256", want: []uint16{tls.TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256}},
+		{raw: "tls_ecdhe_rsa_with_aes_256_gcm_sha384: TLS_ECDHE_ECDSA_WITH_CHACHA20_POLY1305_SHA256", want: []uint16{tls.TLS_ECDHE_RSA_WITH_AES_256_GCM_SHA384, tls.TLS_ECDHE_ECDSA_WITH_CHACHA20_POLY1305_SHA256}},
+		// insecure suites are refused, as are OpenSSL names
+		{raw: "TLS_RSA_WITH_RC4_128_SHA", err: "Unknown or insecure cipher suite 'TLS_RSA_WITH_RC4_128_SHA'"},
+		{raw: "ECDHE-RSA-AES128-GCM-SHA256", err: "Unknown or insecure cipher suite 'ECDHE-RSA-AES128-GCM-SHA256'"},
+	}
+
+	for _, tt := range tests {
+		got, err := ParseTLSCiphers(tt.raw)
+		if tt.err != "" {
+			if err == nil || err.Error() != tt.err {
+				t.Errorf("%q: got error %v, want %q", tt.raw, err, tt.err)
+			}
+			continue
+		}
+		if err != nil || fmt.Sprint(got) != fmt.Sprint(tt.want) {
+			t.Errorf("%q: got %v, %v, want %v", tt.raw, got, err, tt.want)
+		}
+	}
+}
+
+// Certificate authority generated for a single test, it issues the server and client certificates
+type testCA struct {
+	t    *testing.T
+	dir  string
+	cert *x509.Certificate
+	key  *ecdsa.PrivateKey
+	pool *x509.CertPool
+	file string // PEM encoded CA certificate
+}
+
+func newTestCA(t *testing.T) *testCA {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "test CA"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, _ := x509.ParseCertificate(der)
+
+	ca := &testCA{t: t, dir: t.TempDir(), cert: cert, key: key, pool: x509.NewCertPool()}
+	ca.pool.AddCert(cert)
+	ca.file = ca.writePEM("ca.crt", "CERTIFICATE", der)
+	return ca
+}
+
+func (ca *testCA) writePEM(name, blockType string, der []byte) string {
+	ca.t.Helper()
+	path := filepath.Join(ca.dir, name)
+	if err := os.WriteFile(path, pem.EncodeToMemory(&pem.Block{Type: blockType, Bytes: der}), 0o600); err != nil {
+		ca.t.Fatal(err)
+	}
+	return path
+}
+
+// Issues a certificate for cn, server certificates are valid for 127.0.0.1. Returns the certificate and key files too.
+func (ca *testCA) issue(cn string, server bool) (tls.Certificate, string, string) {
+	ca.t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		ca.t.Fatal(err)
+	}
+	serial, _ := rand.Int(rand.Reader, big.NewInt(1<<62))
+	template := &x509.Certificate{
+		SerialNumber: serial,
+		Subject:      pkix.Name{CommonName: cn},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}
+	if server {
+		template.ExtKeyUsage = []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth}
+		template.IPAddresses = []net.IP{net.IPv4(127, 0, 0, 1)}
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, ca.cert, &key.PublicKey, ca.key)
+	if err != nil {
+		ca.t.Fatal(err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		ca.t.Fatal(err)
+	}
+
+	certFile := ca.writePEM(cn+".crt", "CERTIFICATE", der)
+	keyFile := ca.writePEM(cn+".key", "EC PRIVATE KEY", keyDER)
+	cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		ca.t.Fatal(err)
+	}
+	return cert, certFile, keyFile
+}
+
+// Starts a server accepting TLS connections next to the plain loopback listener used by the other tests
+func startTLSServer(t *testing.T, ca *testCA, directives ...string) *Server {
+	t.Helper()
+	_, certFile, keyFile := ca.issue("server", true)
+	cfg := NewConfig()
+	base := []string{
+		fmt.Sprintf("dir %q", t.TempDir()), `save ""`,
+		fmt.Sprintf("tls-cert-file %q", certFile), fmt.Sprintf("tls-key-file %q", keyFile), fmt.Sprintf("tls-ca-cert-file %q", ca.file),
+	}
+	if err := cfg.LoadString(strings.Join(append(base, directives...), "\n")); err != nil {
+		t.Fatal(err)
+	}
+
+	s, err := NewServer(Options{Config: cfg, Addr: "127.0.0.1:0", TLSAddr: "127.0.0.1:0"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { s.Close() })
+	return s
+}
+
+// Connects over TLS, presenting the client certificates if any are given. The handshake is left to the first read or write.
+func dialTLS(t *testing.T, s *Server, ca *testCA, certs ...tls.Certificate) *testClient {
+	t.Helper()
+	conn, err := tls.Dial("tcp", s.TLSAddr(), &tls.Config{RootCAs: ca.pool, Certificates: certs})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	return newTestClient(t, conn)
+}
+
+// A client the server refused gets no reply, the connection fails instead
+func expectRefused(t *testing.T, c *testClient) {
+	t.Helper()
+	c.conn.Write([]byte("*1\r\n$4\r\nPING\r\n"))
+	if v, err := readReply(bufio.NewReader(c.conn)); err == nil {
+		t.Fatalf("got reply %#v, want the connection to be refused", v)
+	}
+}
+
+func TestBuildTLSConfig(t *testing.T) {
+	ca := newTestCA(t)
+	_, certFile, keyFile := ca.issue("server", true)
+	files := fmt.Sprintf("tls-cert-file %q\ntls-key-file %q\n", certFile, keyFile)
+
+	tests := []struct {
+		name   string
+		config string
+		auth   tls.ClientAuthType
+		err    string
+	}{
+		{name: "defaults", config: files + fmt.Sprintf("tls-ca-cert-file %q", ca.file), auth: tls.RequireAndVerifyClientCert},
+		{name: "CA directory", config: files + fmt.Sprintf("tls-ca-cert-dir %q", ca.dir), auth: tls.RequireAndVerifyClientCert},
+		{name: "optional client certificates", config: files + fmt.Sprintf("tls-ca-cert-file %q\ntls-auth-clients optional", ca.file), auth: tls.VerifyClientCertIfGiven},
+		{name: "no client certificates", config: files + "tls-auth-clients no", auth: tls.NoClientCert},
+		{name: "missing key", config: fmt.Sprintf("tls-cert-file %q", certFile), err: "tls-cert-file and tls-key-file must be specified to enable TLS"},
+		{name: "mismatched key", config: fmt.Sprintf("tls-cert-file %q\ntls-key-file %q\ntls-auth-clients no", certFile, ca.file), err: "Failed to load certificate"},
+		{name: "missing CA", config: files, err: "Either tls-ca-cert-file or tls-ca-cert-dir must be specified when tls-auth-clients is enabled"},
+		{name: "CA without certificates", config: files + fmt.Sprintf("tls-ca-cert-file %q", keyFile), err: "no PEM certificates found"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := NewConfig()
+			if err := cfg.LoadString(tt.config); err != nil {
+				t.Fatal(err)
+			}
+			config, err := BuildTLSConfig(cfg)
+			if tt.err != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.err) {
+					t.Fatalf("got error %v, want one containing %q", err, tt.err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if config.ClientAuth != tt.auth || config.MinVersion != tls.VersionTLS12 {
+				t.Fatalf("got client auth %v and min version %x", config.ClientAuth, config.MinVersion)
+			}
+		})
+	}
+}
+
+func TestTLSClientAuth(t *testing.T) {
+	ca := newTestCA(t)
+	s := startTLSServer(t, ca, "tls-auth-clients-user cn")
+	aliceCert, _, _ := ca.issue("alice", false)
+	strangerCert, _, _ := ca.issue("stranger", false)
+
+	expectReply(t, dial(t, s.Addr()).Do("ACL", "SETUSER", "alice", "on", "allkeys", "+@all"), "OK")
+
+	// the certificate's CN logs the client in when it names a user, anyone else starts as default
+	alice := dialTLS(t, s, ca, aliceCert)
+	expectReply(t, alice.Do("ACL", "WHOAMI"), "alice")
+	expectReply(t, alice.Do("SET", "k", "v"), "OK")
+	stranger := dialTLS(t, s, ca, strangerCert)
+	expectReply(t, stranger.Do("ACL", "WHOAMI"), "default")
+
+	// without a certificate, or with one from another CA, the handshake fails
+	expectRefused(t, dialTLS(t, s, ca))
+	otherCert, _, _ := newTestCA(t).issue("alice", false)
+	expectRefused(t, dialTLS(t, s, ca, otherCert))
+
+	// the plain listener keeps working next to the TLS one
+	expectReply(t, dial(t, s.Addr()).Do("GET", "k"), "v")
+}
+
+func TestTLSReload(t *testing.T) {
+	ca := newTestCA(t)
+	s := startTLSServer(t, ca)
+	admin := dial(t, s.Addr())
+	clientCert, _, _ := ca.issue("client", false)
+
+	before := dialTLS(t, s, ca, clientCert)
+	expectReply(t, before.Do("PING"), "PONG")
+
+	// new connections get the replaced certificate, established ones keep going
+	_, certFile, keyFile := ca.issue("renewed", true)
+	expectReply(t, admin.Do("CONFIG", "SET", "tls-cert-file", certFile, "tls-key-file", keyFile), "OK")
+	after := dialTLS(t, s, ca, clientCert)
+	expectReply(t, after.Do("PING"), "PONG")
+	if cn := after.conn.(*tls.Conn).ConnectionState().PeerCertificates[0].Subject.CommonName; cn != "renewed" {
+		t.Fatalf("the server presented %q after the reload", cn)
+	}
+	expectReply(t, before.Do("PING"), "PONG")
+
+	expectReply(t, admin.Do("CONFIG", "SET", "tls-auth-clients", "no"), "OK")
+	expectReply(t, dialTLS(t, s, ca).Do("PING"), "PONG")
+
+	// a configuration that can't be built is refused and the previous one stays in place
+	if reply, ok := admin.Do("CONFIG", "SET", "tls-cert-file", filepath.Join(ca.dir, "missing.crt")).(replyError); !ok || !strings.Contains(string(reply), "Failed to load certificate") {
+		t.Fatalf("got %#v, want a certificate error", reply)
+	}
+	if reply, ok := admin.Do("CONFIG", "SET", "tls-protocols", "SSLv3").(replyError); !ok || !strings.Contains(string(reply), "Invalid tls-protocols specified") {
+		t.Fatalf("got %#v, want a protocols error", reply)
+	}
+	expectReply(t, admin.Do("CONFIG", "GET", "tls-cert-file"), []any{"tls-cert-file", certFile})
+	expectReply(t, dialTLS(t, s, ca).Do("PING"), "PONG")
+
+	// restricting the protocol versions turns away clients that only speak the others
+	expectReply(t, admin.Do("CONFIG", "SET", "tls-protocols", "TLSv1.3"), "OK")
+	conn, err := tls.Dial("tcp", s.TLSAddr(), &tls.Config{RootCAs: ca.pool, MaxVersion: tls.VersionTLS12})
+	if err == nil {
+		conn.Close()
+		t.Fatal("a TLS 1.2 client completed the handshake")
+	}
+}
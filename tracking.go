@@ -0,0 +1,424 @@
+package redisclone
+
+import (
+	"errors"
+	"fmt"
+	"maps"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+const TrackingInvalidateChannel = "__redis__:invalidate"
+
+type TrackingOptions struct {
+	Redirect int64 // client receiving the invalidation messages, 0 for the tracking client itself
+	BCast    bool
+	OptIn    bool
+	OptOut   bool
+	NoLoop   bool     // skip invalidations caused by the client's own writes
+	Prefixes []string // BCAST only, an empty prefix matches every key
+	Caching  *bool    // set by CLIENT CACHING, applies to the next command or the whole transaction
+}
+
+// Server assisted client side caching: the keys each tracking client read and the prefixes broadcasting clients follow
+type Tracking struct {
+	clients  map[*Client]*TrackingOptions
+	keys     map[string]map[*Client]struct{}
+	prefixes map[string]map[*Client]struct{}
+	lock     sync.Mutex
+}
+
+func NewTracking() *Tracking {
+	return &Tracking{
+		clients:  make(map[*Client]*TrackingOptions),
+		keys:     make(map[string]map[*Client]struct{}),
+		prefixes: make(map[string]map[*Client]struct{}),
+	}
+}
+
+// Turns tracking on, or merges opts into the options of a client already tracking in the same mode
+func (t *Tracking) Enable(c *Client, opts TrackingOptions) error {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	current, ok := t.clients[c]
+	if ok {
+		if current.BCast != opts.BCast {
+			return errors.New("ERR You can't switch BCAST mode on/off before disabling tracking for this client, and then re-enabling it with a different mode.")
+		}
+		if current.OptIn != opts.OptIn || current.OptOut != opts.OptOut {
+			return errors.New("ERR You can't switch OPTIN/OPTOUT mode before disabling tracking for this client, and then re-enabling it with a different mode.")
+		}
+	} else {
+		current = &TrackingOptions{BCast: opts.BCast, OptIn: opts.OptIn, OptOut: opts.OptOut}
+	}
+
+	if opts.BCast {
+		if len(opts.Prefixes) == 0 && len(current.Prefixes) == 0 {
+			opts.Prefixes = []string{""}
+		}
+		if err := CheckPrefixCollisions(current.Prefixes, opts.Prefixes); err != nil {
+			return err
+		}
+	}
+
+	current.Redirect = opts.Redirect
+	current.NoLoop = opts.NoLoop
+	for _, prefix := range opts.Prefixes {
+		current.Prefixes = append(current.Prefixes, prefix)
+		UnsafeAddSubscriber(t.prefixes, prefix, c)
+	}
+	t.clients[c] = current
+	return nil
+}
+
+// Stops tracking, keys the client read are dropped lazily when they get invalidated
+func (t *Tracking) Disable(c *Client) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	opts, ok := t.clients[c]
+	if !ok {
+		return
+	}
+	for _, prefix := range opts.Prefixes {
+		UnsafeRemoveSubscriber(t.prefixes, prefix, c)
+	}
+	delete(t.clients, c)
+}
+
+// Returns a copy of the client's tracking options, nil when tracking is off
+func (t *Tracking) Options(c *Client) *TrackingOptions {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	opts, ok := t.clients[c]
+	if !ok {
+		return nil
+	}
+	cp := *opts
+	cp.Prefixes = slices.Clone(opts.Prefixes)
+	return &cp
+}
+
+func (t *Tracking) SetCaching(c *Client, yes bool) error {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	opts, ok := t.clients[c]
+	if !ok || !(opts.OptIn || opts.OptOut) {
+		return errors.New("ERR CLIENT CACHING can be called only when the client is in tracking mode with OPTIN or OPTOUT mode enabled")
+	}
+	if yes && !opts.OptIn {
+		return errors.New("ERR CLIENT CACHING YES is only valid when tracking is enabled in OPTIN mode.")
+	}
+	if !yes && !opts.OptOut {
+		return errors.New("ERR CLIENT CACHING NO is only valid when tracking is enabled in OPTOUT mode.")
+	}
+	opts.Caching = &yes
+	return nil
+}
+
+// Remembers the keys a read command of c returned, honouring OPTIN/OPTOUT and the CLIENT CACHING choice
+func (t *Tracking) RememberKeys(c *Client, keys []string) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	opts, ok := t.clients[c]
+	if !ok || opts.BCast {
+		return
+	}
+	if opts.OptIn && (opts.Caching == nil || !*opts.Caching) {
+		return
+	}
+	if opts.OptOut && opts.Caching != nil && !*opts.Caching {
+		return
+	}
+	for _, key := range keys {
+		UnsafeAddSubscriber(t.keys, key, c)
+	}
+}
+
+func (t *Tracking) ResetCaching(c *Client) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	if opts, ok := t.clients[c]; ok {
+		opts.Caching = nil
+	}
+}
+
+// Collects the keys every tracking client must drop after origin modified keys, origin is nil for expired keys
+func (t *Tracking) Invalidate(origin *Client, keys []string) map[*Client][]string {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	targets := make(map[*Client][]string)
+	for _, key := range keys {
+		for c := range t.keys[key] {
+			opts, ok := t.clients[c]
+			if !ok || opts.BCast || (opts.NoLoop && c == origin) {
+				continue
+			}
+			targets[c] = append(targets[c], key)
+		}
+		delete(t.keys, key)
+
+		for prefix, clients := range t.prefixes {
+			if !strings.HasPrefix(key, prefix) {
+				continue
+			}
+			for c := range clients {
+				if t.clients[c].NoLoop && c == origin {
+					continue
+				}
+				if !slices.Contains(targets[c], key) {
+					targets[c] = append(targets[c], key)
+				}
+			}
+		}
+	}
+	return targets
+}
+
+// Forgets every remembered key and returns all tracking clients
+func (t *Tracking) Flush() []*Client {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	clear(t.keys)
+	return slices.Collect(maps.Keys(t.clients))
+}
+
+// Prefixes of a broadcasting client must not be prefixes of each other, or a key would be reported twice
+func CheckPrefixCollisions(existing, added []string) error {
+	overlaps := func(a, b string) bool { return strings.HasPrefix(a, b) || strings.HasPrefix(b, a) }
+	for i, prefix := range added {
+		for _, other := range existing {
+			if overlaps(prefix, other) {
+				return fmt.Errorf("ERR Prefix '%s' overlaps with an existing prefix '%s'. Prefixes for a single client must not overlap.", prefix, other)
+			}
+		}
+		for _, other := range added[i+1:] {
+			if overlaps(prefix, other) {
+				return fmt.Errorf("ERR Prefix '%s' overlaps with another provided prefix '%s'. Prefixes for a single client must not overlap.", prefix, other)
+			}
+		}
+	}
+	return nil
+}
+
+// Sends the invalidation messages for keys modified by origin
+func (h *Handler) InvalidateKeys(origin *Client, keys []string) {
+	for c, invalidated := range h.Tracking.Invalidate(origin, keys) {
+		opts := h.Tracking.Options(c)
+		if opts == nil {
+			continue
+		}
+		names := [][]byte{}
+		for _, key := range invalidated {
+			names = append(names, []byte(key))
+		}
+		h.SendInvalidation(c, opts, names)
+	}
+}
+
+// Tells every tracking client to drop its whole cache, used when databases are flushed
+func (h *Handler) InvalidateAll() {
+	for _, c := range h.Tracking.Flush() {
+		if opts := h.Tracking.Options(c); opts != nil {
+			h.SendInvalidation(c, opts, nil)
+		}
+	}
+}
+
+// Pushes an invalidate message to c, or to its redirect client as a pub/sub message when that one speaks RESP2.
+// nil keys invalidate everything and are sent as a null.
+func (h *Handler) SendInvalidation(c *Client, opts *TrackingOptions, keys [][]byte) {
+	target := c
+	if opts.Redirect != 0 {
+		redirect, ok := h.Clients.Get(opts.Redirect)
+		if !ok {
+			if _, proto := c.Identity(); proto == RESP3 {
+				c.Push(h.Encoder.GeneratePush(proto, [][]byte{
+					h.Encoder.GenerateBulkString([]byte("tracking-redir-broken")),
+					h.Encoder.GenerateInt(int(opts.Redirect)),
+				}))
+			}
+			return
+		}
+		target = redirect
+	}
+
+	_, proto := target.Identity()
+	payload := h.Encoder.GetNull(proto)
+	if keys != nil {
+		payload = h.Encoder.GenerateArray(keys)
+	}
+	switch {
+	case proto == RESP3:
+		target.Push(h.Encoder.GeneratePush(proto, [][]byte{h.Encoder.GenerateBulkString([]byte("invalidate")), payload}))
+	case target != c:
+		if sub, psub, ssub := h.PubSub.ClientSubscriptions(target); sub+psub+ssub == 0 {
+			return
+		}
+		target.Push(h.Encoder.GeneratePush(proto, [][]byte{
+			h.Encoder.GenerateBulkString([]byte("message")),
+			h.Encoder.GenerateBulkString([]byte(TrackingInvalidateChannel)),
+			payload,
+		}))
+	}
+	// a RESP2 client without a redirect has no way to receive pushes
+}
+
+// Runs after every executed command: writes invalidate their keys, reads of a tracking client are remembered
+func (h *Handler) TrackCommand(c *Client, rc *RedisCommand, cmd Command, reply []byte) {
+	var keys []string
+	if len(reply) == 0 || reply[0] != '-' {
+		for _, key := range rc.Keys(cmd) {
+			keys = append(keys, string(key))
+		}
+	}
+	if len(keys) > 0 && rc.HasFlag(FlagWrite) {
+		h.InvalidateKeys(c, keys)
+	}
+	if len(keys) > 0 && rc.HasFlag(FlagReadonly) {
+		h.Tracking.RememberKeys(c, keys)
+	}
+	// CLIENT CACHING covers the next command, or every command of a transaction
+	if c.Multi == nil && rc.Name != "client|caching" {
+		h.Tracking.ResetCaching(c)
+	}
+}
+
+// Client Tracking Commands
+func (h *Handler) HandleClientTrackingCommand(c *Client, cmd Command) []byte {
+	var on bool
+	switch strings.ToUpper(string(cmd.Args[1])) {
+	case "ON":
+		on = true
+	case "OFF":
+	default:
+		return h.Encoder.GenerateSimpleError("ERR syntax error")
+	}
+
+	var opts TrackingOptions
+	for i := 2; i < len(cmd.Args); i++ {
+		more := i+1 < len(cmd.Args)
+		switch strings.ToUpper(string(cmd.Args[i])) {
+		case "REDIRECT":
+			if !more {
+				return h.Encoder.GenerateSimpleError("ERR syntax error")
+			}
+			i++
+			id, err := strconv.ParseInt(string(cmd.Args[i]), 10, 64)
+			if err != nil {
+				return h.Encoder.GenerateSimpleError("ERR value is not an integer or out of range")
+			}
+			if _, ok := h.Clients.Get(id); !ok {
+				return h.Encoder.GenerateSimpleError("ERR The client ID you want redirect to does not exist")
+			}
+			opts.Redirect = id
+		case "PREFIX":
+			if !more {
+				return h.Encoder.GenerateSimpleError("ERR syntax error")
+			}
+			i++
+			opts.Prefixes = append(opts.Prefixes, string(cmd.Args[i]))
+		case "BCAST":
+			opts.BCast = true
+		case "OPTIN":
+			opts.OptIn = true
+		case "OPTOUT":
+			opts.OptOut = true
+		case "NOLOOP":
+			opts.NoLoop = true
+		default:
+			return h.Encoder.GenerateSimpleError("ERR syntax error")
+		}
+	}
+
+	if !on {
+		h.Tracking.Disable(c)
+		return h.Encoder.GetSimpleStringOk()
+	}
+	if opts.OptIn && opts.OptOut {
+		return h.Encoder.GenerateSimpleError("ERR You can't use both OPTIN and OPTOUT")
+	}
+	if opts.BCast && (opts.OptIn || opts.OptOut) {
+		return h.Encoder.GenerateSimpleError("ERR OPTIN and OPTOUT are not compatible with BCAST")
+	}
+	if !opts.BCast && len(opts.Prefixes) > 0 {
+		return h.Encoder.GenerateSimpleError("ERR PREFIX option requires BCAST mode to be enabled")
+	}
+	if err := h.Tracking.Enable(c, opts); err != nil {
+		return h.Encoder.GenerateSimpleError(err.Error())
+	}
+	return h.Encoder.GetSimpleStringOk()
+}
+
+func (h *Handler) HandleClientCachingCommand(c *Client, cmd Command) []byte {
+	var yes bool
+	switch strings.ToUpper(string(cmd.Args[1])) {
+	case "YES":
+		yes = true
+	case "NO":
+	default:
+		return h.Encoder.GenerateSimpleError("ERR syntax error")
+	}
+	if err := h.Tracking.SetCaching(c, yes); err != nil {
+		return h.Encoder.GenerateSimpleError(err.Error())
+	}
+	return h.Encoder.GetSimpleStringOk()
+}
+
+func (h *Handler) HandleClientGetRedirCommand(c *Client, cmd Command) []byte {
+	opts := h.Tracking.Options(c)
+	if opts == nil {
+		return h.Encoder.GenerateInt(-1)
+	}
+	return h.Encoder.GenerateInt(int(opts.Redirect))
+}
+
+func (h *Handler) HandleClientTrackingInfoCommand(c *Client, cmd Command) []byte {
+	opts := h.Tracking.Options(c)
+	redirect := -1
+	flags := []string{"off"}
+	var prefixes [][]byte
+	if opts != nil {
+		redirect = int(opts.Redirect)
+		flags = []string{"on"}
+		for _, f := range []struct {
+			set  bool
+			name string
+		}{
+			{opts.BCast, "bcast"}, {opts.OptIn, "optin"}, {opts.OptOut, "optout"},
+			{opts.Caching != nil && *opts.Caching, "caching-yes"}, {opts.Caching != nil && !*opts.Caching, "caching-no"},
+			{opts.NoLoop, "noloop"},
+		} {
+			if f.set {
+				flags = append(flags, f.name)
+			}
+		}
+		if opts.Redirect != 0 {
+			if _, ok := h.Clients.Get(opts.Redirect); !ok {
+				flags = append(flags, "broken_redirect")
+			}
+		}
+		for _, prefix := range opts.Prefixes {
+			prefixes = append(prefixes, []byte(prefix))
+		}
+	}
+
+	var flagReplies [][]byte
+	for _, flag := range flags {
+		flagReplies = append(flagReplies, h.Encoder.GenerateBulkString([]byte(flag)))
+	}
+	return h.Encoder.GenerateMap(c.Protocol, [][]byte{
+		h.Encoder.GenerateBulkString([]byte("flags")), h.Encoder.GenerateSet(c.Protocol, flagReplies),
+		h.Encoder.GenerateBulkString([]byte("redirect")), h.Encoder.GenerateInt(redirect),
+		h.Encoder.GenerateBulkString([]byte("prefixes")), h.Encoder.GenerateArray(prefixes),
+	})
+}
@@ -0,0 +1,144 @@
+package redisclone
+
+import (
+	"fmt"
+	"testing"
+)
+
+func TestCheckPrefixCollisions(t *testing.T) {
+	tests := []struct {
+		existing []string
+		added    []string
+		err      bool
+	}{
+		{added: []string{"a:", "b:"}},
+		{existing: []string{"a:"}, added: []string{"b:"}},
+		{added: []string{"a", "ab"}, err: true},
+		{added: []string{"ab", "a"}, err: true},
+		{existing: []string{"user:"}, added: []string{"user:1"}, err: true},
+		{existing: []string{"user:1"}, added: []string{"user:"}, err: true},
+		{existing: []string{""}, added: []string{"x"}, err: true},
+	}
+
+	for _, tt := range tests {
+		if err := CheckPrefixCollisions(tt.existing, tt.added); (err != nil) != tt.err {
+			t.Errorf("existing %q added %q: got %v, want error %v", tt.existing, tt.added, err, tt.err)
+		}
+	}
+}
+
+// Dials a RESP3 connection with tracking turned on with the given options
+func dialTracking(t *testing.T, addr string, options ...string) *testClient {
+	t.Helper()
+	c := dial(t, addr)
+	c.Do("HELLO", "3")
+	expectReply(t, c.Do(append([]string{"CLIENT", "TRACKING", "ON"}, options...)...), "OK")
+	return c
+}
+
+func TestTrackingInvalidation(t *testing.T) {
+	s := startServer(t)
+	writer := dial(t, s.Addr())
+	c := dialTracking(t, s.Addr())
+
+	expectReply(t, c.Do("GET", "k"), nil)
+	expectReply(t, writer.Do("SET", "k", "1"), "OK")
+	expectReply(t, c.Read(), []any{"invalidate", []any{"k"}})
+
+	// a key is only reported once until it's read again
+	expectReply(t, writer.Do("SET", "k", "2"), "OK")
+	expectReply(t, c.Do("PING"), "PONG")
+
+	// the client's own writes invalidate too, unless NOLOOP is set
+	expectReply(t, c.Do("GET", "k"), "2")
+	// the push is queued while the write runs, ahead of its reply
+	expectReply(t, c.Do("SET", "k", "3"), []any{"invalidate", []any{"k"}})
+	expectReply(t, c.Read(), "OK")
+	expectReply(t, c.Do("CLIENT", "TRACKING", "ON", "NOLOOP"), "OK")
+	expectReply(t, c.Do("GET", "k"), "3")
+	expectReply(t, c.Do("SET", "k", "4"), "OK")
+	expectReply(t, c.Do("PING"), "PONG")
+
+	// flushing invalidates everything with a null
+	expectReply(t, writer.Do("FLUSHALL"), "OK")
+	expectReply(t, c.Read(), []any{"invalidate", nil})
+
+	expectReply(t, c.Do("CLIENT", "TRACKING", "OFF"), "OK")
+	expectReply(t, c.Do("GET", "k"), nil)
+	expectReply(t, writer.Do("SET", "k", "5"), "OK")
+	expectReply(t, c.Do("PING"), "PONG")
+}
+
+func TestTrackingModes(t *testing.T) {
+	s := startServer(t)
+	writer := dial(t, s.Addr())
+
+	bcast := dialTracking(t, s.Addr(), "BCAST", "PREFIX", "a:", "PREFIX", "b:")
+	expectReply(t, writer.Do("SET", "a:1", "x"), "OK")
+	expectReply(t, bcast.Read(), []any{"invalidate", []any{"a:1"}})
+	expectReply(t, writer.Do("SET", "c:1", "x"), "OK")
+	expectReply(t, bcast.Do("PING"), "PONG")
+
+	optin := dialTracking(t, s.Addr(), "OPTIN")
+	expectReply(t, optin.Do("GET", "k1"), nil)
+	expectReply(t, optin.Do("CLIENT", "CACHING", "YES"), "OK")
+	expectReply(t, optin.Do("GET", "k2"), nil)
+	expectReply(t, writer.Do("SET", "k1", "x"), "OK")
+	expectReply(t, writer.Do("SET", "k2", "x"), "OK")
+	expectReply(t, optin.Read(), []any{"invalidate", []any{"k2"}})
+
+	optout := dialTracking(t, s.Addr(), "OPTOUT")
+	expectReply(t, optout.Do("CLIENT", "CACHING", "NO"), "OK")
+	expectReply(t, optout.Do("GET", "k3"), nil)
+	expectReply(t, optout.Do("GET", "k4"), nil)
+	expectReply(t, writer.Do("SET", "k3", "x"), "OK")
+	expectReply(t, writer.Do("SET", "k4", "x"), "OK")
+	expectReply(t, optout.Read(), []any{"invalidate", []any{"k4"}})
+}
+
+func TestTrackingRedirect(t *testing.T) {
+	s := startServer(t)
+	writer, c, redirect := dial(t, s.Addr()), dial(t, s.Addr()), dial(t, s.Addr())
+
+	id := redirect.Do("CLIENT", "ID").(int64)
+	expectReply(t, redirect.Do("SUBSCRIBE", TrackingInvalidateChannel), []any{"subscribe", TrackingInvalidateChannel, int64(1)})
+	expectReply(t, c.Do("CLIENT", "TRACKING", "ON", "REDIRECT", fmt.Sprint(id)), "OK")
+	expectReply(t, c.Do("CLIENT", "GETREDIR"), id)
+
+	expectReply(t, c.Do("GET", "k"), nil)
+	expectReply(t, writer.Do("SET", "k", "1"), "OK")
+	expectReply(t, redirect.Read(), []any{"message", TrackingInvalidateChannel, []any{"k"}})
+
+	info := c.Do("CLIENT", "TRACKINGINFO").([]any)
+	expectReply(t, info[:4], []any{"flags", []any{"on"}, "redirect", id})
+	redirect.conn.Close()
+	waitFor(t, func() bool {
+		flags := c.Do("CLIENT", "TRACKINGINFO").([]any)[1].([]any)
+		return len(flags) == 2 && flags[1] == "broken_redirect"
+	})
+}
+
+func TestTrackingErrors(t *testing.T) {
+	tests := []struct {
+		args  []string
+		reply replyError
+	}{
+		{args: []string{"ON", "OPTIN", "OPTOUT"}, reply: "ERR You can't use both OPTIN and OPTOUT"},
+		{args: []string{"ON", "BCAST", "OPTIN"}, reply: "ERR OPTIN and OPTOUT are not compatible with BCAST"},
+		{args: []string{"ON", "PREFIX", "a"}, reply: "ERR PREFIX option requires BCAST mode to be enabled"},
+		{args: []string{"ON", "REDIRECT", "999999"}, reply: "ERR The client ID you want redirect to does not exist"},
+		{args: []string{"ON", "REDIRECT", "x"}, reply: "ERR value is not an integer or out of range"},
+		{args: []string{"ON", "BCAST", "PREFIX", "a", "PREFIX", "ab"}, reply: "ERR Prefix 'a' overlaps with another provided prefix 'ab'. Prefixes for a single client must not overlap."},
+		{args: []string{"MAYBE"}, reply: "ERR syntax error"},
+	}
+
+	s := startServer(t)
+	c := dial(t, s.Addr())
+	for _, tt := range tests {
+		expectReply(t, c.Do(append([]string{"CLIENT", "TRACKING"}, tt.args...)...), tt.reply)
+	}
+	expectReply(t, c.Do("CLIENT", "CACHING", "YES"), replyError("ERR CLIENT CACHING can be called only when the client is in tracking mode with OPTIN or OPTOUT mode enabled"))
+	expectReply(t, c.Do("CLIENT", "TRACKING", "ON", "OPTIN"), "OK")
+	expectReply(t, c.Do("CLIENT", "CACHING", "NO"), replyError("ERR CLIENT CACHING NO is only valid when tracking is enabled in OPTOUT mode."))
+	expectReply(t, c.Do("CLIENT", "TRACKING", "ON", "BCAST"), replyError("ERR You can't switch BCAST mode on/off before disabling tracking for this client, and then re-enabling it with a different mode."))
+}
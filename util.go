@@ -0,0 +1,189 @@
+package redisclone
+
+import (
+	"fmt"
+	"strings"
+)
+
+// Glob-style matching with the same semantics as Redis' stringmatchlen: * ? [abc] [^a-z] and \ escapes
+func StringMatch(pattern, str string, nocase bool) bool {
+	return stringMatch([]byte(pattern), []byte(str), nocase, 0)
+}
+
+func stringMatch(pattern, str []byte, nocase bool, nesting int) bool {
+	// guard against patterns like "a*a*a*a*...b" exploding the recursion
+	if nesting > 1000 {
+		return false
+	}
+
+	for len(pattern) > 0 {
+		switch pattern[0] {
+		case '*':
+			for len(pattern) > 1 && pattern[1] == '*' {
+				pattern = pattern[1:]
+			}
+			if len(pattern) == 1 {
+				return true
+			}
+			for i := 0; i <= len(str); i++ {
+				if stringMatch(pattern[1:], str[i:], nocase, nesting+1) {
+					return true
+				}
+			}
+			return false
+		case '?':
+			if len(str) == 0 {
+				return false
+			}
+			str = str[1:]
+		case '[':
+			if len(str) == 0 {
+				return false
+			}
+			pattern = pattern[1:]
+			not := len(pattern) > 0 && pattern[0] == '^'
+			if not {
+				pattern = pattern[1:]
+			}
+			match := false
+			for {
+				if len(pattern) == 0 {
+					break
+				}
+				if pattern[0] == '\\' && len(pattern) >= 2 {
+					pattern = pattern[1:]
+					if pattern[0] == str[0] {
+						match = true
+					}
+				} else if pattern[0] == ']' {
+					break
+				} else if len(pattern) >= 3 && pattern[1] == '-' {
+					start, end, c := pattern[0], pattern[2], str[0]
+					if start > end {
+						start, end = end, start
+					}
+					if nocase {
+						start, end, c = toLower(start), toLower(end), toLower(c)
+					}
+					pattern = pattern[2:]
+					if c >= start && c <= end {
+						match = true
+					}
+				} else if equalByte(pattern[0], str[0], nocase) {
+					match = true
+				}
+				pattern = pattern[1:]
+			}
+			if not {
+				match = !match
+			}
+			if !match {
+				return false
+			}
+			str = str[1:]
+			if len(pattern) == 0 {
+				// unterminated class, the whole pattern has been consumed
+				return len(str) == 0
+			}
+		case '\\':
+			if len(pattern) >= 2 {
+				pattern = pattern[1:]
+			}
+			fallthrough
+		default:
+			if len(str) == 0 || !equalByte(pattern[0], str[0], nocase) {
+				return false
+			}
+			str = str[1:]
+		}
+		pattern = pattern[1:]
+	}
+
+	return len(str) == 0
+}
+
+func equalByte(a, b byte, nocase bool) bool {
+	if nocase {
+		return toLower(a) == toLower(b)
+	}
+	return a == b
+}
+
+func toLower(b byte) byte {
+	if b >= 'A' && b <= 'Z' {
+		return b + ('a' - 'A')
+	}
+	return b
+}
+
+// Quotes s the way Redis' sdscatrepr does when it isn't a plain word, so that SplitArgs reads it back unchanged
+func QuoteArg(s string) string {
+	if s != "" && !strings.ContainsAny(s, " \"'\\") && isPrintable(s) {
+		return s
+	}
+
+	var out strings.Builder
+	out.WriteByte('"')
+	for i := 0; i < len(s); i++ {
+		switch b := s[i]; b {
+		case '\\', '"':
+			out.WriteByte('\\')
+			out.WriteByte(b)
+		case '\n':
+			out.WriteString("\\n")
+		case '\r':
+			out.WriteString("\\r")
+		case '\t':
+			out.WriteString("\\t")
+		case '\a':
+			out.WriteString("\\a")
+		case '\b':
+			out.WriteString("\\b")
+		default:
+			if b < ' ' || b > '~' {
+				fmt.Fprintf(&out, "\\x%02x", b)
+			} else {
+				out.WriteByte(b)
+			}
+		}
+	}
+	out.WriteByte('"')
+	return out.String()
+}
+
+func isPrintable(s string) bool {
+	for i := 0; i < len(s); i++ {
+		if s[i] < '!' || s[i] > '~' {
+			return false
+		}
+	}
+	return true
+}
+
+const ClusterSlots = 16384
+
+// CRC16-CCITT (XMODEM), the checksum Redis Cluster uses to map keys to hash slots
+func CRC16(b []byte) uint16 {
+	var crc uint16
+	for _, c := range b {
+		crc ^= uint16(c) << 8
+		for range 8 {
+			if crc&0x8000 != 0 {
+				crc = crc<<1 ^ 0x1021
+			} else {
+				crc <<= 1
+			}
+		}
+	}
+	return crc
+}
+
+// Hash slot of key, only the part inside the first non-empty {hashtag} is hashed when there is one
+func KeyHashSlot(key string) int {
+	if start := strings.IndexByte(key, '{'); start != -1 {
+		if end := strings.IndexByte(key[start+1:], '}'); end > 0 {
+			key = key[start+1 : start+1+end]
+		}
+	}
+	return int(CRC16([]byte(key)) % ClusterSlots)
+}
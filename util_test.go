@@ -0,0 +1,62 @@
+package redisclone
+
+import "testing"
+
+func TestStringMatch(t *testing.T) {
+	tests := []struct {
+		pattern string
+		str     string
+		nocase  bool
+		want    bool
+	}{
+		{"*", "", false, true},
+		{"*", "anything", false, true},
+		{"news.*", "news.tech", false, true},
+		{"news.*", "sport.tech", false, false},
+		{"h?llo", "hello", false, true},
+		{"h?llo", "hllo", false, false},
+		{"h[ae]llo", "hallo", false, true},
+		{"h[ae]llo", "hillo", false, false},
+		{"h[^e]llo", "hallo", false, true},
+		{"h[^e]llo", "hello", false, false},
+		{"h[a-c]llo", "hbllo", false, true},
+		{"h[c-a]llo", "hbllo", false, true},
+		{"h\\*llo", "h*llo", false, true},
+		{"h\\*llo", "hello", false, false},
+		{"a*b*c", "aXXbYYc", false, true},
+		{"a*b*c", "aXXbYY", false, false},
+		{"HELLO", "hello", false, false},
+		{"HELLO", "hello", true, true},
+		{"h[A-Z]llo", "hello", true, true},
+	}
+
+	for _, tt := range tests {
+		if got := StringMatch(tt.pattern, tt.str, tt.nocase); got != tt.want {
+			t.Errorf("StringMatch(%q, %q, %v) = %v, want %v", tt.pattern, tt.str, tt.nocase, got, tt.want)
+		}
+	}
+}
+
+func TestKeyHashSlot(t *testing.T) {
+	tests := []struct {
+		key  string
+		want int
+	}{
+		{"", 0},
+		{"123456789", 12739},
+		{"foo", 12182},
+		{"{user1000}.following", KeyHashSlot("user1000")},
+		{"foo{{bar}}zap", KeyHashSlot("{bar")},
+		{"foo{bar}{zap}", KeyHashSlot("bar")},
+	}
+
+	for _, tt := range tests {
+		if got := KeyHashSlot(tt.key); got != tt.want {
+			t.Errorf("KeyHashSlot(%q) = %d, want %d", tt.key, got, tt.want)
+		}
+	}
+	// an empty hashtag hashes the whole key
+	if KeyHashSlot("foo{}{bar}") == KeyHashSlot("bar") {
+		t.Error("an empty hashtag shouldn't select the next one")
+	}
+}